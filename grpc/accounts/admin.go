@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/tools/identifiers"
+	"csb.nc/auth/stores/tools/scim"
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	viperKeyAdminTokens = "admin.tokens"
+
+	// Prefix of the full method names of the AccountsAdmin service.
+	adminMethodPrefix = "/auth.AccountsAdmin/"
+	adminTokenScheme  = "bearer "
+
+	listUsersPageSizeDefault = 100
+	listUsersPageSizeMax     = 1000
+
+	// Paths of the fields changed by UpdateUser.
+	updatePathUsername               = "Username"
+	updatePathClaims                 = "Claims"
+	updatePathDisabled               = "Disabled"
+	updatePathPasswordChangeRequired = "PasswordChangeRequired"
+	updatePathExpiresAt              = "ExpiresAt"
+	updatePathPending                = "Pending"
+)
+
+var (
+	errAdminUnauthenticated = errors.New("A valid bearer token is required to manage the accounts")
+	// Stops reading the users once a page of ListUsers is full.
+	errPageFull = errors.New("The page is full")
+)
+
+// Key of the name of the admin client in the request contexts.
+type adminClientKey struct{}
+
+// Returns the name of the admin client whose token is the bearer token of the request.
+// The tokens are configured by their SHA-256 hex digest, so the configuration does not disclose them.
+func adminClient(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) != 1 || !strings.HasPrefix(strings.ToLower(values[0]), adminTokenScheme) {
+		return "", errAdminUnauthenticated
+	}
+	digest := sha256.Sum256([]byte(strings.TrimSpace(values[0][len(adminTokenScheme):])))
+
+	client := ""
+	// All the tokens are compared, so the time taken does not tell which one is closest.
+	for name, hash := range viper.GetStringMapString(viperKeyAdminTokens) {
+		expected, err := hex.DecodeString(hash)
+		if err != nil {
+			zap.L().Warn("The token digest of an admin client is invalid.", zap.String("client", name))
+			continue
+		}
+		if subtle.ConstantTimeCompare(digest[:], expected) == 1 {
+			client = name
+		}
+	}
+	if client == "" {
+		return "", errAdminUnauthenticated
+	}
+	return client, nil
+}
+
+// Authorizes the calls of the AccountsAdmin service with the bearer token of the request, the other services are not affected.
+func adminAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, adminMethodPrefix) {
+		return handler(ctx, req)
+	}
+	client, err := adminClient(ctx)
+	if err != nil {
+		auditLogger().Warn(
+			"Unauthenticated account management call.",
+			zap.String("method", strings.TrimPrefix(info.FullMethod, adminMethodPrefix)),
+		)
+		return nil, grpcerr.New(users.ErrorCode_UNAUTHENTICATED, storeName, Unauthenticated, err.Error())
+	}
+	return handler(context.WithValue(ctx, adminClientKey{}, client), req)
+}
+
+// The audit log records all the account management calls, apart from the other logs.
+func auditLogger() *zap.Logger {
+	return zap.L().Named("audit")
+}
+
+// Records an account management call in the audit log. The passwords are never recorded.
+func audit(ctx context.Context, method string, subject string, storeError int32, fields ...zap.Field) {
+	client, _ := ctx.Value(adminClientKey{}).(string)
+	fields = append(
+		fields,
+		zap.String("client", client),
+		zap.String("method", method),
+		zap.String("subject", subject),
+		zap.Bool("succeeded", storeError == 0),
+		zap.Int32("error", storeError),
+	)
+	auditLogger().Info("Account management call.", fields...)
+}
+
+// adminServer implements the AccountsAdmin service on the users repository.
+type adminServer struct {
+	users.UnimplementedAccountsAdminServer
+	repo UserRepository
+}
+
+func timestampOf(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func timeOf(t *timestamppb.Timestamp) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.AsTime()
+	return &utc
+}
+
+func toAccount(u *user) *users.Account {
+	return &users.Account{
+		Subject:                u.ID,
+		Username:               u.Username,
+		Claims:                 u.Claims,
+		Disabled:               u.Disabled,
+		Locked:                 isLocked(u, time.Now()),
+		LockedAt:               timestampOf(u.LockedAt),
+		PasswordChangeRequired: u.PasswordChangeRequired,
+		ExpiresAt:              timestampOf(u.ExpiresAt),
+		FailedLogins:           int32(u.FailedLogins),
+		Pending:                u.Pending,
+		TOTPEnabled:            hasTOTP(u),
+		Version:                u.Version,
+		CreatedAt:              timestampOf(u.CreatedAt),
+		UpdatedAt:              timestampOf(u.UpdatedAt),
+	}
+}
+
+// Generates a random subject, formatted as a version 4 UUID.
+func newSubject() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Maps the errors of the repository changes to an error code.
+func changeError(err error) int32 {
+	switch {
+	case errors.Is(err, errVersionConflict):
+		return VersionConflict
+	case errors.Is(err, errUserExists):
+		return UserExists
+	case errors.Is(err, errUserNotFound):
+		return UserNotFound
+	case errors.Is(err, errUsersMissing):
+		return UsersMissing
+	default:
+		zap.L().Error("Could not save the user.", zap.Error(err))
+		return UsersNotSaved
+	}
+}
+
+// Finishes an account management call: sets the shared error code, audits the call, and returns the failures as gRPC statuses.
+func (s adminServer) respond(ctx context.Context, method string, subject string, resp *users.AccountResponse, fields ...zap.Field) (*users.AccountResponse, error) {
+	resp.Code = errorCode(resp.Error)
+	resp.Succeeded = resp.Error == 0
+	if resp.Account != nil {
+		fields = append(fields, zap.Int64("version", resp.Account.Version))
+	}
+	audit(ctx, method, subject, resp.Error, fields...)
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Applies a change to an account, at the requested version, or at its current version when the requested version is zero.
+func (s adminServer) modify(subject string, version int64, change func(u *user) int32) (*user, int32) {
+	if err := identifiers.Validate(subject, users.IdentifierType_SUBJECT); err != nil {
+		return nil, InvalidRequest
+	}
+	u, err := s.repo.Find(subject, users.IdentifierType_SUBJECT)
+	if err != nil {
+		return nil, findUserError(err)
+	}
+	if version == 0 {
+		version = u.Version
+	}
+	if code := change(u); code != 0 {
+		return nil, code
+	}
+	if err := s.repo.Update(u, version); err != nil {
+		return nil, changeError(err)
+	}
+	return u, 0
+}
+
+// Applies a change of the state of an account, such as its lockout, which the repository makes in a single change at the version,
+// and returns the changed account. The version of the account is used when version is 0.
+func (s adminServer) changeState(subject string, version int64, change func(id string, version int64) error) (*user, int32) {
+	if err := identifiers.Validate(subject, users.IdentifierType_SUBJECT); err != nil {
+		return nil, InvalidRequest
+	}
+	u, err := s.repo.Find(subject, users.IdentifierType_SUBJECT)
+	if err != nil {
+		return nil, findUserError(err)
+	}
+	if version == 0 {
+		version = u.Version
+	}
+	if err := change(u.ID, version); err != nil {
+		return nil, changeError(err)
+	}
+	if u, err = s.repo.Find(u.ID, users.IdentifierType_SUBJECT); err != nil {
+		return nil, findUserError(err)
+	}
+	return u, 0
+}
+
+func (s adminServer) CreateUser(ctx context.Context, req *users.CreateUserRequest) (*users.AccountResponse, error) {
+	resp := &users.AccountResponse{}
+	account := req.Account
+	if account == nil {
+		account = &users.Account{}
+	}
+
+	u := &user{
+		ID:                     account.Subject,
+		Username:               strings.TrimSpace(account.Username),
+		Claims:                 make(map[string]string, len(account.Claims)),
+		Disabled:               account.Disabled,
+		PasswordChangeRequired: account.PasswordChangeRequired,
+		ExpiresAt:              timeOf(account.ExpiresAt),
+	}
+	for k, v := range account.Claims {
+		u.Claims[k] = v
+	}
+	if u.ID == "" {
+		var err error
+		if u.ID, err = newSubject(); err != nil {
+			zap.L().Error("Could not generate the subject.", zap.Error(err))
+			resp.Error = UsersNotSaved
+			return s.respond(ctx, "CreateUser", "", resp)
+		}
+	}
+	if identifiers.Validate(u.Username, users.IdentifierType_USER_NAME) != nil || req.Password == "" || identifiers.Validate(u.ID, users.IdentifierType_SUBJECT) != nil {
+		resp.Error = InvalidRequest
+		return s.respond(ctx, "CreateUser", u.ID, resp)
+	}
+
+	if resp.Violations = checkNewPassword(u, req.Password); len(resp.Violations) > 0 {
+		resp.Error = PasswordRejected
+		return s.respond(ctx, "CreateUser", u.ID, resp, zap.String("username", u.Username))
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		zap.L().Error("Could not hash the password.", zap.Error(err))
+		resp.Error = UsersNotSaved
+		return s.respond(ctx, "CreateUser", u.ID, resp)
+	}
+	u.PasswordHash = hash
+	if err := s.repo.Create(u); err != nil {
+		resp.Error = changeError(err)
+		return s.respond(ctx, "CreateUser", u.ID, resp, zap.String("username", u.Username))
+	}
+
+	resp.Account = toAccount(u)
+	return s.respond(ctx, "CreateUser", u.ID, resp, zap.String("username", u.Username))
+}
+
+func (s adminServer) GetUser(ctx context.Context, req *users.GetUserRequest) (*users.AccountResponse, error) {
+	resp := &users.AccountResponse{}
+	if err := identifiers.Validate(req.Subject, users.IdentifierType_SUBJECT); err != nil {
+		resp.Error = InvalidRequest
+		return s.respond(ctx, "GetUser", req.Subject, resp)
+	}
+	u, err := s.repo.Find(req.Subject, users.IdentifierType_SUBJECT)
+	if err != nil {
+		resp.Error = findUserError(err)
+		return s.respond(ctx, "GetUser", req.Subject, resp)
+	}
+	resp.Account = toAccount(u)
+	return s.respond(ctx, "GetUser", req.Subject, resp)
+}
+
+func (s adminServer) UpdateUser(ctx context.Context, req *users.UpdateUserRequest) (*users.AccountResponse, error) {
+	resp := &users.AccountResponse{}
+	account := req.Account
+	paths := req.UpdateMask.GetPaths()
+	if account == nil || account.Version == 0 || len(paths) == 0 {
+		resp.Error = InvalidRequest
+		return s.respond(ctx, "UpdateUser", account.GetSubject(), resp)
+	}
+
+	u, code := s.modify(account.Subject, account.Version, func(u *user) int32 {
+		for _, path := range paths {
+			switch path {
+			case updatePathUsername:
+				// The usernames follow the rules of the identifiers, so the users can be found by them.
+				if identifiers.Validate(strings.TrimSpace(account.Username), users.IdentifierType_USER_NAME) != nil {
+					return InvalidRequest
+				}
+				u.Username = strings.TrimSpace(account.Username)
+			case updatePathClaims:
+				// The claims of the found user may be shared, they are replaced rather than modified.
+				u.Claims = make(map[string]string, len(account.Claims))
+				for k, v := range account.Claims {
+					u.Claims[k] = v
+				}
+			case updatePathDisabled:
+				u.Disabled = account.Disabled
+			case updatePathPasswordChangeRequired:
+				u.PasswordChangeRequired = account.PasswordChangeRequired
+			case updatePathExpiresAt:
+				// The account no longer expires when the expiration is not set.
+				u.ExpiresAt = timeOf(account.ExpiresAt)
+			case updatePathPending:
+				u.Pending = account.Pending
+			default:
+				return InvalidRequest
+			}
+		}
+		return 0
+	})
+	resp.Error = code
+	if u != nil {
+		resp.Account = toAccount(u)
+	}
+	return s.respond(ctx, "UpdateUser", account.Subject, resp, zap.Strings("fields", paths))
+}
+
+func (s adminServer) DeleteUser(ctx context.Context, req *users.DeleteUserRequest) (*users.AccountResponse, error) {
+	resp := &users.AccountResponse{}
+	if err := identifiers.Validate(req.Subject, users.IdentifierType_SUBJECT); err != nil {
+		resp.Error = InvalidRequest
+		return s.respond(ctx, "DeleteUser", req.Subject, resp)
+	}
+	u, err := s.repo.Find(req.Subject, users.IdentifierType_SUBJECT)
+	if err != nil {
+		resp.Error = findUserError(err)
+		return s.respond(ctx, "DeleteUser", req.Subject, resp)
+	}
+	version := req.Version
+	if version == 0 {
+		version = u.Version
+	}
+	if err := s.repo.Delete(u.ID, version); err != nil {
+		resp.Error = changeError(err)
+	}
+	return s.respond(ctx, "DeleteUser", req.Subject, resp, zap.String("username", u.Username))
+}
+
+func (s adminServer) SetPassword(ctx context.Context, req *users.SetPasswordRequest) (*users.AccountResponse, error) {
+	resp := &users.AccountResponse{}
+	u, code := s.modify(req.Subject, req.Version, func(u *user) int32 {
+		if req.Password == "" {
+			return InvalidRequest
+		}
+		if resp.Violations = checkNewPassword(u, req.Password); len(resp.Violations) > 0 {
+			return PasswordRejected
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			zap.L().Error("Could not hash the password.", zap.Error(err))
+			return UsersNotSaved
+		}
+		u.PasswordHistory = passwordHistory(u)
+		u.PasswordHash = hash
+		u.PasswordChangeRequired = req.ChangeRequired
+		return 0
+	})
+	resp.Error = code
+	if u != nil {
+		resp.Account = toAccount(u)
+	}
+	return s.respond(ctx, "SetPassword", req.Subject, resp, zap.Bool("changeRequired", req.ChangeRequired))
+}
+
+func (s adminServer) DisableUser(ctx context.Context, req *users.DisableUserRequest) (*users.AccountResponse, error) {
+	resp := &users.AccountResponse{}
+	u, code := s.modify(req.Subject, req.Version, func(u *user) int32 {
+		u.Disabled = true
+		return 0
+	})
+	resp.Error = code
+	if u != nil {
+		resp.Account = toAccount(u)
+	}
+	return s.respond(ctx, "DisableUser", req.Subject, resp)
+}
+
+func (s adminServer) UnlockUser(ctx context.Context, req *users.UnlockUserRequest) (*users.AccountResponse, error) {
+	resp := &users.AccountResponse{}
+	u, code := s.changeState(req.Subject, req.Version, s.repo.Unlock)
+	resp.Error = code
+	if u != nil {
+		resp.Account = toAccount(u)
+	}
+	return s.respond(ctx, "UnlockUser", req.Subject, resp)
+}
+
+func (s adminServer) ResetTOTP(ctx context.Context, req *users.ResetTOTPRequest) (*users.AccountResponse, error) {
+	resp := &users.AccountResponse{}
+	u, code := s.changeState(req.Subject, req.Version, s.repo.RemoveTOTP)
+	resp.Error = code
+	if u != nil {
+		resp.Account = toAccount(u)
+	}
+	return s.respond(ctx, "ResetTOTP", req.Subject, resp)
+}
+
+func (s adminServer) ListUsers(ctx context.Context, req *users.ListUsersRequest) (*users.ListUsersResponse, error) {
+	resp := s.listUsers(req)
+	resp.Code = errorCode(resp.Error)
+	audit(ctx, "ListUsers", "", resp.Error, zap.Int("count", len(resp.Accounts)))
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Lists a page of the accounts sorted by subject. The page token is the encoded subject of the last account of the previous page.
+func (s adminServer) listUsers(req *users.ListUsersRequest) *users.ListUsersResponse {
+	resp := &users.ListUsersResponse{}
+
+	pageSize := int(req.PageSize)
+	switch {
+	case pageSize < 0:
+		resp.Error = InvalidRequest
+		return resp
+	case pageSize == 0:
+		pageSize = listUsersPageSizeDefault
+	case pageSize > listUsersPageSizeMax:
+		pageSize = listUsersPageSizeMax
+	}
+	after, err := base64.RawURLEncoding.DecodeString(req.PageToken)
+	if err != nil {
+		resp.Error = InvalidRequest
+		return resp
+	}
+	if req.Filter != nil {
+		if err := scim.Validate(req.Filter); err != nil {
+			zap.L().Warn("Invalid search filter.", zap.Error(err))
+			resp.Error = InvalidFilter
+			return resp
+		}
+	}
+
+	resp.Accounts = make([]*users.Account, 0, pageSize)
+	err = s.repo.ForEach(string(after), func(u *user) error {
+		if req.Filter != nil && !scim.Match(req.Filter, u.Claims) {
+			return nil
+		}
+		if len(resp.Accounts) == pageSize {
+			resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(resp.Accounts[pageSize-1].Subject))
+			return errPageFull
+		}
+		resp.Accounts = append(resp.Accounts, toAccount(u))
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		zap.L().Error("Could not read the users.", zap.Error(err))
+		resp.Accounts = nil
+		resp.Error = UsersMissing
+		return resp
+	}
+	resp.Succeeded = true
+
+	return resp
+}
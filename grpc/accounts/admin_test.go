@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"csb.nc/auth/stores/tools/scim"
+	"csb.nc/auth/stores/users"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAdminAuthInterceptor(t *testing.T) {
+	testCases := []struct {
+		method        string
+		authorization []string
+		client        string
+		status        codes.Code
+	}{
+		{"/auth.AccountsAdmin/GetUser", []string{"Bearer test-admin-token"}, "tests", codes.OK},
+		{"/auth.AccountsAdmin/GetUser", []string{"bearer test-admin-token"}, "tests", codes.OK},
+		{"/auth.AccountsAdmin/GetUser", []string{"Bearer incorrect"}, "", codes.Unauthenticated},
+		{"/auth.AccountsAdmin/GetUser", []string{"Basic dGVzdHM6dGVzdA=="}, "", codes.Unauthenticated},
+		{"/auth.AccountsAdmin/GetUser", []string{"Bearer test-admin-token", "Bearer test-admin-token"}, "", codes.Unauthenticated},
+		{"/auth.AccountsAdmin/GetUser", nil, "", codes.Unauthenticated},
+		{"/auth.User/FindClaims", nil, "", codes.OK},
+	}
+	for _, tc := range testCases {
+		ctx := context.Background()
+		if tc.authorization != nil {
+			ctx = metadata.NewIncomingContext(ctx, metadata.MD{"authorization": tc.authorization})
+		}
+		client := ""
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			client, _ = ctx.Value(adminClientKey{}).(string)
+			return nil, nil
+		}
+		_, err := adminAuthInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+		if status.Code(err) != tc.status {
+			t.Errorf("%s %v: the status is %s instead of %s.", tc.method, tc.authorization, status.Code(err), tc.status)
+		}
+		if client != tc.client {
+			t.Errorf("%s %v: the client is '%s' instead of '%s'.", tc.method, tc.authorization, client, tc.client)
+		}
+	}
+}
+
+func TestAdminCreateUser(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := adminServer{repo: repo}
+		ctx := context.Background()
+
+		resp, err := s.CreateUser(ctx, &users.CreateUserRequest{
+			Account:  &users.Account{Username: " dave.petit ", Claims: map[string]string{"email": "dave.petit@csb.nc"}},
+			Password: "Dave-Password1",
+		})
+		if err != nil || !resp.Succeeded {
+			t.Fatalf("Could not create the user: %v, %v", resp, err)
+		}
+		account := resp.Account
+		if account.Subject == "" || account.Username != "dave.petit" || account.Version != 1 || account.CreatedAt == nil {
+			t.Errorf("The created account is %v.", account)
+		}
+
+		resp, err = s.GetUser(ctx, &users.GetUserRequest{Subject: account.Subject})
+		if err != nil || resp.Account.Claims["email"] != "dave.petit@csb.nc" {
+			t.Errorf("The created account is not found: %v, %v", resp, err)
+		}
+		if auth := (server{repo: repo}).authenticate(&users.AuthRequest{Username: "dave.petit", Password: "Dave-Password1"}); !auth.Succeeded {
+			t.Errorf("Could not authenticate the created user, error: %d", auth.Error)
+		}
+
+		resp, err = s.CreateUser(ctx, &users.CreateUserRequest{Account: &users.Account{Username: "Alice.Martin"}, Password: "Tropical-Reef-42"})
+		if err != nil || resp.Error != UserExists || resp.Code != users.ErrorCode_USER_EXISTS {
+			t.Errorf("An existing username should be rejected: %v, %v", resp, err)
+		}
+		resp, err = s.CreateUser(ctx, &users.CreateUserRequest{Account: &users.Account{Username: "eve.bernard"}, Password: "eve.bernard-42"})
+		if err != nil || resp.Error != PasswordRejected || len(resp.Violations) != 1 || resp.Violations[0].Type != users.PasswordViolationType_CONTAINS_USER_NAME {
+			t.Errorf("A password containing the username should be rejected: %v, %v", resp, err)
+		}
+		for _, req := range []*users.CreateUserRequest{
+			{Account: &users.Account{Username: "eve.bernard"}},
+			{Account: &users.Account{Username: " "}, Password: "Password1"},
+			{Account: &users.Account{Username: "eve*bernard"}, Password: "Password1"},
+			{Password: "Password1"},
+		} {
+			if _, err := s.CreateUser(ctx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("The request %v should be invalid, error: %v", req, err)
+			}
+		}
+	})
+}
+
+func TestAdminUpdateUser(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := adminServer{repo: repo}
+		ctx := context.Background()
+
+		account := &users.Account{Subject: bobID, Username: "robert.durand", Claims: map[string]string{"name": "Robert Durand"}, Version: 1}
+		resp, err := s.UpdateUser(ctx, &users.UpdateUserRequest{
+			Account:    account,
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"Username", "Claims"}},
+		})
+		if err != nil || !resp.Succeeded {
+			t.Fatalf("Could not update the user: %v, %v", resp, err)
+		}
+		if resp.Account.Username != "robert.durand" || len(resp.Account.Claims) != 1 || resp.Account.Version != 2 {
+			t.Errorf("The updated account is %v.", resp.Account)
+		}
+		if u, err := repo.Find("robert.durand", users.IdentifierType_USER_NAME); err != nil || u.ID != bobID || u.Claims["email"] != "" {
+			t.Errorf("The update is not stored: %+v, %v", u, err)
+		}
+
+		expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		resp, err = s.UpdateUser(ctx, &users.UpdateUserRequest{
+			Account:    &users.Account{Subject: bobID, ExpiresAt: timestamppb.New(expiresAt), Version: 2},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"ExpiresAt"}},
+		})
+		if err != nil || !resp.Succeeded || !resp.Account.ExpiresAt.AsTime().Equal(expiresAt) || resp.Account.Version != 3 {
+			t.Errorf("Could not set the expiration: %v, %v", resp, err)
+		}
+
+		// The version 1 has been replaced by the update.
+		resp, err = s.UpdateUser(ctx, &users.UpdateUserRequest{
+			Account:    &users.Account{Subject: bobID, Disabled: true, Version: 1},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"Disabled"}},
+		})
+		if err != nil || resp.Error != VersionConflict || resp.Code != users.ErrorCode_VERSION_CONFLICT {
+			t.Errorf("A stale version should be rejected: %v, %v", resp, err)
+		}
+
+		resp, err = s.UpdateUser(ctx, &users.UpdateUserRequest{
+			Account:    &users.Account{Subject: bobID, Username: "alice.martin", Version: 3},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"Username"}},
+		})
+		if err != nil || resp.Error != UserExists {
+			t.Errorf("The username of another user should be rejected: %v, %v", resp, err)
+		}
+
+		resp, err = s.UpdateUser(ctx, &users.UpdateUserRequest{
+			Account:    &users.Account{Subject: "3e7c1a9b-8d2f-4b6e-a1c5-6d9f3b2e7a04", Version: 1},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"Disabled"}},
+		})
+		if err != nil || resp.Error != UserNotFound {
+			t.Errorf("An unknown user should not be found: %v, %v", resp, err)
+		}
+
+		for _, req := range []*users.UpdateUserRequest{
+			{Account: &users.Account{Subject: bobID, Version: 3}, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"PasswordHash"}}},
+			{Account: &users.Account{Subject: bobID, Version: 3}},
+			{Account: &users.Account{Subject: bobID}, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"Disabled"}}},
+			{Account: &users.Account{Subject: bobID, Username: "bob(durand)", Version: 3}, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"Username"}}},
+		} {
+			if _, err := s.UpdateUser(ctx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("The request %v should be invalid, error: %v", req, err)
+			}
+		}
+	})
+}
+
+func TestAdminDisableAndUnlockUser(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := adminServer{repo: repo}
+		ctx := context.Background()
+		authenticate := func() int32 {
+			return (server{repo: repo}).authenticate(&users.AuthRequest{Username: "alice.martin", Password: "Lor49914"}).Error
+		}
+
+		resp, err := s.DisableUser(ctx, &users.DisableUserRequest{Subject: aliceID})
+		if err != nil || !resp.Account.Disabled {
+			t.Fatalf("Could not disable the user: %v, %v", resp, err)
+		}
+		if code := authenticate(); code != AccountDisabled {
+			t.Errorf("A disabled user should not be authenticated, error: %d", code)
+		}
+		resp, err = s.UpdateUser(ctx, &users.UpdateUserRequest{
+			Account:    &users.Account{Subject: aliceID, Disabled: false, Version: resp.Account.Version},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"Disabled"}},
+		})
+		if err != nil || resp.Account.Disabled {
+			t.Fatalf("Could not enable the user: %v, %v", resp, err)
+		}
+
+		u, err := repo.Find(aliceID, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		if err := repo.RecordFailedLogin(aliceID, 1); err != nil {
+			t.Fatalf("Could not lock the user: %v", err)
+		}
+		if code := authenticate(); code != AccountLocked {
+			t.Errorf("A locked user should not be authenticated, error: %d", code)
+		}
+		if resp, _ := s.UnlockUser(ctx, &users.UnlockUserRequest{Subject: aliceID, Version: u.Version - 1}); resp.Error != VersionConflict {
+			t.Errorf("The user should not be unlocked at a previous version: %v", resp)
+		}
+		resp, err = s.UnlockUser(ctx, &users.UnlockUserRequest{Subject: aliceID, Version: u.Version})
+		if err != nil || resp.Account.Locked || resp.Account.FailedLogins != 0 || resp.Account.Version != u.Version+1 {
+			t.Fatalf("Could not unlock the user: %v, %v", resp, err)
+		}
+		if code := authenticate(); code != 0 {
+			t.Errorf("Could not authenticate the unlocked user, error: %d", code)
+		}
+	})
+}
+
+func TestAdminResetTOTP(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := adminServer{repo: repo}
+		ctx := context.Background()
+		enrollTestTOTP(t, totpServer{repo: repo}, aliceID)
+
+		get, err := s.GetUser(ctx, &users.GetUserRequest{Subject: aliceID})
+		if err != nil || !get.Account.TOTPEnabled {
+			t.Fatalf("The second factor is not enabled: %v, %v", get, err)
+		}
+		// The changes of the account do not remove the second factor.
+		resp, err := s.DisableUser(ctx, &users.DisableUserRequest{Subject: aliceID, Version: get.Account.Version})
+		if err != nil || !resp.Account.TOTPEnabled {
+			t.Fatalf("The second factor has been removed by the change: %v, %v", resp, err)
+		}
+		if resp, _ := s.ResetTOTP(ctx, &users.ResetTOTPRequest{Subject: aliceID, Version: get.Account.Version}); resp.Error != VersionConflict {
+			t.Errorf("The second factor should not be reset at a previous version: %v", resp)
+		}
+		resp, err = s.ResetTOTP(ctx, &users.ResetTOTPRequest{Subject: aliceID, Version: resp.Account.Version})
+		if err != nil || resp.Account.TOTPEnabled || resp.Account.Version != get.Account.Version+2 {
+			t.Fatalf("Could not reset the second factor: %v, %v", resp, err)
+		}
+		if u, err := repo.Find(aliceID, users.IdentifierType_SUBJECT); err != nil || u.TOTP != nil {
+			t.Errorf("The second factor is still stored: %v, %v", u, err)
+		}
+	})
+}
+
+func TestAdminSetPasswordAndDeleteUser(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := adminServer{repo: repo}
+		ctx := context.Background()
+
+		resp, err := s.SetPassword(ctx, &users.SetPasswordRequest{Subject: bobID, Password: "Lagoon-Sunset-77", ChangeRequired: true})
+		if err != nil || !resp.Account.PasswordChangeRequired {
+			t.Fatalf("Could not set the password: %v, %v", resp, err)
+		}
+		auth := (server{repo: repo}).authenticate(&users.AuthRequest{Username: "bob.durand", Password: "Lagoon-Sunset-77"})
+		if auth.Error != PasswordChangeRequired {
+			t.Errorf("The password change should be required, error: %d", auth.Error)
+		}
+		rejected, err := s.SetPassword(ctx, &users.SetPasswordRequest{Subject: bobID, Password: "Bob-Password1"})
+		if err != nil || rejected.Error != PasswordRejected || len(rejected.Violations) != 2 {
+			t.Errorf("A previous password containing the name should be rejected: %v, %v", rejected, err)
+		}
+		if _, err := s.SetPassword(ctx, &users.SetPasswordRequest{Subject: bobID}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("An empty password should be rejected, error: %v", err)
+		}
+
+		del, err := s.DeleteUser(ctx, &users.DeleteUserRequest{Subject: bobID, Version: 1})
+		if err != nil || del.Error != VersionConflict {
+			t.Errorf("A stale version should not be deleted: %v, %v", del, err)
+		}
+		if del, err = s.DeleteUser(ctx, &users.DeleteUserRequest{Subject: bobID, Version: resp.Account.Version}); err != nil || !del.Succeeded {
+			t.Fatalf("Could not delete the user: %v, %v", del, err)
+		}
+		if get, err := s.GetUser(ctx, &users.GetUserRequest{Subject: bobID}); err != nil || get.Error != UserNotFound {
+			t.Errorf("The deleted user should not be found: %v, %v", get, err)
+		}
+		if u, err := repo.Find("+687 250000", users.IdentifierType_PHONE_NUMBER); err != nil || u.ID != aliceID {
+			t.Errorf("The claims of the deleted user should be deleted: %+v, %v", u, err)
+		}
+	})
+}
+
+func TestAdminListUsers(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := adminServer{repo: repo}
+		ctx := context.Background()
+
+		var subjects []string
+		req := &users.ListUsersRequest{PageSize: 2}
+		for pages := 0; ; pages++ {
+			if pages == 3 {
+				t.Fatalf("The listing does not end.")
+			}
+			resp, err := s.ListUsers(ctx, req)
+			if err != nil {
+				t.Fatalf("Could not list the users: %v", err)
+			}
+			for _, account := range resp.Accounts {
+				subjects = append(subjects, account.Subject)
+			}
+			if resp.NextPageToken == "" {
+				break
+			}
+			req.PageToken = resp.NextPageToken
+		}
+		if len(subjects) != 3 || subjects[0] != aliceID || subjects[1] != bobID || subjects[2] != carolID {
+			t.Errorf("The listed users are %v.", subjects)
+		}
+
+		filter, err := scim.Parse(`email co "leroy"`)
+		if err != nil {
+			t.Fatalf("Could not parse the filter: %v", err)
+		}
+		resp, err := s.ListUsers(ctx, &users.ListUsersRequest{Filter: filter})
+		if err != nil || len(resp.Accounts) != 1 || resp.Accounts[0].Subject != carolID {
+			t.Errorf("The filtered users are %v, error: %v", resp, err)
+		}
+
+		for _, req := range []*users.ListUsersRequest{{PageSize: -1}, {PageToken: "not base64!"}} {
+			if _, err := s.ListUsers(ctx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("The request %v should be invalid, error: %v", req, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"csb.nc/auth/stores/tools/identifiers"
+	"csb.nc/auth/stores/tools/passwords"
+	"csb.nc/auth/stores/users"
+	"go.uber.org/zap"
+)
+
+// Modes of the imports.
+const (
+	// The accounts of the file are created or updated, the other accounts are kept.
+	importModeUpsert = "upsert"
+	// The accounts of the file are created or updated, the other accounts are deleted.
+	importModeReplace = "replace"
+)
+
+// Client of the imports in the audit log.
+const importClient = "import"
+
+const commandsUsage = `Usage:
+  accounts                 serves the gRPC API
+  accounts export [flags] FILE
+  accounts import [flags] FILE
+
+Run 'accounts export -h' or 'accounts import -h' for their flags.
+`
+
+// Runs a command of the accounts store, instead of serving the gRPC API, and returns its exit code.
+// The reports are written to out.
+func runCommand(args []string, out io.Writer) int {
+	var err error
+	switch args[0] {
+	case "export":
+		err = runExport(args[1:], out)
+	case "import":
+		err = runImport(args[1:], out)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(out, commandsUsage)
+		return 0
+	default:
+		fmt.Fprintf(out, "Unknown command: %s\n\n%s", args[0], commandsUsage)
+		return 2
+	}
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	case err != nil:
+		fmt.Fprintf(out, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// errUsage is returned when the flags or the arguments of a command are invalid, once its usage is written.
+var errUsage = errors.New("invalid usage")
+
+// Parses the flags of a command, which has a single file argument.
+func parseCommand(fs *flag.FlagSet, args []string, out io.Writer) (string, error) {
+	fs.SetOutput(out)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return "", err
+		}
+		return "", errUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(out, "A single file is expected.\n")
+		fs.Usage()
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
+
+// Exports the accounts to a file.
+func runExport(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "", "format of the file: json, csv or ldif (default: the extension of the file)")
+	baseDN := fs.String("base-dn", ldifBaseDNDefault, "DN under which the LDIF entries are named")
+	fs.Usage = func() {
+		fmt.Fprintf(out, "Usage: accounts export [flags] FILE\n\nExports the accounts, with their password hashes, to FILE.\n\n")
+		fs.PrintDefaults()
+	}
+	path, err := parseCommand(fs, args, out)
+	if err != nil {
+		return err
+	}
+	if *format, err = fileFormat(path, *format); err != nil {
+		return err
+	}
+
+	repo, err := newRepository()
+	if err != nil {
+		return fmt.Errorf("could not open the users repository: %w", err)
+	}
+	defer repo.Close()
+
+	// The file holds the password hashes, so it is only readable by its owner.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := exportAccounts(repo, f, *format, *baseDN)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not export the accounts: %w", err)
+	}
+	zap.L().Sugar().Infof("%d accounts have been exported to %s.", n, path)
+	fmt.Fprintf(out, "%d accounts exported to %s.\n", n, path)
+	return nil
+}
+
+// Writes the accounts to w in the format, sorted by username, and returns their number.
+func exportAccounts(repo UserRepository, w io.Writer, format string, baseDN string) (int, error) {
+	usrs, err := repo.List()
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(usrs, func(i, j int) bool {
+		return strings.ToLower(usrs[i].Username) < strings.ToLower(usrs[j].Username)
+	})
+	records := make([]accountRecord, 0, len(usrs))
+	for i := range usrs {
+		records = append(records, recordOf(&usrs[i]))
+	}
+	return len(records), writeRecords(w, format, records, baseDN)
+}
+
+// importOptions are the flags of an import.
+type importOptions struct {
+	mode string
+	// The changes are only reported.
+	dryRun bool
+	// The plaintext passwords of the file are hashed, otherwise they are rejected.
+	hashPasswords bool
+	// The plaintext passwords are not checked against the password policy.
+	skipPasswordPolicy bool
+}
+
+// Imports the accounts of a file.
+func runImport(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "format of the file: json, csv or ldif (default: the extension of the file)")
+	var opts importOptions
+	fs.StringVar(&opts.mode, "mode", importModeUpsert, "upsert keeps the accounts missing from the file, replace deletes them")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "only report the changes, without applying them")
+	fs.BoolVar(&opts.hashPasswords, "hash-passwords", false, "hash the plaintext passwords of the file, which are rejected otherwise")
+	fs.BoolVar(&opts.skipPasswordPolicy, "skip-password-policy", false, "do not check the plaintext passwords against the password policy")
+	fs.Usage = func() {
+		fmt.Fprintf(out, "Usage: accounts import [flags] FILE\n\nCreates and updates the accounts of FILE. Nothing is changed when a record is invalid.\nThe import is not atomic: the changes are applied one at a time, the deletions last, and the changes applied before a failure are kept.\n\n")
+		fs.PrintDefaults()
+	}
+	path, err := parseCommand(fs, args, out)
+	if err != nil {
+		return err
+	}
+	if opts.mode != importModeUpsert && opts.mode != importModeReplace {
+		return fmt.Errorf("unknown mode '%s', the mode must be upsert or replace", opts.mode)
+	}
+	if *format, err = fileFormat(path, *format); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	records, err := readRecords(f, *format)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+
+	repo, err := newRepository()
+	if err != nil {
+		return fmt.Errorf("could not open the users repository: %w", err)
+	}
+	defer repo.Close()
+	return importAccounts(repo, records, opts, out)
+}
+
+// accountChange is a change of the import.
+type accountChange struct {
+	action byte
+	user   user
+	// The version of the user updated or deleted.
+	version int64
+	// The fields updated.
+	fields []string
+	// The plaintext password, hashed when the change is applied.
+	password string
+}
+
+// Actions of the changes, as they are reported.
+const (
+	actionCreate = '+'
+	actionUpdate = '~'
+	actionDelete = '-'
+)
+
+// Returns the method of the AccountsAdmin service making the same change, recorded in the audit log.
+func (c *accountChange) method() string {
+	switch c.action {
+	case actionCreate:
+		return "CreateUser"
+	case actionUpdate:
+		return "UpdateUser"
+	default:
+		return "DeleteUser"
+	}
+}
+
+// Imports the records in the repository, reporting the changes to out.
+// The records are all validated first, and nothing is changed when one of them is invalid.
+// The import is not atomic, the changes applied before a failed change are kept.
+func importAccounts(repo UserRepository, records []accountRecord, opts importOptions, out io.Writer) error {
+	current, err := repo.List()
+	if err != nil {
+		return fmt.Errorf("could not list the accounts: %w", err)
+	}
+	changes, unchanged, errs := planImport(records, current, opts)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(out, "%v\n", err)
+		}
+		return fmt.Errorf("%d invalid records, no account has been changed", len(errs))
+	}
+
+	counts := make(map[byte]int)
+	for _, c := range changes {
+		counts[c.action]++
+		id := c.user.ID
+		if id == "" {
+			id = "new"
+		}
+		if c.action == actionUpdate {
+			fmt.Fprintf(out, "%c %s (%s): %s\n", c.action, c.user.Username, id, strings.Join(c.fields, ", "))
+		} else {
+			fmt.Fprintf(out, "%c %s (%s)\n", c.action, c.user.Username, id)
+		}
+	}
+	if opts.dryRun {
+		fmt.Fprintf(out, "Dry run, nothing has been changed: %d to create, %d to update, %d to delete, %d unchanged.\n",
+			counts[actionCreate], counts[actionUpdate], counts[actionDelete], unchanged)
+		return nil
+	}
+
+	// The changes are applied one at a time, the deletions being planned last: when a change fails, the accounts are kept
+	// rather than deleted, and the import can be run again. The usernames of the accounts cannot be taken by other records,
+	// so the order of the other changes does not matter.
+	// Each change is recorded in the audit log, as the changes of the AccountsAdmin service.
+	ctx := context.WithValue(context.Background(), adminClientKey{}, importClient)
+	for i, c := range changes {
+		err := applyChange(repo, &c)
+		var code int32
+		if err != nil {
+			code = changeError(err)
+		}
+		audit(ctx, c.method(), c.user.ID, code, zap.String("username", c.user.Username), zap.Strings("fields", c.fields))
+		if err != nil {
+			fmt.Fprintf(out, "%d of the %d changes have been applied.\n", i, len(changes))
+			return fmt.Errorf("could not import the account %s: %w", c.user.Username, err)
+		}
+	}
+	summary := fmt.Sprintf("%d created, %d updated, %d deleted, %d unchanged.", counts[actionCreate], counts[actionUpdate], counts[actionDelete], unchanged)
+	zap.L().Sugar().Infof("The accounts have been imported: %s", summary)
+	fmt.Fprintf(out, "The accounts have been imported: %s\n", summary)
+	return nil
+}
+
+// Computes the changes of the import, and the number of accounts unchanged, or the errors of the invalid records.
+func planImport(records []accountRecord, current []user, opts importOptions) (changes []accountChange, unchanged int, errs []error) {
+	byID := make(map[string]*user)
+	byUsername := make(map[string]*user)
+	for i := range current {
+		byID[strings.ToLower(current[i].ID)] = &current[i]
+		byUsername[strings.ToLower(current[i].Username)] = &current[i]
+	}
+	fail := func(rec *accountRecord, format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s (%s): %s", rec.position, rec.Username, fmt.Sprintf(format, a...)))
+	}
+
+	ids := make(map[string]bool)
+	usernames := make(map[string]bool)
+	matched := make(map[string]bool)
+	for i := range records {
+		rec := &records[i]
+		if err := validateRecord(rec, opts); err != nil {
+			fail(rec, "%v", err)
+			continue
+		}
+		id, username := strings.ToLower(rec.ID), strings.ToLower(rec.Username)
+		if rec.ID != "" && ids[id] {
+			fail(rec, "the id %s is used by another record", rec.ID)
+			continue
+		}
+		if usernames[username] {
+			fail(rec, "the username is used by another record")
+			continue
+		}
+		ids[id], usernames[username] = true, true
+
+		// The records are matched by id, or by username when they have no id.
+		existing := byUsername[username]
+		if rec.ID != "" {
+			existing = byID[id]
+			if other := byUsername[username]; other != nil && other != existing {
+				fail(rec, "the username is used by the account %s", other.ID)
+				continue
+			}
+		}
+
+		if existing == nil {
+			if rec.PasswordHash == "" && rec.Password == "" {
+				fail(rec, "a password or a password hash is required to create the account")
+				continue
+			}
+			c := accountChange{action: actionCreate, user: newAccount(rec), password: rec.Password}
+			if err := checkImportedPassword(&c, opts); err != nil {
+				fail(rec, "%v", err)
+				continue
+			}
+			changes = append(changes, c)
+			continue
+		}
+		if matched[existing.ID] {
+			fail(rec, "the account %s is matched by another record", existing.ID)
+			continue
+		}
+		matched[existing.ID] = true
+		c := updateAccount(existing, rec)
+		if len(c.fields) == 0 {
+			unchanged++
+			continue
+		}
+		if err := checkImportedPassword(&c, opts); err != nil {
+			fail(rec, "%v", err)
+			continue
+		}
+		changes = append(changes, c)
+	}
+
+	if opts.mode == importModeReplace {
+		for i := range current {
+			if !matched[current[i].ID] {
+				changes = append(changes, accountChange{action: actionDelete, user: current[i], version: current[i].Version})
+			}
+		}
+	}
+	return changes, unchanged, errs
+}
+
+// Validates a record: its identifiers, its password and its claims.
+func validateRecord(rec *accountRecord, opts importOptions) error {
+	if strings.TrimSpace(rec.Username) == "" {
+		return fmt.Errorf("the username is required")
+	}
+	if strings.TrimSpace(rec.Username) != rec.Username || strings.IndexFunc(rec.Username, unicode.IsControl) >= 0 {
+		return fmt.Errorf("the username has spaces around it or control characters")
+	}
+	if rec.ID != "" {
+		if err := identifiers.Validate(rec.ID, users.IdentifierType_SUBJECT); err != nil {
+			return fmt.Errorf("invalid id: %w", err)
+		}
+	}
+
+	switch {
+	case rec.Password != "" && rec.PasswordHash != "":
+		return fmt.Errorf("the record has both a password and a password hash")
+	case rec.Password != "" && !opts.hashPasswords:
+		return fmt.Errorf("the record has a plaintext password, which is only imported with -hash-passwords")
+	case rec.PasswordHash != "":
+		if err := passwords.Validate(rec.PasswordHash); err != nil {
+			return fmt.Errorf("invalid password hash: %w", err)
+		}
+	}
+
+	// The claims matched by the identifiers must be valid identifiers, so the users can be found by them.
+	identifierClaims := make(map[string]users.IdentifierType)
+	for identifierType := range identifierKeys {
+		if claim, err := identifierClaim(identifierType); err == nil {
+			identifierClaims[claim] = identifierType
+		}
+	}
+	for name, value := range rec.Claims {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+			return fmt.Errorf("the claim name '%s' is empty or has spaces or control characters", name)
+		}
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("the claim %s is not valid UTF-8", name)
+		}
+		if identifierType, ok := identifierClaims[name]; ok && value != "" {
+			if err := identifiers.Validate(value, identifierType); err != nil {
+				return fmt.Errorf("invalid claim %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks the plaintext password of a change against the password policy, unless the import skips it.
+// The password hashes of the file cannot be checked.
+func checkImportedPassword(c *accountChange, opts importOptions) error {
+	if c.password == "" || opts.skipPasswordPolicy {
+		return nil
+	}
+	violations := checkNewPassword(&c.user, c.password)
+	if len(violations) == 0 {
+		return nil
+	}
+	messages := make([]string, len(violations))
+	for i, v := range violations {
+		messages[i] = v.Message
+	}
+	return fmt.Errorf("the password is rejected by the password policy: %s", strings.Join(messages, " "))
+}
+
+// Returns the account created for a record. Its id is generated when the change is applied, if the record has none.
+func newAccount(rec *accountRecord) user {
+	return user{
+		ID:                     rec.ID,
+		Username:               rec.Username,
+		PasswordHash:           rec.PasswordHash,
+		PasswordChangeRequired: rec.PasswordChangeRequired,
+		Disabled:               rec.Disabled,
+		Pending:                rec.Pending,
+		ExpiresAt:              rec.ExpiresAt,
+		Claims:                 recordClaims(rec),
+	}
+}
+
+// Returns the update of an account to a record, whose fields are empty when it is unchanged.
+// The claims are replaced as a whole, and the password is kept when the record has none.
+func updateAccount(existing *user, rec *accountRecord) accountChange {
+	c := accountChange{action: actionUpdate, user: *existing, version: existing.Version}
+	u := &c.user
+	if u.Username != rec.Username {
+		u.Username = rec.Username
+		c.fields = append(c.fields, "username")
+	}
+	switch {
+	case rec.PasswordHash != "" && rec.PasswordHash != u.PasswordHash:
+		u.PasswordHistory = passwordHistory(existing)
+		u.PasswordHash = rec.PasswordHash
+		c.fields = append(c.fields, "password")
+	case rec.Password != "" && !checkPassword(existing, rec.Password):
+		u.PasswordHistory = passwordHistory(existing)
+		c.password = rec.Password
+		c.fields = append(c.fields, "password")
+	}
+	if u.PasswordChangeRequired != rec.PasswordChangeRequired {
+		u.PasswordChangeRequired = rec.PasswordChangeRequired
+		c.fields = append(c.fields, "password_change_required")
+	}
+	if u.Disabled != rec.Disabled {
+		u.Disabled = rec.Disabled
+		c.fields = append(c.fields, "disabled")
+	}
+	if u.Pending != rec.Pending {
+		u.Pending = rec.Pending
+		c.fields = append(c.fields, "pending")
+	}
+	if (u.ExpiresAt == nil) != (rec.ExpiresAt == nil) || (u.ExpiresAt != nil && !u.ExpiresAt.Equal(*rec.ExpiresAt)) {
+		u.ExpiresAt = rec.ExpiresAt
+		c.fields = append(c.fields, "expires_at")
+	}
+
+	claims := recordClaims(rec)
+	var changed []string
+	for name, value := range claims {
+		if existing.Claims[name] != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range existing.Claims {
+		if _, ok := claims[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		u.Claims = claims
+		c.fields = append(c.fields, fmt.Sprintf("claims (%s)", strings.Join(changed, ", ")))
+	}
+	return c
+}
+
+// Returns the claims of a record, without the empty ones.
+func recordClaims(rec *accountRecord) map[string]string {
+	claims := make(map[string]string, len(rec.Claims))
+	for name, value := range rec.Claims {
+		if value != "" {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+// Applies a change to the repository, hashing its plaintext password.
+func applyChange(repo UserRepository, c *accountChange) error {
+	if c.password != "" {
+		hash, err := hashPassword(c.password)
+		if err != nil {
+			return err
+		}
+		c.user.PasswordHash = hash
+	}
+	switch c.action {
+	case actionCreate:
+		if c.user.ID == "" {
+			id, err := newSubject()
+			if err != nil {
+				return err
+			}
+			c.user.ID = id
+		}
+		return repo.Create(&c.user)
+	case actionUpdate:
+		return repo.Update(&c.user, c.version)
+	default:
+		return repo.Delete(c.user.ID, c.version)
+	}
+}
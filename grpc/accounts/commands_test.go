@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"csb.nc/auth/stores/users"
+)
+
+// Returns the test users as records, to be changed by the tests.
+func testRecords(t *testing.T, repo UserRepository) []accountRecord {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := exportAccounts(repo, &b, formatJSON, ""); err != nil {
+		t.Fatalf("Could not export the accounts: %v", err)
+	}
+	records, err := readJSONRecords(&b)
+	if err != nil {
+		t.Fatalf("Could not read the accounts: %v", err)
+	}
+	return records
+}
+
+func TestImportAccounts(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		// alice.martin, bob.durand and carol.leroy, in this order.
+		records := testRecords(t, repo)
+		records[0].Claims["email"] = "alice.martin@example.nc"
+		records[1].PasswordHash = ""
+		records[1].Password = "Tropical-Reef-42"
+		records = append(records[:2], accountRecord{Username: "dave.noel", Password: "Lagoon-Sunset-77", Claims: map[string]string{"name": "Dave Noël"}})
+		opts := importOptions{mode: importModeReplace, dryRun: true, hashPasswords: true}
+
+		var out bytes.Buffer
+		if err := importAccounts(repo, records, opts, &out); err != nil {
+			t.Fatalf("Could not plan the import: %v", err)
+		}
+		want := []string{
+			"~ alice.martin (" + aliceID + "): claims (email)",
+			"~ bob.durand (" + bobID + "): password",
+			"+ dave.noel (new)",
+			"- carol.leroy (" + carolID + ")",
+			"Dry run, nothing has been changed: 1 to create, 2 to update, 1 to delete, 0 unchanged.",
+		}
+		if report := strings.TrimSpace(out.String()); report != strings.Join(want, "\n") {
+			t.Errorf("Unexpected report:\n%s", report)
+		}
+		if usrs, _ := repo.List(); len(usrs) != 3 {
+			t.Fatalf("The dry run has changed the accounts: %v", usrs)
+		}
+
+		opts.dryRun = false
+		if err := importAccounts(repo, records, opts, &out); err != nil {
+			t.Fatalf("Could not import the accounts: %v", err)
+		}
+		if _, err := repo.Find(carolID, users.IdentifierType_SUBJECT); err != errUserNotFound {
+			t.Errorf("The account missing from the file should be deleted: %v", err)
+		}
+		if u, err := repo.Find("alice.martin@example.nc", users.IdentifierType_EMAIL); err != nil || u.ID != aliceID {
+			t.Errorf("The claims have not been updated: %v, %v", u, err)
+		}
+		for username, password := range map[string]string{"alice.martin": "Lor49914", "bob.durand": "Tropical-Reef-42", "dave.noel": "Lagoon-Sunset-77"} {
+			if resp := (server{repo: repo}).authenticate(&users.AuthRequest{Username: username, Password: password}); !resp.Succeeded {
+				t.Errorf("Could not authenticate %s, error: %d", username, resp.Error)
+			}
+		}
+
+		// The same file changes nothing once it is imported.
+		out.Reset()
+		if err := importAccounts(repo, testRecords(t, repo), importOptions{mode: importModeUpsert}, &out); err != nil {
+			t.Fatalf("Could not import the accounts again: %v", err)
+		}
+		if report := strings.TrimSpace(out.String()); report != "The accounts have been imported: 0 created, 0 updated, 0 deleted, 3 unchanged." {
+			t.Errorf("Unexpected report:\n%s", report)
+		}
+	})
+}
+
+func TestImportAccountsValidation(t *testing.T) {
+	testCases := []struct {
+		name   string
+		record accountRecord
+		opts   importOptions
+	}{
+		{"Missing username", accountRecord{PasswordHash: "d90a83ee66e0bc4ce6f5150cafa84edf0b4117644edb70e54fbd468e2fc183e5"}, importOptions{}},
+		{"Invalid id", accountRecord{ID: "not a subject", Username: "dave.noel", PasswordHash: "d90a83ee66e0bc4ce6f5150cafa84edf0b4117644edb70e54fbd468e2fc183e5"}, importOptions{}},
+		{"Invalid hash", accountRecord{Username: "dave.noel", PasswordHash: "$md5$X03MO1qnZdYdgyfeuILPmQ"}, importOptions{}},
+		{"Plaintext password", accountRecord{Username: "dave.noel", Password: "Lagoon-Sunset-77"}, importOptions{}},
+		{"Password and hash", accountRecord{Username: "dave.noel", Password: "Lagoon-Sunset-77", PasswordHash: "d90a83ee66e0bc4ce6f5150cafa84edf0b4117644edb70e54fbd468e2fc183e5"}, importOptions{hashPasswords: true}},
+		{"No password", accountRecord{Username: "dave.noel"}, importOptions{}},
+		{"Invalid email", accountRecord{Username: "dave.noel", Password: "Lagoon-Sunset-77", Claims: map[string]string{"email": "dave.noel"}}, importOptions{hashPasswords: true}},
+		{"Invalid claim name", accountRecord{Username: "dave.noel", Password: "Lagoon-Sunset-77", Claims: map[string]string{"full name": "Dave Noël"}}, importOptions{hashPasswords: true}},
+		{"Weak password", accountRecord{Username: "dave.noel", Password: "lagoon"}, importOptions{hashPasswords: true}},
+		{"Password with the username", accountRecord{Username: "dave.noel", Password: "Dave.Noel-2024!"}, importOptions{hashPasswords: true}},
+		{"Weak password of an account", accountRecord{ID: bobID, Username: "bob.durand", Password: "lagoon"}, importOptions{hashPasswords: true}},
+		{"Username of another account", accountRecord{ID: "7e3c2a9d-4b1f-4c6e-8a2d-5f9b1e7c3a84", Username: "Bob.Durand", Password: "Lagoon-Sunset-77"}, importOptions{hashPasswords: true}},
+		{"Duplicate username", accountRecord{Username: "Alice.Martin"}, importOptions{}},
+	}
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		records := testRecords(t, repo)
+		for _, tc := range testCases {
+			tc.opts.mode = importModeUpsert
+			tc.record.position = "record 4"
+			var out bytes.Buffer
+			if err := importAccounts(repo, append(records[:3:3], tc.record), tc.opts, &out); err == nil || !strings.HasPrefix(out.String(), "record 4 ") {
+				t.Errorf("%s: the record should be rejected: %v\n%s", tc.name, err, out.String())
+			}
+		}
+		if usrs, _ := repo.List(); len(usrs) != 3 {
+			t.Errorf("The rejected imports have changed the accounts: %v", usrs)
+		}
+	})
+}
+
+func TestImportAccountsSkipPasswordPolicy(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		records := append(testRecords(t, repo), accountRecord{Username: "dave.noel", Password: "lagoon"})
+		var out bytes.Buffer
+		if err := importAccounts(repo, records, importOptions{mode: importModeUpsert, hashPasswords: true, skipPasswordPolicy: true}, &out); err != nil {
+			t.Fatalf("The password policy should be skipped: %v\n%s", err, out.String())
+		}
+		if resp := (server{repo: repo}).authenticate(&users.AuthRequest{Username: "dave.noel", Password: "lagoon"}); !resp.Succeeded {
+			t.Errorf("Could not authenticate dave.noel, error: %d", resp.Error)
+		}
+	})
+}
+
+// failingCreateRepository fails the creations, as a backend failing in the middle of an import.
+type failingCreateRepository struct {
+	UserRepository
+}
+
+func (r failingCreateRepository) Create(u *user) error {
+	return errors.New("the backend has failed")
+}
+
+func TestImportAccountsFailureKeepsAccounts(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		// alice.martin and bob.durand are kept, carol.leroy is missing from the file.
+		records := append(testRecords(t, repo)[:2], accountRecord{Username: "dave.noel", Password: "Lagoon-Sunset-77"})
+		var out bytes.Buffer
+		err := importAccounts(failingCreateRepository{repo}, records, importOptions{mode: importModeReplace, hashPasswords: true}, &out)
+		if err == nil {
+			t.Fatalf("The failed creation should fail the import:\n%s", out.String())
+		}
+		// The deletions are applied last, so the accounts missing from the file are kept when a change fails.
+		if _, err := repo.Find(carolID, users.IdentifierType_SUBJECT); err != nil {
+			t.Errorf("The account missing from the file has been deleted before the failure: %v", err)
+		}
+		if !strings.Contains(out.String(), "0 of the 2 changes have been applied.") {
+			t.Errorf("Unexpected report:\n%s", out.String())
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"csb.nc/auth/stores/tools/authflow"
+	"csb.nc/auth/stores/users"
+	"go.uber.org/zap"
+)
+
+var flowStore = authflow.Store{
+	Name:         storeName,
+	ErrorCode:    errorCode,
+	InvalidState: InvalidFlowState,
+}
+
+// Changes the password of a user after checking its current password, and clears the password change requirement.
+// The violations of the password policy are returned with the PasswordRejected error.
+func changePassword(repo UserRepository, username string, password string, newPassword string) (int32, []*users.PasswordViolation) {
+	zap.L().Sugar().Infof("Changing the password of the user: %s", username)
+
+	u, err := repo.Find(username, users.IdentifierType_USER_NAME)
+	if err != nil {
+		return findUserError(err), nil
+	}
+	// The password change is also a way to guess the passwords, it is refused and counted the same as the logins.
+	if isLocked(u, time.Now()) {
+		return AccountLocked, nil
+	}
+	if !checkPassword(u, password) {
+		recordFailedLogin(repo, u)
+		return InvalidPassword, nil
+	}
+	if violations := checkNewPassword(u, newPassword); len(violations) > 0 {
+		zap.L().Sugar().Infof("The new password of the user %s has been rejected by the password policy.", username)
+		return PasswordRejected, violations
+	}
+
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		zap.L().Error("Could not hash the password.", zap.Error(err))
+		return UsersNotSaved, nil
+	}
+	switch err := repo.SetPassword(u.ID, u.PasswordHash, hash, passwordHistory(u), false); {
+	case errors.Is(err, errPasswordChanged):
+		// The current password is no longer the one checked.
+		return InvalidPassword, nil
+	case errors.Is(err, errUserNotFound):
+		return UserNotFound, nil
+	case err != nil:
+		zap.L().Error("Could not save the password.", zap.Error(err))
+		return UsersNotSaved, nil
+	}
+	return 0, nil
+}
+
+// Runs the steps of an authentication flow against the users repository.
+type flowHandler struct {
+	s server
+	// Set once the one-time code of the user has been checked, as it cannot be used again.
+	otpChecked bool
+}
+
+func (h *flowHandler) Password(creds *users.AuthRequest) *authflow.Step {
+	return h.next(h.s.login(creds, false))
+}
+
+func (h *flowHandler) OTP(creds *users.AuthRequest, otp string) *authflow.Step {
+	resp := h.s.login(&users.AuthRequest{
+		Username: creds.Username,
+		Password: creds.Password,
+		Claims:   creds.Claims,
+		Otp:      otp,
+	}, false)
+	if resp.Error == InvalidOTP {
+		return &authflow.Step{Error: resp.Error}
+	}
+	if resp.Error == 0 || resp.Error == PasswordChangeRequired {
+		h.otpChecked = true
+	}
+	return h.next(resp)
+}
+
+func (h *flowHandler) NewPassword(creds *users.AuthRequest, newPassword string) *authflow.Step {
+	switch code, violations := changePassword(h.s.repo, creds.Username, creds.Password, newPassword); code {
+	case 0:
+	case PasswordRejected:
+		return &authflow.Step{Error: code, Violations: violations}
+	default:
+		return &authflow.Step{Result: &users.AuthResponse{Error: code}}
+	}
+
+	return &authflow.Step{Result: h.s.login(&users.AuthRequest{
+		Username: creds.Username,
+		Password: newPassword,
+		Claims:   creds.Claims,
+	}, h.otpChecked)}
+}
+
+// Sends the challenge of the login errors that the user can answer, or ends the flow with the result of the login.
+func (h *flowHandler) next(resp *users.AuthResponse) *authflow.Step {
+	switch resp.Error {
+	case SecondFactorRequired:
+		return &authflow.Step{Challenge: users.ChallengeType_OTP_REQUIRED}
+	case PasswordChangeRequired:
+		return &authflow.Step{Challenge: users.ChallengeType_NEW_PASSWORD_REQUIRED}
+	}
+	return &authflow.Step{Result: resp}
+}
@@ -6,7 +6,12 @@ replace csb.nc/auth/stores => ../../
 
 require (
 	csb.nc/auth/stores v0.0.0-00010101000000-000000000000
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/grpc-ecosystem/go-grpc-middleware v1.0.0
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/spf13/viper v1.7.1
 	go.uber.org/zap v1.16.0
 	google.golang.org/grpc v1.33.2
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+)
+
+// userIndex indexes the users by the lower cased values of their identifiers.
+// The indexes of all the supported identifier types are built at once, so an index is never modified and can be shared between the requests.
+type userIndex struct {
+	users   []user
+	indexes map[users.IdentifierType]map[string][]int
+}
+
+func newUserIndex(usrs []user) *userIndex {
+	idx := &userIndex{
+		users:   usrs,
+		indexes: make(map[users.IdentifierType]map[string][]int),
+	}
+	for identifierType := range users.IdentifierType_name {
+		value, err := identifierValue(users.IdentifierType(identifierType))
+		if err != nil {
+			// The identifier type is not mapped to a claim.
+			continue
+		}
+		index := make(map[string][]int, len(usrs))
+		for i := range usrs {
+			if v := value(&usrs[i]); v != "" {
+				key := strings.ToLower(v)
+				index[key] = append(index[key], i)
+			}
+		}
+		idx.indexes[users.IdentifierType(identifierType)] = index
+	}
+	return idx
+}
+
+// Returns the claim matched by an identifier type, other than SUBJECT and USER_NAME.
+func identifierClaim(identifierType users.IdentifierType) (string, error) {
+	var claim string
+	if key, ok := identifierKeys[identifierType]; ok {
+		claim = viper.GetString(fmt.Sprintf("%s.%s", viperKeyIdentifiers, key))
+	}
+	if claim == "" {
+		return "", errUnsupportedType
+	}
+	return claim, nil
+}
+
+// Returns the function reading the identifier of a user, for the identifier type.
+func identifierValue(identifierType users.IdentifierType) (func(u *user) string, error) {
+	switch identifierType {
+	case users.IdentifierType_SUBJECT:
+		return func(u *user) string { return u.ID }, nil
+	case users.IdentifierType_USER_NAME:
+		return func(u *user) string { return u.Username }, nil
+	}
+
+	claim, err := identifierClaim(identifierType)
+	if err != nil {
+		return nil, err
+	}
+	return func(u *user) string { return u.Claims[claim] }, nil
+}
+
+// find returns the single user matching the identifier.
+func (idx *userIndex) find(identifier string, identifierType users.IdentifierType) (*user, error) {
+	index, ok := idx.indexes[identifierType]
+	if !ok {
+		return nil, errUnsupportedType
+	}
+
+	switch matches := index[strings.ToLower(identifier)]; len(matches) {
+	case 0:
+		return nil, errUserNotFound
+	case 1:
+		return &idx.users[matches[0]], nil
+	default:
+		return nil, errAmbiguousIdentifier
+	}
+}
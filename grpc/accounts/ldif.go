@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"csb.nc/auth/stores/tools/ldif"
+)
+
+// Attributes of the LDIF entries, the other attributes are claims.
+const (
+	ldifAttributeDN                     = "dn"
+	ldifAttributeObjectClass            = "objectClass"
+	ldifAttributeID                     = "entryUUID"
+	ldifAttributeUsername               = "uid"
+	ldifAttributePassword               = "userPassword"
+	ldifAttributePasswordChangeRequired = "pwdReset"
+	ldifAttributeDisabled               = "accountDisabled"
+	ldifAttributePending                = "accountPending"
+	ldifAttributeExpiresAt              = "accountExpires"
+
+	ldifBaseDNDefault = "ou=users,dc=csb,dc=nc"
+	// The dates are written as LDAP generalized times, in UTC.
+	ldifTimeFormat = "20060102150405Z"
+	// The lines longer than this are folded.
+	ldifLineLength = 76
+
+	// The password hashes are written with the schemes of userPassword: CRYPT for the crypt formatted hashes,
+	// and SHA256 for the legacy hex digests, which are base64 encoded.
+	ldifSchemeCrypt  = "CRYPT"
+	ldifSchemeSHA256 = "SHA256"
+)
+
+// The attributes of the records, which cannot be the names of claims.
+var ldifAttributes = []string{
+	ldifAttributeDN,
+	ldifAttributeObjectClass,
+	ldifAttributeID,
+	ldifAttributeUsername,
+	ldifAttributePassword,
+	ldifAttributePasswordChangeRequired,
+	ldifAttributeDisabled,
+	ldifAttributePending,
+	ldifAttributeExpiresAt,
+}
+
+// The object classes of the entries written.
+var ldifObjectClasses = []string{"top", "inetOrgPerson"}
+
+// ldifLine is an attribute of an entry, once the lines are unfolded and the value decoded.
+type ldifLine struct {
+	attribute string
+	value     string
+	line      int
+}
+
+// Reads the entries of a LDIF content file. The change records are not supported.
+func readLDIFRecords(r io.Reader) ([]accountRecord, error) {
+	entries, err := readLDIFEntries(r)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]accountRecord, 0, len(entries))
+	for i, entry := range entries {
+		rec := accountRecord{Claims: make(map[string]string), position: fmt.Sprintf("record %d (line %d)", i+1, entry[0].line)}
+		if err := rec.setLDIFAttributes(entry); err != nil {
+			return nil, fmt.Errorf("%s: %w", rec.position, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// Reads the attributes of the entries, skipping the version.
+func readLDIFEntries(r io.Reader) ([][]ldifLine, error) {
+	lines, err := ldif.Unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		entries [][]ldifLine
+		entry   []ldifLine
+	)
+	// Ends the entry read so far.
+	end := func() error {
+		if len(entry) == 0 {
+			return nil
+		}
+		if !strings.EqualFold(entry[0].attribute, ldifAttributeDN) {
+			return fmt.Errorf("line %d: the entry does not start with its dn", entry[0].line)
+		}
+		entries = append(entries, entry)
+		entry = nil
+		return nil
+	}
+	for _, line := range lines {
+		if line.Text == "" {
+			if err := end(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		l, err := parseLDIFLine(line.Text, line.Number)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 && len(entry) == 0 && strings.EqualFold(l.attribute, "version") {
+			continue
+		}
+		entry = append(entry, l)
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Parses an attribute and its value, which is base64 encoded after a double colon.
+func parseLDIFLine(logical string, line int) (ldifLine, error) {
+	i := strings.IndexByte(logical, ':')
+	if i <= 0 {
+		return ldifLine{}, fmt.Errorf("line %d: the line has no attribute", line)
+	}
+	l := ldifLine{attribute: logical[:i], line: line}
+	value := logical[i+1:]
+	switch {
+	case strings.HasPrefix(value, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimLeft(value[1:], " "))
+		if err != nil {
+			return ldifLine{}, fmt.Errorf("line %d: the value of %s is not base64 encoded: %w", line, l.attribute, err)
+		}
+		l.value = string(decoded)
+	case strings.HasPrefix(value, "<"):
+		return ldifLine{}, fmt.Errorf("line %d: the value of %s is an URL, which is not supported", line, l.attribute)
+	default:
+		l.value = strings.TrimLeft(value, " ")
+	}
+	if strings.EqualFold(l.attribute, "changetype") {
+		return ldifLine{}, fmt.Errorf("line %d: the change records are not supported", line)
+	}
+	return l, nil
+}
+
+// Sets the fields and the claims of the attributes of an entry.
+func (rec *accountRecord) setLDIFAttributes(entry []ldifLine) error {
+	set := make(map[string]bool)
+	for _, l := range entry {
+		key := strings.ToLower(l.attribute)
+		if key == strings.ToLower(ldifAttributeObjectClass) {
+			continue
+		}
+		if set[key] {
+			return fmt.Errorf("line %d: the attribute %s has several values", l.line, l.attribute)
+		}
+		set[key] = true
+
+		var err error
+		switch key {
+		case strings.ToLower(ldifAttributeDN):
+		case strings.ToLower(ldifAttributeID):
+			rec.ID = l.value
+		case strings.ToLower(ldifAttributeUsername):
+			rec.Username = l.value
+		case strings.ToLower(ldifAttributePassword):
+			err = rec.setLDIFPassword(l.value)
+		case strings.ToLower(ldifAttributePasswordChangeRequired):
+			rec.PasswordChangeRequired, err = parseLDIFBool(l.value)
+		case strings.ToLower(ldifAttributeDisabled):
+			rec.Disabled, err = parseLDIFBool(l.value)
+		case strings.ToLower(ldifAttributePending):
+			rec.Pending, err = parseLDIFBool(l.value)
+		case strings.ToLower(ldifAttributeExpiresAt):
+			var t time.Time
+			if t, err = time.Parse(ldifTimeFormat, l.value); err == nil {
+				rec.ExpiresAt = &t
+			}
+		default:
+			rec.Claims[l.attribute] = l.value
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: invalid %s: %w", l.line, l.attribute, err)
+		}
+	}
+	return nil
+}
+
+// Sets the password hash of a userPassword value, or the plaintext password when the value has no scheme.
+func (rec *accountRecord) setLDIFPassword(value string) error {
+	if !strings.HasPrefix(value, "{") {
+		rec.Password = value
+		return nil
+	}
+	end := strings.IndexByte(value, '}')
+	if end < 0 {
+		return fmt.Errorf("the scheme is not closed")
+	}
+	switch scheme := strings.ToUpper(value[1:end]); scheme {
+	case ldifSchemeCrypt:
+		rec.PasswordHash = value[end+1:]
+	case ldifSchemeSHA256:
+		digest, err := base64.StdEncoding.DecodeString(value[end+1:])
+		if err != nil {
+			return err
+		}
+		rec.PasswordHash = hex.EncodeToString(digest)
+	default:
+		return fmt.Errorf("the scheme %s is not supported", scheme)
+	}
+	return nil
+}
+
+func parseLDIFBool(value string) (bool, error) {
+	switch strings.ToUpper(value) {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s is not TRUE or FALSE", value)
+	}
+}
+
+// Writes the records as LDIF entries, named by their username under the base DN.
+func writeLDIFRecords(w io.Writer, records []accountRecord, baseDN string) error {
+	if baseDN == "" {
+		baseDN = ldifBaseDNDefault
+	}
+	names := claimNames(records)
+	for _, name := range names {
+		for _, attribute := range ldifAttributes {
+			if strings.EqualFold(name, attribute) {
+				return fmt.Errorf("the claim %s cannot be written, it has the name of an attribute", name)
+			}
+		}
+		if !isLDIFAttribute(name) {
+			return fmt.Errorf("the claim %s cannot be written, it is not a valid attribute name", name)
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprint(b, "version: 1\n")
+	for _, rec := range records {
+		b.WriteString("\n")
+		writeLDIFLine(b, ldifAttributeDN, fmt.Sprintf("%s=%s,%s", ldifAttributeUsername, ldif.EscapeDNValue(rec.Username), baseDN))
+		for _, class := range ldifObjectClasses {
+			writeLDIFLine(b, ldifAttributeObjectClass, class)
+		}
+		writeLDIFLine(b, ldifAttributeUsername, rec.Username)
+		writeLDIFLine(b, ldifAttributeID, rec.ID)
+		if rec.PasswordHash != "" {
+			password, err := ldifPassword(rec.PasswordHash)
+			if err != nil {
+				return fmt.Errorf("the password hash of %s cannot be written: %w", rec.Username, err)
+			}
+			writeLDIFLine(b, ldifAttributePassword, password)
+		}
+		if rec.PasswordChangeRequired {
+			writeLDIFLine(b, ldifAttributePasswordChangeRequired, "TRUE")
+		}
+		if rec.Disabled {
+			writeLDIFLine(b, ldifAttributeDisabled, "TRUE")
+		}
+		if rec.Pending {
+			writeLDIFLine(b, ldifAttributePending, "TRUE")
+		}
+		if rec.ExpiresAt != nil {
+			writeLDIFLine(b, ldifAttributeExpiresAt, rec.ExpiresAt.UTC().Format(ldifTimeFormat))
+		}
+		claims := make([]string, 0, len(rec.Claims))
+		for name := range rec.Claims {
+			claims = append(claims, name)
+		}
+		sort.Strings(claims)
+		for _, name := range claims {
+			writeLDIFLine(b, name, rec.Claims[name])
+		}
+	}
+	return b.Flush()
+}
+
+// Returns the userPassword value of a password hash.
+func ldifPassword(hash string) (string, error) {
+	if strings.HasPrefix(hash, "$") {
+		return fmt.Sprintf("{%s}%s", ldifSchemeCrypt, hash), nil
+	}
+	digest, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("{%s}%s", ldifSchemeSHA256, base64.StdEncoding.EncodeToString(digest)), nil
+}
+
+// Writes an attribute, base64 encoding the values which are not safe strings, and folding the long lines.
+func writeLDIFLine(b *bufio.Writer, attribute string, value string) {
+	line := attribute + ": " + value
+	if !isLDIFSafe(value) {
+		line = attribute + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	for len(line) > ldifLineLength {
+		b.WriteString(line[:ldifLineLength])
+		b.WriteString("\n ")
+		line = line[ldifLineLength:]
+	}
+	b.WriteString(line)
+	b.WriteString("\n")
+}
+
+// A safe string of RFC 2849 is made of ASCII characters, other than the line breaks, and does not start with a space, a colon or a less-than sign.
+// The values ending with a space are also encoded, so they are not trimmed.
+func isLDIFSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	if value[0] == ' ' || value[0] == ':' || value[0] == '<' || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == 0 || c == '\n' || c == '\r' || c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// An attribute name is made of letters, digits and hyphens, starting with a letter.
+// The underscores of the claim names are also accepted, as most LDIF readers do.
+func isLDIFAttribute(name string) bool {
+	for i, c := range name {
+		letter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || !(c >= '0' && c <= '9' || c == '-' || c == '_')) {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyLockoutThreshold = "lockout.threshold"
+	viperKeyLockoutDuration  = "lockout.duration"
+
+	lockoutThresholdDefault = 5
+	lockoutDurationDefault  = 15 * time.Minute
+)
+
+// Returns the number of consecutive failed logins locking an account, the accounts are never locked when it is 0.
+func lockoutThreshold() int {
+	if viper.IsSet(viperKeyLockoutThreshold) {
+		return viper.GetInt(viperKeyLockoutThreshold)
+	}
+	return lockoutThresholdDefault
+}
+
+// Returns how long an account stays locked, until it is unlocked by an administrator when it is 0.
+func lockoutDuration() time.Duration {
+	if viper.IsSet(viperKeyLockoutDuration) {
+		return viper.GetDuration(viperKeyLockoutDuration)
+	}
+	return lockoutDurationDefault
+}
+
+// Checks if the lock of a user is still in effect at now.
+func isLocked(u *user, now time.Time) bool {
+	if u.LockedAt == nil {
+		return false
+	}
+	d := lockoutDuration()
+	return d <= 0 || now.Before(u.LockedAt.Add(d))
+}
+
+// Checks if the account of a user has expired at now.
+func isExpired(u *user, now time.Time) bool {
+	return u.ExpiresAt != nil && !now.Before(*u.ExpiresAt)
+}
+
+// Counts a failed login of a user, which locks the user once the threshold is reached.
+// The login fails anyway when the failure cannot be saved.
+func recordFailedLogin(repo UserRepository, u *user) {
+	threshold := lockoutThreshold()
+	if threshold <= 0 {
+		return
+	}
+	if err := repo.RecordFailedLogin(u.ID, threshold); err != nil {
+		zap.L().Error("Could not save the failed login.", zap.Error(err), zap.String("id", u.ID))
+		return
+	}
+	if u.FailedLogins+1 >= threshold && u.LockedAt == nil {
+		zap.L().Sugar().Warnf("The user %s has been locked after %d failed logins.", u.Username, u.FailedLogins+1)
+	}
+}
+
+// Clears the failed logins and the expired lock of a user.
+func resetFailedLogins(repo UserRepository, u *user) {
+	if err := repo.ResetFailedLogins(u.ID); err != nil {
+		zap.L().Error("Could not reset the failed logins.", zap.Error(err), zap.String("id", u.ID))
+		return
+	}
+	u.FailedLogins = 0
+	u.LockedAt = nil
+}
@@ -2,73 +2,358 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"errors"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"csb.nc/auth/stores/tools"
+	"csb.nc/auth/stores/tools/authflow"
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/tools/identifiers"
+	"csb.nc/auth/stores/tools/scim"
 	"csb.nc/auth/stores/users"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
 	cfgName = "config"
 	cfgType = "yaml"
 	cfgPath = "."
+
+	// How long the store waits for the messages being sent in the background when it stops.
+	shutdownTimeout = 30 * time.Second
 )
 
 type server struct {
 	users.UnimplementedUserServer
+	repo UserRepository
 }
 
 type user struct {
-	ID           string            `id:"id"`
-	Username     string            `json:"username"`
-	PasswordHash string            `json:"password_hash"`
-	Claims       map[string]string `json:"claims"`
+	ID                     string `json:"id"`
+	Username               string `json:"username"`
+	PasswordHash           string `json:"password_hash"`
+	PasswordChangeRequired bool   `json:"password_change_required,omitempty"`
+	// The hashes of the previous passwords, from the most recent one, which cannot be reused.
+	PasswordHistory []string          `json:"password_history,omitempty"`
+	Disabled        bool              `json:"disabled,omitempty"`
+	Pending         bool              `json:"pending,omitempty"`
+	LockedAt        *time.Time        `json:"locked_at,omitempty"`
+	ExpiresAt       *time.Time        `json:"expires_at,omitempty"`
+	Claims          map[string]string `json:"claims"`
+	Version         int64             `json:"version,omitempty"`
+	CreatedAt       *time.Time        `json:"created_at,omitempty"`
+	UpdatedAt       *time.Time        `json:"updated_at,omitempty"`
+	// The consecutive failed logins, which lock the user once they reach the lockout threshold. They do not change the version.
+	FailedLogins int `json:"failed_logins,omitempty"`
+	// The tokens issued to the user, only stored here by the JSON repository.
+	Tokens []userToken `json:"tokens,omitempty"`
+	// The TOTP second factor of the user. It does not change the version either.
+	TOTP *userTOTP `json:"totp,omitempty"`
 }
 
 const (
 	UserNotFound = iota + 1
 	UsersMissing
 	InvalidPassword
+	InvalidFilter
+	InvalidIdentifier
+	AmbiguousIdentifier
+	PasswordChangeRequired
+	PasswordRejected
+	UsersNotSaved
+	InvalidFlowState
+	UserExists
+	VersionConflict
+	InvalidRequest
+	Unauthenticated
+	AccountDisabled
+	AccountLocked
+	AccountExpired
+	AccountPending
+	InvalidToken
+	RateLimited
+	SecondFactorRequired
+	InvalidOTP
+	OTPNotEnabled
+	OTPAlreadyEnabled
+
+	viperKeyIdentifiers = "identifiers"
+
+	storeName = "accounts"
+)
+
+// Shared error codes of the accounts store error codes.
+var errorCodes = map[int32]users.ErrorCode{
+	UserNotFound:           users.ErrorCode_USER_NOT_FOUND,
+	UsersMissing:           users.ErrorCode_STORE_UNAVAILABLE,
+	InvalidPassword:        users.ErrorCode_INVALID_CREDENTIALS,
+	InvalidFilter:          users.ErrorCode_INVALID_FILTER,
+	InvalidIdentifier:      users.ErrorCode_INVALID_IDENTIFIER,
+	AmbiguousIdentifier:    users.ErrorCode_AMBIGUOUS_IDENTIFIER,
+	PasswordChangeRequired: users.ErrorCode_PASSWORD_CHANGE_REQUIRED,
+	PasswordRejected:       users.ErrorCode_PASSWORD_REJECTED,
+	UsersNotSaved:          users.ErrorCode_STORE_FAILURE,
+	InvalidFlowState:       users.ErrorCode_INVALID_FLOW_STATE,
+	UserExists:             users.ErrorCode_USER_EXISTS,
+	VersionConflict:        users.ErrorCode_VERSION_CONFLICT,
+	InvalidRequest:         users.ErrorCode_INVALID_REQUEST,
+	Unauthenticated:        users.ErrorCode_UNAUTHENTICATED,
+	AccountDisabled:        users.ErrorCode_ACCOUNT_DISABLED,
+	AccountLocked:          users.ErrorCode_ACCOUNT_LOCKED,
+	AccountExpired:         users.ErrorCode_ACCOUNT_EXPIRED,
+	AccountPending:         users.ErrorCode_EMAIL_NOT_VERIFIED,
+	InvalidToken:           users.ErrorCode_INVALID_TOKEN,
+	RateLimited:            users.ErrorCode_RATE_LIMITED,
+	SecondFactorRequired:   users.ErrorCode_SECOND_FACTOR_REQUIRED,
+	InvalidOTP:             users.ErrorCode_INVALID_OTP,
+	OTPNotEnabled:          users.ErrorCode_OTP_NOT_ENABLED,
+	OTPAlreadyEnabled:      users.ErrorCode_OTP_ALREADY_ENABLED,
+}
+
+// Returns the shared error code of an accounts store error code.
+func errorCode(storeError int32) users.ErrorCode {
+	if storeError == 0 {
+		return users.ErrorCode_NONE
+	}
+	if code, ok := errorCodes[storeError]; ok {
+		return code
+	}
+	return users.ErrorCode_STORE_FAILURE
+}
 
-	userNotFoundError = "User not found"
+var (
+	errUserNotFound        = errors.New("User not found")
+	errAmbiguousIdentifier = errors.New("Several users match the identifier")
+	errUnsupportedType     = errors.New("The identifier type is not mapped to a claim")
+	errUsersMissing        = errors.New("The users could not be read")
 )
 
+// Keys of the identifier types in the identifiers configuration, which sets the claim matched by each type.
+var identifierKeys = map[users.IdentifierType]string{
+	users.IdentifierType_EMAIL:               "email",
+	users.IdentifierType_USER_PRINCIPAL_NAME: "userPrincipalName",
+	users.IdentifierType_DISTINGUISHED_NAME:  "distinguishedName",
+	users.IdentifierType_PHONE_NUMBER:        "phoneNumber",
+	users.IdentifierType_EXTERNAL_ID:         "externalId",
+}
+
 func (s *server) Authenticate(ctx context.Context, req *users.AuthRequest) (*users.AuthResponse, error) {
+	resp := s.authenticate(req)
+	resp.Code = errorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) AuthenticateFlow(stream users.User_AuthenticateFlowServer) error {
+	return authflow.Run(stream, &flowHandler{s: s}, flowStore)
+}
+
+func (s server) GetAccountStatus(ctx context.Context, req *users.AccountStatusRequest) (*users.AccountStatusResponse, error) {
+	resp := s.getAccountStatus(req)
+	resp.Code = errorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) FindClaims(ctx context.Context, req *users.ClaimsRequest) (*users.ClaimsResponse, error) {
+	resp := s.findClaims(req)
+	resp.Code = errorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) FindClaimsBatch(ctx context.Context, req *users.ClaimsBatchRequest) (*users.ClaimsBatchResponse, error) {
+	resp := s.findClaimsBatch(req)
+	resp.Code = errorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	// The errors of the identifiers are returned in their results.
+	for _, result := range resp.Results {
+		result.Code = errorCode(result.Error)
+	}
+	return resp, nil
+}
+
+func (s server) SearchClaims(ctx context.Context, req *users.SearchRequest) (*users.SearchResponse, error) {
+	resp := s.searchClaims(req)
+	resp.Code = errorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) ValidatePassword(ctx context.Context, req *users.ValidatePasswordRequest) (*users.ValidatePasswordResponse, error) {
+	resp := s.validatePassword(req)
+	resp.Code = errorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) authenticate(req *users.AuthRequest) *users.AuthResponse {
+	return s.login(req, false)
+}
+
+// Checks the credentials of a user, with the one-time code of its second factor when it is enabled.
+// The one-time code is not checked again when otpChecked is set, once it has been checked earlier in the same flow.
+func (s server) login(req *users.AuthRequest, otpChecked bool) *users.AuthResponse {
 	resp := &users.AuthResponse{}
 
-	u, err := findUser(req.Username, users.IdentifierType_USER_NAME)
-	if err != nil {
+	u, err := s.repo.Find(req.Username, users.IdentifierType_USER_NAME)
+	if errors.Is(err, errUsersMissing) {
+		resp.Error = UsersMissing
+		return resp
+	} else if err != nil {
 		resp.Error = UserNotFound
+		return resp
+	}
+
+	now := time.Now()
+	// The password of a locked account is not checked, so the lock stops the password guessing.
+	if isLocked(u, now) {
+		resp.Error = AccountLocked
+		return resp
+	}
+	if u.LockedAt != nil {
+		// The lock has expired, the failed logins are counted again from zero.
+		resetFailedLogins(s.repo, u)
+	}
+
+	// The other states of the account are only disclosed to the users knowing its password.
+	if !checkPassword(u, req.Password) {
+		recordFailedLogin(s.repo, u)
+		resp.Error = InvalidPassword
+		return resp
+	}
+	// The failed logins are only reset once the second factor is checked, so the codes cannot be guessed indefinitely with the password.
+	if hasTOTP(u) && !otpChecked {
+		if req.Otp == "" {
+			resp.Error = SecondFactorRequired
+			return resp
+		}
+		if resp.Error, _ = checkSecondFactor(s.repo, u, req.Otp, true); resp.Error != 0 {
+			return resp
+		}
+	}
+	if u.FailedLogins > 0 {
+		resetFailedLogins(s.repo, u)
+	}
+	if u.Disabled {
+		resp.Error = AccountDisabled
+	} else if isExpired(u, now) {
+		resp.Error = AccountExpired
+	} else if u.Pending {
+		resp.Error = AccountPending
+	} else if u.PasswordChangeRequired {
+		resp.Error = PasswordChangeRequired
 	} else {
-		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(req.Password)))
-		if strings.EqualFold(hash, u.PasswordHash) {
-			resp.Succeeded = true
-			resp.Subject = u.ID
-		} else {
-			resp.Error = InvalidPassword
+		upgradePassword(s.repo, u, req.Password)
+		resp.Succeeded = true
+		resp.Subject = u.ID
+		if len(req.Claims) > 0 {
+			resp.Claims = make(map[string]string, len(req.Claims))
+			for _, k := range req.Claims {
+				resp.Claims[k] = u.Claims[k]
+			}
 		}
 	}
 
-	return resp, nil
+	return resp
 }
 
-func (s server) FindClaims(ctx context.Context, req *users.ClaimsRequest) (*users.ClaimsResponse, error) {
+// The passwords of the accounts store do not expire.
+func (s server) getAccountStatus(req *users.AccountStatusRequest) *users.AccountStatusResponse {
+	resp := &users.AccountStatusResponse{}
+
+	if err := identifiers.Validate(req.Identifier, req.IdentifierType); err != nil {
+		zap.L().Warn("Invalid identifier.", zap.Error(err))
+		resp.Error = InvalidIdentifier
+		return resp
+	}
+
+	u, err := s.repo.Find(req.Identifier, req.IdentifierType)
+	if err != nil {
+		resp.Error = findUserError(err)
+		return resp
+	}
+
+	now := time.Now()
+	resp.Succeeded = true
+	resp.Subject = u.ID
+	resp.Enabled = !u.Disabled
+	resp.Locked = isLocked(u, now)
+	if resp.Locked {
+		resp.LockedAt = timestamppb.New(*u.LockedAt)
+	}
+	resp.Expired = isExpired(u, now)
+	if u.ExpiresAt != nil {
+		resp.ExpiresAt = timestamppb.New(*u.ExpiresAt)
+	}
+	resp.PasswordChangeRequired = u.PasswordChangeRequired
+
+	return resp
+}
+
+// Checks a password against the password policy, and against the names and the previous passwords of the user when it is identified.
+func (s server) validatePassword(req *users.ValidatePasswordRequest) *users.ValidatePasswordResponse {
+	resp := &users.ValidatePasswordResponse{}
+
+	var u *user
+	if req.Identifier != "" {
+		if err := identifiers.Validate(req.Identifier, req.IdentifierType); err != nil {
+			zap.L().Warn("Invalid identifier.", zap.Error(err))
+			resp.Error = InvalidIdentifier
+			return resp
+		}
+		var err error
+		if u, err = s.repo.Find(req.Identifier, req.IdentifierType); err != nil {
+			resp.Error = findUserError(err)
+			return resp
+		}
+	}
+
+	if resp.Violations = checkNewPassword(u, req.Password); len(resp.Violations) > 0 {
+		resp.Error = PasswordRejected
+		return resp
+	}
+	resp.Succeeded = true
+
+	return resp
+}
+
+func (s server) findClaims(req *users.ClaimsRequest) *users.ClaimsResponse {
 	resp := &users.ClaimsResponse{
 		Claims: make(map[string]string, len(req.Claims)),
 	}
 
-	u, err := findUser(req.Identifier, req.IdentifierType)
+	if err := identifiers.Validate(req.Identifier, req.IdentifierType); err != nil {
+		zap.L().Warn("Invalid identifier.", zap.Error(err))
+		resp.Error = InvalidIdentifier
+		return resp
+	}
+
+	u, err := s.repo.Find(req.Identifier, req.IdentifierType)
 	if err != nil {
-		resp.Error = UserNotFound
+		resp.Error = findUserError(err)
 	} else {
 		for _, k := range req.Claims {
 			resp.Claims[k] = u.Claims[k]
@@ -76,70 +361,129 @@ func (s server) FindClaims(ctx context.Context, req *users.ClaimsRequest) (*user
 		resp.Succeeded = true
 	}
 
-	return resp, nil
+	return resp
 }
 
-func (s server) SearchClaims(ctx context.Context, req *users.SearchRequest) (*users.SearchResponse, error) {
-	resp := &users.SearchResponse{}
-
-	usrs, err := getUsers()
-	if err != nil {
-		resp.Error = UsersMissing
+func (s server) findClaimsBatch(req *users.ClaimsBatchRequest) *users.ClaimsBatchResponse {
+	resp := &users.ClaimsBatchResponse{
+		Results: make([]*users.ClaimsBatchResult, len(req.Identifiers)),
 	}
 
-	resp.Results = make([]*users.SearchResponseResult, 0)
-	search := strings.ToLower(req.Search)
-	for _, u := range usrs {
-		if strings.Contains(strings.ToLower(u.Username), search) || strings.Contains(strings.ToLower(u.Claims["name"]), search) {
-			item := &users.SearchResponseResult{
-				Properties: make(map[string]string, len(req.Claims)),
-			}
-			for _, k := range req.Claims {
-				item.Properties[k] = u.Claims[k]
-			}
-			resp.Results = append(resp.Results, item)
+	for i, id := range req.Identifiers {
+		result := &users.ClaimsBatchResult{
+			Identifier:     id.Identifier,
+			IdentifierType: id.IdentifierType,
+			Claims:         make(map[string]string, len(req.Claims)),
+		}
+		resp.Results[i] = result
+
+		if err := identifiers.Validate(id.Identifier, id.IdentifierType); err != nil {
+			zap.L().Warn("Invalid identifier.", zap.Error(err))
+			result.Error = InvalidIdentifier
+			continue
+		}
+		u, err := s.repo.Find(id.Identifier, id.IdentifierType)
+		if errors.Is(err, errUsersMissing) {
+			// The users cannot be read, the other identifiers would fail the same way.
+			zap.L().Error("Could not read the users.", zap.Error(err))
+			resp.Error = UsersMissing
+			return resp
+		}
+		if err != nil {
+			result.Error = findUserError(err)
+			continue
 		}
+		for _, k := range req.Claims {
+			result.Claims[k] = u.Claims[k]
+		}
+		result.Succeeded = true
 	}
 	resp.Succeeded = true
 
-	return resp, nil
+	return resp
 }
 
-func getUsers() ([]user, error) {
-	jsonData, err := ioutil.ReadFile("users.json")
-	if err != nil {
-		return []user{}, err
+func (s server) searchClaims(req *users.SearchRequest) *users.SearchResponse {
+	resp := &users.SearchResponse{}
+
+	if req.Filter != nil {
+		if err := scim.Validate(req.Filter); err != nil {
+			zap.L().Warn("Invalid search filter.", zap.Error(err))
+			resp.Error = InvalidFilter
+			return resp
+		}
 	}
 
-	var usrs []user
-	err = json.Unmarshal(jsonData, &usrs)
+	resp.Results = make([]*users.SearchResponseResult, 0)
+	err := s.searchUsers(req, func(item *users.SearchResponseResult) error {
+		resp.Results = append(resp.Results, item)
+		return nil
+	})
 	if err != nil {
-		return []user{}, err
+		zap.L().Error("Could not read the users.", zap.Error(err))
+		resp.Results = nil
+		resp.Error = UsersMissing
+		return resp
 	}
+	resp.Succeeded = true
 
-	return usrs, nil
+	return resp
 }
 
-func findUser(identifier string, identifierType users.IdentifierType) (*user, error) {
-	usrs, err := getUsers()
-	if err != nil {
-		return nil, err
+func (s server) StreamSearchClaims(req *users.SearchRequest, stream users.User_StreamSearchClaimsServer) error {
+	if req.Filter != nil {
+		if err := scim.Validate(req.Filter); err != nil {
+			zap.L().Warn("Invalid search filter.", zap.Error(err))
+			return grpcerr.New(errorCode(InvalidFilter), storeName, InvalidFilter, err.Error())
+		}
 	}
 
-	for _, u := range usrs {
-		switch identifierType {
-		case users.IdentifierType_SUBJECT:
-			if strings.EqualFold(identifier, u.ID) {
-				return &u, nil
-			}
-		case users.IdentifierType_USER_NAME:
-			if strings.EqualFold(identifier, u.Username) {
-				return &u, nil
-			}
+	// The results are sent as they match, Send blocks while the client does not consume them.
+	err := s.searchUsers(req, func(item *users.SearchResponseResult) error {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
 		}
+		return stream.Send(item)
+	})
+	if errors.Is(err, errUsersMissing) {
+		return grpcerr.New(errorCode(UsersMissing), storeName, UsersMissing, err.Error())
 	}
+	return err
+}
+
+// Calls the function with the claims of each user matching the search, until the function fails.
+// The users are read by pages, so they are not all loaded at once.
+func (s server) searchUsers(req *users.SearchRequest, fn func(item *users.SearchResponseResult) error) error {
+	search := strings.ToLower(req.Search)
+	return s.repo.ForEach("", func(u *user) error {
+		if req.Filter != nil && !scim.Match(req.Filter, u.Claims) {
+			return nil
+		}
+		if !strings.Contains(strings.ToLower(u.Username), search) && !strings.Contains(strings.ToLower(u.Claims["name"]), search) {
+			return nil
+		}
+		item := &users.SearchResponseResult{
+			Properties: make(map[string]string, len(req.Claims)),
+		}
+		for _, k := range req.Claims {
+			item.Properties[k] = u.Claims[k]
+		}
+		return fn(item)
+	})
+}
 
-	return nil, fmt.Errorf(userNotFoundError)
+// Maps the errors of the user lookups to an error code.
+func findUserError(err error) int32 {
+	switch {
+	case errors.Is(err, errAmbiguousIdentifier):
+		return AmbiguousIdentifier
+	case errors.Is(err, errUnsupportedType):
+		return InvalidIdentifier
+	case errors.Is(err, errUsersMissing):
+		return UsersMissing
+	default:
+		return UserNotFound
+	}
 }
 
 func init() {
@@ -149,6 +493,24 @@ func init() {
 func main() {
 	defer zap.L().Sync()
 
+	if err := passwordPolicy().Validate(); err != nil {
+		zap.L().Fatal("The password policy is invalid.", zap.Error(err))
+	}
+
+	// The commands run instead of the server, and exit with their own code.
+	if len(os.Args) > 1 {
+		code := runCommand(os.Args[1:], os.Stdout)
+		zap.L().Sync()
+		os.Exit(code)
+	}
+
+	zap.L().Info("Opening the users repository.")
+	repo, err := newRepository()
+	if err != nil {
+		zap.L().Fatal("Could not open the users repository.", zap.Error(err))
+	}
+	defer repo.Close()
+
 	lis := tools.CreateNetworkListner()
 	defer lis.Close()
 
@@ -166,11 +528,43 @@ func main() {
 		grpc.UnaryInterceptor(
 			grpc_middleware.ChainUnaryServer(
 				grpc_zap.UnaryServerInterceptor(zap.L()),
+				adminAuthInterceptor,
 			),
 		),
 	)
 	defer srv.Stop()
-	users.RegisterUserServer(srv, &server{})
+	users.RegisterUserServer(srv, &server{repo: repo})
+	users.RegisterAccountsAdminServer(srv, &adminServer{repo: repo})
+	var notifier Notifier
+	if registrationEnabled() || passwordResetEnabled() {
+		if notifier, err = newNotifier(); err != nil {
+			zap.L().Fatal("Could not create the notifier.", zap.Error(err))
+		}
+	}
+	if registrationEnabled() {
+		registration, err := newRegistrationServer(repo, notifier)
+		if err != nil {
+			zap.L().Fatal("Could not create the registration service.", zap.Error(err))
+		}
+		users.RegisterAccountsRegistrationServer(srv, registration)
+	}
+	var reset *resetServer
+	if passwordResetEnabled() {
+		reset = newResetServer(repo, notifier)
+		users.RegisterAccountsPasswordResetServer(srv, reset)
+	}
+	if totpEnabled() {
+		users.RegisterAccountsTOTPServer(srv, &totpServer{repo: repo})
+	}
+
+	// The server stops on SIGINT and SIGTERM, once the current requests have been served.
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		zap.L().Info("Stopping the gRPC server.")
+		srv.GracefulStop()
+	}()
 
 	zap.L().Info("Starting the gRPC server.")
 	if err := srv.Serve(lis); err != nil {
@@ -179,4 +573,7 @@ func main() {
 			zap.Error(err),
 		)
 	}
+	if reset != nil && !reset.drain(shutdownTimeout) {
+		zap.L().Warn("The store has stopped before all the password reset tokens were sent.")
+	}
 }
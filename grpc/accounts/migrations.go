@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+
+	"go.uber.org/zap"
+)
+
+// Schema migrations of the SQL repositories, applied in order at startup.
+// The version of a migration is its position in the list, starting at 1: a released migration must never be changed, the schema changes are added as new migrations.
+var migrations = [][]string{
+	{
+		`CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			username_key TEXT NOT NULL,
+			password_hash TEXT NOT NULL,
+			password_change_required BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE UNIQUE INDEX users_username_key ON users (username_key)`,
+		// The subjects are compared without case, the primary key index cannot be used for it.
+		`CREATE INDEX users_id_key ON users (lower(id))`,
+		`CREATE TABLE user_claims (
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			value_key TEXT NOT NULL,
+			PRIMARY KEY (user_id, name)
+		)`,
+		`CREATE INDEX user_claims_value_key ON user_claims (name, value_key)`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+		`ALTER TABLE users ADD COLUMN created_at TIMESTAMP NULL`,
+		`ALTER TABLE users ADD COLUMN updated_at TIMESTAMP NULL`,
+	},
+	{
+		`CREATE TABLE password_history (
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			password_hash TEXT NOT NULL,
+			PRIMARY KEY (user_id, position)
+		)`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN locked_at TIMESTAMP NULL`,
+		`ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN expires_at TIMESTAMP NULL`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN pending BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE user_tokens (
+			token_hash TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			purpose TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX user_tokens_user_id ON user_tokens (user_id, purpose)`,
+	},
+	{
+		`CREATE TABLE user_totp (
+			user_id TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			secret TEXT NOT NULL,
+			confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+			last_step BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE user_recovery_codes (
+			user_id TEXT NOT NULL REFERENCES user_totp (user_id) ON DELETE CASCADE,
+			code_hash TEXT NOT NULL,
+			PRIMARY KEY (user_id, code_hash)
+		)`,
+	},
+}
+
+// Applies the migrations not applied yet, in a single transaction.
+func migrate(db *sql.DB, d *dialect) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The lock prevents several instances starting at the same time from applying the same migrations.
+	if d.lockMigrations != "" {
+		if _, err := tx.Exec(d.lockMigrations); err != nil {
+			return err
+		}
+	}
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		zap.L().Sugar().Infof("Applying the migration %d of the users schema.", version+1)
+		for _, stmt := range migrations[version] {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(d.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version+1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyNotifierType         = "notifier.type"
+	viperKeyNotifierSMTPHost     = "notifier.smtp.host"
+	viperKeyNotifierSMTPPort     = "notifier.smtp.port"
+	viperKeyNotifierSMTPUsername = "notifier.smtp.username"
+	viperKeyNotifierSMTPPassword = "notifier.smtp.password"
+	viperKeyNotifierSMTPFrom     = "notifier.smtp.from"
+
+	notifierTypeLog     = "log"
+	notifierTypeSMTP    = "smtp"
+	notifierTypeDefault = notifierTypeLog
+
+	notifierSMTPPortDefault = 587
+)
+
+// Notifier delivers the messages of the accounts store to the users, such as their verification tokens.
+type Notifier interface {
+	// Notify sends a plain text message to an email address.
+	Notify(to string, subject string, body string) error
+}
+
+// Creates the notifier of the configured type.
+func newNotifier() (Notifier, error) {
+	notifierType := notifierTypeDefault
+	if viper.IsSet(viperKeyNotifierType) {
+		notifierType = strings.ToLower(viper.GetString(viperKeyNotifierType))
+	}
+
+	switch notifierType {
+	case notifierTypeLog:
+		zap.L().Warn("The messages to the users are only logged, they are not sent.")
+		return logNotifier{}, nil
+	case notifierTypeSMTP:
+		port := notifierSMTPPortDefault
+		if viper.IsSet(viperKeyNotifierSMTPPort) {
+			port = viper.GetInt(viperKeyNotifierSMTPPort)
+		}
+		host := viper.GetString(viperKeyNotifierSMTPHost)
+		from := viper.GetString(viperKeyNotifierSMTPFrom)
+		if host == "" || from == "" {
+			return nil, errors.New("the SMTP host and sender of the notifier must be set")
+		}
+		return newSMTPNotifier(host, port, viper.GetString(viperKeyNotifierSMTPUsername), viper.GetString(viperKeyNotifierSMTPPassword), from), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type '%s'", notifierType)
+	}
+}
+
+// logNotifier writes the messages to the log instead of sending them, for the development.
+type logNotifier struct{}
+
+func (logNotifier) Notify(to string, subject string, body string) error {
+	zap.L().Info("Message to a user.", zap.String("to", to), zap.String("subject", subject), zap.String("body", body))
+	return nil
+}
+
+// smtpNotifier sends the messages by email through an SMTP server, with STARTTLS when the server supports it.
+type smtpNotifier struct {
+	addr string
+	// Not set when the server does not require authentication.
+	auth smtp.Auth
+	from string
+}
+
+func newSMTPNotifier(host string, port int, username string, password string, from string) smtpNotifier {
+	n := smtpNotifier{addr: net.JoinHostPort(host, strconv.Itoa(port)), from: from}
+	if username != "" {
+		// The credentials are only sent over TLS, or to localhost.
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n
+}
+
+func (n smtpNotifier) Notify(to string, subject string, body string) error {
+	// The header values must not add other headers.
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("the recipient must be a single line")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	return smtp.SendMail(n.addr, n.auth, n.from, []string{to}, msg.Bytes())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// Receives a single message, with the minimal SMTP exchange of net/smtp, without STARTTLS nor authentication.
+type testSMTPServer struct {
+	lis      net.Listener
+	from, to string
+	data     string
+	err      error
+	done     chan struct{}
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	s := &testSMTPServer{lis: lis, done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func (s *testSMTPServer) serve() {
+	defer close(s.done)
+	conn, err := s.lis.Accept()
+	if err != nil {
+		s.err = err
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			s.err = err
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			s.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.to = strings.Trim(line[len("RCPT TO:"):], "<>")
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					s.err = err
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.data = data.String()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	srv := newTestSMTPServer(t)
+	defer srv.lis.Close()
+
+	addr := srv.lis.Addr().(*net.TCPAddr)
+	n := newSMTPNotifier("127.0.0.1", addr.Port, "", "", "comptes@csb.nc")
+	body := "Bonjour dave.petit,\n\nVotre lien : https://portal.csb.nc/verify?token=abc.def\n"
+	if err := n.Notify("dave.petit@csb.nc", "Vérifiez votre adresse e-mail", body); err != nil {
+		t.Fatalf("Could not send the message: %v", err)
+	}
+	<-srv.done
+	if srv.err != nil {
+		t.Fatalf("The SMTP server has failed: %v", srv.err)
+	}
+
+	if srv.from != "comptes@csb.nc" || srv.to != "dave.petit@csb.nc" {
+		t.Errorf("The message is sent from %s to %s.", srv.from, srv.to)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(srv.data))
+	if err != nil {
+		t.Fatalf("Could not read the message: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Vérifiez votre adresse e-mail" {
+		t.Errorf("The subject is %s, %v", subject, err)
+	}
+	received, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil || strings.ReplaceAll(string(received), "\r\n", "\n") != body {
+		t.Errorf("The body is %q, %v", received, err)
+	}
+
+	if err := n.Notify("dave.petit@csb.nc\r\nBcc: eve@csb.nc", "Subject", body); err == nil {
+		t.Errorf("A recipient with several lines should be rejected.")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+
+	"csb.nc/auth/stores/tools/passwords"
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyPasswordsAlgorithm        = "passwords.algorithm"
+	viperKeyPasswordsArgon2Memory     = "passwords.argon2.memory"
+	viperKeyPasswordsArgon2Time       = "passwords.argon2.time"
+	viperKeyPasswordsArgon2Threads    = "passwords.argon2.threads"
+	viperKeyPasswordsBcryptCost       = "passwords.bcrypt.cost"
+	viperKeyPasswordsPBKDF2Iterations = "passwords.pbkdf2.iterations"
+
+	viperKeyPasswordsPolicy           = "passwords.policy"
+	viperKeyPasswordsPolicyNameClaims = "passwords.policy.nameClaims"
+	viperKeyPasswordsPolicyHistory    = "passwords.policy.history"
+
+	passwordsPolicyHistoryDefault = 5
+)
+
+// Claims holding the names of the users, which must not be found in their passwords.
+var passwordsPolicyNameClaimsDefault = []string{"name", "given_name", "family_name"}
+
+// Reads the hashing parameters of the new passwords, the parameters not configured keeping their default value.
+func hashParams() passwords.Params {
+	p := passwords.DefaultParams
+	if viper.IsSet(viperKeyPasswordsAlgorithm) {
+		p.Algorithm = viper.GetString(viperKeyPasswordsAlgorithm)
+	}
+	if viper.IsSet(viperKeyPasswordsArgon2Memory) {
+		p.Argon2Memory = viper.GetUint32(viperKeyPasswordsArgon2Memory)
+	}
+	if viper.IsSet(viperKeyPasswordsArgon2Time) {
+		p.Argon2Time = viper.GetUint32(viperKeyPasswordsArgon2Time)
+	}
+	if viper.IsSet(viperKeyPasswordsArgon2Threads) {
+		p.Argon2Threads = uint8(viper.GetUint(viperKeyPasswordsArgon2Threads))
+	}
+	if viper.IsSet(viperKeyPasswordsBcryptCost) {
+		p.BcryptCost = viper.GetInt(viperKeyPasswordsBcryptCost)
+	}
+	if viper.IsSet(viperKeyPasswordsPBKDF2Iterations) {
+		p.PBKDF2Iterations = viper.GetInt(viperKeyPasswordsPBKDF2Iterations)
+	}
+	return p
+}
+
+// Checks the password against the password hash of the user.
+func checkPassword(u *user, password string) bool {
+	ok, err := passwords.Verify(password, u.PasswordHash)
+	if err != nil {
+		zap.L().Error("Could not verify the password hash.", zap.Error(err), zap.String("id", u.ID))
+	}
+	return ok
+}
+
+func hashPassword(password string) (string, error) {
+	return passwords.Hash(password, hashParams())
+}
+
+// Rehashes the password of a user authenticated with a legacy hash, or a hash of other parameters than the configured ones.
+// The login does not fail when the new hash cannot be saved, the hash is upgraded at the next one.
+func upgradePassword(repo UserRepository, u *user, password string) {
+	params := hashParams()
+	if !passwords.NeedsRehash(u.PasswordHash, params) {
+		return
+	}
+	zap.L().Sugar().Infof("Upgrading the password hash of the user: %s", u.Username)
+
+	hash, err := passwords.Hash(password, params)
+	if err != nil {
+		zap.L().Error("Could not hash the password.", zap.Error(err), zap.String("id", u.ID))
+		return
+	}
+
+	// The hash is not replaced if the password has been changed since the authentication.
+	// The version of the user is kept, as the logins must not conflict with its administration.
+	err = repo.RehashPassword(u.ID, u.PasswordHash, hash)
+	if err != nil && !errors.Is(err, errPasswordChanged) {
+		zap.L().Error("Could not save the upgraded password hash.", zap.Error(err), zap.String("id", u.ID))
+	}
+}
+
+// Reads the password policy, the rules not configured keeping their default value.
+func passwordPolicy() passwords.Policy {
+	return passwords.LoadPolicy(viperKeyPasswordsPolicy)
+}
+
+// Returns the number of previous passwords kept in the password history of the users.
+func passwordHistorySize() int {
+	if viper.IsSet(viperKeyPasswordsPolicyHistory) {
+		return viper.GetInt(viperKeyPasswordsPolicyHistory)
+	}
+	return passwordsPolicyHistoryDefault
+}
+
+// Checks a new password against the password policy. When the user is known, the password must not contain its names,
+// and must differ from its current password and the previous ones.
+func checkNewPassword(u *user, password string) []*users.PasswordViolation {
+	if u == nil {
+		return passwordPolicy().Check(password, passwords.Owner{})
+	}
+
+	nameClaims := passwordsPolicyNameClaimsDefault
+	if viper.IsSet(viperKeyPasswordsPolicyNameClaims) {
+		nameClaims = viper.GetStringSlice(viperKeyPasswordsPolicyNameClaims)
+	}
+	owner := passwords.Owner{Username: u.Username}
+	for _, claim := range nameClaims {
+		if name := u.Claims[claim]; name != "" {
+			owner.Names = append(owner.Names, name)
+		}
+	}
+
+	// The current password is always checked, with the previous ones kept in the history. A user being created has no password yet.
+	var hashes []string
+	if u.PasswordHash != "" {
+		hashes = append([]string{u.PasswordHash}, u.PasswordHistory...)
+	}
+	if size := passwordHistorySize(); len(hashes) > size+1 {
+		hashes = hashes[:size+1]
+	}
+	violations := passwordPolicy().Check(password, owner)
+	if v := passwords.CheckHistory(password, hashes); v != nil {
+		violations = append(violations, v)
+	}
+	return violations
+}
+
+// Returns the password history of the user once its current password is replaced: the current password hash followed by the previous ones,
+// up to the history size.
+func passwordHistory(u *user) []string {
+	size := passwordHistorySize()
+	if size <= 0 {
+		return nil
+	}
+	history := append([]string{u.PasswordHash}, u.PasswordHistory...)
+	if len(history) > size {
+		history = history[:size]
+	}
+	return history
+}
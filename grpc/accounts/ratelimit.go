@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows a number of events per key in a sliding window.
+// The events are counted in memory, by each instance of the store.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mutex  sync.Mutex
+	events map[string][]time.Time
+	// The keys without event in the window are removed once per window.
+	swept time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, events: make(map[string][]time.Time)}
+}
+
+// Records an event of the key at now, unless the limit of the key is reached. The events are not limited when the limit is 0.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.swept) >= l.window {
+		for k, events := range l.events {
+			if !now.Before(events[len(events)-1].Add(l.window)) {
+				delete(l.events, k)
+			}
+		}
+		l.swept = now
+	}
+
+	events := l.events[key]
+	for len(events) > 0 && !now.Before(events[0].Add(l.window)) {
+		events = events[1:]
+	}
+	if len(events) >= l.limit {
+		l.events[key] = events
+		return false
+	}
+	l.events[key] = append(events, now)
+	return true
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the files imported and exported by the commands.
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+	formatLDIF = "ldif"
+)
+
+// Columns of the CSV files, the other columns are claims.
+const (
+	csvColumnID                     = "id"
+	csvColumnUsername               = "username"
+	csvColumnPasswordHash           = "password_hash"
+	csvColumnPassword               = "password"
+	csvColumnPasswordChangeRequired = "password_change_required"
+	csvColumnDisabled               = "disabled"
+	csvColumnPending                = "pending"
+	csvColumnExpiresAt              = "expires_at"
+)
+
+// The columns written to the CSV files, before the claims. The plaintext passwords are only imported.
+var csvColumns = []string{
+	csvColumnID,
+	csvColumnUsername,
+	csvColumnPasswordHash,
+	csvColumnPasswordChangeRequired,
+	csvColumnDisabled,
+	csvColumnPending,
+	csvColumnExpiresAt,
+}
+
+// accountRecord is an account as imported and exported by the commands.
+// The state managed by the store, such as the lock, the tokens and the second factor, is neither imported nor exported.
+// The JSON records have the fields of the users file, which can be imported as it is.
+type accountRecord struct {
+	ID           string `json:"id,omitempty"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	// The plaintext password, only imported when the passwords are hashed by the import.
+	Password               string            `json:"password,omitempty"`
+	PasswordChangeRequired bool              `json:"password_change_required,omitempty"`
+	Disabled               bool              `json:"disabled,omitempty"`
+	Pending                bool              `json:"pending,omitempty"`
+	ExpiresAt              *time.Time        `json:"expires_at,omitempty"`
+	Claims                 map[string]string `json:"claims,omitempty"`
+	// The position of the record in its file, to report its errors.
+	position string
+}
+
+// Returns the record exported for a user.
+func recordOf(u *user) accountRecord {
+	return accountRecord{
+		ID:                     u.ID,
+		Username:               u.Username,
+		PasswordHash:           u.PasswordHash,
+		PasswordChangeRequired: u.PasswordChangeRequired,
+		Disabled:               u.Disabled,
+		Pending:                u.Pending,
+		ExpiresAt:              u.ExpiresAt,
+		Claims:                 u.Claims,
+	}
+}
+
+// Returns the format of a file: the format requested, or the one of the file extension.
+func fileFormat(path string, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	switch format = strings.ToLower(format); format {
+	case formatJSON, formatCSV, formatLDIF:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format '%s', the format must be json, csv or ldif", format)
+	}
+}
+
+// Reads the records of a file in the format.
+func readRecords(r io.Reader, format string) ([]accountRecord, error) {
+	switch format {
+	case formatJSON:
+		return readJSONRecords(r)
+	case formatCSV:
+		return readCSVRecords(r)
+	default:
+		return readLDIFRecords(r)
+	}
+}
+
+// Writes the records to a file in the format. The LDIF entries are named under the base DN.
+func writeRecords(w io.Writer, format string, records []accountRecord, baseDN string) error {
+	switch format {
+	case formatJSON:
+		return writeJSONRecords(w, records)
+	case formatCSV:
+		return writeCSVRecords(w, records)
+	default:
+		return writeLDIFRecords(w, records, baseDN)
+	}
+}
+
+func readJSONRecords(r io.Reader) ([]accountRecord, error) {
+	var records []accountRecord
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, err
+	}
+	for i := range records {
+		records[i].position = fmt.Sprintf("record %d", i+1)
+	}
+	return records, nil
+}
+
+func writeJSONRecords(w io.Writer, records []accountRecord) error {
+	jsonData, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(jsonData, '\n'))
+	return err
+}
+
+func readCSVRecords(r io.Reader) ([]accountRecord, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the header: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var records []accountRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rec := accountRecord{Claims: make(map[string]string), position: fmt.Sprintf("record %d", len(records)+1)}
+		for i, value := range row {
+			if err := rec.setCSVColumn(header[i], value); err != nil {
+				return nil, fmt.Errorf("%s: %w", rec.position, err)
+			}
+		}
+		records = append(records, rec)
+	}
+}
+
+// Sets the field or the claim of a CSV column. The empty claims are not set.
+func (rec *accountRecord) setCSVColumn(column string, value string) error {
+	var err error
+	switch column {
+	case csvColumnID:
+		rec.ID = value
+	case csvColumnUsername:
+		rec.Username = value
+	case csvColumnPasswordHash:
+		rec.PasswordHash = value
+	case csvColumnPassword:
+		rec.Password = value
+	case csvColumnPasswordChangeRequired:
+		rec.PasswordChangeRequired, err = parseCSVBool(column, value)
+	case csvColumnDisabled:
+		rec.Disabled, err = parseCSVBool(column, value)
+	case csvColumnPending:
+		rec.Pending, err = parseCSVBool(column, value)
+	case csvColumnExpiresAt:
+		if value != "" {
+			var t time.Time
+			if t, err = time.Parse(time.RFC3339, value); err != nil {
+				return fmt.Errorf("the column %s is not a RFC 3339 date: %s", column, value)
+			}
+			rec.ExpiresAt = &t
+		}
+	default:
+		if value != "" {
+			rec.Claims[column] = value
+		}
+	}
+	return err
+}
+
+func parseCSVBool(column string, value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("the column %s is not a boolean: %s", column, value)
+	}
+	return b, nil
+}
+
+func writeCSVRecords(w io.Writer, records []accountRecord) error {
+	// The claims of all the records are written, in the order of their names.
+	names := claimNames(records)
+	for _, name := range names {
+		if name == csvColumnPassword {
+			return fmt.Errorf("the claim %s cannot be written, it has the name of a column", name)
+		}
+		for _, column := range csvColumns {
+			if name == column {
+				return fmt.Errorf("the claim %s cannot be written, it has the name of a column", name)
+			}
+		}
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(append(append([]string(nil), csvColumns...), names...)); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		expiresAt := ""
+		if rec.ExpiresAt != nil {
+			expiresAt = rec.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		row := []string{
+			rec.ID,
+			rec.Username,
+			rec.PasswordHash,
+			strconv.FormatBool(rec.PasswordChangeRequired),
+			strconv.FormatBool(rec.Disabled),
+			strconv.FormatBool(rec.Pending),
+			expiresAt,
+		}
+		for _, name := range names {
+			row = append(row, rec.Claims[name])
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Returns the names of the claims of the records, sorted.
+func claimNames(records []accountRecord) []string {
+	set := make(map[string]bool)
+	for _, rec := range records {
+		for name := range rec.Claims {
+			set[name] = true
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordsRoundTrip(t *testing.T) {
+	expiresAt := time.Date(2027, 3, 31, 12, 0, 0, 0, time.UTC)
+	records := []accountRecord{
+		{
+			ID:           aliceID,
+			Username:     "alice.martin",
+			PasswordHash: "d90a83ee66e0bc4ce6f5150cafa84edf0b4117644edb70e54fbd468e2fc183e5",
+			Claims:       map[string]string{"name": "Alice Martin", "email": "alice.martin@csb.nc", "phone_number": "+687 250000"},
+		},
+		{
+			ID:                     carolID,
+			Username:               "carol.leroy",
+			PasswordHash:           "$pbkdf2-sha256$i=1000$YWNjb3VudHNzYWx0$PyCHvdyXA6YryWwdUCQSyoqnoInlhSFr1mWEorsqvek",
+			PasswordChangeRequired: true,
+			Disabled:               true,
+			Pending:                true,
+			ExpiresAt:              &expiresAt,
+			// The values which are not safe strings are base64 encoded in LDIF.
+			Claims: map[string]string{"name": "Carole Lëroy", "description": " starts with a space, and is long enough to be folded in LDIF"},
+		},
+	}
+	for _, format := range []string{formatJSON, formatCSV, formatLDIF} {
+		var b bytes.Buffer
+		if err := writeRecords(&b, format, records, ""); err != nil {
+			t.Fatalf("%s: could not write the records: %v", format, err)
+		}
+		read, err := readRecords(&b, format)
+		if err != nil {
+			t.Fatalf("%s: could not read the records: %v", format, err)
+		}
+		if len(read) != len(records) {
+			t.Fatalf("%s: %d records have been read instead of %d.", format, len(read), len(records))
+		}
+		for i := range read {
+			read[i].position = ""
+			if !reflect.DeepEqual(read[i], records[i]) {
+				t.Errorf("%s: the record %d is %+v instead of %+v.", format, i, read[i], records[i])
+			}
+		}
+	}
+}
+
+func TestReadLDIFRecords(t *testing.T) {
+	ldif := `version: 1
+# The entries may have comments,
+  which can be folded.
+
+dn: uid=dave.noel,ou=people,dc=example,dc=nc
+objectClass: top
+objectClass: inetOrgPerson
+uid: dave.noel
+userPassword: Clear-Password-1
+cn:: RGF2ZSBOb8OrbA==
+mail: dave.noel@exa
+ mple.nc
+`
+	records, err := readLDIFRecords(strings.NewReader(ldif))
+	if err != nil {
+		t.Fatalf("Could not read the records: %v", err)
+	}
+	want := accountRecord{
+		Username: "dave.noel",
+		Password: "Clear-Password-1",
+		Claims:   map[string]string{"cn": "Dave Noël", "mail": "dave.noel@example.nc"},
+		position: "record 1 (line 5)",
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0], want) {
+		t.Errorf("The records are %+v instead of %+v.", records, want)
+	}
+
+	invalid := []string{
+		"uid: dave.noel\n",
+		"dn: uid=dave.noel\nchangetype: delete\n",
+		"dn: uid=dave.noel\nuserPassword: {MD5}X03MO1qnZdYdgyfeuILPmQ==\n",
+		"dn: uid=dave.noel\nmail: dave@csb.nc\nmail: noel@csb.nc\n",
+		"dn: uid=dave.noel\npwdReset: yes\n",
+		"dn: uid=dave.noel\njpegPhoto:< file:///photo.jpg\n",
+	}
+	for _, ldif := range invalid {
+		if _, err := readLDIFRecords(strings.NewReader(ldif)); err == nil {
+			t.Errorf("The LDIF should be rejected: %q", ldif)
+		}
+	}
+}
+
+func TestReadCSVRecords(t *testing.T) {
+	csv := "username,password,disabled,email,phone_number\ndave.noel,Clear-Password-1,true,dave.noel@csb.nc,\n"
+	records, err := readCSVRecords(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("Could not read the records: %v", err)
+	}
+	want := accountRecord{
+		Username: "dave.noel",
+		Password: "Clear-Password-1",
+		Disabled: true,
+		// The empty claims are not set.
+		Claims:   map[string]string{"email": "dave.noel@csb.nc"},
+		position: "record 1",
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0], want) {
+		t.Errorf("The records are %+v instead of %+v.", records, want)
+	}
+
+	if _, err := readCSVRecords(strings.NewReader("username,disabled\ndave.noel,maybe\n")); err == nil {
+		t.Errorf("An invalid boolean should be rejected.")
+	}
+	if err := writeCSVRecords(&bytes.Buffer{}, []accountRecord{{Username: "dave.noel", Claims: map[string]string{"disabled": "yes"}}}); err == nil {
+		t.Errorf("A claim with the name of a column should not be written.")
+	}
+}
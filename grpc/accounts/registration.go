@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/tools/identifiers"
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyRegistrationEnabled         = "registration.enabled"
+	viperKeyRegistrationClaims          = "registration.claims"
+	viperKeyRegistrationTokenKey        = "registration.tokenKey"
+	viperKeyRegistrationTokenLifetime   = "registration.tokenLifetime"
+	viperKeyRegistrationVerificationURL = "registration.verificationUrl"
+	viperKeyRegistrationMessageSubject  = "registration.message.subject"
+	viperKeyRegistrationMessageBody     = "registration.message.body"
+
+	registrationTokenLifetimeDefault  = 24 * time.Hour
+	registrationMessageSubjectDefault = "Vérifiez votre adresse e-mail"
+	registrationMessageBodyDefault    = `Bonjour {{.Username}},
+
+Pour activer votre compte, confirmez votre adresse e-mail :
+
+{{if .URL}}{{.URL}}{{else}}{{.Token}}{{end}}
+
+Ce lien est valable jusqu'au {{.ExpiresAt.Format "02/01/2006 à 15:04"}}.
+`
+
+	// Placeholder of the token in the URLs sent to the users.
+	tokenURLPlaceholder = "{token}"
+	// Claim telling if the email address of the user has been verified, "true" or "false".
+	emailVerifiedClaim = "email_verified"
+	emailClaimDefault  = "email"
+	// The verification is retried when the user is changed meanwhile, as its token has already been consumed.
+	verifyEmailAttempts = 3
+	tokenKeyLength      = 32
+)
+
+// Claims the users can set when they register.
+var registrationClaimsDefault = []string{"name", "given_name", "family_name"}
+
+// registrationServer implements the AccountsRegistration service on the users repository.
+type registrationServer struct {
+	users.UnimplementedAccountsRegistrationServer
+	repo     UserRepository
+	notifier Notifier
+	// Signs the verification tokens.
+	key []byte
+}
+
+func registrationEnabled() bool {
+	return viper.GetBool(viperKeyRegistrationEnabled)
+}
+
+// Creates the registration service, with the configured token key.
+// Without a key, a random key is generated, and the tokens issued before a restart can no longer be verified.
+func newRegistrationServer(repo UserRepository, notifier Notifier) (*registrationServer, error) {
+	key := []byte(viper.GetString(viperKeyRegistrationTokenKey))
+	if len(key) == 0 {
+		zap.L().Warn("The registration token key is not set, a random key is used until the store is restarted.")
+		key = make([]byte, tokenKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &registrationServer{repo: repo, notifier: notifier, key: key}, nil
+}
+
+func registrationTokenLifetime() time.Duration {
+	if viper.IsSet(viperKeyRegistrationTokenLifetime) {
+		return viper.GetDuration(viperKeyRegistrationTokenLifetime)
+	}
+	return registrationTokenLifetimeDefault
+}
+
+// Returns the claims the users can set when they register, the other claims being rejected.
+func registrationClaims() []string {
+	if viper.IsSet(viperKeyRegistrationClaims) {
+		return viper.GetStringSlice(viperKeyRegistrationClaims)
+	}
+	return registrationClaimsDefault
+}
+
+// Returns the claim holding the email address of the users, matched by the EMAIL identifier type.
+func emailClaim() string {
+	if claim, err := identifierClaim(users.IdentifierType_EMAIL); err == nil {
+		return claim
+	}
+	return emailClaimDefault
+}
+
+// Fields of the templates of the messages sending a token.
+type tokenMessage struct {
+	Username  string
+	Token     string
+	URL       string
+	ExpiresAt time.Time
+}
+
+// Renders a message template of the configuration, or its default value.
+func renderMessage(key string, defaultTemplate string, data interface{}) (string, error) {
+	text := defaultTemplate
+	if viper.IsSet(key) {
+		text = viper.GetString(key)
+	}
+	tmpl, err := template.New(key).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (s registrationServer) Register(ctx context.Context, req *users.RegisterRequest) (*users.RegistrationResponse, error) {
+	return s.respond(ctx, s.register(req))
+}
+
+func (s registrationServer) SendVerification(ctx context.Context, req *users.SendVerificationRequest) (*users.RegistrationResponse, error) {
+	return s.respond(ctx, s.sendVerification(req))
+}
+
+func (s registrationServer) VerifyEmail(ctx context.Context, req *users.VerifyEmailRequest) (*users.RegistrationResponse, error) {
+	return s.respond(ctx, s.verifyEmail(req))
+}
+
+func (s registrationServer) respond(ctx context.Context, resp *users.RegistrationResponse) (*users.RegistrationResponse, error) {
+	resp.Code = errorCode(resp.Error)
+	resp.Succeeded = resp.Error == 0
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Creates a pending user, and sends a verification token to its email address.
+// The registration succeeds even if the token cannot be sent, the user can ask for a new one.
+func (s registrationServer) register(req *users.RegisterRequest) *users.RegistrationResponse {
+	resp := &users.RegistrationResponse{}
+
+	email := strings.TrimSpace(req.Email)
+	u := &user{
+		Username: strings.TrimSpace(req.Username),
+		Pending:  true,
+		Claims:   make(map[string]string, len(req.Claims)+2),
+	}
+	if u.Username == "" || req.Password == "" || identifiers.Validate(email, users.IdentifierType_EMAIL) != nil {
+		resp.Error = InvalidRequest
+		return resp
+	}
+	registrable := make(map[string]bool)
+	for _, claim := range registrationClaims() {
+		registrable[claim] = true
+	}
+	for k, v := range req.Claims {
+		if !registrable[k] {
+			zap.L().Sugar().Warnf("The claim %s cannot be registered.", k)
+			resp.Error = InvalidRequest
+			return resp
+		}
+		u.Claims[k] = v
+	}
+	// The email address and its verification state are only set by the store.
+	u.Claims[emailClaim()] = email
+	u.Claims[emailVerifiedClaim] = "false"
+
+	// The claims matched by the identifier types, such as the email address, identify the users, they must not be shared.
+	ids := make(map[users.IdentifierType]string)
+	for identifierType := range identifierKeys {
+		claim, err := identifierClaim(identifierType)
+		if err != nil || u.Claims[claim] == "" {
+			continue
+		}
+		if identifiers.Validate(u.Claims[claim], identifierType) != nil {
+			resp.Error = InvalidRequest
+			return resp
+		}
+		ids[identifierType] = u.Claims[claim]
+	}
+
+	if resp.Violations = checkNewPassword(u, req.Password); len(resp.Violations) > 0 {
+		resp.Error = PasswordRejected
+		return resp
+	}
+
+	for identifierType, identifier := range ids {
+		switch _, err := s.repo.Find(identifier, identifierType); {
+		case err == nil, errors.Is(err, errAmbiguousIdentifier):
+			resp.Error = UserExists
+			return resp
+		case !errors.Is(err, errUserNotFound):
+			resp.Error = findUserError(err)
+			return resp
+		}
+	}
+
+	var err error
+	if u.ID, err = newSubject(); err != nil {
+		zap.L().Error("Could not generate the subject.", zap.Error(err))
+		resp.Error = UsersNotSaved
+		return resp
+	}
+	if u.PasswordHash, err = hashPassword(req.Password); err != nil {
+		zap.L().Error("Could not hash the password.", zap.Error(err))
+		resp.Error = UsersNotSaved
+		return resp
+	}
+	if err := s.repo.Create(u); err != nil {
+		resp.Error = changeError(err)
+		return resp
+	}
+	zap.L().Sugar().Infof("The user %s has been registered.", u.Username)
+	resp.Subject = u.ID
+
+	if err := s.issueVerification(u, email); err != nil {
+		zap.L().Error("Could not send the verification token.", zap.Error(err), zap.String("id", u.ID))
+	}
+	return resp
+}
+
+// Issues a verification token to a user and sends it to its email address, replacing its previous token.
+// The token is bound to the address, so it no longer verifies the user once its address is changed.
+func (s registrationServer) issueVerification(u *user, email string) error {
+	token, stored, err := signToken(s.key, tokenPurposeVerifyEmail, u.ID, hashAddress(email), time.Now().Add(registrationTokenLifetime()))
+	if err != nil {
+		return err
+	}
+	if err := s.repo.AddToken(stored); err != nil {
+		return err
+	}
+
+	msg := tokenMessage{
+		Username:  u.Username,
+		Token:     token,
+		URL:       strings.ReplaceAll(viper.GetString(viperKeyRegistrationVerificationURL), tokenURLPlaceholder, url.QueryEscape(token)),
+		ExpiresAt: stored.ExpiresAt,
+	}
+	subject, err := renderMessage(viperKeyRegistrationMessageSubject, registrationMessageSubjectDefault, msg)
+	if err != nil {
+		return err
+	}
+	body, err := renderMessage(viperKeyRegistrationMessageBody, registrationMessageBodyDefault, msg)
+	if err != nil {
+		return err
+	}
+	return s.notifier.Notify(email, subject, body)
+}
+
+// Sends a new verification token to the user of the email address, if its address has not been verified yet.
+func (s registrationServer) sendVerification(req *users.SendVerificationRequest) *users.RegistrationResponse {
+	resp := &users.RegistrationResponse{}
+
+	email := strings.TrimSpace(req.Email)
+	if identifiers.Validate(email, users.IdentifierType_EMAIL) != nil {
+		resp.Error = InvalidRequest
+		return resp
+	}
+
+	u, err := s.repo.Find(email, users.IdentifierType_EMAIL)
+	if errors.Is(err, errUsersMissing) {
+		resp.Error = UsersMissing
+		return resp
+	}
+	// The response is the same whether the address is used or not.
+	if err != nil || u.Claims[emailVerifiedClaim] == "true" {
+		zap.L().Sugar().Infof("No verification token is sent to %s.", email)
+		return resp
+	}
+	// The token is sent to the stored address, which may differ from the requested one by its case.
+	// A failure is only logged, as it would tell that the address is used.
+	if err := s.issueVerification(u, u.Claims[emailClaim()]); err != nil {
+		zap.L().Error("Could not send the verification token.", zap.Error(err), zap.String("id", u.ID))
+	}
+	return resp
+}
+
+// Consumes a verification token, and activates its user.
+func (s registrationServer) verifyEmail(req *users.VerifyEmailRequest) *users.RegistrationResponse {
+	resp := &users.RegistrationResponse{}
+
+	now := time.Now()
+	claims, err := parseSignedToken(s.key, tokenPurposeVerifyEmail, req.Token, now)
+	if err != nil {
+		resp.Error = InvalidToken
+		return resp
+	}
+	t, err := s.repo.ConsumeToken(tokenPurposeVerifyEmail, hashToken(req.Token))
+	if errors.Is(err, errInvalidToken) {
+		resp.Error = InvalidToken
+		return resp
+	} else if err != nil {
+		resp.Error = changeError(err)
+		return resp
+	}
+	subject := claims.Subject
+	if t.UserID != subject || !t.valid(now) {
+		resp.Error = InvalidToken
+		return resp
+	}
+
+	for attempt := 1; ; attempt++ {
+		u, err := s.repo.Find(subject, users.IdentifierType_SUBJECT)
+		if err != nil {
+			resp.Error = findUserError(err)
+			return resp
+		}
+		// The address has been changed since the token was sent, the token does not verify the new one.
+		if claims.Address == "" || claims.Address != hashAddress(u.Claims[emailClaim()]) {
+			zap.L().Sugar().Warnf("The verification token of the user %s was sent to another address.", subject)
+			resp.Error = InvalidToken
+			return resp
+		}
+		u.Pending = false
+		// The claims of the found user may be shared, they are replaced rather than modified.
+		claims := make(map[string]string, len(u.Claims)+1)
+		for k, v := range u.Claims {
+			claims[k] = v
+		}
+		claims[emailVerifiedClaim] = "true"
+		u.Claims = claims
+
+		err = s.repo.Update(u, u.Version)
+		if errors.Is(err, errVersionConflict) && attempt < verifyEmailAttempts {
+			continue
+		}
+		if err != nil {
+			resp.Error = changeError(err)
+			return resp
+		}
+		break
+	}
+	zap.L().Sugar().Infof("The email address of the user %s has been verified.", subject)
+	resp.Subject = subject
+
+	return resp
+}
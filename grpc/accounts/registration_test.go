@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"csb.nc/auth/stores/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Keeps the messages instead of sending them.
+type testNotifier struct {
+	mutex    sync.Mutex
+	messages []testMessage
+}
+
+type testMessage struct {
+	to, subject, body string
+}
+
+func (n *testNotifier) Notify(to string, subject string, body string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.messages = append(n.messages, testMessage{to, subject, body})
+	return nil
+}
+
+var testTokenURL = regexp.MustCompile(`https://portal\.csb\.nc/\w+\?token=(\S+)`)
+
+// Returns the token of the last message sent to the address.
+func (n *testNotifier) token(t *testing.T, to string) string {
+	for i := len(n.messages) - 1; i >= 0; i-- {
+		if n.messages[i].to != to {
+			continue
+		}
+		m := testTokenURL.FindStringSubmatch(n.messages[i].body)
+		if m == nil {
+			t.Fatalf("The message has no token URL: %s", n.messages[i].body)
+		}
+		token, err := url.QueryUnescape(m[1])
+		if err != nil {
+			t.Fatalf("Could not read the token: %v", err)
+		}
+		return token
+	}
+	t.Fatalf("No message has been sent to %s.", to)
+	return ""
+}
+
+func TestSignedTokens(t *testing.T) {
+	key := []byte("test-key")
+	now := time.Now()
+	token, stored, err := signToken(key, tokenPurposeVerifyEmail, aliceID, hashAddress("alice.martin@csb.nc"), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Could not sign the token: %v", err)
+	}
+	if stored.Hash != hashToken(token) || stored.UserID != aliceID {
+		t.Errorf("The stored token is %+v.", stored)
+	}
+	if claims, err := parseSignedToken(key, tokenPurposeVerifyEmail, token, now); err != nil || claims.Subject != aliceID || claims.Address != hashAddress("Alice.Martin@csb.nc") {
+		t.Errorf("The token is not valid: %+v, %v", claims, err)
+	}
+
+	testCases := []struct {
+		name    string
+		key     string
+		purpose string
+		token   string
+		now     time.Time
+	}{
+		{"other key", "other-key", tokenPurposeVerifyEmail, token, now},
+		{"other purpose", "test-key", "reset_password", token, now},
+		{"expired", "test-key", tokenPurposeVerifyEmail, token, now.Add(time.Hour)},
+		{"tampered", "test-key", tokenPurposeVerifyEmail, "e30" + token[strings.IndexByte(token, '.'):], now},
+		{"malformed", "test-key", tokenPurposeVerifyEmail, "token", now},
+	}
+	for _, tc := range testCases {
+		if _, err := parseSignedToken([]byte(tc.key), tc.purpose, tc.token, tc.now); err != errInvalidToken {
+			t.Errorf("%s: the token should be invalid, error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		notifier := &testNotifier{}
+		s, err := newRegistrationServer(repo, notifier)
+		if err != nil {
+			t.Fatalf("Could not create the registration service: %v", err)
+		}
+		ctx := context.Background()
+
+		resp, err := s.Register(ctx, &users.RegisterRequest{
+			Username: "dave.petit",
+			Password: "Tropical-Reef-42",
+			Email:    "dave.petit@csb.nc",
+			Claims:   map[string]string{"name": "Dave Petit"},
+		})
+		if err != nil || !resp.Succeeded || resp.Subject == "" {
+			t.Fatalf("Could not register the user: %v, %v", resp, err)
+		}
+		subject := resp.Subject
+
+		u, err := repo.Find("dave.petit@csb.nc", users.IdentifierType_EMAIL)
+		if err != nil || !u.Pending || u.Claims[emailVerifiedClaim] != "false" || u.Claims["name"] != "Dave Petit" {
+			t.Fatalf("The registered user is %+v, %v", u, err)
+		}
+		authenticate := func() int32 {
+			return (server{repo: repo}).authenticate(&users.AuthRequest{Username: "dave.petit", Password: "Tropical-Reef-42"}).Error
+		}
+		if code := authenticate(); code != AccountPending {
+			t.Errorf("A pending user should not be authenticated, error: %d", code)
+		}
+
+		// A new token replaces the first one.
+		first := notifier.token(t, "dave.petit@csb.nc")
+		if resp, err := s.SendVerification(ctx, &users.SendVerificationRequest{Email: "Dave.Petit@csb.nc"}); err != nil || !resp.Succeeded {
+			t.Fatalf("Could not send a new token: %v, %v", resp, err)
+		}
+		token := notifier.token(t, "dave.petit@csb.nc")
+		if token == first {
+			t.Errorf("The new token is the same as the first one.")
+		}
+		if resp, err := s.VerifyEmail(ctx, &users.VerifyEmailRequest{Token: first}); err != nil || resp.Error != InvalidToken || resp.Code != users.ErrorCode_INVALID_TOKEN {
+			t.Errorf("The replaced token should be rejected: %v, %v", resp, err)
+		}
+
+		if resp, err := s.VerifyEmail(ctx, &users.VerifyEmailRequest{Token: token}); err != nil || !resp.Succeeded || resp.Subject != subject {
+			t.Fatalf("Could not verify the email address: %v, %v", resp, err)
+		}
+		if resp, err := s.VerifyEmail(ctx, &users.VerifyEmailRequest{Token: token}); err != nil || resp.Error != InvalidToken {
+			t.Errorf("A token should only be used once: %v, %v", resp, err)
+		}
+		if u, err := repo.Find(subject, users.IdentifierType_SUBJECT); err != nil || u.Pending || u.Claims[emailVerifiedClaim] != "true" {
+			t.Errorf("The verified user is %+v, %v", u, err)
+		}
+		if code := authenticate(); code != 0 {
+			t.Errorf("Could not authenticate the verified user, error: %d", code)
+		}
+
+		// No token is sent to the verified and unknown addresses, but the responses do not tell.
+		sent := len(notifier.messages)
+		for _, email := range []string{"dave.petit@csb.nc", "nobody@csb.nc"} {
+			if resp, err := s.SendVerification(ctx, &users.SendVerificationRequest{Email: email}); err != nil || !resp.Succeeded {
+				t.Errorf("%s: the response is %v, %v", email, resp, err)
+			}
+		}
+		if len(notifier.messages) != sent {
+			t.Errorf("%d tokens have been sent.", len(notifier.messages)-sent)
+		}
+	})
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s, err := newRegistrationServer(repo, &testNotifier{})
+		if err != nil {
+			t.Fatalf("Could not create the registration service: %v", err)
+		}
+		ctx := context.Background()
+
+		testCases := []struct {
+			req   *users.RegisterRequest
+			error int32
+		}{
+			{&users.RegisterRequest{Username: "alice.martin", Password: "Tropical-Reef-42", Email: "alice.m@csb.nc"}, UserExists},
+			{&users.RegisterRequest{Username: "alice.m", Password: "Tropical-Reef-42", Email: "alice.martin@csb.nc"}, UserExists},
+			{&users.RegisterRequest{Username: "dave.petit", Password: "Short-1", Email: "dave.petit@csb.nc"}, PasswordRejected},
+			// The identifier claims of the other users cannot be registered.
+			{&users.RegisterRequest{Username: "dave.petit", Password: "Tropical-Reef-42", Email: "dave.petit@csb.nc", Claims: map[string]string{"external_id": "A-1002"}}, UserExists},
+		}
+		for _, tc := range testCases {
+			resp, err := s.Register(ctx, tc.req)
+			if err != nil || resp.Error != tc.error || resp.Succeeded {
+				t.Errorf("%v: the response is %v, %v", tc.req, resp, err)
+			}
+		}
+
+		for _, req := range []*users.RegisterRequest{
+			{Username: "dave.petit", Password: "Tropical-Reef-42", Email: "dave.petit"},
+			{Password: "Tropical-Reef-42", Email: "dave.petit@csb.nc"},
+			// Only the configured claims can be registered, the verification state is set by the store.
+			{Username: "dave.petit", Password: "Tropical-Reef-42", Email: "dave.petit@csb.nc", Claims: map[string]string{emailVerifiedClaim: "true"}},
+			{Username: "dave.petit", Password: "Tropical-Reef-42", Email: "dave.petit@csb.nc", Claims: map[string]string{"upn": "alice.martin@csb.nc"}},
+			{Username: "dave.petit", Password: "Tropical-Reef-42", Email: "dave.petit@csb.nc", Claims: map[string]string{"external_id": "a 1002"}},
+		} {
+			if _, err := s.Register(ctx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%v: the request should be invalid, error: %v", req, err)
+			}
+		}
+	})
+}
+
+func TestVerifyEmailChangedAddress(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		notifier := &testNotifier{}
+		s, err := newRegistrationServer(repo, notifier)
+		if err != nil {
+			t.Fatalf("Could not create the registration service: %v", err)
+		}
+		ctx := context.Background()
+
+		resp, err := s.Register(ctx, &users.RegisterRequest{Username: "dave.petit", Password: "Tropical-Reef-42", Email: "dave.petit@csb.nc"})
+		if err != nil || !resp.Succeeded {
+			t.Fatalf("Could not register the user: %v, %v", resp, err)
+		}
+		token := notifier.token(t, "dave.petit@csb.nc")
+
+		// The token sent to the first address does not verify the new one.
+		u, err := repo.Find(resp.Subject, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		u.Claims = map[string]string{"email": "dave.petit@example.nc", emailVerifiedClaim: "false"}
+		if err := repo.Update(u, u.Version); err != nil {
+			t.Fatalf("Could not change the address: %v", err)
+		}
+		if resp, err := s.VerifyEmail(ctx, &users.VerifyEmailRequest{Token: token}); err != nil || resp.Error != InvalidToken {
+			t.Errorf("The token of the previous address should be rejected: %v, %v", resp, err)
+		}
+		if u, err := repo.Find(resp.Subject, users.IdentifierType_SUBJECT); err != nil || !u.Pending || u.Claims[emailVerifiedClaim] != "false" {
+			t.Errorf("The user should not be verified: %+v, %v", u, err)
+		}
+	})
+}
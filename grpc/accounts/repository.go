@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+)
+
+const (
+	viperKeyUsersBackend     = "users.backend"
+	viperKeyUsersSqliteFile  = "users.sqlite.file"
+	viperKeyUsersPostgresDSN = "users.postgres.dsn"
+
+	usersBackendJSON     = "json"
+	usersBackendSqlite   = "sqlite"
+	usersBackendPostgres = "postgres"
+	usersBackendDefault  = usersBackendJSON
+
+	usersSqliteFileDefault = "users.db"
+)
+
+// Number of users read at once by ForEach.
+var usersPageSize = 500
+
+var (
+	errUserExists      = errors.New("A user with the same id or username already exists")
+	errPasswordChanged = errors.New("The password has been changed meanwhile")
+	errVersionConflict = errors.New("The user has been changed meanwhile")
+)
+
+// UserRepository stores the users of the accounts store.
+//
+// The lookups return errUserNotFound, errAmbiguousIdentifier or errUnsupportedType when the identifier does not match a single user,
+// and an error wrapping errUsersMissing when the users cannot be read.
+type UserRepository interface {
+	// Find returns the single user matching the identifier, compared without case.
+	Find(identifier string, identifierType users.IdentifierType) (*user, error)
+	// List returns all the users.
+	List() ([]user, error)
+	// ForEach calls fn with each user whose id follows after, in the order of the ids, until fn returns an error, which is returned.
+	// The users are read by pages, with their claims and second factors but without their password histories.
+	ForEach(after string, fn func(u *user) error) error
+	// Create adds a user at the version 1, returning errUserExists when its id or username is already used.
+	Create(u *user) error
+	// Update replaces the user with the same id, only if its version is still version, otherwise errVersionConflict is returned.
+	// The version of the user is incremented, and errUserExists is returned when its new username is already used.
+	Update(u *user, version int64) error
+	// Delete removes a user, only if its version is still version, otherwise errVersionConflict is returned.
+	Delete(id string, version int64) error
+	// SetPassword replaces the password hash and the password history of a user, only if its hash is still currentHash,
+	// otherwise errPasswordChanged is returned. The version of the user is incremented.
+	SetPassword(id string, currentHash string, newHash string, history []string, changeRequired bool) error
+	// RehashPassword replaces the password hash of a user by a new hash of the same password, only if its hash is still currentHash,
+	// otherwise errPasswordChanged is returned. The version and the password history of the user are kept, as for a login.
+	RehashPassword(id string, currentHash string, newHash string) error
+	// ResetPassword consumes the token of the purpose with the hash and replaces the password of its user as SetPassword does,
+	// without requiring a change, in one change. errInvalidToken is returned when the user has no such token,
+	// and errPasswordChanged when its hash is no longer currentHash, the token being kept.
+	ResetPassword(purpose string, tokenHash string, id string, currentHash string, newHash string, history []string) error
+	// RecordFailedLogin increments the failed logins of a user, and locks it when they reach threshold.
+	// The failed logins do not change the version of the user, so they do not conflict with its administration.
+	RecordFailedLogin(id string, threshold int) error
+	// ResetFailedLogins clears the failed logins and the lock of a user, without changing its version.
+	ResetFailedLogins(id string) error
+	// Unlock clears the failed logins and the lock of a user, only if its version is still version, otherwise errVersionConflict
+	// is returned. The version of the user is incremented, as the unlock is an administrative change.
+	Unlock(id string, version int64) error
+	// AddToken stores a token of a user, replacing its other tokens of the same purpose, which can no longer be used.
+	AddToken(t *userToken) error
+	// FindToken returns the token of the purpose with the hash, or errInvalidToken when it is not stored.
+	FindToken(purpose string, hash string) (*userToken, error)
+	// ConsumeToken removes the token of the purpose with the hash and returns it, or errInvalidToken when it is not stored.
+	// The expiration of the token is checked by the caller.
+	ConsumeToken(purpose string, hash string) (*userToken, error)
+	// SetTOTP replaces the second factor of a user, or removes it when t is nil, without changing its version.
+	SetTOTP(id string, t *userTOTP) error
+	// UseTOTPStep records the time step of a TOTP code of a user, only if it is after its last step and its second factor is confirmed,
+	// otherwise errInvalidOTP is returned.
+	UseTOTPStep(id string, step int64) error
+	// UseRecoveryCode removes the recovery code of a user with the hash, or returns errInvalidOTP when it is not stored.
+	UseRecoveryCode(id string, hash string) error
+	// RemoveTOTP removes the second factor and the recovery codes of a user, only if its version is still version,
+	// otherwise errVersionConflict is returned. The version of the user is incremented, as the removal is an administrative change.
+	RemoveTOTP(id string, version int64) error
+	// SetRecoveryCodes replaces the recovery codes of a user whose second factor is confirmed, otherwise errInvalidOTP is returned.
+	SetRecoveryCodes(id string, hashes []string) error
+	// Close releases the resources of the repository.
+	Close() error
+}
+
+// Opens the users repository of the configured backend.
+func newRepository() (UserRepository, error) {
+	backend := usersBackendDefault
+	if viper.IsSet(viperKeyUsersBackend) {
+		backend = strings.ToLower(viper.GetString(viperKeyUsersBackend))
+	}
+
+	switch backend {
+	case usersBackendJSON:
+		return newJSONRepository(usersFile())
+	case usersBackendSqlite:
+		file := usersSqliteFileDefault
+		if viper.IsSet(viperKeyUsersSqliteFile) {
+			file = viper.GetString(viperKeyUsersSqliteFile)
+		}
+		return newSQLRepository(sqliteDialect, sqliteDSN(file))
+	case usersBackendPostgres:
+		return newSQLRepository(postgresDialect, viper.GetString(viperKeyUsersPostgresDSN))
+	default:
+		return nil, fmt.Errorf("unknown users backend '%s'", backend)
+	}
+}
+
+// Sets the version and the timestamps of a user created now.
+func created(u *user) {
+	now := time.Now().UTC()
+	u.Version = 1
+	u.CreatedAt = &now
+	u.UpdatedAt = &now
+}
+
+// Sets the version and the update timestamp of a user changed now, from the version.
+func updated(u *user, version int64) {
+	now := time.Now().UTC()
+	u.Version = version + 1
+	u.UpdatedAt = &now
+}
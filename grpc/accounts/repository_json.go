@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"csb.nc/auth/stores/users"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyUsersFile = "users.file"
+
+	usersFileDefault = "users.json"
+)
+
+// Returns the path of the users file.
+func usersFile() string {
+	if viper.IsSet(viperKeyUsersFile) {
+		return viper.GetString(viperKeyUsersFile)
+	}
+	return usersFileDefault
+}
+
+// jsonRepository stores the users in a JSON file, loaded in memory and reloaded each time it changes.
+type jsonRepository struct {
+	path string
+	// Holds the *userIndex of the last users successfully loaded, replaced as a whole on each reload.
+	// The users of an index are never modified: the changes are applied to a copy, which is saved and loaded in a new index.
+	current atomic.Value
+	// Serializes the changes of the users file, which is read, modified and written back.
+	mutex   sync.Mutex
+	watcher *fsnotify.Watcher
+}
+
+// Opens the users file and watches its changes.
+// The repository is opened even if the file cannot be read, its users are missing until the file is fixed.
+func newJSONRepository(path string) (*jsonRepository, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &jsonRepository{path: path}
+	if err := r.load(); err != nil {
+		zap.L().Error("Could not load the users.", zap.Error(err))
+	}
+	if err := r.watch(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reads and indexes the users file, replacing the current users only when the file is valid.
+// The file is read under the lock of the changes, so a reload cannot replace the users saved meanwhile by older ones.
+func (r *jsonRepository) load() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	jsonData, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	var usrs []user
+	if err := json.Unmarshal(jsonData, &usrs); err != nil {
+		return err
+	}
+	for i := range usrs {
+		// The users written before the versioning of the users are at the first version.
+		if usrs[i].Version == 0 {
+			usrs[i].Version = 1
+		}
+	}
+
+	r.current.Store(newUserIndex(usrs))
+	zap.L().Sugar().Infof("%d users loaded from %s.", len(usrs), r.path)
+	return nil
+}
+
+// Reloads the users file each time it changes, until the repository is closed.
+// The directory is watched rather than the file, so the file is still watched after being replaced by a rename.
+func (r *jsonRepository) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	r.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != r.path || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				zap.L().Debug("The users file has changed.", zap.String("op", event.Op.String()))
+				if err := r.load(); err != nil {
+					zap.L().Error("Could not reload the users, the last loaded users are kept.", zap.Error(err))
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				zap.L().Error("Could not watch the users file.", zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Returns the index of the current users, which must not be modified.
+func (r *jsonRepository) index() (*userIndex, error) {
+	idx, ok := r.current.Load().(*userIndex)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has not been loaded", errUsersMissing, r.path)
+	}
+	return idx, nil
+}
+
+func (r *jsonRepository) Find(identifier string, identifierType users.IdentifierType) (*user, error) {
+	idx, err := r.index()
+	if err != nil {
+		return nil, err
+	}
+	u, err := idx.find(identifier, identifierType)
+	if err != nil {
+		return nil, err
+	}
+	// The user is copied, so the caller cannot modify the shared index.
+	found := *u
+	return &found, nil
+}
+
+func (r *jsonRepository) List() ([]user, error) {
+	idx, err := r.index()
+	if err != nil {
+		return []user{}, err
+	}
+	return append([]user(nil), idx.users...), nil
+}
+
+func (r *jsonRepository) ForEach(after string, fn func(u *user) error) error {
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	sort.Slice(usrs, func(i, j int) bool { return usrs[i].ID < usrs[j].ID })
+	for i := range usrs {
+		if usrs[i].ID <= after {
+			continue
+		}
+		if err := fn(&usrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *jsonRepository) Create(u *user) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	for i := range usrs {
+		if strings.EqualFold(usrs[i].ID, u.ID) || strings.EqualFold(usrs[i].Username, u.Username) {
+			return errUserExists
+		}
+	}
+	created(u)
+	return r.save(append(usrs, *u))
+}
+
+func (r *jsonRepository) Update(u *user, version int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	found := -1
+	for i := range usrs {
+		switch {
+		case usrs[i].ID == u.ID:
+			found = i
+		case strings.EqualFold(usrs[i].Username, u.Username):
+			return errUserExists
+		}
+	}
+	if found < 0 {
+		return errUserNotFound
+	}
+	if usrs[found].Version != version {
+		return errVersionConflict
+	}
+	// The second factor, the lockout and the tokens are only changed by their own methods, so the changes of the account do not revert them.
+	u.TOTP = usrs[found].TOTP
+	u.FailedLogins = usrs[found].FailedLogins
+	u.LockedAt = usrs[found].LockedAt
+	u.Tokens = usrs[found].Tokens
+	updated(u, version)
+	usrs[found] = *u
+	return r.save(usrs)
+}
+
+func (r *jsonRepository) Delete(id string, version int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	for i := range usrs {
+		if usrs[i].ID != id {
+			continue
+		}
+		if usrs[i].Version != version {
+			return errVersionConflict
+		}
+		return r.save(append(usrs[:i], usrs[i+1:]...))
+	}
+	return errUserNotFound
+}
+
+func (r *jsonRepository) SetPassword(id string, currentHash string, newHash string, history []string, changeRequired bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// The users are read again, as they may have changed since the user has been found.
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	for i := range usrs {
+		if usrs[i].ID != id {
+			continue
+		}
+		if usrs[i].PasswordHash != currentHash {
+			return errPasswordChanged
+		}
+		usrs[i].PasswordHash = newHash
+		usrs[i].PasswordHistory = history
+		usrs[i].PasswordChangeRequired = changeRequired
+		updated(&usrs[i], usrs[i].Version)
+		return r.save(usrs)
+	}
+	return errUserNotFound
+}
+
+func (r *jsonRepository) RehashPassword(id string, currentHash string, newHash string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	for i := range usrs {
+		if usrs[i].ID != id {
+			continue
+		}
+		if usrs[i].PasswordHash != currentHash {
+			return errPasswordChanged
+		}
+		usrs[i].PasswordHash = newHash
+		return r.save(usrs)
+	}
+	return errUserNotFound
+}
+
+func (r *jsonRepository) ResetPassword(purpose string, tokenHash string, id string, currentHash string, newHash string, history []string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	for i := range usrs {
+		if usrs[i].ID != id {
+			continue
+		}
+		for j, t := range usrs[i].Tokens {
+			if t.Purpose != purpose || t.Hash != tokenHash {
+				continue
+			}
+			if usrs[i].PasswordHash != currentHash {
+				return errPasswordChanged
+			}
+			// The tokens of the index are shared, they are replaced rather than modified.
+			usrs[i].Tokens = append(append([]userToken(nil), usrs[i].Tokens[:j]...), usrs[i].Tokens[j+1:]...)
+			usrs[i].PasswordHash = newHash
+			usrs[i].PasswordHistory = history
+			usrs[i].PasswordChangeRequired = false
+			updated(&usrs[i], usrs[i].Version)
+			return r.save(usrs)
+		}
+		return errInvalidToken
+	}
+	return errInvalidToken
+}
+
+func (r *jsonRepository) RecordFailedLogin(id string, threshold int) error {
+	return r.change(id, func(u *user) {
+		u.FailedLogins++
+		if u.LockedAt == nil && u.FailedLogins >= threshold {
+			now := time.Now().UTC()
+			u.LockedAt = &now
+		}
+	})
+}
+
+func (r *jsonRepository) ResetFailedLogins(id string) error {
+	return r.change(id, func(u *user) {
+		u.FailedLogins = 0
+		u.LockedAt = nil
+	})
+}
+
+func (r *jsonRepository) Unlock(id string, version int64) error {
+	return r.changeVersion(id, version, func(u *user) {
+		u.FailedLogins = 0
+		u.LockedAt = nil
+	})
+}
+
+func (r *jsonRepository) AddToken(t *userToken) error {
+	now := time.Now()
+	return r.change(t.UserID, func(u *user) {
+		tokens := make([]userToken, 0, len(u.Tokens)+1)
+		for _, other := range u.Tokens {
+			// The expired tokens are removed along the way.
+			if other.Purpose != t.Purpose && other.valid(now) {
+				tokens = append(tokens, other)
+			}
+		}
+		u.Tokens = append(tokens, *t)
+	})
+}
+
+func (r *jsonRepository) FindToken(purpose string, hash string) (*userToken, error) {
+	usrs, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range usrs {
+		for _, t := range usrs[i].Tokens {
+			if t.Purpose == purpose && t.Hash == hash {
+				t.UserID = usrs[i].ID
+				return &t, nil
+			}
+		}
+	}
+	return nil, errInvalidToken
+}
+
+func (r *jsonRepository) ConsumeToken(purpose string, hash string) (*userToken, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range usrs {
+		for j, t := range usrs[i].Tokens {
+			if t.Purpose != purpose || t.Hash != hash {
+				continue
+			}
+			// The tokens of the index are shared, they are replaced rather than modified.
+			usrs[i].Tokens = append(append([]userToken(nil), usrs[i].Tokens[:j]...), usrs[i].Tokens[j+1:]...)
+			if err := r.save(usrs); err != nil {
+				return nil, err
+			}
+			t.UserID = usrs[i].ID
+			return &t, nil
+		}
+	}
+	return nil, errInvalidToken
+}
+
+func (r *jsonRepository) SetTOTP(id string, t *userTOTP) error {
+	return r.change(id, func(u *user) {
+		u.TOTP = t
+	})
+}
+
+func (r *jsonRepository) RemoveTOTP(id string, version int64) error {
+	return r.changeVersion(id, version, func(u *user) {
+		u.TOTP = nil
+	})
+}
+
+func (r *jsonRepository) UseTOTPStep(id string, step int64) error {
+	return r.changeTOTP(id, func(t *userTOTP) error {
+		if step <= t.LastStep {
+			return errInvalidOTP
+		}
+		t.LastStep = step
+		return nil
+	})
+}
+
+func (r *jsonRepository) UseRecoveryCode(id string, hash string) error {
+	return r.changeTOTP(id, func(t *userTOTP) error {
+		for i, code := range t.RecoveryCodes {
+			if code == hash {
+				t.RecoveryCodes = append(append([]string(nil), t.RecoveryCodes[:i]...), t.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return errInvalidOTP
+	})
+}
+
+func (r *jsonRepository) SetRecoveryCodes(id string, hashes []string) error {
+	return r.changeTOTP(id, func(t *userTOTP) error {
+		t.RecoveryCodes = hashes
+		return nil
+	})
+}
+
+// Applies a change to a copy of the confirmed second factor of the user with the id and saves it, unless the change fails.
+func (r *jsonRepository) changeTOTP(id string, change func(t *userTOTP) error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	for i := range usrs {
+		if usrs[i].ID != id {
+			continue
+		}
+		if !hasTOTP(&usrs[i]) {
+			return errInvalidOTP
+		}
+		// The second factors of the index are shared, they are replaced rather than modified.
+		t := *usrs[i].TOTP
+		if err := change(&t); err != nil {
+			return err
+		}
+		usrs[i].TOTP = &t
+		return r.save(usrs)
+	}
+	return errUserNotFound
+}
+
+// Applies a change to a copy of the user with the id and saves it, without changing its version.
+func (r *jsonRepository) change(id string, change func(u *user)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	for i := range usrs {
+		if usrs[i].ID == id {
+			change(&usrs[i])
+			return r.save(usrs)
+		}
+	}
+	return errUserNotFound
+}
+
+// Applies a change to a copy of the user with the id and saves it, only if its version is still version, incrementing it.
+func (r *jsonRepository) changeVersion(id string, version int64, change func(u *user)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usrs, err := r.List()
+	if err != nil {
+		return err
+	}
+	for i := range usrs {
+		if usrs[i].ID != id {
+			continue
+		}
+		if usrs[i].Version != version {
+			return errVersionConflict
+		}
+		change(&usrs[i])
+		updated(&usrs[i], version)
+		return r.save(usrs)
+	}
+	return errUserNotFound
+}
+
+func (r *jsonRepository) Close() error {
+	return r.watcher.Close()
+}
+
+// Writes the users to the users file, replacing it only once it has been entirely written, and makes them the current users.
+func (r *jsonRepository) save(usrs []user) error {
+	jsonData, err := json.MarshalIndent(usrs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(jsonData); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return err
+	}
+
+	// The watcher reloads the file as well, but the change must be visible to the next request.
+	r.current.Store(newUserIndex(usrs))
+	return nil
+}
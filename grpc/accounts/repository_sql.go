@@ -0,0 +1,823 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"csb.nc/auth/stores/users"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// dialect holds the differences between the SQL databases.
+type dialect struct {
+	driver string
+	// Converts the `?` placeholders of a query to the placeholders of the database.
+	rebind func(query string) string
+	// Statement locking the migrations, run at the start of their transaction.
+	lockMigrations string
+	// Checks if an error is the violation of a primary key or a unique index.
+	isUniqueViolation func(err error) bool
+}
+
+var sqliteDialect = &dialect{
+	driver: "sqlite3",
+	rebind: func(query string) string { return query },
+	isUniqueViolation: func(err error) bool {
+		var sqliteErr sqlite3.Error
+		return errors.As(err, &sqliteErr) &&
+			(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+	},
+}
+
+var postgresDialect = &dialect{
+	driver: "postgres",
+	rebind: func(query string) string {
+		var b strings.Builder
+		n := 0
+		for _, c := range query {
+			if c == '?' {
+				n++
+				b.WriteString("$" + strconv.Itoa(n))
+				continue
+			}
+			b.WriteRune(c)
+		}
+		return b.String()
+	},
+	lockMigrations: `LOCK TABLE schema_migrations IN EXCLUSIVE MODE`,
+	isUniqueViolation: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation"
+	},
+}
+
+// Returns the DSN of a SQLite database file, with the foreign keys enforced.
+func sqliteDSN(file string) string {
+	return fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000", file)
+}
+
+// sqlRepository stores the users in a SQL database, SQLite or PostgreSQL.
+// The identifiers are compared with their lower cased keys, computed when the users are stored.
+type sqlRepository struct {
+	db *sql.DB
+	d  *dialect
+}
+
+// Opens the database and applies the schema migrations.
+func newSQLRepository(d *dialect, dsn string) (*sqlRepository, error) {
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db, d); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate the users schema: %w", err)
+	}
+	return &sqlRepository{db: db, d: d}, nil
+}
+
+const sqlUserColumns = `u.id, u.username, u.password_hash, u.password_change_required, u.disabled, u.locked_at, u.failed_logins, u.expires_at, u.pending, u.version, u.created_at, u.updated_at`
+
+// Reads a user from the columns of sqlUserColumns.
+func scanUser(rows *sql.Rows) (user, error) {
+	var u user
+	var lockedAt, expiresAt, createdAt, updatedAt sql.NullTime
+	err := rows.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.PasswordChangeRequired, &u.Disabled, &lockedAt, &u.FailedLogins, &expiresAt, &u.Pending, &u.Version, &createdAt, &updatedAt)
+	u.LockedAt = timePtr(lockedAt)
+	u.ExpiresAt = timePtr(expiresAt)
+	u.CreatedAt = timePtr(createdAt)
+	u.UpdatedAt = timePtr(updatedAt)
+	return u, err
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+func (r *sqlRepository) Find(identifier string, identifierType users.IdentifierType) (*user, error) {
+	var query string
+	var args []interface{}
+	switch identifierType {
+	case users.IdentifierType_SUBJECT:
+		query = `SELECT ` + sqlUserColumns + ` FROM users u WHERE lower(u.id) = ?`
+		args = []interface{}{strings.ToLower(identifier)}
+	case users.IdentifierType_USER_NAME:
+		query = `SELECT ` + sqlUserColumns + ` FROM users u WHERE u.username_key = ?`
+		args = []interface{}{strings.ToLower(identifier)}
+	default:
+		claim, err := identifierClaim(identifierType)
+		if err != nil {
+			return nil, err
+		}
+		query = `SELECT ` + sqlUserColumns + ` FROM users u JOIN user_claims c ON c.user_id = u.id WHERE c.name = ? AND c.value_key = ?`
+		args = []interface{}{claim, strings.ToLower(identifier)}
+	}
+
+	// Two users are enough to know that the identifier is ambiguous.
+	rows, err := r.db.Query(r.d.rebind(query+` LIMIT 2`), args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	defer rows.Close()
+
+	var found []user
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+		}
+		found = append(found, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, errUserNotFound
+	case 1:
+	default:
+		return nil, errAmbiguousIdentifier
+	}
+
+	u := &found[0]
+	claims, err := r.claims(`WHERE user_id = ?`, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	u.Claims = claims[u.ID]
+	if u.Claims == nil {
+		u.Claims = map[string]string{}
+	}
+	history, err := r.history(`WHERE user_id = ?`, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	u.PasswordHistory = history[u.ID]
+	totp, err := r.totp(`WHERE user_id = ?`, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	u.TOTP = totp[u.ID]
+	return u, nil
+}
+
+// Reads the claims of the users matching the where clause, by user id.
+func (r *sqlRepository) claims(where string, args ...interface{}) (map[string]map[string]string, error) {
+	rows, err := r.db.Query(r.d.rebind(`SELECT user_id, name, value FROM user_claims `+where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	defer rows.Close()
+
+	claims := make(map[string]map[string]string)
+	for rows.Next() {
+		var id, name, value string
+		if err := rows.Scan(&id, &name, &value); err != nil {
+			return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+		}
+		if claims[id] == nil {
+			claims[id] = make(map[string]string)
+		}
+		claims[id][name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	return claims, nil
+}
+
+// Reads the password histories of the users matching the where clause, by user id.
+func (r *sqlRepository) history(where string, args ...interface{}) (map[string][]string, error) {
+	rows, err := r.db.Query(r.d.rebind(`SELECT user_id, password_hash FROM password_history `+where+` ORDER BY user_id, position`), args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	defer rows.Close()
+
+	history := make(map[string][]string)
+	for rows.Next() {
+		var id, hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+		}
+		history[id] = append(history[id], hash)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	return history, nil
+}
+
+// Reads the second factors of the users matching the where clause, with their recovery codes, by user id.
+func (r *sqlRepository) totp(where string, args ...interface{}) (map[string]*userTOTP, error) {
+	rows, err := r.db.Query(r.d.rebind(`SELECT user_id, secret, confirmed, last_step FROM user_totp `+where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	defer rows.Close()
+
+	totp := make(map[string]*userTOTP)
+	for rows.Next() {
+		var id string
+		t := &userTOTP{}
+		if err := rows.Scan(&id, &t.Secret, &t.Confirmed, &t.LastStep); err != nil {
+			return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+		}
+		totp[id] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	if len(totp) == 0 {
+		return totp, nil
+	}
+
+	codes, err := r.db.Query(r.d.rebind(`SELECT user_id, code_hash FROM user_recovery_codes `+where+` ORDER BY user_id, code_hash`), args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	defer codes.Close()
+	for codes.Next() {
+		var id, hash string
+		if err := codes.Scan(&id, &hash); err != nil {
+			return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+		}
+		if t := totp[id]; t != nil {
+			t.RecoveryCodes = append(t.RecoveryCodes, hash)
+		}
+	}
+	if err := codes.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	return totp, nil
+}
+
+func (r *sqlRepository) List() ([]user, error) {
+	rows, err := r.db.Query(`SELECT ` + sqlUserColumns + ` FROM users u ORDER BY u.id`)
+	if err != nil {
+		return []user{}, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	defer rows.Close()
+
+	usrs := make([]user, 0)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return []user{}, fmt.Errorf("%w: %v", errUsersMissing, err)
+		}
+		usrs = append(usrs, u)
+	}
+	if err := rows.Err(); err != nil {
+		return []user{}, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+
+	claims, err := r.claims(``)
+	if err != nil {
+		return []user{}, err
+	}
+	history, err := r.history(``)
+	if err != nil {
+		return []user{}, err
+	}
+	totp, err := r.totp(``)
+	if err != nil {
+		return []user{}, err
+	}
+	for i := range usrs {
+		usrs[i].Claims = claims[usrs[i].ID]
+		if usrs[i].Claims == nil {
+			usrs[i].Claims = map[string]string{}
+		}
+		usrs[i].PasswordHistory = history[usrs[i].ID]
+		usrs[i].TOTP = totp[usrs[i].ID]
+	}
+	return usrs, nil
+}
+
+func (r *sqlRepository) ForEach(after string, fn func(u *user) error) error {
+	for {
+		rows, err := r.db.Query(r.d.rebind(fmt.Sprintf(`SELECT %s FROM users u WHERE u.id > ? ORDER BY u.id LIMIT %d`, sqlUserColumns, usersPageSize)), after)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errUsersMissing, err)
+		}
+		page := make([]user, 0, usersPageSize)
+		for rows.Next() {
+			u, err := scanUser(rows)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("%w: %v", errUsersMissing, err)
+			}
+			page = append(page, u)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %v", errUsersMissing, err)
+		}
+		if len(page) == 0 {
+			return nil
+		}
+
+		// The claims and the second factors of the page are read between its first and its last id.
+		last := page[len(page)-1].ID
+		claims, err := r.claims(`WHERE user_id > ? AND user_id <= ?`, after, last)
+		if err != nil {
+			return err
+		}
+		totp, err := r.totp(`WHERE user_id > ? AND user_id <= ?`, after, last)
+		if err != nil {
+			return err
+		}
+		for i := range page {
+			page[i].Claims = claims[page[i].ID]
+			if page[i].Claims == nil {
+				page[i].Claims = map[string]string{}
+			}
+			page[i].TOTP = totp[page[i].ID]
+			if err := fn(&page[i]); err != nil {
+				return err
+			}
+		}
+		if len(page) < usersPageSize {
+			return nil
+		}
+		after = last
+	}
+}
+
+func (r *sqlRepository) Create(u *user) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The ids are compared without case by the lookups, so they must also be unique without case.
+	var exists int
+	err = tx.QueryRow(r.d.rebind(`SELECT COUNT(*) FROM users WHERE lower(id) = ?`), strings.ToLower(u.ID)).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return errUserExists
+	}
+
+	created(u)
+	_, err = tx.Exec(
+		r.d.rebind(`INSERT INTO users (id, username, username_key, password_hash, password_change_required, disabled, locked_at, failed_logins, expires_at, pending, version, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		u.ID, u.Username, strings.ToLower(u.Username), u.PasswordHash, u.PasswordChangeRequired, u.Disabled, nullTime(u.LockedAt), u.FailedLogins, nullTime(u.ExpiresAt), u.Pending, u.Version, nullTime(u.CreatedAt), nullTime(u.UpdatedAt),
+	)
+	if r.d.isUniqueViolation(err) {
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.insertClaims(tx, u); err != nil {
+		return err
+	}
+	if err := r.replaceHistory(tx, u.ID, u.PasswordHistory); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlRepository) insertClaims(tx *sql.Tx, u *user) error {
+	for name, value := range u.Claims {
+		_, err := tx.Exec(
+			r.d.rebind(`INSERT INTO user_claims (user_id, name, value, value_key) VALUES (?, ?, ?, ?)`),
+			u.ID, name, value, strings.ToLower(value),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the password history of a user.
+func (r *sqlRepository) replaceHistory(tx *sql.Tx, id string, history []string) error {
+	if _, err := tx.Exec(r.d.rebind(`DELETE FROM password_history WHERE user_id = ?`), id); err != nil {
+		return err
+	}
+	for position, hash := range history {
+		_, err := tx.Exec(
+			r.d.rebind(`INSERT INTO password_history (user_id, position, password_hash) VALUES (?, ?, ?)`),
+			id, position, hash,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Maps a statement changing no user to errUserNotFound, or to the conflict error when the user exists.
+func (r *sqlRepository) notChanged(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, id string, conflict error) error {
+	var exists int
+	if err := q.QueryRow(r.d.rebind(`SELECT COUNT(*) FROM users WHERE id = ?`), id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errUserNotFound
+	}
+	return conflict
+}
+
+func (r *sqlRepository) Update(u *user, version int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changed := *u
+	updated(&changed, version)
+	// The lockout is only changed by its own methods, so the changes of the account do not revert it.
+	res, err := tx.Exec(
+		r.d.rebind(`UPDATE users SET username = ?, username_key = ?, password_hash = ?, password_change_required = ?, disabled = ?, expires_at = ?,
+			pending = ?, version = ?, updated_at = ? WHERE id = ? AND version = ?`),
+		changed.Username, strings.ToLower(changed.Username), changed.PasswordHash, changed.PasswordChangeRequired, changed.Disabled, nullTime(changed.ExpiresAt),
+		changed.Pending, changed.Version, nullTime(changed.UpdatedAt),
+		changed.ID, version,
+	)
+	if r.d.isUniqueViolation(err) {
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return r.notChanged(tx, u.ID, errVersionConflict)
+	}
+
+	// The claims are replaced as a whole.
+	if _, err := tx.Exec(r.d.rebind(`DELETE FROM user_claims WHERE user_id = ?`), u.ID); err != nil {
+		return err
+	}
+	if err := r.insertClaims(tx, &changed); err != nil {
+		return err
+	}
+	if err := r.replaceHistory(tx, u.ID, changed.PasswordHistory); err != nil {
+		return err
+	}
+	var lockedAt sql.NullTime
+	if err := tx.QueryRow(r.d.rebind(`SELECT failed_logins, locked_at FROM users WHERE id = ?`), u.ID).Scan(&changed.FailedLogins, &lockedAt); err != nil {
+		return err
+	}
+	changed.LockedAt = timePtr(lockedAt)
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*u = changed
+	return nil
+}
+
+func (r *sqlRepository) Delete(id string, version int64) error {
+	// The claims are deleted by the foreign key cascade.
+	res, err := r.db.Exec(r.d.rebind(`DELETE FROM users WHERE id = ? AND version = ?`), id, version)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return r.notChanged(r.db, id, errVersionConflict)
+}
+
+func (r *sqlRepository) SetPassword(id string, currentHash string, newHash string, history []string, changeRequired bool) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := r.setPassword(tx, id, currentHash, newHash, history, changeRequired); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Replaces the password hash and the password history of a user in the transaction, only if its hash is still currentHash.
+func (r *sqlRepository) setPassword(tx *sql.Tx, id string, currentHash string, newHash string, history []string, changeRequired bool) error {
+	res, err := tx.Exec(
+		r.d.rebind(`UPDATE users SET password_hash = ?, password_change_required = ?, version = version + 1, updated_at = ? WHERE id = ? AND password_hash = ?`),
+		newHash, changeRequired, time.Now().UTC(), id, currentHash,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return r.notChanged(tx, id, errPasswordChanged)
+	}
+	return r.replaceHistory(tx, id, history)
+}
+
+func (r *sqlRepository) RehashPassword(id string, currentHash string, newHash string) error {
+	res, err := r.db.Exec(r.d.rebind(`UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?`), newHash, id, currentHash)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return r.notChanged(r.db, id, errPasswordChanged)
+}
+
+func (r *sqlRepository) ResetPassword(purpose string, tokenHash string, id string, currentHash string, newHash string, history []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The token is only consumed by the request deleting it, when the same token is used concurrently,
+	// and it is restored by the rollback when the password cannot be replaced.
+	res, err := tx.Exec(r.d.rebind(`DELETE FROM user_tokens WHERE token_hash = ? AND purpose = ? AND user_id = ?`), tokenHash, purpose, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvalidToken
+	}
+	if err := r.setPassword(tx, id, currentHash, newHash, history, false); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlRepository) RecordFailedLogin(id string, threshold int) error {
+	// The failed logins are incremented by the database, so the concurrent failures are all counted.
+	res, err := r.db.Exec(
+		r.d.rebind(`UPDATE users SET failed_logins = failed_logins + 1,
+			locked_at = CASE WHEN locked_at IS NULL AND failed_logins + 1 >= ? THEN ? ELSE locked_at END WHERE id = ?`),
+		threshold, time.Now().UTC(), id,
+	)
+	return r.changed(res, err)
+}
+
+func (r *sqlRepository) ResetFailedLogins(id string) error {
+	res, err := r.db.Exec(r.d.rebind(`UPDATE users SET failed_logins = 0, locked_at = NULL WHERE id = ?`), id)
+	return r.changed(res, err)
+}
+
+func (r *sqlRepository) Unlock(id string, version int64) error {
+	res, err := r.db.Exec(
+		r.d.rebind(`UPDATE users SET failed_logins = 0, locked_at = NULL, version = version + 1, updated_at = ? WHERE id = ? AND version = ?`),
+		time.Now().UTC(), id, version,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return r.notChanged(r.db, id, errVersionConflict)
+}
+
+func (r *sqlRepository) AddToken(t *userToken) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The expired tokens of the user are removed along the way.
+	_, err = tx.Exec(
+		r.d.rebind(`DELETE FROM user_tokens WHERE user_id = ? AND (purpose = ? OR expires_at <= ?)`),
+		t.UserID, t.Purpose, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	var exists int
+	if err := tx.QueryRow(r.d.rebind(`SELECT COUNT(*) FROM users WHERE id = ?`), t.UserID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errUserNotFound
+	}
+	_, err = tx.Exec(
+		r.d.rebind(`INSERT INTO user_tokens (token_hash, user_id, purpose, expires_at) VALUES (?, ?, ?, ?)`),
+		t.Hash, t.UserID, t.Purpose, t.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlRepository) FindToken(purpose string, hash string) (*userToken, error) {
+	t := &userToken{Purpose: purpose, Hash: hash}
+	err := r.db.QueryRow(
+		r.d.rebind(`SELECT user_id, expires_at FROM user_tokens WHERE token_hash = ? AND purpose = ?`), hash, purpose,
+	).Scan(&t.UserID, &t.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsersMissing, err)
+	}
+	return t, nil
+}
+
+func (r *sqlRepository) ConsumeToken(purpose string, hash string) (*userToken, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	t := &userToken{Purpose: purpose, Hash: hash}
+	err = tx.QueryRow(
+		r.d.rebind(`SELECT user_id, expires_at FROM user_tokens WHERE token_hash = ? AND purpose = ?`), hash, purpose,
+	).Scan(&t.UserID, &t.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The token is only consumed by the request deleting it, when the same token is used concurrently.
+	res, err := tx.Exec(r.d.rebind(`DELETE FROM user_tokens WHERE token_hash = ?`), hash)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, errInvalidToken
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *sqlRepository) SetTOTP(id string, t *userTOTP) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow(r.d.rebind(`SELECT COUNT(*) FROM users WHERE id = ?`), id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errUserNotFound
+	}
+	// The recovery codes are deleted by the foreign key cascade.
+	if _, err := tx.Exec(r.d.rebind(`DELETE FROM user_totp WHERE user_id = ?`), id); err != nil {
+		return err
+	}
+	if t != nil {
+		_, err := tx.Exec(
+			r.d.rebind(`INSERT INTO user_totp (user_id, secret, confirmed, last_step) VALUES (?, ?, ?, ?)`),
+			id, t.Secret, t.Confirmed, t.LastStep,
+		)
+		if err != nil {
+			return err
+		}
+		if err := r.insertRecoveryCodes(tx, id, t.RecoveryCodes); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlRepository) RemoveTOTP(id string, version int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(r.d.rebind(`UPDATE users SET version = version + 1, updated_at = ? WHERE id = ? AND version = ?`), time.Now().UTC(), id, version)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return r.notChanged(tx, id, errVersionConflict)
+	}
+	// The recovery codes are deleted by the foreign key cascade.
+	if _, err := tx.Exec(r.d.rebind(`DELETE FROM user_totp WHERE user_id = ?`), id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlRepository) insertRecoveryCodes(tx *sql.Tx, id string, hashes []string) error {
+	for _, hash := range hashes {
+		if _, err := tx.Exec(r.d.rebind(`INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)`), id, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlRepository) UseTOTPStep(id string, step int64) error {
+	res, err := r.db.Exec(
+		r.d.rebind(`UPDATE user_totp SET last_step = ? WHERE user_id = ? AND confirmed = ? AND last_step < ?`),
+		step, id, true, step,
+	)
+	return r.otpUsed(res, err)
+}
+
+func (r *sqlRepository) UseRecoveryCode(id string, hash string) error {
+	res, err := r.db.Exec(r.d.rebind(`DELETE FROM user_recovery_codes WHERE user_id = ? AND code_hash = ?`), id, hash)
+	return r.otpUsed(res, err)
+}
+
+func (r *sqlRepository) SetRecoveryCodes(id string, hashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var confirmed int
+	if err := tx.QueryRow(r.d.rebind(`SELECT COUNT(*) FROM user_totp WHERE user_id = ? AND confirmed = ?`), id, true).Scan(&confirmed); err != nil {
+		return err
+	}
+	if confirmed == 0 {
+		return errInvalidOTP
+	}
+	if _, err := tx.Exec(r.d.rebind(`DELETE FROM user_recovery_codes WHERE user_id = ?`), id); err != nil {
+		return err
+	}
+	if err := r.insertRecoveryCodes(tx, id, hashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Maps a statement using no one-time code to errInvalidOTP.
+func (r *sqlRepository) otpUsed(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvalidOTP
+	}
+	return nil
+}
+
+// Maps a statement changing no user to errUserNotFound.
+func (r *sqlRepository) changed(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (r *sqlRepository) Close() error {
+	return r.db.Close()
+}
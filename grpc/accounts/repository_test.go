@@ -0,0 +1,713 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"csb.nc/auth/stores/tools"
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+)
+
+const (
+	viperKeyTestsAccountsUsers            = "tests.accounts.users"
+	viperKeyTestsAccountsPostgresDSN      = "tests.accounts.postgres.dsn"
+	viperKeyTestsAccountsPostgresBin      = "tests.accounts.postgres.bin"
+	viperKeyTestsAccountsPostgresRequired = "tests.accounts.postgres.required"
+
+	aliceID = "0f1b6c3e-52a4-4c8d-9e7b-3a2f8d6c1e45"
+	bobID   = "5c9e2a7d-1b3f-4e6a-8d4c-7f0b9e2a6c13"
+	carolID = "9a4d7e1c-6f2b-4a8e-b5c3-2e8f1d7a4b96"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv(strings.ToUpper(tools.ViperKeyEnvironment), "test")
+	tools.InitConfig(cfgName, cfgType, cfgPath)
+	stop := startTestPostgres()
+	if viper.GetString(viperKeyTestsAccountsPostgresDSN) == "" {
+		fmt.Fprintf(os.Stderr, "The PostgreSQL repository is not tested: %s\n", postgresSkipReason)
+	}
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// Reason of the skipped tests of the PostgreSQL repository, when no server is available.
+var postgresSkipReason = fmt.Sprintf("the DSN is not set in %s, and initdb and pg_ctl are not found or could not start a server.", viperKeyTestsAccountsPostgresDSN)
+
+// Starts a throwaway PostgreSQL server for the tests when no DSN is set and initdb and pg_ctl are found,
+// in the configured directory or in the PATH. It listens on a Unix socket only, and is removed by the returned function.
+func startTestPostgres() func() {
+	noop := func() {}
+	if viper.GetString(viperKeyTestsAccountsPostgresDSN) != "" {
+		return noop
+	}
+	initdb, pgctl := "initdb", "pg_ctl"
+	if bin := viper.GetString(viperKeyTestsAccountsPostgresBin); bin != "" {
+		initdb, pgctl = filepath.Join(bin, initdb), filepath.Join(bin, pgctl)
+	}
+	if _, err := exec.LookPath(initdb); err != nil {
+		return noop
+	}
+	if _, err := exec.LookPath(pgctl); err != nil {
+		return noop
+	}
+
+	dir, err := ioutil.TempDir("", "accounts-postgres")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create the PostgreSQL directory: %v\n", err)
+		return noop
+	}
+	data := filepath.Join(dir, "data")
+	run := func(name string, args ...string) error {
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %v\n%s", name, err, out)
+		}
+		return nil
+	}
+	err = run(initdb, "-D", data, "-U", "postgres", "-A", "trust", "--no-sync")
+	if err == nil {
+		err = run(pgctl, "-D", data, "-l", filepath.Join(dir, "postgres.log"), "-w", "-o", "-F -c listen_addresses='' -k "+dir, "start")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not start PostgreSQL, its repository is not tested: %v\n", err)
+		os.RemoveAll(dir)
+		return noop
+	}
+
+	viper.Set(viperKeyTestsAccountsPostgresDSN, fmt.Sprintf("host=%s user=postgres dbname=postgres sslmode=disable", dir))
+	return func() {
+		if err := run(pgctl, "-D", data, "-m", "immediate", "-w", "stop"); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not stop PostgreSQL: %v\n", err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// Reads the users loaded in the repositories.
+func testUsers(t *testing.T) []user {
+	jsonData, err := ioutil.ReadFile(viper.GetString(viperKeyTestsAccountsUsers))
+	if err != nil {
+		t.Fatalf("Could not read the test users: %v", err)
+	}
+	var usrs []user
+	if err := json.Unmarshal(jsonData, &usrs); err != nil {
+		t.Fatalf("Could not parse the test users: %v", err)
+	}
+	return usrs
+}
+
+// Opens an empty SQL repository and creates the test users.
+func newTestSQLRepository(t *testing.T, d *dialect, dsn string) UserRepository {
+	repo, err := newSQLRepository(d, dsn)
+	if err != nil {
+		t.Fatalf("Could not open the repository: %v", err)
+	}
+	for _, u := range testUsers(t) {
+		u := u
+		if err := repo.Create(&u); err != nil {
+			repo.Close()
+			t.Fatalf("Could not create the user %s: %v", u.Username, err)
+		}
+	}
+	return repo
+}
+
+// The repositories tested, each one being opened with the test users only.
+var testRepositories = map[string]func(t *testing.T) UserRepository{
+	usersBackendJSON: func(t *testing.T) UserRepository {
+		path := filepath.Join(t.TempDir(), "users.json")
+		jsonData, err := ioutil.ReadFile(viper.GetString(viperKeyTestsAccountsUsers))
+		if err == nil {
+			err = ioutil.WriteFile(path, jsonData, 0600)
+		}
+		if err != nil {
+			t.Fatalf("Could not copy the test users: %v", err)
+		}
+		repo, err := newJSONRepository(path)
+		if err != nil {
+			t.Fatalf("Could not open the repository: %v", err)
+		}
+		return repo
+	},
+	usersBackendSqlite: func(t *testing.T) UserRepository {
+		return newTestSQLRepository(t, sqliteDialect, sqliteDSN(filepath.Join(t.TempDir(), "users.db")))
+	},
+	usersBackendPostgres: func(t *testing.T) UserRepository {
+		dsn := viper.GetString(viperKeyTestsAccountsPostgresDSN)
+		if dsn == "" {
+			if viper.GetBool(viperKeyTestsAccountsPostgresRequired) {
+				t.Fatalf("The PostgreSQL repository must be tested: %s", postgresSkipReason)
+			}
+			t.Skip(postgresSkipReason)
+		}
+		repo, err := newSQLRepository(postgresDialect, dsn)
+		if err != nil {
+			t.Fatalf("Could not open the repository: %v", err)
+		}
+		// The tables of the previous test are dropped, and created again by the migrations.
+		_, err = repo.db.Exec(`DROP TABLE IF EXISTS user_recovery_codes, user_totp, user_tokens, password_history, user_claims, users, schema_migrations`)
+		repo.Close()
+		if err != nil {
+			t.Fatalf("Could not drop the tables: %v", err)
+		}
+		return newTestSQLRepository(t, postgresDialect, dsn)
+	},
+}
+
+// Runs the test against each repository.
+func forEachRepository(t *testing.T, test func(t *testing.T, repo UserRepository)) {
+	for _, backend := range []string{usersBackendJSON, usersBackendSqlite, usersBackendPostgres} {
+		t.Run(fmt.Sprintf("Backend=%s", backend), func(t *testing.T) {
+			repo := testRepositories[backend](t)
+			defer repo.Close()
+			test(t, repo)
+		})
+	}
+}
+
+func TestRepositoryFind(t *testing.T) {
+	testCases := []struct {
+		identifier     string
+		identifierType users.IdentifierType
+		id             string
+		err            error
+	}{
+		{aliceID, users.IdentifierType_SUBJECT, aliceID, nil},
+		{strings.ToUpper(aliceID), users.IdentifierType_SUBJECT, aliceID, nil},
+		{"Bob.Durand", users.IdentifierType_USER_NAME, bobID, nil},
+		{"CAROL.LEROY@csb.nc", users.IdentifierType_EMAIL, carolID, nil},
+		{"alice.martin@csb.nc", users.IdentifierType_USER_PRINCIPAL_NAME, aliceID, nil},
+		{"a-1002", users.IdentifierType_EXTERNAL_ID, bobID, nil},
+		{"+687 250000", users.IdentifierType_PHONE_NUMBER, "", errAmbiguousIdentifier},
+		{"CN=Alice Martin,DC=csb,DC=nc", users.IdentifierType_DISTINGUISHED_NAME, "", errUnsupportedType},
+		{"unknown", users.IdentifierType_USER_NAME, "", errUserNotFound},
+		{"unknown@csb.nc", users.IdentifierType_EMAIL, "", errUserNotFound},
+	}
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		for _, tc := range testCases {
+			u, err := repo.Find(tc.identifier, tc.identifierType)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%d:%s: the error is '%v' instead of '%v'.", tc.identifierType, tc.identifier, err, tc.err)
+				continue
+			}
+			if tc.err == nil && u.ID != tc.id {
+				t.Errorf("%d:%s: the user %s is found instead of %s.", tc.identifierType, tc.identifier, u.ID, tc.id)
+			}
+		}
+
+		u, err := repo.Find("carol.leroy", users.IdentifierType_USER_NAME)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		if !u.PasswordChangeRequired || u.Claims["name"] != "Carol Leroy" || len(u.Claims) != 2 {
+			t.Errorf("The user is not read entirely: %+v", u)
+		}
+	})
+}
+
+func TestRepositoryList(t *testing.T) {
+	expected := testUsers(t)
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		usrs, err := repo.List()
+		if err != nil {
+			t.Fatalf("Could not list the users: %v", err)
+		}
+		if len(usrs) != len(expected) {
+			t.Fatalf("%d users are listed instead of %d.", len(usrs), len(expected))
+		}
+		for _, e := range expected {
+			found := false
+			for _, u := range usrs {
+				if u.ID == e.ID {
+					found = true
+					if u.Username != e.Username || u.PasswordHash != e.PasswordHash || len(u.Claims) != len(e.Claims) {
+						t.Errorf("The user %s is listed as %+v.", e.ID, u)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("The user %s is not listed.", e.ID)
+			}
+		}
+	})
+}
+
+func TestRepositoryForEach(t *testing.T) {
+	// The 3 test users are read in 2 pages.
+	defer func(size int) { usersPageSize = size }(usersPageSize)
+	usersPageSize = 2
+	errStop := errors.New("stop")
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		testCases := []struct {
+			after string
+			stop  int
+			ids   []string
+		}{
+			{"", 0, []string{aliceID, bobID, carolID}},
+			{aliceID, 0, []string{bobID, carolID}},
+			{carolID, 0, nil},
+			{"", 2, []string{aliceID, bobID}},
+		}
+		for _, tc := range testCases {
+			var ids []string
+			err := repo.ForEach(tc.after, func(u *user) error {
+				if len(u.Claims) == 0 {
+					t.Errorf("The claims of %s have not been read.", u.ID)
+				}
+				ids = append(ids, u.ID)
+				if len(ids) == tc.stop {
+					return errStop
+				}
+				return nil
+			})
+			if (tc.stop > 0) != (err == errStop) || (tc.stop == 0 && err != nil) {
+				t.Errorf("After '%s', unexpected error: %v", tc.after, err)
+			}
+			if strings.Join(ids, ",") != strings.Join(tc.ids, ",") {
+				t.Errorf("After '%s', the users %v have been read instead of %v.", tc.after, ids, tc.ids)
+			}
+		}
+	})
+}
+
+func TestRepositoryUpdateKeepsTokens(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		stale, err := repo.Find(aliceID, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		token := &userToken{UserID: aliceID, Purpose: "tests", Hash: hashToken("token"), ExpiresAt: time.Now().Add(time.Hour).UTC()}
+		if err := repo.AddToken(token); err != nil {
+			t.Fatalf("Could not add the token: %v", err)
+		}
+		stale.Claims["name"] = "Alice Martin-Leroy"
+		if err := repo.Update(stale, stale.Version); err != nil {
+			t.Fatalf("Could not change the user: %v", err)
+		}
+		if _, err := repo.FindToken("tests", token.Hash); err != nil {
+			t.Errorf("The token has been removed by the change of the user: %v", err)
+		}
+	})
+}
+
+func TestRepositoryCreate(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		dave := &user{
+			ID:           "3e7c1a9b-8d2f-4b6e-a1c5-6d9f3b2e7a04",
+			Username:     "Dave.Petit",
+			PasswordHash: "7019c11cedf6d4d05ce68b359f7873a7bd31f423356dd87320846990435fb299",
+			Claims:       map[string]string{"email": "dave.petit@csb.nc"},
+		}
+		if err := repo.Create(dave); err != nil {
+			t.Fatalf("Could not create the user: %v", err)
+		}
+		if u, err := repo.Find("DAVE.PETIT@CSB.NC", users.IdentifierType_EMAIL); err != nil || u.ID != dave.ID || u.Username != dave.Username {
+			t.Errorf("The created user is not found: %+v, %v", u, err)
+		}
+
+		duplicates := []*user{
+			{ID: "c1d2e3f4-0000-4000-8000-000000000001", Username: "ALICE.MARTIN", PasswordHash: dave.PasswordHash},
+			{ID: strings.ToUpper(bobID), Username: "bob.durand2", PasswordHash: dave.PasswordHash},
+		}
+		for _, u := range duplicates {
+			if err := repo.Create(u); !errors.Is(err, errUserExists) {
+				t.Errorf("The user %s:%s should already exist, error: %v", u.ID, u.Username, err)
+			}
+		}
+	})
+}
+
+func TestRepositorySetPassword(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		u, err := repo.Find(carolID, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+
+		if err := repo.SetPassword(carolID, "stale", "new", nil, false); !errors.Is(err, errPasswordChanged) {
+			t.Errorf("A stale hash should not be replaced, error: %v", err)
+		}
+		if err := repo.SetPassword("unknown", u.PasswordHash, "new", nil, false); !errors.Is(err, errUserNotFound) {
+			t.Errorf("The password of an unknown user should not be set, error: %v", err)
+		}
+		if err := repo.SetPassword(carolID, u.PasswordHash, "new", []string{u.PasswordHash, "older"}, false); err != nil {
+			t.Fatalf("Could not set the password: %v", err)
+		}
+
+		u, err = repo.Find(carolID, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		if u.PasswordHash != "new" || u.PasswordChangeRequired {
+			t.Errorf("The password is not set: %+v", u)
+		}
+		if len(u.PasswordHistory) != 2 || u.PasswordHistory[1] != "older" {
+			t.Errorf("The password history is not set: %v", u.PasswordHistory)
+		}
+	})
+}
+
+func TestRepositoryResetPassword(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		u, err := repo.Find(bobID, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		token := &userToken{UserID: bobID, Purpose: "tests", Hash: hashToken("token"), ExpiresAt: time.Now().Add(time.Hour).UTC()}
+		if err := repo.AddToken(token); err != nil {
+			t.Fatalf("Could not add the token: %v", err)
+		}
+
+		// The token is kept when the password has been changed meanwhile, so the reset can be done again.
+		if err := repo.ResetPassword("tests", token.Hash, bobID, "stale", "new", nil); !errors.Is(err, errPasswordChanged) {
+			t.Errorf("A stale hash should not be replaced, error: %v", err)
+		}
+		if err := repo.ResetPassword("tests", token.Hash, aliceID, u.PasswordHash, "new", nil); !errors.Is(err, errInvalidToken) {
+			t.Errorf("The token of another user should not reset the password, error: %v", err)
+		}
+		if _, err := repo.FindToken("tests", token.Hash); err != nil {
+			t.Fatalf("The token has been consumed by the rejected resets: %v", err)
+		}
+		if err := repo.ResetPassword("tests", token.Hash, bobID, u.PasswordHash, "new", []string{u.PasswordHash}); err != nil {
+			t.Fatalf("Could not reset the password: %v", err)
+		}
+		if _, err := repo.FindToken("tests", token.Hash); !errors.Is(err, errInvalidToken) {
+			t.Errorf("The token should be consumed, error: %v", err)
+		}
+		if err := repo.ResetPassword("tests", token.Hash, bobID, "new", "newer", nil); !errors.Is(err, errInvalidToken) {
+			t.Errorf("A token should only be used once, error: %v", err)
+		}
+		if u, err := repo.Find(bobID, users.IdentifierType_SUBJECT); err != nil || u.PasswordHash != "new" || len(u.PasswordHistory) != 1 {
+			t.Errorf("The password is not reset: %+v, %v", u, err)
+		}
+	})
+}
+
+func TestAuthenticateUpgradesPasswordHash(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := server{repo: repo}
+		for _, username := range []string{"alice.martin", "bob.durand"} {
+			password := map[string]string{"alice.martin": "Lor49914", "bob.durand": "Bob-Password1"}[username]
+			before, err := repo.Find(username, users.IdentifierType_USER_NAME)
+			if err != nil {
+				t.Fatalf("Could not find the user: %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				if resp := s.authenticate(&users.AuthRequest{Username: username, Password: password}); !resp.Succeeded {
+					t.Fatalf("Could not authenticate %s, attempt %d, error: %d", username, i+1, resp.Error)
+				}
+			}
+			if resp := s.authenticate(&users.AuthRequest{Username: username, Password: "incorrect"}); resp.Error != InvalidPassword {
+				t.Errorf("%s is authenticated with an incorrect password, error: %d", username, resp.Error)
+			}
+
+			u, err := repo.Find(username, users.IdentifierType_USER_NAME)
+			if err != nil {
+				t.Fatalf("Could not find the user: %v", err)
+			}
+			if !strings.HasPrefix(u.PasswordHash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+				t.Errorf("The password hash of %s has not been upgraded: %s", username, u.PasswordHash)
+			}
+			// The logins do not change the version, so they do not conflict with the administration of the user.
+			if u.Version != before.Version || len(u.PasswordHistory) != len(before.PasswordHistory) {
+				t.Errorf("The upgrade of the hash of %s has changed its version or its history: %d, %v", username, u.Version, u.PasswordHistory)
+			}
+		}
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := server{repo: repo}
+		if resp := s.authenticate(&users.AuthRequest{Username: "carol.leroy", Password: "Carol-Password1"}); resp.Error != PasswordChangeRequired {
+			t.Fatalf("The password change should be required, error: %d", resp.Error)
+		}
+
+		testCases := []struct {
+			password    string
+			newPassword string
+			code        int32
+		}{
+			{"incorrect", "Tropical-Reef-42", InvalidPassword},
+			{"Carol-Password1", "Short-1", PasswordRejected},
+			// The name of the user.
+			{"Carol-Password1", "Leroy-Password2", PasswordRejected},
+			{"Carol-Password1", "Tropical-Reef-42", 0},
+			{"Tropical-Reef-42", "Lagoon-Sunset-77", 0},
+			// A previous password.
+			{"Lagoon-Sunset-77", "Tropical-Reef-42", PasswordRejected},
+		}
+		for _, tc := range testCases {
+			code, violations := changePassword(repo, "carol.leroy", tc.password, tc.newPassword)
+			if code != tc.code {
+				t.Errorf("Changing %s to %s returns %d instead of %d.", tc.password, tc.newPassword, code, tc.code)
+			}
+			if (code == PasswordRejected) != (len(violations) > 0) {
+				t.Errorf("Changing %s to %s returns the violations %v.", tc.password, tc.newPassword, violations)
+			}
+		}
+
+		if resp := s.authenticate(&users.AuthRequest{Username: "carol.leroy", Password: "Lagoon-Sunset-77"}); !resp.Succeeded {
+			t.Errorf("Could not authenticate with the new password, error: %d", resp.Error)
+		}
+	})
+}
+
+func TestValidatePassword(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := server{repo: repo}
+		testCases := []struct {
+			identifier string
+			password   string
+			error      int32
+			violations []users.PasswordViolationType
+		}{
+			{"", "Tropical-Reef-42", 0, nil},
+			{"", "Alice-Reef-2024", 0, nil},
+			{aliceID, "Alice-Reef-2024", PasswordRejected, []users.PasswordViolationType{users.PasswordViolationType_CONTAINS_NAME}},
+			{aliceID, "Lor49914", PasswordRejected, []users.PasswordViolationType{users.PasswordViolationType_TOO_SHORT, users.PasswordViolationType_REUSED}},
+			{"3e7c1a9b-8d2f-4b6e-a1c5-6d9f3b2e7a04", "Tropical-Reef-42", UserNotFound, nil},
+		}
+		for _, tc := range testCases {
+			resp := s.validatePassword(&users.ValidatePasswordRequest{Identifier: tc.identifier, Password: tc.password})
+			if resp.Error != tc.error || resp.Succeeded != (tc.error == 0) || len(resp.Violations) != len(tc.violations) {
+				t.Errorf("%s:%s: the response is %v.", tc.identifier, tc.password, resp)
+				continue
+			}
+			for i, v := range resp.Violations {
+				if v.Type != tc.violations[i] {
+					t.Errorf("%s:%s: the violations are %v instead of %v.", tc.identifier, tc.password, resp.Violations, tc.violations)
+					break
+				}
+			}
+		}
+	})
+}
+
+func TestLockout(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := server{repo: repo}
+		authenticate := func(password string) int32 {
+			return s.authenticate(&users.AuthRequest{Username: "alice.martin", Password: password}).Error
+		}
+
+		// A successful login resets the failed logins.
+		for i := 1; i < lockoutThreshold(); i++ {
+			if code := authenticate("incorrect"); code != InvalidPassword {
+				t.Fatalf("The failed login %d returns %d.", i, code)
+			}
+		}
+		if code := authenticate("Lor49914"); code != 0 {
+			t.Fatalf("Could not authenticate before the threshold, error: %d", code)
+		}
+
+		stale, err := repo.Find(aliceID, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		for i := 1; i <= lockoutThreshold(); i++ {
+			if code := authenticate("incorrect"); code != InvalidPassword {
+				t.Fatalf("The failed login %d returns %d.", i, code)
+			}
+		}
+		if code := authenticate("Lor49914"); code != AccountLocked {
+			t.Fatalf("The user should be locked after %d failed logins, error: %d", lockoutThreshold(), code)
+		}
+		status := s.getAccountStatus(&users.AccountStatusRequest{Identifier: aliceID, IdentifierType: users.IdentifierType_SUBJECT})
+		if !status.Locked || status.LockedAt == nil {
+			t.Errorf("The status of the user is not locked: %v", status)
+		}
+
+		u, err := repo.Find(aliceID, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		if u.FailedLogins != lockoutThreshold() {
+			t.Errorf("%d failed logins are counted instead of %d.", u.FailedLogins, lockoutThreshold())
+		}
+
+		// The changes of the account do not unlock it, even from a copy read before the lock.
+		stale.Claims["name"] = "Alice Martin-Leroy"
+		if err := repo.Update(stale, stale.Version); err != nil {
+			t.Fatalf("Could not change the user: %v", err)
+		}
+		if stale.LockedAt == nil || stale.FailedLogins != lockoutThreshold() {
+			t.Errorf("The changed user is not locked: %+v", stale)
+		}
+		if code := authenticate("Lor49914"); code != AccountLocked {
+			t.Errorf("The user should still be locked after a change, error: %d", code)
+		}
+
+		// The lock expires after the lockout duration.
+		defer viper.Set(viperKeyLockoutDuration, lockoutDuration())
+		viper.Set(viperKeyLockoutDuration, time.Nanosecond)
+		if code := authenticate("incorrect"); code != InvalidPassword {
+			t.Errorf("The failed login after the lock returns %d.", code)
+		}
+		if code := authenticate("Lor49914"); code != 0 {
+			t.Errorf("Could not authenticate after the lock, error: %d", code)
+		}
+		if u, err = repo.Find(aliceID, users.IdentifierType_SUBJECT); err != nil || u.FailedLogins != 0 || u.LockedAt != nil {
+			t.Errorf("The failed logins are not reset: %+v, %v", u, err)
+		}
+	})
+}
+
+func TestAccountExpiration(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := server{repo: repo}
+		u, err := repo.Find(aliceID, users.IdentifierType_SUBJECT)
+		if err != nil {
+			t.Fatalf("Could not find the user: %v", err)
+		}
+		expiresAt := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+		u.ExpiresAt = &expiresAt
+		if err := repo.Update(u, u.Version); err != nil {
+			t.Fatalf("Could not set the expiration: %v", err)
+		}
+
+		if resp := s.authenticate(&users.AuthRequest{Username: "alice.martin", Password: "incorrect"}); resp.Error != InvalidPassword {
+			t.Errorf("The expiration should only be disclosed with the password, error: %d", resp.Error)
+		}
+		if resp := s.authenticate(&users.AuthRequest{Username: "alice.martin", Password: "Lor49914"}); resp.Error != AccountExpired {
+			t.Errorf("An expired user should not be authenticated, error: %d", resp.Error)
+		}
+		status := s.getAccountStatus(&users.AccountStatusRequest{Identifier: aliceID, IdentifierType: users.IdentifierType_SUBJECT})
+		if !status.Expired || !status.ExpiresAt.AsTime().Equal(expiresAt) {
+			t.Errorf("The status of the user is not expired: %v", status)
+		}
+	})
+}
+
+func TestMigrationsAreAppliedOnce(t *testing.T) {
+	dsn := sqliteDSN(filepath.Join(t.TempDir(), "users.db"))
+	for i := 0; i < 2; i++ {
+		repo, err := newSQLRepository(sqliteDialect, dsn)
+		if err != nil {
+			t.Fatalf("Could not open the repository, attempt %d: %v", i+1, err)
+		}
+		var count, version int
+		err = repo.db.QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&count, &version)
+		repo.Close()
+		if err != nil {
+			t.Fatalf("Could not read the migrations: %v", err)
+		}
+		if count != len(migrations) || version != len(migrations) {
+			t.Errorf("%d migrations are applied up to the version %d, instead of %d.", count, version, len(migrations))
+		}
+	}
+}
+
+func TestJSONRepositoryReload(t *testing.T) {
+	repo := testRepositories[usersBackendJSON](t).(*jsonRepository)
+	defer repo.Close()
+
+	// Waits for the watcher to load the file, which may take some time.
+	waitFor := func(condition func() bool) bool {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if condition() {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := ioutil.WriteFile(repo.path, []byte(`[{"id": "broken"`), 0600); err != nil {
+		t.Fatalf("Could not write the users file: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := repo.Find("alice.martin", users.IdentifierType_USER_NAME); err != nil {
+		t.Errorf("The last loaded users should be kept when the file is invalid, error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(repo.path, []byte(`[{"id": "1", "username": "eve.bernard"}]`), 0600); err != nil {
+		t.Fatalf("Could not write the users file: %v", err)
+	}
+	if !waitFor(func() bool {
+		_, err := repo.Find("eve.bernard", users.IdentifierType_USER_NAME)
+		return err == nil
+	}) {
+		t.Fatalf("The users file has not been reloaded.")
+	}
+	if _, err := repo.Find("alice.martin", users.IdentifierType_USER_NAME); !errors.Is(err, errUserNotFound) {
+		t.Errorf("The users should be replaced by the reloaded ones, error: %v", err)
+	}
+}
+
+func TestJSONRepositoryLoad(t *testing.T) {
+	// The repository is opened without its file, whose users are missing until it is created.
+	dir := t.TempDir()
+	repo, err := newJSONRepository(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatalf("Could not open the repository: %v", err)
+	}
+	defer repo.Close()
+	if _, err := repo.Find("eve.bernard", users.IdentifierType_USER_NAME); !errors.Is(err, errUsersMissing) {
+		t.Errorf("The users should be missing, error: %v", err)
+	}
+
+	// The file is written aside and renamed, as the editors do, and the users written before their versioning are at the first version.
+	path := filepath.Join(dir, "users.json.tmp")
+	if err := ioutil.WriteFile(path, []byte(`[{"id": "1", "username": "eve.bernard", "claims": {"email": "Eve.Bernard@csb.nc"}}]`), 0600); err != nil {
+		t.Fatalf("Could not write the users file: %v", err)
+	}
+	if err := os.Rename(path, repo.path); err != nil {
+		t.Fatalf("Could not rename the users file: %v", err)
+	}
+	var u *user
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline) && u == nil; time.Sleep(10 * time.Millisecond) {
+		u, _ = repo.Find("eve.bernard@CSB.NC", users.IdentifierType_EMAIL)
+	}
+	if u == nil || u.ID != "1" || u.Version != 1 {
+		t.Errorf("The users file has not been loaded and indexed: %v", u)
+	}
+}
+
+func TestJSONRepositoryConcurrentReload(t *testing.T) {
+	repo := testRepositories[usersBackendJSON](t).(*jsonRepository)
+	defer repo.Close()
+
+	// The file is reloaded continuously while it is changed, as when the watcher receives the events of the previous saves.
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if err := repo.load(); err != nil {
+					t.Errorf("Could not reload the users: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	const count = 200
+	for i := 0; i < count; i++ {
+		if err := repo.Create(&user{ID: fmt.Sprintf("reload-%d", i), Username: fmt.Sprintf("reload.%d", i)}); err != nil {
+			t.Fatalf("Could not create the user %d: %v", i, err)
+		}
+	}
+	close(done)
+	<-reloaded
+
+	usrs, err := repo.List()
+	if err != nil {
+		t.Fatalf("Could not list the users: %v", err)
+	}
+	if len(usrs) != len(testUsers(t))+count {
+		t.Errorf("The users created while the file was reloaded have been lost: %d users instead of %d.", len(usrs), len(testUsers(t))+count)
+	}
+}
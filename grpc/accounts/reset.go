@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/tools/identifiers"
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyPasswordResetEnabled           = "passwordReset.enabled"
+	viperKeyPasswordResetTokenLifetime     = "passwordReset.tokenLifetime"
+	viperKeyPasswordResetURL               = "passwordReset.url"
+	viperKeyPasswordResetMessageSubject    = "passwordReset.message.subject"
+	viperKeyPasswordResetMessageBody       = "passwordReset.message.body"
+	viperKeyPasswordResetRateLimitRequests = "passwordReset.rateLimit.requests"
+	viperKeyPasswordResetRateLimitWindow   = "passwordReset.rateLimit.window"
+	viperKeyPasswordResetRateLimitGlobal   = "passwordReset.rateLimit.global"
+
+	passwordResetTokenLifetimeDefault     = 30 * time.Minute
+	passwordResetRateLimitRequestsDefault = 3
+	passwordResetRateLimitWindowDefault   = time.Hour
+	passwordResetRateLimitGlobalDefault   = 1000
+	passwordResetMessageSubjectDefault    = "Réinitialisez votre mot de passe"
+	passwordResetMessageBodyDefault       = `Bonjour {{.Username}},
+
+Pour choisir un nouveau mot de passe :
+
+{{if .URL}}{{.URL}}{{else}}{{.Token}}{{end}}
+
+Ce lien est valable jusqu'au {{.ExpiresAt.Format "02/01/2006 à 15:04"}}. Si vous n'avez pas demandé à réinitialiser votre mot de passe, ignorez ce message.
+`
+)
+
+// resetServer implements the AccountsPasswordReset service on the users repository.
+type resetServer struct {
+	users.UnimplementedAccountsPasswordResetServer
+	repo     UserRepository
+	notifier Notifier
+	// Limits the requests of each identifier, and the tokens sent to each user.
+	limiter *rateLimiter
+	// Limits the requests of all the identifiers together.
+	global *rateLimiter
+	// Tracks the tokens being sent in the background, which are waited for when the store stops.
+	sending sync.WaitGroup
+}
+
+func passwordResetEnabled() bool {
+	return viper.GetBool(viperKeyPasswordResetEnabled)
+}
+
+// Creates the password reset service, with the configured rate limits.
+func newResetServer(repo UserRepository, notifier Notifier) *resetServer {
+	requests := passwordResetRateLimitRequestsDefault
+	if viper.IsSet(viperKeyPasswordResetRateLimitRequests) {
+		requests = viper.GetInt(viperKeyPasswordResetRateLimitRequests)
+	}
+	window := passwordResetRateLimitWindowDefault
+	if viper.IsSet(viperKeyPasswordResetRateLimitWindow) {
+		window = viper.GetDuration(viperKeyPasswordResetRateLimitWindow)
+	}
+	global := passwordResetRateLimitGlobalDefault
+	if viper.IsSet(viperKeyPasswordResetRateLimitGlobal) {
+		global = viper.GetInt(viperKeyPasswordResetRateLimitGlobal)
+	}
+	return &resetServer{repo: repo, notifier: notifier, limiter: newRateLimiter(requests, window), global: newRateLimiter(global, window)}
+}
+
+// Waits for the tokens being sent in the background when the store stops, at most for the timeout.
+// Returns false when some tokens are still being sent.
+func (s *resetServer) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func passwordResetTokenLifetime() time.Duration {
+	if viper.IsSet(viperKeyPasswordResetTokenLifetime) {
+		return viper.GetDuration(viperKeyPasswordResetTokenLifetime)
+	}
+	return passwordResetTokenLifetimeDefault
+}
+
+func (s *resetServer) RequestPasswordReset(ctx context.Context, req *users.RequestPasswordResetRequest) (*users.PasswordResetResponse, error) {
+	return s.respond(ctx, s.requestPasswordReset(req))
+}
+
+func (s *resetServer) ResetPassword(ctx context.Context, req *users.ResetPasswordRequest) (*users.PasswordResetResponse, error) {
+	return s.respond(ctx, s.resetPassword(req))
+}
+
+func (s *resetServer) respond(ctx context.Context, resp *users.PasswordResetResponse) (*users.PasswordResetResponse, error) {
+	resp.Code = errorCode(resp.Error)
+	resp.Succeeded = resp.Error == 0
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Sends a password reset token to the user of the identifier, if any.
+// The response only depends on the identifier, and not on the user, so it does not tell whether a user matches the identifier.
+func (s *resetServer) requestPasswordReset(req *users.RequestPasswordResetRequest) *users.PasswordResetResponse {
+	resp := &users.PasswordResetResponse{}
+
+	if err := identifiers.Validate(req.Identifier, req.IdentifierType); err != nil {
+		zap.L().Warn("Invalid identifier.", zap.Error(err))
+		resp.Error = InvalidIdentifier
+		return resp
+	}
+	// The requests are limited by identifier, whether a user matches it or not, and all together.
+	now := time.Now()
+	if !s.limiter.allow(fmt.Sprintf("%d:%s", req.IdentifierType, strings.ToLower(req.Identifier)), now) {
+		zap.L().Sugar().Warnf("Too many password resets have been requested for the identifier: %d:%s", req.IdentifierType, req.Identifier)
+		resp.Error = RateLimited
+		return resp
+	}
+	if !s.global.allow("", now) {
+		zap.L().Warn("Too many password resets have been requested.")
+		resp.Error = RateLimited
+		return resp
+	}
+
+	// The token is issued in the background, so the response time does not tell whether a user matches the identifier either.
+	s.sending.Add(1)
+	go func() {
+		defer s.sending.Done()
+		s.issueReset(req.Identifier, req.IdentifierType)
+	}()
+
+	return resp
+}
+
+// Issues a password reset token to the user of the identifier, and sends it to its email address.
+// A new token replaces the previous one, so a single token of each user can be used.
+func (s *resetServer) issueReset(identifier string, identifierType users.IdentifierType) {
+	u, err := s.repo.Find(identifier, identifierType)
+	if errors.Is(err, errUserNotFound) {
+		zap.L().Sugar().Infof("No user matches the password reset identifier: %d:%s", identifierType, identifier)
+		return
+	} else if err != nil {
+		zap.L().Error("Could not find the user of the password reset.", zap.Error(err))
+		return
+	}
+	email := u.Claims[emailClaim()]
+	if email == "" {
+		zap.L().Sugar().Warnf("The password of the user %s cannot be reset, the user has no email address.", u.Username)
+		return
+	}
+	// The tokens are also limited by user, as each of its identifiers has its own limit.
+	// The response has already been sent, so the user is not told.
+	if !s.limiter.allow("user:"+u.ID, time.Now()) {
+		zap.L().Sugar().Warnf("Too many password reset tokens have been sent to the user %s.", u.Username)
+		return
+	}
+
+	token, stored, err := randomToken(tokenPurposeResetPassword, u.ID, time.Now().Add(passwordResetTokenLifetime()))
+	if err == nil {
+		err = s.repo.AddToken(stored)
+	}
+	if err != nil {
+		zap.L().Error("Could not issue the password reset token.", zap.Error(err), zap.String("id", u.ID))
+		return
+	}
+
+	msg := tokenMessage{
+		Username:  u.Username,
+		Token:     token,
+		URL:       strings.ReplaceAll(viper.GetString(viperKeyPasswordResetURL), tokenURLPlaceholder, url.QueryEscape(token)),
+		ExpiresAt: stored.ExpiresAt,
+	}
+	subject, err := renderMessage(viperKeyPasswordResetMessageSubject, passwordResetMessageSubjectDefault, msg)
+	if err == nil {
+		var body string
+		if body, err = renderMessage(viperKeyPasswordResetMessageBody, passwordResetMessageBodyDefault, msg); err == nil {
+			err = s.notifier.Notify(email, subject, body)
+		}
+	}
+	if err != nil {
+		zap.L().Error("Could not send the password reset token.", zap.Error(err), zap.String("id", u.ID))
+		return
+	}
+	zap.L().Sugar().Infof("A password reset token has been sent to the user %s.", u.Username)
+}
+
+// Replaces the password of the user of a password reset token, which is consumed once the new password is accepted.
+func (s *resetServer) resetPassword(req *users.ResetPasswordRequest) *users.PasswordResetResponse {
+	resp := &users.PasswordResetResponse{}
+
+	if req.Token == "" || req.NewPassword == "" {
+		resp.Error = InvalidRequest
+		return resp
+	}
+
+	hash := hashToken(req.Token)
+	t, err := s.repo.FindToken(tokenPurposeResetPassword, hash)
+	if errors.Is(err, errInvalidToken) || (err == nil && !t.valid(time.Now())) {
+		resp.Error = InvalidToken
+		return resp
+	} else if err != nil {
+		resp.Error = changeError(err)
+		return resp
+	}
+	u, err := s.repo.Find(t.UserID, users.IdentifierType_SUBJECT)
+	if err != nil {
+		resp.Error = findUserError(err)
+		return resp
+	}
+
+	// The token is kept when the password is rejected, so the user can choose another one.
+	if resp.Violations = checkNewPassword(u, req.NewPassword); len(resp.Violations) > 0 {
+		zap.L().Sugar().Infof("The new password of the user %s has been rejected by the password policy.", u.Username)
+		resp.Error = PasswordRejected
+		return resp
+	}
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		zap.L().Error("Could not hash the password.", zap.Error(err))
+		resp.Error = UsersNotSaved
+		return resp
+	}
+
+	// The token is consumed with the change of the password, so concurrent resets with the same token cannot both succeed,
+	// and the token is kept when the password has been changed meanwhile, such as by the upgrade of its hash at a login.
+	switch err := s.repo.ResetPassword(tokenPurposeResetPassword, hash, u.ID, u.PasswordHash, newHash, passwordHistory(u)); {
+	case errors.Is(err, errInvalidToken):
+		resp.Error = InvalidToken
+		return resp
+	case errors.Is(err, errPasswordChanged):
+		// The password has been changed since the user has been found.
+		resp.Error = VersionConflict
+		return resp
+	case err != nil:
+		resp.Error = changeError(err)
+		return resp
+	}
+	// The guesses of the previous password are no longer relevant, the lock is lifted.
+	if u.FailedLogins > 0 || u.LockedAt != nil {
+		resetFailedLogins(s.repo, u)
+	}
+	zap.L().Sugar().Infof("The password of the user %s has been reset.", u.Username)
+
+	return resp
+}
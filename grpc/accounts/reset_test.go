@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"csb.nc/auth/stores/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, time.Minute)
+	now := time.Now()
+	testCases := []struct {
+		key     string
+		elapsed time.Duration
+		allowed bool
+	}{
+		{"alice", 0, true},
+		{"alice", time.Second, true},
+		{"alice", 2 * time.Second, false},
+		{"bob", 2 * time.Second, true},
+		// The first event leaves the window.
+		{"alice", time.Minute, true},
+		{"alice", time.Minute + time.Second/2, false},
+		{"alice", 2*time.Minute + 2*time.Second, true},
+	}
+	for _, tc := range testCases {
+		if allowed := l.allow(tc.key, now.Add(tc.elapsed)); allowed != tc.allowed {
+			t.Errorf("%s after %s: allowed is %t instead of %t.", tc.key, tc.elapsed, allowed, tc.allowed)
+		}
+	}
+	if _, ok := l.events["bob"]; ok {
+		t.Errorf("The events of bob should have been removed.")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		notifier := &testNotifier{}
+		s := newResetServer(repo, notifier)
+		ctx := context.Background()
+		request := func(identifier string, identifierType users.IdentifierType) {
+			t.Helper()
+			resp, err := s.RequestPasswordReset(ctx, &users.RequestPasswordResetRequest{Identifier: identifier, IdentifierType: identifierType})
+			if err != nil || !resp.Succeeded {
+				t.Fatalf("%s: the response is %v, %v", identifier, resp, err)
+			}
+			s.sending.Wait()
+		}
+		reset := func(token string, password string) *users.PasswordResetResponse {
+			t.Helper()
+			resp, err := s.ResetPassword(ctx, &users.ResetPasswordRequest{Token: token, NewPassword: password})
+			if err != nil {
+				t.Fatalf("Could not reset the password: %v", err)
+			}
+			return resp
+		}
+
+		// The unknown identifiers have the same response, without message.
+		request("nobody@csb.nc", users.IdentifierType_EMAIL)
+		if len(notifier.messages) != 0 {
+			t.Fatalf("A message has been sent to an unknown user: %v", notifier.messages)
+		}
+
+		// A new token replaces the previous one.
+		request("alice.martin", users.IdentifierType_USER_NAME)
+		first := notifier.token(t, "alice.martin@csb.nc")
+		request("Alice.Martin@csb.nc", users.IdentifierType_EMAIL)
+		token := notifier.token(t, "alice.martin@csb.nc")
+		if resp := reset(first, "Tropical-Reef-42"); resp.Error != InvalidToken {
+			t.Errorf("The replaced token should be rejected: %v", resp)
+		}
+
+		// The token is kept when the password is rejected.
+		if resp := reset(token, "Short-1"); resp.Error != PasswordRejected || len(resp.Violations) == 0 {
+			t.Errorf("The password should be rejected: %v", resp)
+		}
+		if resp := reset(token, "Tropical-Reef-42"); !resp.Succeeded {
+			t.Fatalf("Could not reset the password: %v", resp)
+		}
+		if resp := reset(token, "Lagoon-Sunset-77"); resp.Error != InvalidToken || resp.Code != users.ErrorCode_INVALID_TOKEN {
+			t.Errorf("A token should only be used once: %v", resp)
+		}
+		if resp := (server{repo: repo}).authenticate(&users.AuthRequest{Username: "alice.martin", Password: "Tropical-Reef-42"}); !resp.Succeeded {
+			t.Errorf("Could not authenticate with the new password, error: %d", resp.Error)
+		}
+
+		// The requests of each identifier are limited, whether it matches a user or not.
+		request("nobody@csb.nc", users.IdentifierType_EMAIL)
+		request("nobody@csb.nc", users.IdentifierType_EMAIL)
+		_, err := s.RequestPasswordReset(ctx, &users.RequestPasswordResetRequest{Identifier: "nobody@csb.nc", IdentifierType: users.IdentifierType_EMAIL})
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("The fourth request should be limited, error: %v", err)
+		}
+	})
+}
+
+func TestPasswordResetUnlocksUser(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		notifier := &testNotifier{}
+		s := newResetServer(repo, notifier)
+		authenticate := func(password string) int32 {
+			return (server{repo: repo}).authenticate(&users.AuthRequest{Username: "alice.martin", Password: password}).Error
+		}
+		for i := 0; i < lockoutThreshold(); i++ {
+			authenticate("incorrect")
+		}
+		if code := authenticate("Lor49914"); code != AccountLocked {
+			t.Fatalf("The user should be locked, error: %d", code)
+		}
+
+		s.requestPasswordReset(&users.RequestPasswordResetRequest{Identifier: aliceID, IdentifierType: users.IdentifierType_SUBJECT})
+		s.sending.Wait()
+		if resp := s.resetPassword(&users.ResetPasswordRequest{Token: notifier.token(t, "alice.martin@csb.nc"), NewPassword: "Tropical-Reef-42"}); resp.Error != 0 {
+			t.Fatalf("Could not reset the password: %v", resp)
+		}
+		if code := authenticate("Tropical-Reef-42"); code != 0 {
+			t.Errorf("Could not authenticate after the reset, error: %d", code)
+		}
+	})
+}
+
+func TestPasswordResetLimits(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		notifier := &testNotifier{}
+		s := newResetServer(repo, notifier)
+
+		// The identifiers of the same user share the limit of the user, the requests above it succeed without sending a token.
+		for _, id := range []*users.RequestPasswordResetRequest{
+			{Identifier: "alice.martin", IdentifierType: users.IdentifierType_USER_NAME},
+			{Identifier: "alice.martin@csb.nc", IdentifierType: users.IdentifierType_EMAIL},
+			{Identifier: aliceID, IdentifierType: users.IdentifierType_SUBJECT},
+			{Identifier: "alice.martin@csb.nc", IdentifierType: users.IdentifierType_USER_PRINCIPAL_NAME},
+		} {
+			if resp := s.requestPasswordReset(id); resp.Error != 0 {
+				t.Errorf("%s: the request should succeed, error: %d", id.Identifier, resp.Error)
+			}
+		}
+		if !s.drain(time.Second) {
+			t.Fatalf("The tokens are still being sent.")
+		}
+		if len(notifier.messages) != 3 {
+			t.Errorf("%d tokens have been sent instead of 3.", len(notifier.messages))
+		}
+
+		// The requests of all the identifiers are limited together.
+		s.global = newRateLimiter(1, time.Minute)
+		if resp := s.requestPasswordReset(&users.RequestPasswordResetRequest{Identifier: "bob.durand", IdentifierType: users.IdentifierType_USER_NAME}); resp.Error != 0 {
+			t.Errorf("The first request should succeed, error: %d", resp.Error)
+		}
+		if resp := s.requestPasswordReset(&users.RequestPasswordResetRequest{Identifier: "carol.leroy", IdentifierType: users.IdentifierType_USER_NAME}); resp.Error != RateLimited {
+			t.Errorf("The second request should be limited, error: %d", resp.Error)
+		}
+		s.drain(time.Second)
+	})
+}
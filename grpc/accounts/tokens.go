@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// Purpose of the tokens verifying the email address of the users.
+	tokenPurposeVerifyEmail = "verify_email"
+	// Purpose of the tokens resetting the password of the users.
+	tokenPurposeResetPassword = "reset_password"
+
+	tokenNonceLength  = 16
+	tokenRandomLength = 32
+)
+
+var errInvalidToken = errors.New("The token is invalid, expired or already used")
+
+// userToken is a single-use token issued to a user, stored by its hash so the stored tokens cannot be used.
+type userToken struct {
+	// The user is not stored in the tokens of the JSON repository, which are stored in their user.
+	UserID    string    `json:"-"`
+	Purpose   string    `json:"purpose"`
+	Hash      string    `json:"hash"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Returns the hash of a token, which is stored instead of the token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checks if a stored token can still be used at now.
+func (t *userToken) valid(now time.Time) bool {
+	return now.Before(t.ExpiresAt)
+}
+
+// Issues a random token for the purpose and the subject, and returns it with its stored form.
+// The token is only valid while its hash is stored.
+func randomToken(purpose string, subject string, expiresAt time.Time) (string, *userToken, error) {
+	b := make([]byte, tokenRandomLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, &userToken{UserID: subject, Purpose: purpose, Hash: hashToken(token), ExpiresAt: expiresAt}, nil
+}
+
+// Returns the hash of an email address, compared without case, which binds the signed tokens to the address they are sent to.
+func hashAddress(address string) string {
+	return hashToken(strings.ToLower(strings.TrimSpace(address)))
+}
+
+// Payload of the signed tokens.
+type signedTokenClaims struct {
+	Purpose string `json:"pur"`
+	Subject string `json:"sub"`
+	// The hash of the address the token is sent to.
+	Address string `json:"adr,omitempty"`
+	Expires int64  `json:"exp"`
+	// Makes each token unique, so the tokens of the same subject and expiration differ.
+	Nonce string `json:"nonce"`
+}
+
+// Issues a token signed with the key, for the purpose, the subject and the hash of its address, and returns it with its stored form.
+// The signature rejects the forged tokens without reading the repository, and the stored token makes it single-use.
+func signToken(key []byte, purpose string, subject string, address string, expiresAt time.Time) (string, *userToken, error) {
+	nonce := make([]byte, tokenNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	payload, err := json.Marshal(signedTokenClaims{
+		Purpose: purpose,
+		Subject: subject,
+		Address: address,
+		Expires: expiresAt.Unix(),
+		Nonce:   base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	token := encoded + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(key, encoded))
+	return token, &userToken{UserID: subject, Purpose: purpose, Hash: hashToken(token), ExpiresAt: expiresAt}, nil
+}
+
+func tokenSignature(key []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// Checks the signature, the purpose and the expiration of a signed token, and returns its payload.
+func parseSignedToken(key []byte, purpose string, token string, now time.Time) (*signedTokenClaims, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(signature, tokenSignature(key, token[:i])) {
+		return nil, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims signedTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if claims.Purpose != purpose || claims.Subject == "" || !now.Before(time.Unix(claims.Expires, 0)) {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
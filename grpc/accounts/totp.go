@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/tools/identifiers"
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyTOTPEnabled       = "totp.enabled"
+	viperKeyTOTPIssuer        = "totp.issuer"
+	viperKeyTOTPSkew          = "totp.skew"
+	viperKeyTOTPRecoveryCodes = "totp.recoveryCodes"
+
+	totpIssuerDefault        = "CSB"
+	totpSkewDefault          = 1
+	totpRecoveryCodesDefault = 10
+
+	// The parameters of the codes, the default ones of RFC 6238, which all the authenticator applications support.
+	totpPeriod       = 30
+	totpDigits       = 6
+	totpSecretLength = 20
+	// The recovery codes have 80 random bits, written as 16 base32 characters in groups of 4.
+	recoveryCodeLength = 10
+	recoveryCodeGroup  = 4
+)
+
+var (
+	errInvalidOTP = errors.New("The one-time code is invalid or already used")
+
+	// The secrets and the recovery codes are written without padding, as the authenticator applications expect.
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// userTOTP is the TOTP second factor of a user. It is only checked at the logins once it is confirmed.
+type userTOTP struct {
+	// The base32 secret shared with the authenticator of the user.
+	Secret    string `json:"secret"`
+	Confirmed bool   `json:"confirmed,omitempty"`
+	// The time step of the last code accepted, the codes of this step and of the previous ones cannot be used again.
+	LastStep int64 `json:"last_step,omitempty"`
+	// The hashes of the recovery codes not used yet.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// totpServer implements the AccountsTOTP service on the users repository.
+type totpServer struct {
+	users.UnimplementedAccountsTOTPServer
+	repo UserRepository
+}
+
+func totpEnabled() bool {
+	return viper.GetBool(viperKeyTOTPEnabled)
+}
+
+// Returns the number of time steps accepted before and after the current one, to allow the clock drift of the authenticators.
+func totpSkew() int {
+	if viper.IsSet(viperKeyTOTPSkew) {
+		return viper.GetInt(viperKeyTOTPSkew)
+	}
+	return totpSkewDefault
+}
+
+// Checks if the second factor of a user is confirmed, and so required at its logins.
+func hasTOTP(u *user) bool {
+	return u.TOTP != nil && u.TOTP.Confirmed
+}
+
+// Generates a random TOTP secret.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// Returns the otpauth URI of a secret, read by the authenticator applications from a QR code.
+func totpURI(username string, secret string) string {
+	issuer := totpIssuerDefault
+	if viper.IsSet(viperKeyTOTPIssuer) {
+		issuer = viper.GetString(viperKeyTOTPIssuer)
+	}
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer) + ":" + url.PathEscape(username) + "?" + q.Encode()
+}
+
+// Computes the code of a time step, as defined by RFC 4226 and RFC 6238.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// Returns the time step of a code within the skew of now, ignoring the steps already used.
+func matchTOTP(t *userTOTP, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(t.Secret))
+	if err != nil {
+		zap.L().Error("The TOTP secret is invalid.", zap.Error(err))
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	current := now.Unix() / totpPeriod
+	skew := int64(totpSkew())
+	for step := current - skew; step <= current+skew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(totpCode(key, step))) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Generates the configured number of recovery codes, and returns them with their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	n := totpRecoveryCodesDefault
+	if viper.IsSet(viperKeyTOTPRecoveryCodes) {
+		n = viper.GetInt(viperKeyTOTPRecoveryCodes)
+	}
+	codes := make([]string, n)
+	hashes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := totpEncoding.EncodeToString(b)
+		groups := make([]string, 0, len(code)/recoveryCodeGroup)
+		for j := 0; j < len(code); j += recoveryCodeGroup {
+			groups = append(groups, code[j:j+recoveryCodeGroup])
+		}
+		codes[i] = strings.Join(groups, "-")
+		hashes[i] = hashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+// Returns a code as typed by a user without its separators, or an empty string when it is not a recovery code.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != totpEncoding.EncodedLen(recoveryCodeLength) {
+		return ""
+	}
+	return code
+}
+
+// Checks a one-time code of the confirmed second factor of a user: a TOTP code, or a recovery code when recovery is set.
+// Each code is only accepted once. usedRecovery tells if a recovery code has been used.
+func checkOTP(repo UserRepository, u *user, otp string, recovery bool) (code int32, usedRecovery bool) {
+	if !hasTOTP(u) {
+		return OTPNotEnabled, false
+	}
+
+	if recovery {
+		if normalized := normalizeRecoveryCode(otp); normalized != "" {
+			switch err := repo.UseRecoveryCode(u.ID, hashToken(normalized)); {
+			case errors.Is(err, errInvalidOTP):
+				return InvalidOTP, false
+			case err != nil:
+				return changeError(err), false
+			}
+			zap.L().Sugar().Infof("The user %s has used a recovery code, %d left.", u.Username, len(u.TOTP.RecoveryCodes)-1)
+			return 0, true
+		}
+	}
+
+	step, ok := matchTOTP(u.TOTP, otp, time.Now())
+	if !ok {
+		return InvalidOTP, false
+	}
+	// The step is only recorded if it is still after the last one, so a code used concurrently is only accepted once.
+	switch err := repo.UseTOTPStep(u.ID, step); {
+	case errors.Is(err, errInvalidOTP):
+		return InvalidOTP, false
+	case err != nil:
+		return changeError(err), false
+	}
+	return 0, false
+}
+
+// Checks the second factor of a user like a password: the locked users are refused, and the invalid codes are counted as failed logins.
+func checkSecondFactor(repo UserRepository, u *user, otp string, recovery bool) (int32, bool) {
+	if isLocked(u, time.Now()) {
+		return AccountLocked, false
+	}
+	code, usedRecovery := checkOTP(repo, u, otp, recovery)
+	if code == InvalidOTP {
+		recordFailedLogin(repo, u)
+	}
+	return code, usedRecovery
+}
+
+func (s totpServer) EnrollTOTP(ctx context.Context, req *users.EnrollTOTPRequest) (*users.TOTPResponse, error) {
+	return s.respond(ctx, s.enrollTOTP(req))
+}
+
+func (s totpServer) ConfirmTOTP(ctx context.Context, req *users.TOTPRequest) (*users.TOTPResponse, error) {
+	return s.respond(ctx, s.confirmTOTP(req))
+}
+
+func (s totpServer) VerifyTOTP(ctx context.Context, req *users.TOTPRequest) (*users.TOTPResponse, error) {
+	return s.respond(ctx, s.verifyTOTP(req))
+}
+
+func (s totpServer) DisableTOTP(ctx context.Context, req *users.TOTPRequest) (*users.TOTPResponse, error) {
+	return s.respond(ctx, s.disableTOTP(req))
+}
+
+func (s totpServer) RegenerateRecoveryCodes(ctx context.Context, req *users.TOTPRequest) (*users.TOTPResponse, error) {
+	return s.respond(ctx, s.regenerateRecoveryCodes(req))
+}
+
+func (s totpServer) respond(ctx context.Context, resp *users.TOTPResponse) (*users.TOTPResponse, error) {
+	resp.Code = errorCode(resp.Error)
+	resp.Succeeded = resp.Error == 0
+	if err := grpcerr.Check(ctx, resp.Code, storeName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Finds the user of a subject, or returns the error code of the lookup.
+func (s totpServer) find(subject string) (*user, int32) {
+	if err := identifiers.Validate(subject, users.IdentifierType_SUBJECT); err != nil {
+		return nil, InvalidRequest
+	}
+	u, err := s.repo.Find(subject, users.IdentifierType_SUBJECT)
+	if err != nil {
+		return nil, findUserError(err)
+	}
+	return u, 0
+}
+
+// Finds the user of a subject and checks its current password, or returns the error code of the check.
+// The failures count as failed logins, so the password cannot be guessed through these requests either.
+func (s totpServer) authenticate(subject string, password string) (*user, int32) {
+	u, code := s.find(subject)
+	if code != 0 {
+		return nil, code
+	}
+	if isLocked(u, time.Now()) {
+		return nil, AccountLocked
+	}
+	if !checkPassword(u, password) {
+		recordFailedLogin(s.repo, u)
+		return nil, InvalidPassword
+	}
+	if u.Disabled {
+		return nil, AccountDisabled
+	}
+	return u, 0
+}
+
+// Generates a new secret for a user whose second factor is not confirmed yet. The second factor is only required once it is confirmed.
+func (s totpServer) enrollTOTP(req *users.EnrollTOTPRequest) *users.TOTPResponse {
+	resp := &users.TOTPResponse{}
+
+	u, code := s.authenticate(req.Subject, req.Password)
+	if code != 0 {
+		resp.Error = code
+		return resp
+	}
+	if hasTOTP(u) {
+		resp.Error = OTPAlreadyEnabled
+		return resp
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		zap.L().Error("Could not generate the TOTP secret.", zap.Error(err))
+		resp.Error = UsersNotSaved
+		return resp
+	}
+	if err := s.repo.SetTOTP(u.ID, &userTOTP{Secret: secret}); err != nil {
+		resp.Error = changeError(err)
+		return resp
+	}
+	zap.L().Sugar().Infof("The user %s is enrolling a TOTP second factor.", u.Username)
+	resp.Secret = secret
+	resp.Uri = totpURI(u.Username, secret)
+
+	return resp
+}
+
+// Enables the second factor of a user with a first code of its authenticator, and returns its recovery codes.
+func (s totpServer) confirmTOTP(req *users.TOTPRequest) *users.TOTPResponse {
+	resp := &users.TOTPResponse{}
+
+	u, code := s.authenticate(req.Subject, req.Password)
+	if code != 0 {
+		resp.Error = code
+		return resp
+	}
+	switch {
+	case u.TOTP == nil:
+		resp.Error = OTPNotEnabled
+		return resp
+	case u.TOTP.Confirmed:
+		resp.Error = OTPAlreadyEnabled
+		return resp
+	}
+	step, ok := matchTOTP(u.TOTP, req.Otp, time.Now())
+	if !ok {
+		resp.Error = InvalidOTP
+		return resp
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		zap.L().Error("Could not generate the recovery codes.", zap.Error(err))
+		resp.Error = UsersNotSaved
+		return resp
+	}
+	if err := s.repo.SetTOTP(u.ID, &userTOTP{Secret: u.TOTP.Secret, Confirmed: true, LastStep: step, RecoveryCodes: hashes}); err != nil {
+		resp.Error = changeError(err)
+		return resp
+	}
+	zap.L().Sugar().Infof("The TOTP second factor of the user %s has been enabled.", u.Username)
+	resp.RecoveryCodes = codes
+	resp.RecoveryCodesLeft = int32(len(codes))
+
+	return resp
+}
+
+// Checks a TOTP code or a recovery code of a user.
+func (s totpServer) verifyTOTP(req *users.TOTPRequest) *users.TOTPResponse {
+	resp := &users.TOTPResponse{}
+
+	u, code := s.find(req.Subject)
+	if code != 0 {
+		resp.Error = code
+		return resp
+	}
+	code, usedRecovery := checkSecondFactor(s.repo, u, req.Otp, true)
+	if code != 0 {
+		resp.Error = code
+		return resp
+	}
+	if u.FailedLogins > 0 {
+		resetFailedLogins(s.repo, u)
+	}
+	resp.RecoveryCodesLeft = int32(len(u.TOTP.RecoveryCodes))
+	if usedRecovery {
+		resp.RecoveryCodesLeft--
+	}
+
+	return resp
+}
+
+// Removes the second factor of a user, after checking one of its codes when it is confirmed.
+func (s totpServer) disableTOTP(req *users.TOTPRequest) *users.TOTPResponse {
+	resp := &users.TOTPResponse{}
+
+	u, code := s.authenticate(req.Subject, req.Password)
+	if code != 0 {
+		resp.Error = code
+		return resp
+	}
+	if u.TOTP == nil {
+		resp.Error = OTPNotEnabled
+		return resp
+	}
+	// An enrollment not confirmed yet is cancelled without code.
+	if hasTOTP(u) {
+		if code, _ := checkSecondFactor(s.repo, u, req.Otp, true); code != 0 {
+			resp.Error = code
+			return resp
+		}
+	}
+
+	if err := s.repo.SetTOTP(u.ID, nil); err != nil {
+		resp.Error = changeError(err)
+		return resp
+	}
+	zap.L().Sugar().Infof("The TOTP second factor of the user %s has been disabled.", u.Username)
+
+	return resp
+}
+
+// Replaces the recovery codes of a user, after checking a TOTP code.
+func (s totpServer) regenerateRecoveryCodes(req *users.TOTPRequest) *users.TOTPResponse {
+	resp := &users.TOTPResponse{}
+
+	u, code := s.authenticate(req.Subject, req.Password)
+	if code != 0 {
+		resp.Error = code
+		return resp
+	}
+	if code, _ := checkSecondFactor(s.repo, u, req.Otp, false); code != 0 {
+		resp.Error = code
+		return resp
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		zap.L().Error("Could not generate the recovery codes.", zap.Error(err))
+		resp.Error = UsersNotSaved
+		return resp
+	}
+	if err := s.repo.SetRecoveryCodes(u.ID, hashes); err != nil {
+		resp.Error = changeError(err)
+		return resp
+	}
+	zap.L().Sugar().Infof("The recovery codes of the user %s have been replaced.", u.Username)
+	resp.RecoveryCodes = codes
+	resp.RecoveryCodesLeft = int32(len(codes))
+
+	return resp
+}
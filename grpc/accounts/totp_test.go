@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"csb.nc/auth/stores/users"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, truncated to 6 digits.
+	key := []byte("12345678901234567890")
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range testCases {
+		if code := totpCode(key, tc.unix/totpPeriod); code != tc.code {
+			t.Errorf("%d: the code is %s instead of %s.", tc.unix, code, tc.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	testCases := []struct {
+		step     int64
+		lastStep int64
+		matched  bool
+	}{
+		{current, 0, true},
+		{current - 1, 0, true},
+		{current + 1, 0, true},
+		{current - 2, 0, false},
+		{current + 2, 0, false},
+		// The steps already used are rejected.
+		{current, current, false},
+		{current + 1, current, true},
+	}
+	for _, tc := range testCases {
+		totp := &userTOTP{Secret: totpEncoding.EncodeToString(key), LastStep: tc.lastStep}
+		step, matched := matchTOTP(totp, totpCode(key, tc.step), now)
+		if matched != tc.matched || (matched && step != tc.step) {
+			t.Errorf("Step %d after %d: matched is %t at %d.", tc.step-current, tc.lastStep-current, matched, step-current)
+		}
+	}
+}
+
+// testAuthenticator computes the codes of a secret from the step at which the test starts.
+// Only this step and the next one are used, as both stay in the window when the step changes during the test.
+type testAuthenticator struct {
+	key   []byte
+	first int64
+}
+
+// The passwords of the test users, which authenticate the changes of their second factor.
+var testPasswords = map[string]string{aliceID: "Lor49914", bobID: "Bob-Password1", carolID: "Carol-Password1"}
+
+// Enrolls and confirms the second factor of a user, with the code of the first step, and returns its authenticator and its recovery codes.
+func enrollTestTOTP(t *testing.T, s totpServer, subject string) (testAuthenticator, []string) {
+	t.Helper()
+	ctx := context.Background()
+	enrolled, err := s.EnrollTOTP(ctx, &users.EnrollTOTPRequest{Subject: subject, Password: testPasswords[subject]})
+	if err != nil || !enrolled.Succeeded {
+		t.Fatalf("Could not enroll the user: %v, %v", enrolled, err)
+	}
+	key, err := totpEncoding.DecodeString(enrolled.Secret)
+	if err != nil {
+		t.Fatalf("Could not decode the secret: %v", err)
+	}
+	a := testAuthenticator{key: key, first: time.Now().Unix() / totpPeriod}
+	confirmed, err := s.ConfirmTOTP(ctx, &users.TOTPRequest{Subject: subject, Otp: a.code(0), Password: testPasswords[subject]})
+	if err != nil || !confirmed.Succeeded {
+		t.Fatalf("Could not confirm the second factor: %v, %v", confirmed, err)
+	}
+	return a, confirmed.RecoveryCodes
+}
+
+func (a testAuthenticator) code(step int64) string {
+	return totpCode(a.key, a.first+step)
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := totpServer{repo: repo}
+		ctx := context.Background()
+		authenticate := func(otp string) int32 {
+			return (server{repo: repo}).authenticate(&users.AuthRequest{Username: "alice.martin", Password: "Lor49914", Otp: otp}).Error
+		}
+		call := func(rpc func(context.Context, *users.TOTPRequest) (*users.TOTPResponse, error), otp string) *users.TOTPResponse {
+			t.Helper()
+			resp, err := rpc(ctx, &users.TOTPRequest{Subject: aliceID, Otp: otp, Password: "Lor49914"})
+			if err != nil {
+				t.Fatalf("The call has failed: %v", err)
+			}
+			return resp
+		}
+
+		// The second factor is not required until it is confirmed.
+		enrolled, err := s.EnrollTOTP(ctx, &users.EnrollTOTPRequest{Subject: aliceID, Password: "Lor49914"})
+		if err != nil || !enrolled.Succeeded || len(enrolled.Secret) != 32 {
+			t.Fatalf("Could not enroll the user: %v, %v", enrolled, err)
+		}
+		if !strings.HasPrefix(enrolled.Uri, "otpauth://totp/CSB:alice.martin?") || !strings.Contains(enrolled.Uri, "secret="+enrolled.Secret) {
+			t.Errorf("Unexpected URI: %s", enrolled.Uri)
+		}
+		if code := authenticate(""); code != 0 {
+			t.Errorf("The second factor is required before its confirmation, error: %d", code)
+		}
+		if resp := call(s.ConfirmTOTP, "000000"); resp.Error != InvalidOTP {
+			t.Errorf("An invalid code should not confirm the second factor: %v", resp)
+		}
+
+		a, recoveryCodes := enrollTestTOTP(t, s, aliceID)
+		if len(recoveryCodes) != totpRecoveryCodesDefault || len(recoveryCodes[0]) != 19 {
+			t.Errorf("Unexpected recovery codes: %v", recoveryCodes)
+		}
+		if resp, _ := s.EnrollTOTP(ctx, &users.EnrollTOTPRequest{Subject: aliceID, Password: "Lor49914"}); resp.Error != OTPAlreadyEnabled {
+			t.Errorf("A confirmed second factor should not be replaced: %v", resp)
+		}
+
+		// The logins require an unused code.
+		if code := authenticate(""); code != SecondFactorRequired {
+			t.Errorf("The second factor is not required, error: %d", code)
+		}
+		if code := authenticate(a.code(0)); code != InvalidOTP {
+			t.Errorf("The code of the confirmation has been used again, error: %d", code)
+		}
+		if code := authenticate(a.code(1)); code != 0 {
+			t.Errorf("Could not authenticate with the code, error: %d", code)
+		}
+
+		// The recovery codes are accepted once, without their separators and case.
+		recoveryCode := strings.ToLower(strings.ReplaceAll(recoveryCodes[0], "-", ""))
+		if resp := call(s.VerifyTOTP, recoveryCode); !resp.Succeeded || resp.RecoveryCodesLeft != totpRecoveryCodesDefault-1 {
+			t.Errorf("Could not verify the recovery code: %v", resp)
+		}
+		if resp := call(s.VerifyTOTP, recoveryCodes[0]); resp.Error != InvalidOTP {
+			t.Errorf("A recovery code should only be used once: %v", resp)
+		}
+		u, err := repo.Find(aliceID, users.IdentifierType_SUBJECT)
+		if err != nil || u.FailedLogins != 1 {
+			t.Errorf("The invalid code should count as a failed login: %v, %v", u, err)
+		}
+
+		if resp := call(s.DisableTOTP, recoveryCodes[1]); !resp.Succeeded {
+			t.Fatalf("Could not disable the second factor: %v", resp)
+		}
+		if code := authenticate(""); code != 0 {
+			t.Errorf("The second factor is still required, error: %d", code)
+		}
+		if resp := call(s.VerifyTOTP, a.code(1)); resp.Error != OTPNotEnabled {
+			t.Errorf("The second factor should be disabled: %v", resp)
+		}
+	})
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := totpServer{repo: repo}
+		ctx := context.Background()
+		a, previous := enrollTestTOTP(t, s, bobID)
+
+		// The recovery codes cannot replace themselves.
+		if resp, _ := s.RegenerateRecoveryCodes(ctx, &users.TOTPRequest{Subject: bobID, Otp: previous[0], Password: "Bob-Password1"}); resp.Error != InvalidOTP {
+			t.Errorf("A recovery code should not regenerate the recovery codes: %v", resp)
+		}
+		resp, err := s.RegenerateRecoveryCodes(ctx, &users.TOTPRequest{Subject: bobID, Otp: a.code(1), Password: "Bob-Password1"})
+		if err != nil || !resp.Succeeded || len(resp.RecoveryCodes) != totpRecoveryCodesDefault {
+			t.Fatalf("Could not regenerate the recovery codes: %v, %v", resp, err)
+		}
+		if resp, _ := s.VerifyTOTP(ctx, &users.TOTPRequest{Subject: bobID, Otp: previous[1]}); resp.Error != InvalidOTP {
+			t.Errorf("The previous recovery codes should be replaced: %v", resp)
+		}
+		if resp, _ := s.VerifyTOTP(ctx, &users.TOTPRequest{Subject: bobID, Otp: resp.RecoveryCodes[0]}); !resp.Succeeded {
+			t.Errorf("Could not verify a new recovery code: %v", resp)
+		}
+	})
+}
+
+func TestTOTPRequiresPassword(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		s := totpServer{repo: repo}
+		ctx := context.Background()
+		a, recoveryCodes := enrollTestTOTP(t, s, bobID)
+
+		// The subject and a code are not enough to change the second factor.
+		for _, password := range []string{"", "incorrect"} {
+			if resp, _ := s.EnrollTOTP(ctx, &users.EnrollTOTPRequest{Subject: aliceID, Password: password}); resp.Error != InvalidPassword {
+				t.Errorf("EnrollTOTP should require the password: %v", resp)
+			}
+			if resp, _ := s.ConfirmTOTP(ctx, &users.TOTPRequest{Subject: aliceID, Otp: "000000", Password: password}); resp.Error != InvalidPassword {
+				t.Errorf("ConfirmTOTP should require the password: %v", resp)
+			}
+			if resp, _ := s.DisableTOTP(ctx, &users.TOTPRequest{Subject: bobID, Otp: recoveryCodes[0], Password: password}); resp.Error != InvalidPassword {
+				t.Errorf("DisableTOTP should require the password: %v", resp)
+			}
+			if resp, _ := s.RegenerateRecoveryCodes(ctx, &users.TOTPRequest{Subject: bobID, Otp: a.code(1), Password: password}); resp.Error != InvalidPassword {
+				t.Errorf("RegenerateRecoveryCodes should require the password: %v", resp)
+			}
+			if u, err := repo.Find(aliceID, users.IdentifierType_SUBJECT); err != nil || u.TOTP != nil || u.FailedLogins != 2 {
+				t.Errorf("The invalid passwords should count as failed logins, without enrolling the user: %+v, %v", u, err)
+			}
+			// The users are not locked by the failures of the previous password.
+			repo.ResetFailedLogins(aliceID)
+			repo.ResetFailedLogins(bobID)
+		}
+
+		// The locked users cannot change their second factor.
+		for i := 0; i < lockoutThreshold(); i++ {
+			s.DisableTOTP(ctx, &users.TOTPRequest{Subject: bobID, Otp: recoveryCodes[0], Password: "incorrect"})
+		}
+		if resp, _ := s.DisableTOTP(ctx, &users.TOTPRequest{Subject: bobID, Otp: recoveryCodes[0], Password: "Bob-Password1"}); resp.Error != AccountLocked {
+			t.Errorf("A locked user should not disable its second factor: %v", resp)
+		}
+	})
+}
+
+func TestTOTPFlow(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo UserRepository) {
+		a, _ := enrollTestTOTP(t, totpServer{repo: repo}, carolID)
+		h := &flowHandler{s: server{repo: repo}}
+		creds := &users.AuthRequest{Username: "carol.leroy", Password: "Carol-Password1"}
+
+		if step := h.Password(creds); step.Challenge != users.ChallengeType_OTP_REQUIRED {
+			t.Fatalf("The OTP_REQUIRED challenge has not been sent: %+v", step)
+		}
+		if step := h.OTP(creds, "000000"); step.Result != nil || step.Error != InvalidOTP {
+			t.Fatalf("The invalid code should be answered again: %+v", step)
+		}
+		// Carol must change its password, which does not require another code.
+		if step := h.OTP(creds, a.code(1)); step.Challenge != users.ChallengeType_NEW_PASSWORD_REQUIRED {
+			t.Fatalf("The NEW_PASSWORD_REQUIRED challenge has not been sent: %+v", step)
+		}
+		if step := h.NewPassword(creds, "Tropical-Reef-42"); step.Result == nil || !step.Result.Succeeded {
+			t.Errorf("Could not authenticate with the new password: %+v", step)
+		}
+	})
+}
@@ -13,5 +13,6 @@ require (
 	github.com/stretchr/testify v1.5.1 // indirect
 	go.uber.org/zap v1.16.0
 	google.golang.org/grpc v1.33.2
-	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d // indirect
+	google.golang.org/protobuf v1.25.0
+	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d
 )
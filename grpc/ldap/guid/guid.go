@@ -3,10 +3,14 @@ package guid
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
+const urnPrefix = "urn:uuid:"
+
 // GUID represents a GUID/UUID. It has the same structure as
 // golang.org/x/sys/windows.GUID so that it can be used with functions expecting
 // that type. It is defined as its own type so that stringification and
@@ -53,6 +57,18 @@ func FromWindowsArray(b [16]byte) GUID {
 	return fromArray(b, binary.LittleEndian)
 }
 
+// FromWindowsBytes constructs a GUID from a Windows encoding slice of bytes,
+// such as the objectGUID attribute of Active Directory. It returns an error if
+// the slice is not 16 bytes long.
+func FromWindowsBytes(b []byte) (GUID, error) {
+	if len(b) != 16 {
+		return GUID{}, fmt.Errorf("invalid GUID length %d, expected 16 bytes", len(b))
+	}
+	var a [16]byte
+	copy(a[:], b)
+	return FromWindowsArray(a), nil
+}
+
 // ToWindowsArray returns an array of 16 bytes representing the GUID in Windows
 // encoding.
 func (g GUID) ToWindowsArray() [16]byte {
@@ -69,44 +85,91 @@ func (g GUID) String() string {
 		g.Data4[2:])
 }
 
-// FromString parses a string containing a GUID and returns the GUID. The only
-// format currently supported is the `xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx`
-// format.
+// FromString parses a string containing a GUID and returns the GUID. The
+// supported formats are:
+//   - xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
+//   - {xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx}
+//   - urn:uuid:xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
+//   - xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx
 func FromString(s string) (GUID, error) {
-	if len(s) != 36 {
-		return GUID{}, fmt.Errorf("invalid GUID %q", s)
+	v := s
+	if len(v) > len(urnPrefix) && strings.EqualFold(v[:len(urnPrefix)], urnPrefix) {
+		v = v[len(urnPrefix):]
+	} else if len(v) == 38 && v[0] == '{' && v[37] == '}' {
+		v = v[1:37]
 	}
-	if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+
+	switch len(v) {
+	case 36:
+		if v[8] != '-' || v[13] != '-' || v[18] != '-' || v[23] != '-' {
+			return GUID{}, fmt.Errorf("invalid GUID %q", s)
+		}
+		v = v[0:8] + v[9:13] + v[14:18] + v[19:23] + v[24:36]
+	case 32:
+	default:
 		return GUID{}, fmt.Errorf("invalid GUID %q", s)
 	}
 
 	var g GUID
 
-	data1, err := strconv.ParseUint(s[0:8], 16, 32)
+	data1, err := strconv.ParseUint(v[0:8], 16, 32)
 	if err != nil {
 		return GUID{}, fmt.Errorf("invalid GUID %q", s)
 	}
 	g.Data1 = uint32(data1)
 
-	data2, err := strconv.ParseUint(s[9:13], 16, 16)
+	data2, err := strconv.ParseUint(v[8:12], 16, 16)
 	if err != nil {
 		return GUID{}, fmt.Errorf("invalid GUID %q", s)
 	}
 	g.Data2 = uint16(data2)
 
-	data3, err := strconv.ParseUint(s[14:18], 16, 16)
+	data3, err := strconv.ParseUint(v[12:16], 16, 16)
 	if err != nil {
 		return GUID{}, fmt.Errorf("invalid GUID %q", s)
 	}
 	g.Data3 = uint16(data3)
 
-	for i, x := range []int{19, 21, 24, 26, 28, 30, 32, 34} {
-		v, err := strconv.ParseUint(s[x:x+2], 16, 8)
+	for i := range g.Data4 {
+		x := 16 + i*2
+		b, err := strconv.ParseUint(v[x:x+2], 16, 8)
 		if err != nil {
 			return GUID{}, fmt.Errorf("invalid GUID %q", s)
 		}
-		g.Data4[i] = uint8(v)
+		g.Data4[i] = uint8(b)
 	}
 
 	return g, nil
 }
+
+// MarshalText returns the string representation of the GUID. As GUID
+// implements encoding.TextMarshaler, it's also marshaled as a JSON string.
+func (g GUID) MarshalText() ([]byte, error) {
+	return []byte(g.String()), nil
+}
+
+// UnmarshalText parses a GUID in any of the formats supported by FromString.
+// As GUID implements encoding.TextUnmarshaler, it's also unmarshaled from a
+// JSON string.
+func (g *GUID) UnmarshalText(text []byte) error {
+	parsed, err := FromString(string(text))
+	if err != nil {
+		return err
+	}
+	*g = parsed
+	return nil
+}
+
+// EscapeFilter returns the GUID as an LDAP filter value, which matches the
+// objectGUID attribute of Active Directory: the bytes of the Windows encoding,
+// each escaped as \xx.
+func (g GUID) EscapeFilter() string {
+	b := g.ToWindowsArray()
+	var sb strings.Builder
+	sb.Grow(len(b) * 3)
+	for _, c := range b {
+		sb.WriteByte('\\')
+		sb.WriteString(hex.EncodeToString([]byte{c}))
+	}
+	return sb.String()
+}
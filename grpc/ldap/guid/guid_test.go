@@ -0,0 +1,84 @@
+package guid
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testGUID = "4e8b910b-c12f-49cd-abe7-ced2b6a8d6af"
+
+func TestFromString(t *testing.T) {
+	for _, s := range []string{
+		testGUID,
+		"4E8B910B-C12F-49CD-ABE7-CED2B6A8D6AF",
+		"{4e8b910b-c12f-49cd-abe7-ced2b6a8d6af}",
+		"urn:uuid:4e8b910b-c12f-49cd-abe7-ced2b6a8d6af",
+		"URN:UUID:4e8b910b-c12f-49cd-abe7-ced2b6a8d6af",
+		"4e8b910bc12f49cdabe7ced2b6a8d6af",
+	} {
+		g, err := FromString(s)
+		if err != nil {
+			t.Errorf("Could not parse %q: %v", s, err)
+		} else if g.String() != testGUID {
+			t.Errorf("The GUID %s parsed from %q is different from %s.", g, s, testGUID)
+		}
+	}
+}
+
+func TestFromStringInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"4e8b910b-c12f-49cd-abe7",
+		"4e8b910b_c12f_49cd_abe7_ced2b6a8d6af",
+		"{4e8b910b-c12f-49cd-abe7-ced2b6a8d6af",
+		"urn:uuid:{4e8b910b-c12f-49cd-abe7-ced2b6a8d6af}",
+		"4e8b910bc12f49cdabe7ced2b6a8d6ag",
+		"+e8b910b-c12f-49cd-abe7-ced2b6a8d6af",
+	} {
+		if _, err := FromString(s); err == nil {
+			t.Errorf("The invalid GUID %q has been parsed.", s)
+		}
+	}
+}
+
+func TestFromWindowsBytes(t *testing.T) {
+	g, _ := FromString(testGUID)
+	b := g.ToWindowsArray()
+	if parsed, err := FromWindowsBytes(b[:]); err != nil || parsed != g {
+		t.Errorf("The GUID %s is different from %s, error: %v", parsed, g, err)
+	}
+	for _, b := range [][]byte{nil, b[:15], append(b[:], 0)} {
+		if _, err := FromWindowsBytes(b); err == nil {
+			t.Errorf("The GUID has been read from %d bytes.", len(b))
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	g, _ := FromString(testGUID)
+	data, err := json.Marshal(map[string]GUID{"id": g})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"id":"`+testGUID+`"}` {
+		t.Errorf("Unexpected JSON: %s", data)
+	}
+	var parsed map[string]GUID
+	if err := json.Unmarshal([]byte(`{"id":"{`+testGUID+`}"}`), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed["id"] != g {
+		t.Errorf("The GUID %s is different from %s.", parsed["id"], g)
+	}
+	if err := json.Unmarshal([]byte(`{"id":"invalid"}`), &parsed); err == nil {
+		t.Errorf("The invalid GUID has been unmarshaled.")
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	g, _ := FromString(testGUID)
+	expected := `\0b\91\8b\4e\2f\c1\cd\49\ab\e7\ce\d2\b6\a8\d6\af`
+	if escaped := g.EscapeFilter(); escaped != expected {
+		t.Errorf("The escaped GUID %s is different from %s.", escaped, expected)
+	}
+}
@@ -0,0 +1,224 @@
+package ldaptest
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+)
+
+const (
+	attrDistinguishedName   = "distinguishedName"
+	attrObjectCategory      = "objectCategory"
+	attrUserAccountControl  = "userAccountControl"
+	attrUserPrincipalName   = "userPrincipalName"
+	attrUserPassword        = "userPassword"
+	attrUnicodePwd          = "unicodePwd"
+	attrPwdLastSet          = "pwdLastSet"
+	attrUSNChanged          = "uSNChanged"
+	attrUSNCreated          = "uSNCreated"
+	attrWhenChanged         = "whenChanged"
+	attrHighestCommittedUSN = "highestCommittedUSN"
+	attrDefaultNamingCtx    = "defaultNamingContext"
+
+	// Bitwise AND and OR matching rules of Active Directory.
+	matchingRuleBitAnd = "1.2.840.113556.1.4.803"
+	matchingRuleBitOr  = "1.2.840.113556.1.4.804"
+
+	generalizedTimeFormat = "20060102150405.0Z"
+)
+
+// Attributes whose values are compared as bytes instead of case insensitive strings.
+var binaryAttrs = map[string]bool{
+	"objectguid": true,
+	"objectsid":  true,
+}
+
+// Attributes that are never returned by searches.
+var secretAttrs = map[string]bool{
+	strings.ToLower(attrUserPassword): true,
+	strings.ToLower(attrUnicodePwd):   true,
+}
+
+// Attribute is an LDAP attribute with its values.
+type Attribute struct {
+	Name   string
+	Values [][]byte
+}
+
+// Entry is an entry of the directory.
+type Entry struct {
+	DN         string
+	Attributes []*Attribute
+}
+
+// Get returns the attribute with the provided name, ignoring the case, or nil if the entry does not have it.
+func (e *Entry) Get(name string) *Attribute {
+	for _, attr := range e.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			return attr
+		}
+	}
+	return nil
+}
+
+// Value returns the first value of the attribute, or an empty string.
+func (e *Entry) Value(name string) string {
+	if attr := e.Get(name); attr != nil && len(attr.Values) > 0 {
+		return string(attr.Values[0])
+	}
+	return ""
+}
+
+// Set replaces the values of the attribute, and removes it when there are no values.
+func (e *Entry) Set(name string, values ...[]byte) {
+	for i, attr := range e.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			if len(values) == 0 {
+				e.Attributes = append(e.Attributes[:i], e.Attributes[i+1:]...)
+			} else {
+				attr.Values = values
+			}
+			return
+		}
+	}
+	if len(values) > 0 {
+		e.Attributes = append(e.Attributes, &Attribute{Name: name, Values: values})
+	}
+}
+
+// Add appends the values to the attribute.
+func (e *Entry) Add(name string, values ...[]byte) {
+	if attr := e.Get(name); attr != nil {
+		attr.Values = append(attr.Values, values...)
+	} else {
+		e.Set(name, values...)
+	}
+}
+
+// Values returns the values of the attribute, including the virtual distinguishedName attribute.
+func (e *Entry) values(name string) [][]byte {
+	if strings.EqualFold(name, attrDistinguishedName) {
+		return [][]byte{[]byte(e.DN)}
+	}
+	if attr := e.Get(name); attr != nil {
+		return attr.Values
+	}
+	return nil
+}
+
+func (e *Entry) clone() *Entry {
+	c := &Entry{DN: e.DN, Attributes: make([]*Attribute, len(e.Attributes))}
+	for i, attr := range e.Attributes {
+		values := make([][]byte, len(attr.Values))
+		for j, v := range attr.Values {
+			values[j] = append([]byte(nil), v...)
+		}
+		c.Attributes[i] = &Attribute{Name: attr.Name, Values: values}
+	}
+	return c
+}
+
+// Normalizes a DN so it can be compared, or returns the lower cased DN if it can't be parsed.
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(dn))
+	}
+	rdns := make([]string, len(parsed.RDNs))
+	for i, rdn := range parsed.RDNs {
+		parts := make([]string, len(rdn.Attributes))
+		for j, attr := range rdn.Attributes {
+			parts[j] = strings.ToLower(attr.Type) + "=" + strings.ToLower(attr.Value)
+		}
+		rdns[i] = strings.Join(parts, "+")
+	}
+	return strings.Join(rdns, ",")
+}
+
+// Checks if the normalized DN is in the scope of the normalized base DN.
+func inScope(dn string, base string, scope int) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == base
+	case ldap.ScopeSingleLevel:
+		if base == "" {
+			return dn != "" && !strings.Contains(dn, ",")
+		}
+		return strings.HasSuffix(dn, ","+base) && !strings.Contains(strings.TrimSuffix(dn, ","+base), ",")
+	default:
+		return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+// Compares an attribute value with an assertion value.
+func equalValues(attr string, value []byte, assertion []byte) bool {
+	if binaryAttrs[strings.ToLower(attr)] {
+		return bytes.Equal(value, assertion)
+	}
+	if strings.EqualFold(attr, attrObjectCategory) && !bytes.ContainsRune(assertion, '=') {
+		// Active Directory accepts the LDAP display name of the category, instead of its DN.
+		if dn, err := ldap.ParseDN(string(value)); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			return strings.EqualFold(dn.RDNs[0].Attributes[0].Value, string(assertion))
+		}
+	}
+	if strings.EqualFold(attr, attrDistinguishedName) {
+		return normalizeDN(string(value)) == normalizeDN(string(assertion))
+	}
+	return strings.EqualFold(string(value), string(assertion))
+}
+
+// Orders an attribute value and an assertion value, as integers when both are integers.
+func compareValues(value []byte, assertion []byte) int {
+	v, verr := strconv.ParseInt(string(value), 10, 64)
+	a, aerr := strconv.ParseInt(string(assertion), 10, 64)
+	if verr == nil && aerr == nil {
+		switch {
+		case v < a:
+			return -1
+		case v > a:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return strings.Compare(strings.ToLower(string(value)), strings.ToLower(string(assertion)))
+}
+
+// Checks if an attribute value matches a substrings assertion.
+func matchSubstrings(value string, initial string, any []string, final string) bool {
+	value = strings.ToLower(value)
+	if !strings.HasPrefix(value, strings.ToLower(initial)) {
+		return false
+	}
+	value = value[len(initial):]
+	for _, sub := range any {
+		index := strings.Index(value, strings.ToLower(sub))
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(sub):]
+	}
+	return strings.HasSuffix(value, strings.ToLower(final))
+}
+
+// Checks if an attribute value matches an extensible match assertion.
+func matchExtensible(rule string, value []byte, assertion []byte) bool {
+	switch rule {
+	case matchingRuleBitAnd, matchingRuleBitOr:
+		v, verr := strconv.ParseInt(string(value), 10, 64)
+		a, aerr := strconv.ParseInt(string(assertion), 10, 64)
+		if verr != nil || aerr != nil {
+			return false
+		}
+		if rule == matchingRuleBitAnd {
+			return v&a == a
+		}
+		return v&a != 0
+	case "":
+		return bytes.EqualFold(value, assertion)
+	default:
+		return false
+	}
+}
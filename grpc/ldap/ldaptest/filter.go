@@ -0,0 +1,107 @@
+package ldaptest
+
+import (
+	"fmt"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// Evaluates a BER encoded LDAP filter against an entry.
+func matchFilter(f *ber.Packet, e *Entry) (bool, error) {
+	if f.ClassType != ber.ClassContext {
+		return false, fmt.Errorf("invalid filter class %d", f.ClassType)
+	}
+
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, child := range f.Children {
+			if ok, err := matchFilter(child, e); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case ldap.FilterOr:
+		for _, child := range f.Children {
+			if ok, err := matchFilter(child, e); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case ldap.FilterNot:
+		if len(f.Children) != 1 {
+			return false, fmt.Errorf("invalid not filter")
+		}
+		ok, err := matchFilter(f.Children[0], e)
+		return !ok, err
+	case ldap.FilterPresent:
+		return len(e.values(f.Data.String())) > 0, nil
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(f.Children) != 2 {
+			return false, fmt.Errorf("invalid %s filter", ldap.FilterMap[uint64(f.Tag)])
+		}
+		attr := f.Children[0].Data.String()
+		assertion := f.Children[1].Data.Bytes()
+		for _, value := range e.values(attr) {
+			switch f.Tag {
+			case ldap.FilterGreaterOrEqual:
+				if compareValues(value, assertion) >= 0 {
+					return true, nil
+				}
+			case ldap.FilterLessOrEqual:
+				if compareValues(value, assertion) <= 0 {
+					return true, nil
+				}
+			default:
+				if equalValues(attr, value, assertion) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case ldap.FilterSubstrings:
+		if len(f.Children) != 2 {
+			return false, fmt.Errorf("invalid substrings filter")
+		}
+		attr := f.Children[0].Data.String()
+		var initial, final string
+		any := make([]string, 0)
+		for _, sub := range f.Children[1].Children {
+			switch sub.Tag {
+			case ldap.FilterSubstringsInitial:
+				initial = sub.Data.String()
+			case ldap.FilterSubstringsAny:
+				any = append(any, sub.Data.String())
+			case ldap.FilterSubstringsFinal:
+				final = sub.Data.String()
+			}
+		}
+		for _, value := range e.values(attr) {
+			if matchSubstrings(string(value), initial, any, final) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case ldap.FilterExtensibleMatch:
+		var rule, attr string
+		var assertion []byte
+		for _, child := range f.Children {
+			switch child.Tag {
+			case ldap.MatchingRuleAssertionMatchingRule:
+				rule = child.Data.String()
+			case ldap.MatchingRuleAssertionType:
+				attr = child.Data.String()
+			case ldap.MatchingRuleAssertionMatchValue:
+				assertion = child.Data.Bytes()
+			}
+		}
+		for _, value := range e.values(attr) {
+			if matchExtensible(rule, value, assertion) {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("unsupported filter %d", f.Tag)
+	}
+}
@@ -0,0 +1,60 @@
+package ldaptest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"csb.nc/auth/stores/tools/ldif"
+)
+
+// ParseLDIF parses the content records of an LDIF file (RFC 2849).
+// Attribute values can be plain (`attr: value`) or base64 encoded (`attr:: dmFsdWU=`), which is required for binary values such as objectGUID.
+func ParseLDIF(r io.Reader) ([]*Entry, error) {
+	lines, err := ldif.Unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Entry, 0)
+	var current *Entry
+	for _, l := range lines {
+		line := l.Text
+		if line == "" {
+			current = nil
+			continue
+		}
+		sep := strings.Index(line, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("invalid LDIF line %d: %q", l.Number, line)
+		}
+		name := line[:sep]
+		raw := line[sep+1:]
+		var value []byte
+		if strings.HasPrefix(raw, ":") {
+			value, err = base64.StdEncoding.DecodeString(strings.TrimSpace(raw[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value of %s at LDIF line %d: %v", name, l.Number, err)
+			}
+		} else {
+			value = []byte(strings.TrimLeft(raw, " "))
+		}
+
+		switch {
+		case current == nil && strings.EqualFold(name, "version"):
+			continue
+		case current == nil && strings.EqualFold(name, "dn"):
+			current = &Entry{DN: string(value)}
+			entries = append(entries, current)
+		case current == nil:
+			return nil, fmt.Errorf("the LDIF record at line %d does not start with a dn", l.Number)
+		case strings.EqualFold(name, "changetype"):
+			return nil, fmt.Errorf("LDIF change records are not supported, at line %d", l.Number)
+		default:
+			current.Add(name, value)
+		}
+	}
+
+	return entries, nil
+}
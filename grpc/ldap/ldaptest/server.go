@@ -0,0 +1,642 @@
+// Package ldaptest provides an in-process LDAP server that mimics the Active Directory behaviors used by the LDAP store.
+//
+// The server supports the simple bind, the search with filters and paged results, and the modification of entries.
+// It's seeded with LDIF records, and keeps the entries in memory.
+// The passwords are read from the `userPassword` attribute, which is never returned by the searches.
+package ldaptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+const (
+	userAccountControlAccountDisable = 0x00000002
+	userAccountControlLockout        = 0x00000010
+
+	// Active Directory diagnostic messages, which carry the reason of the failures in their data field.
+	diagInvalidCredentials = "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data %s, v3839"
+	diagBindRequired       = "000004DC: LdapErr: DSID-0C090A5C, comment: In order to perform this operation a successful bind must be completed on the connection., data 0, v3839"
+	diagNoSuchObject       = "0000208D: NameErr: DSID-03100288, problem 2001 (NO_OBJECT), data 0, best match of:\n\t'%s'\n"
+	diagWrongPassword      = "00000056: AtrErr: DSID-03190F80, #1:\n\t0: 00000056: DSID-03190F80, problem 1005 (CONSTRAINT_ATT_TYPE), data 0, Att 9005a (unicodePwd)\n"
+	diagPasswordPolicy     = "0000052D: AtrErr: DSID-03191083, #1:\n\t0: 0000052D: DSID-03191083, problem 1005 (CONSTRAINT_ATT_TYPE), data 0, Att 9005a (unicodePwd)\n"
+
+	// DataInvalidPassword is the data field of the diagnostic message when the password is invalid.
+	DataInvalidPassword = "52e"
+	// DataAccountDisabled is the data field of the diagnostic message when the account is disabled.
+	DataAccountDisabled = "533"
+	// DataPasswordMustChange is the data field of the diagnostic message when the password must be changed.
+	DataPasswordMustChange = "773"
+	// DataAccountLocked is the data field of the diagnostic message when the account is locked.
+	DataAccountLocked = "775"
+
+	modifyAdd     = 0
+	modifyDelete  = 1
+	modifyReplace = 2
+
+	// Number of 100 nanoseconds intervals between 1601-01-01 and 1970-01-01.
+	fileTimeEpochOffset = 116444736000000000
+)
+
+// Server is an in-process LDAP server.
+type Server struct {
+	// MinPasswordLength is the minimum length of the passwords set by a unicodePwd change, like the domain password policy.
+	// It must be set before the server is started.
+	MinPasswordLength int
+
+	mu       sync.RWMutex
+	entries  []*Entry
+	usn      int64
+	searches int64
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a server with the provided entries.
+func NewServer(entries ...*Entry) *Server {
+	s := &Server{
+		entries: make([]*Entry, 0, len(entries)),
+		conns:   make(map[net.Conn]bool),
+	}
+	for _, e := range entries {
+		s.AddEntry(e)
+	}
+	return s
+}
+
+// NewServerFromLDIF creates a server with the entries of the LDIF file.
+func NewServerFromLDIF(path string) (*Server, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := ParseLDIF(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(entries...), nil
+}
+
+// Start listens on a random port of the loopback interface, and serves the connections in the background.
+func (s *Server) Start() error {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.listener = lis
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+
+			s.wg.Add(1)
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Host returns the host the server listens on.
+func (s *Server) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops listening and closes the opened connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// AddEntry adds an entry to the directory, and assigns its update sequence numbers.
+func (s *Server) AddEntry(e *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e = e.clone()
+	for _, attr := range []string{attrUSNCreated, attrUSNChanged} {
+		if usn, err := strconv.ParseInt(e.Value(attr), 10, 64); err == nil {
+			if usn > s.usn {
+				s.usn = usn
+			}
+		} else {
+			s.usn++
+			e.Set(attr, []byte(strconv.FormatInt(s.usn, 10)))
+		}
+	}
+	s.entries = append(s.entries, e)
+}
+
+// Entry returns a copy of the entry with the provided DN, or nil if it does not exist.
+func (s *Server) Entry(dn string) *Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if e := s.find(normalizeDN(dn)); e != nil {
+		return e.clone()
+	}
+	return nil
+}
+
+// Modify applies the change to the entry with the provided DN, and updates its uSNChanged and whenChanged attributes.
+func (s *Server) Modify(dn string, change func(e *Entry)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.find(normalizeDN(dn))
+	if e == nil {
+		return fmt.Errorf("the entry %s does not exist", dn)
+	}
+	change(e)
+	s.touch(e)
+	return nil
+}
+
+// HighestCommittedUSN returns the highest update sequence number of the directory.
+func (s *Server) HighestCommittedUSN() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.usn
+}
+
+// Searches returns the number of searches served, including the RootDSE reads.
+func (s *Server) Searches() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.searches
+}
+
+func (s *Server) find(normalizedDN string) *Entry {
+	for _, e := range s.entries {
+		if normalizeDN(e.DN) == normalizedDN {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *Server) touch(e *Entry) {
+	s.usn++
+	e.Set(attrUSNChanged, []byte(strconv.FormatInt(s.usn, 10)))
+	e.Set(attrWhenChanged, []byte(time.Now().UTC().Format(generalizedTimeFormat)))
+}
+
+// FileTime converts a time to the Windows file time format used by Active Directory timestamps.
+func FileTime(t time.Time) int64 {
+	return t.UnixNano()/100 + fileTimeEpochOffset
+}
+
+// session is the state of an LDAP connection.
+type session struct {
+	server *Server
+	conn   net.Conn
+	bound  *Entry
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	sess := &session{server: s, conn: conn}
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		id, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		op := packet.Children[1]
+		var controls []*ber.Packet
+		if len(packet.Children) > 2 {
+			controls = packet.Children[2].Children
+		}
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			err = sess.bind(id, op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationSearchRequest:
+			err = sess.search(id, op, controls)
+		case ldap.ApplicationModifyRequest:
+			err = sess.modify(id, op)
+		case ldap.ApplicationAbandonRequest:
+			continue
+		case ldap.ApplicationAddRequest:
+			err = sess.reply(id, ldap.ApplicationAddResponse, ldap.LDAPResultUnwillingToPerform, "", nil)
+		case ldap.ApplicationDelRequest:
+			err = sess.reply(id, ldap.ApplicationDelResponse, ldap.LDAPResultUnwillingToPerform, "", nil)
+		case ldap.ApplicationModifyDNRequest:
+			err = sess.reply(id, ldap.ApplicationModifyDNResponse, ldap.LDAPResultUnwillingToPerform, "", nil)
+		case ldap.ApplicationCompareRequest:
+			err = sess.reply(id, ldap.ApplicationCompareResponse, ldap.LDAPResultUnwillingToPerform, "", nil)
+		case ldap.ApplicationExtendedRequest:
+			err = sess.reply(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform, "", nil)
+		default:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Writes an LDAP message with the provided protocol operation.
+func (sess *session) write(id int64, op *ber.Packet, controls []*ber.Packet) error {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	if len(controls) > 0 {
+		wrapper := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			wrapper.AppendChild(control)
+		}
+		packet.AppendChild(wrapper)
+	}
+	_, err := sess.conn.Write(packet.Bytes())
+	return err
+}
+
+// Writes an LDAP result.
+func (sess *session) reply(id int64, application ber.Tag, code int, diag string, controls []*ber.Packet) error {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, application, nil, ldap.ApplicationMap[uint8(application)])
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diag, "diagnosticMessage"))
+	return sess.write(id, op, controls)
+}
+
+func (sess *session) bind(id int64, op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return sess.reply(id, ldap.ApplicationBindResponse, ldap.LDAPResultProtocolError, "", nil)
+	}
+	name := op.Children[1].Data.String()
+	auth := op.Children[2]
+	if auth.ClassType != ber.ClassContext || auth.Tag != 0 {
+		return sess.reply(id, ldap.ApplicationBindResponse, ldap.LDAPResultAuthMethodNotSupported, "", nil)
+	}
+	password := auth.Data.String()
+
+	sess.bound = nil
+	if name == "" && password == "" {
+		// Anonymous bind.
+		return sess.reply(id, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "", nil)
+	}
+
+	sess.server.mu.RLock()
+	var entry *Entry
+	normalized := normalizeDN(name)
+	for _, e := range sess.server.entries {
+		if normalizeDN(e.DN) == normalized || strings.EqualFold(e.Value(attrUserPrincipalName), name) {
+			entry = e.clone()
+			break
+		}
+	}
+	sess.server.mu.RUnlock()
+
+	data := ""
+	switch {
+	case entry == nil || password == "" || entry.Value(attrUserPassword) != password:
+		data = DataInvalidPassword
+	default:
+		uac, _ := strconv.ParseInt(entry.Value(attrUserAccountControl), 10, 64)
+		if uac&userAccountControlAccountDisable != 0 {
+			data = DataAccountDisabled
+		} else if uac&userAccountControlLockout != 0 {
+			data = DataAccountLocked
+		} else if entry.Value(attrPwdLastSet) == "0" {
+			data = DataPasswordMustChange
+		}
+	}
+	if data != "" {
+		return sess.reply(id, ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials, fmt.Sprintf(diagInvalidCredentials, data), nil)
+	}
+
+	sess.bound = entry
+	return sess.reply(id, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "", nil)
+}
+
+func (sess *session) search(id int64, op *ber.Packet, controls []*ber.Packet) error {
+	if len(op.Children) < 8 {
+		return sess.reply(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError, "", nil)
+	}
+	base := op.Children[0].Data.String()
+	scope, _ := op.Children[1].Value.(int64)
+	typesOnly, _ := op.Children[5].Value.(bool)
+	filter := op.Children[6]
+	attrs := make([]string, 0, len(op.Children[7].Children))
+	for _, attr := range op.Children[7].Children {
+		attrs = append(attrs, attr.Data.String())
+	}
+
+	sess.server.mu.Lock()
+	sess.server.searches++
+	sess.server.mu.Unlock()
+
+	if base == "" && scope == ldap.ScopeBaseObject {
+		return sess.rootDSE(id, attrs)
+	}
+	if sess.bound == nil {
+		return sess.reply(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultOperationsError, diagBindRequired, nil)
+	}
+
+	normalizedBase := normalizeDN(base)
+	matches := make([]*Entry, 0)
+	sess.server.mu.RLock()
+	baseExists := normalizedBase == ""
+	for _, e := range sess.server.entries {
+		dn := normalizeDN(e.DN)
+		if dn == normalizedBase {
+			baseExists = true
+		}
+		if !inScope(dn, normalizedBase, int(scope)) {
+			continue
+		}
+		ok, err := matchFilter(filter, e)
+		if err != nil {
+			sess.server.mu.RUnlock()
+			return sess.reply(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultOperationsError, err.Error(), nil)
+		}
+		if ok {
+			matches = append(matches, e.clone())
+		}
+	}
+	sess.server.mu.RUnlock()
+
+	if !baseExists {
+		return sess.reply(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject, fmt.Sprintf(diagNoSuchObject, base), nil)
+	}
+
+	var paging *ldap.ControlPaging
+	for _, packet := range controls {
+		if control, err := ldap.DecodeControl(packet); err == nil {
+			if p, ok := control.(*ldap.ControlPaging); ok {
+				paging = p
+			}
+		}
+	}
+
+	var doneControls []*ber.Packet
+	if paging != nil {
+		offset := 0
+		if len(paging.Cookie) > 0 {
+			var err error
+			if offset, err = strconv.Atoi(string(paging.Cookie)); err != nil || offset > len(matches) {
+				return sess.reply(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultUnwillingToPerform, "invalid paging cookie", nil)
+			}
+		}
+		end := offset + int(paging.PagingSize)
+		if paging.PagingSize == 0 || end > len(matches) {
+			end = len(matches)
+		}
+		next := ldap.NewControlPaging(paging.PagingSize)
+		if end < len(matches) && paging.PagingSize > 0 {
+			next.SetCookie([]byte(strconv.Itoa(end)))
+		}
+		if paging.PagingSize == 0 {
+			// A page size of zero abandons the paged search.
+			end = offset
+		}
+		matches = matches[offset:end]
+		doneControls = []*ber.Packet{next.Encode()}
+	}
+
+	for _, e := range matches {
+		if err := sess.write(id, searchResultEntry(e, attrs, typesOnly), nil); err != nil {
+			return err
+		}
+	}
+	return sess.reply(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, "", doneControls)
+}
+
+func (sess *session) rootDSE(id int64, attrs []string) error {
+	sess.server.mu.RLock()
+	root := &Entry{}
+	root.Set(attrHighestCommittedUSN, []byte(strconv.FormatInt(sess.server.usn, 10)))
+	for _, e := range sess.server.entries {
+		if dn, err := ldap.ParseDN(e.DN); err == nil && len(dn.RDNs) > 0 && strings.EqualFold(dn.RDNs[0].Attributes[0].Type, "DC") {
+			root.Set(attrDefaultNamingCtx, []byte(e.DN))
+			break
+		}
+	}
+	sess.server.mu.RUnlock()
+
+	if err := sess.write(id, searchResultEntry(root, attrs, false), nil); err != nil {
+		return err
+	}
+	return sess.reply(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, "", nil)
+}
+
+// Encodes a search result entry, with the requested attributes.
+func searchResultEntry(e *Entry, attrs []string, typesOnly bool) *ber.Packet {
+	all := len(attrs) == 0
+	requested := make(map[string]bool, len(attrs))
+	for _, attr := range attrs {
+		if attr == "*" {
+			all = true
+		}
+		requested[strings.ToLower(attr)] = true
+	}
+
+	selected := make([]*Attribute, 0, len(e.Attributes))
+	for _, attr := range e.Attributes {
+		name := strings.ToLower(attr.Name)
+		if !secretAttrs[name] && (all || requested[name]) {
+			selected = append(selected, attr)
+		}
+	}
+	if requested[strings.ToLower(attrDistinguishedName)] && e.Get(attrDistinguishedName) == nil {
+		selected = append(selected, &Attribute{Name: attrDistinguishedName, Values: [][]byte{[]byte(e.DN)}})
+	}
+
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "objectName"))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for _, attr := range selected {
+		partial := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "PartialAttribute")
+		partial.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attr.Name, "type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		if !typesOnly {
+			for _, v := range attr.Values {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(v), "value"))
+			}
+		}
+		partial.AppendChild(values)
+		list.AppendChild(partial)
+	}
+	op.AppendChild(list)
+	return op
+}
+
+func (sess *session) modify(id int64, op *ber.Packet) error {
+	if sess.bound == nil {
+		return sess.reply(id, ldap.ApplicationModifyResponse, ldap.LDAPResultOperationsError, diagBindRequired, nil)
+	}
+	if len(op.Children) < 2 {
+		return sess.reply(id, ldap.ApplicationModifyResponse, ldap.LDAPResultProtocolError, "", nil)
+	}
+	dn := op.Children[0].Data.String()
+
+	s := sess.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := s.find(normalizeDN(dn))
+	if target == nil {
+		return sess.reply(id, ldap.ApplicationModifyResponse, ldap.LDAPResultNoSuchObject, fmt.Sprintf(diagNoSuchObject, dn), nil)
+	}
+
+	// The changes are applied to a copy, so a failing change does not alter the entry.
+	e := target.clone()
+	for _, change := range op.Children[1].Children {
+		if len(change.Children) < 2 || len(change.Children[1].Children) < 2 {
+			return sess.reply(id, ldap.ApplicationModifyResponse, ldap.LDAPResultProtocolError, "", nil)
+		}
+		operation, _ := change.Children[0].Value.(int64)
+		attr := change.Children[1].Children[0].Data.String()
+		values := make([][]byte, 0)
+		for _, v := range change.Children[1].Children[1].Children {
+			values = append(values, append([]byte(nil), v.Data.Bytes()...))
+		}
+
+		if strings.EqualFold(attr, attrUnicodePwd) {
+			if code, diag := changePassword(e, operation, values, s.MinPasswordLength); code != ldap.LDAPResultSuccess {
+				return sess.reply(id, ldap.ApplicationModifyResponse, code, diag, nil)
+			}
+			continue
+		}
+
+		switch operation {
+		case modifyAdd:
+			e.Add(attr, values...)
+		case modifyDelete:
+			if len(values) == 0 {
+				e.Set(attr)
+				continue
+			}
+			remaining := make([][]byte, 0)
+			for _, current := range e.values(attr) {
+				keep := true
+				for _, v := range values {
+					if equalValues(attr, current, v) {
+						keep = false
+					}
+				}
+				if keep {
+					remaining = append(remaining, current)
+				}
+			}
+			e.Set(attr, remaining...)
+		case modifyReplace:
+			e.Set(attr, values...)
+		default:
+			return sess.reply(id, ldap.ApplicationModifyResponse, ldap.LDAPResultProtocolError, "", nil)
+		}
+	}
+
+	*target = *e
+	s.touch(target)
+	return sess.reply(id, ldap.ApplicationModifyResponse, ldap.LDAPResultSuccess, "", nil)
+}
+
+// Applies a unicodePwd change, which is either a reset (replace) or a change (delete the old password, add the new one).
+func changePassword(e *Entry, operation int64, values [][]byte, minLength int) (int, string) {
+	passwords := make([]string, len(values))
+	for i, v := range values {
+		p, err := DecodePassword(v)
+		if err != nil {
+			return ldap.LDAPResultConstraintViolation, err.Error()
+		}
+		passwords[i] = p
+	}
+
+	switch {
+	case operation == modifyDelete && len(passwords) == 1:
+		if passwords[0] != e.Value(attrUserPassword) {
+			return ldap.LDAPResultConstraintViolation, diagWrongPassword
+		}
+		e.Set(attrUserPassword)
+	case (operation == modifyAdd || operation == modifyReplace) && len(passwords) == 1:
+		if len([]rune(passwords[0])) < minLength {
+			return ldap.LDAPResultConstraintViolation, diagPasswordPolicy
+		}
+		e.Set(attrUserPassword, []byte(passwords[0]))
+		e.Set(attrPwdLastSet, []byte(strconv.FormatInt(FileTime(time.Now()), 10)))
+	default:
+		return ldap.LDAPResultUnwillingToPerform, "unsupported unicodePwd change"
+	}
+	return ldap.LDAPResultSuccess, ""
+}
+
+// EncodePassword encodes a password as expected by the unicodePwd attribute: quoted and encoded in UTF-16LE.
+func EncodePassword(password string) []byte {
+	var buf bytes.Buffer
+	for _, c := range utf16.Encode([]rune("\"" + password + "\"")) {
+		binary.Write(&buf, binary.LittleEndian, c)
+	}
+	return buf.Bytes()
+}
+
+// DecodePassword decodes a unicodePwd value.
+func DecodePassword(value []byte) (string, error) {
+	if len(value)%2 != 0 {
+		return "", fmt.Errorf("invalid UTF-16 password")
+	}
+	codes := make([]uint16, len(value)/2)
+	if err := binary.Read(bytes.NewReader(value), binary.LittleEndian, codes); err != nil && err != io.EOF {
+		return "", err
+	}
+	password := string(utf16.Decode(codes))
+	if len(password) < 2 || password[0] != '"' || password[len(password)-1] != '"' {
+		return "", fmt.Errorf("the password must be quoted")
+	}
+	return password[1 : len(password)-1], nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"csb.nc/auth/stores/grpc/ldap/svc"
 	"csb.nc/auth/stores/tools"
+	"csb.nc/auth/stores/tools/grpcerr"
 	"csb.nc/auth/stores/users"
 	grpcmiddleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpczap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
@@ -24,15 +25,73 @@ type server struct {
 }
 
 func (s *server) Authenticate(ctx context.Context, req *users.AuthRequest) (*users.AuthResponse, error) {
-	return svc.Authenticate(req), nil
+	resp := svc.Authenticate(req)
+	resp.Code = svc.ErrorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, svc.StoreName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) AuthenticateFlow(stream users.User_AuthenticateFlowServer) error {
+	return svc.AuthenticateFlow(stream)
+}
+
+func (s server) GetAccountStatus(ctx context.Context, req *users.AccountStatusRequest) (*users.AccountStatusResponse, error) {
+	resp := svc.GetAccountStatus(req)
+	resp.Code = svc.ErrorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, svc.StoreName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 func (s server) FindClaims(ctx context.Context, req *users.ClaimsRequest) (*users.ClaimsResponse, error) {
-	return svc.FindClaims(req), nil
+	resp := svc.FindClaims(req)
+	resp.Code = svc.ErrorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, svc.StoreName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) FindClaimsBatch(ctx context.Context, req *users.ClaimsBatchRequest) (*users.ClaimsBatchResponse, error) {
+	resp := svc.FindClaimsBatch(req)
+	resp.Code = svc.ErrorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, svc.StoreName, resp.Error); err != nil {
+		return nil, err
+	}
+	// The errors of the identifiers are returned in their results, even the infrastructure ones.
+	for _, result := range resp.Results {
+		result.Code = svc.ErrorCode(result.Error)
+	}
+	return resp, nil
 }
 
 func (s server) SearchClaims(ctx context.Context, req *users.SearchRequest) (*users.SearchResponse, error) {
-	return svc.SearchClaims(req), nil
+	resp := svc.SearchClaims(req)
+	resp.Code = svc.ErrorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, svc.StoreName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) StreamSearchClaims(req *users.SearchRequest, stream users.User_StreamSearchClaimsServer) error {
+	return svc.StreamSearchClaims(req, stream)
+}
+
+func (s server) ValidatePassword(ctx context.Context, req *users.ValidatePasswordRequest) (*users.ValidatePasswordResponse, error) {
+	resp := svc.ValidatePassword(req)
+	resp.Code = svc.ErrorCode(resp.Error)
+	if err := grpcerr.Check(ctx, resp.Code, svc.StoreName, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s server) WatchUsers(req *users.WatchRequest, stream users.User_WatchUsersServer) error {
+	return svc.WatchUsers(req, stream)
 }
 
 func init() {
@@ -42,6 +101,10 @@ func init() {
 func main() {
 	defer zap.L().Sync()
 
+	if err := svc.CheckPasswordPolicy(); err != nil {
+		zap.L().Fatal("The password policy is invalid.", zap.Error(err))
+	}
+
 	lis := tools.CreateNetworkListner()
 	defer lis.Close()
 
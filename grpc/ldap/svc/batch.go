@@ -0,0 +1,185 @@
+package svc
+
+import (
+	"fmt"
+	"strings"
+
+	"csb.nc/auth/stores/users"
+	"github.com/go-ldap/ldap"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyLdapBatchChunkSize      = "ldap.batch.chunkSize"
+	viperKeyLdapBatchMaxIdentifiers = "ldap.batch.maxIdentifiers"
+
+	ldapBatchChunkSizeDefault      = 50
+	ldapBatchMaxIdentifiersDefault = 1000
+)
+
+// FindClaimsBatch finds the requested claims of several users, with a single LDAP connection.
+// The identifiers are searched with OR filters, chunked to stay under the filter size limits of the domain controller.
+// Each result carries its own error, the response error is only set when the LDAP connection could not be opened.
+func FindClaimsBatch(req *users.ClaimsBatchRequest) *users.ClaimsBatchResponse {
+	zap.L().Sugar().Infof("Searching claims for %d users.", len(req.Identifiers))
+
+	maxIdentifiers := ldapBatchMaxIdentifiersDefault
+	if viper.IsSet(viperKeyLdapBatchMaxIdentifiers) {
+		maxIdentifiers = viper.GetInt(viperKeyLdapBatchMaxIdentifiers)
+	}
+	if len(req.Identifiers) > maxIdentifiers {
+		zap.L().Sugar().Warnf("The batch of %d identifiers exceeds the maximum of %d.", len(req.Identifiers), maxIdentifiers)
+		return &users.ClaimsBatchResponse{Error: InvalidRequest}
+	}
+
+	resp := &users.ClaimsBatchResponse{
+		Results: make([]*users.ClaimsBatchResult, len(req.Identifiers)),
+	}
+
+	lookups := make([]*identifierLookup, len(req.Identifiers))
+	pending := make([]int, 0, len(req.Identifiers))
+	for index, id := range req.Identifiers {
+		resp.Results[index] = &users.ClaimsBatchResult{
+			Identifier:     id.Identifier,
+			IdentifierType: id.IdentifierType,
+			Claims:         make(map[string]string),
+		}
+		l, err := newIdentifierLookup(id.Identifier, id.IdentifierType)
+		if err != nil {
+			zap.L().Warn(
+				"The identifier is invalid.",
+				zap.Error(err),
+				zap.String("identifier", id.Identifier),
+				zap.Int("identifierType", int(id.IdentifierType)),
+			)
+			resp.Results[index].Error = InvalidIdentifier
+			continue
+		}
+		lookups[index] = l
+		pending = append(pending, index)
+	}
+
+	if len(pending) == 0 {
+		resp.Succeeded = true
+		return resp
+	}
+
+	zap.L().Debug("Opening LDAP connection.")
+	conn, err := openConn()
+	if err != nil {
+		zap.L().Error("Could not open LDAP connection", zap.Error(err))
+		resp.Error = openConnError(err)
+		return resp
+	}
+	defer conn.Close()
+
+	// The identifier attributes are fetched along with the claims, to match the entries with the identifiers.
+	attrs := mapClaimsToLdapAttrs(req.Claims)
+	requested := make(map[string]bool, len(attrs))
+	for _, attr := range attrs {
+		requested[strings.ToLower(attr)] = true
+	}
+	for _, index := range pending {
+		if attr := lookups[index].attr; !requested[strings.ToLower(attr)] {
+			requested[strings.ToLower(attr)] = true
+			attrs = append(attrs, attr)
+		}
+	}
+
+	chunkSize := viper.GetInt(viperKeyLdapBatchChunkSize)
+	if chunkSize <= 0 {
+		chunkSize = ldapBatchChunkSizeDefault
+	}
+
+	entries := make([]*ldap.Entry, 0, len(pending))
+	seen := make(map[string]bool, len(pending))
+	for start := 0; start < len(pending); start += chunkSize {
+		end := start + chunkSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		chunk := pending[start:end]
+
+		var sb strings.Builder
+		sb.WriteString("(|")
+		for _, index := range chunk {
+			sb.WriteString(lookups[index].condition())
+		}
+		sb.WriteString(")")
+		filter := fmt.Sprintf(ldapUserFilter, sb.String())
+
+		found, err := findEntries(conn, filter, attrs)
+		if err != nil {
+			zap.L().Error("Could not search a chunk of identifiers.", zap.Error(err), zap.String("filter", filter))
+			for _, index := range chunk {
+				resp.Results[index].Error = LdapSearchFailed
+				lookups[index] = nil
+			}
+			continue
+		}
+		for _, entry := range found {
+			if key := strings.ToLower(entry.DN); !seen[key] {
+				seen[key] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	// Each identifier must match exactly one entry.
+	matched := make(map[int]*ldap.Entry, len(pending))
+	for _, index := range pending {
+		l := lookups[index]
+		if l == nil {
+			continue
+		}
+		var match *ldap.Entry
+		for _, entry := range entries {
+			if !l.matches(entry) {
+				continue
+			}
+			if match != nil {
+				resp.Results[index].Error = AmbiguousIdentifier
+				break
+			}
+			match = entry
+		}
+		switch {
+		case resp.Results[index].Error != 0:
+		case match == nil:
+			resp.Results[index].Error = UserNotFound
+		default:
+			matched[index] = match
+		}
+	}
+
+	claimEntries := make([]*ldap.Entry, 0, len(matched))
+	positions := make(map[*ldap.Entry]int, len(matched))
+	for _, entry := range matched {
+		if _, ok := positions[entry]; !ok {
+			positions[entry] = len(claimEntries)
+			claimEntries = append(claimEntries, entry)
+		}
+	}
+	claims, err := entriesClaims(conn, claimEntries, req.Claims)
+	if err != nil {
+		zap.L().Error("An error has occured while fetching claims.", zap.Error(err))
+		for index := range matched {
+			resp.Results[index].Error = LdapSearchFailed
+		}
+		resp.Succeeded = true
+		return resp
+	}
+
+	for index, entry := range matched {
+		result := resp.Results[index]
+		result.Succeeded = true
+		// An entry can be matched by several identifiers, so its claims are copied.
+		for k, v := range claims[positions[entry]] {
+			result.Claims[k] = v
+		}
+	}
+
+	resp.Succeeded = true
+	return resp
+}
@@ -0,0 +1,120 @@
+package svc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"csb.nc/auth/stores/tools/ldif"
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyLdapBindMode     = "ldap.bind.mode"
+	viperKeyLdapBindTemplate = "ldap.bind.template"
+
+	// The domain controller binding uses the service account to find the user's DN.
+	ldapBindModeService = "service"
+	// The domain controller binding uses the user's credentials, with a DN or UPN built from the username.
+	ldapBindModeUser = "user"
+
+	ldapBindTemplateUsername = "{username}"
+	ldapDNSpecialChars       = ",+\"\\<>;="
+)
+
+var errServiceAccountRequired = errors.New("the operation requires a service account, which is not configured in bind-as-user mode")
+
+// Checks if the domain controller binding uses the user's credentials.
+func isBindAsUser() bool {
+	return strings.EqualFold(viper.GetString(viperKeyLdapBindMode), ldapBindModeUser)
+}
+
+// Builds the bind name of the user using the configured DN or UPN template.
+func bindName(username string) (string, error) {
+	template := viper.GetString(viperKeyLdapBindTemplate)
+	if !strings.Contains(template, ldapBindTemplateUsername) {
+		return "", fmt.Errorf("the bind template '%s' does not contain the %s placeholder", template, ldapBindTemplateUsername)
+	}
+	if strings.Contains(template, "=") {
+		// The template is a DN, so the username is an RDN value that must be escaped.
+		username = ldif.EscapeDNValue(username)
+	} else if strings.ContainsAny(username, "@"+ldapDNSpecialChars) {
+		return "", fmt.Errorf("the username '%s' contains characters that are not allowed in a UPN", username)
+	}
+	return strings.ReplaceAll(template, ldapBindTemplateUsername, username), nil
+}
+
+// Authenticates a user by binding directly with the user's credentials, then reads the user's own entry.
+func authenticateAsUser(req *users.AuthRequest) *users.AuthResponse {
+	resp := &users.AuthResponse{}
+
+	name, err := bindName(req.Username)
+	if err != nil {
+		zap.L().Warn("Could not build the bind name.", zap.Error(err), zap.String("userName", req.Username))
+		resp.Error = UserBindFailed
+		return resp
+	}
+
+	zap.L().Debug("Opening LDAP connection.")
+	conn, err := dialConn()
+	if err != nil {
+		zap.L().Error("Could not open LDAP connection", zap.Error(err))
+		resp.Error = LdapConnectionFailed
+		return resp
+	}
+	defer conn.Close()
+
+	zap.L().Sugar().Debugf("Binding to the domain controller using: %s", name)
+	if err := conn.Bind(name, req.Password); err != nil {
+		zap.L().Warn(
+			"Domain controller binding failed",
+			zap.Error(err),
+			zap.String("bindName", name),
+			zap.String("userName", req.Username),
+		)
+		resp.Error = bindError(err)
+		return resp
+	}
+
+	entry, item, err := findAuthEntry(conn, req.Username, req.Claims)
+	if err != nil {
+		zap.L().Error(
+			fmt.Sprintf("Could not search LDAP attributes using sAMAccountName: %s", req.Username),
+			zap.Error(err),
+			zap.String("userName", req.Username),
+		)
+		resp.Error = LdapSearchFailed
+		return resp
+	}
+
+	if entry == nil {
+		// The user is bound, but cannot read its own entry.
+		resp.Error = UserNotFound
+		return resp
+	}
+
+	if resp.Error = checkUserAccountControl(item); resp.Error > 0 {
+		return resp
+	}
+
+	// The claims and the password expiration are read with the user's rights.
+	claims, err := authClaims(conn, entry, req.Claims)
+	if err != nil {
+		zap.L().Error("An error has occured while fetching claims.", zap.Error(err), zap.String("userName", req.Username))
+		resp.Error = LdapSearchFailed
+		return resp
+	}
+	expires, err := passwordExpiration(conn, entry)
+	if err != nil {
+		zap.L().Warn("Could not read the password expiration.", zap.Error(err), zap.String("userName", req.Username))
+	}
+
+	resp.Succeeded = true
+	resp.Subject = item[ldapObjectGUIDAttr]
+	resp.Claims = claims
+	setPasswordExpiration(resp, expires)
+
+	return resp
+}
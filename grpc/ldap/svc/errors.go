@@ -0,0 +1,44 @@
+package svc
+
+import (
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/users"
+)
+
+// StoreName is the name of the store in the error details.
+const StoreName = "ldap"
+
+// Shared error codes of the LDAP store error codes.
+var errorCodes = map[int32]users.ErrorCode{
+	LdapConnectionFailed:   users.ErrorCode_STORE_UNAVAILABLE,
+	LdapSearchFailed:       users.ErrorCode_STORE_FAILURE,
+	UserNotFound:           users.ErrorCode_USER_NOT_FOUND,
+	UserBindFailed:         users.ErrorCode_INVALID_CREDENTIALS,
+	UserAccountDisabled:    users.ErrorCode_ACCOUNT_DISABLED,
+	UserAccountLocked:      users.ErrorCode_ACCOUNT_LOCKED,
+	InvalidFilter:          users.ErrorCode_INVALID_FILTER,
+	ServiceAccountRequired: users.ErrorCode_SERVICE_ACCOUNT_REQUIRED,
+	InvalidIdentifier:      users.ErrorCode_INVALID_IDENTIFIER,
+	AmbiguousIdentifier:    users.ErrorCode_AMBIGUOUS_IDENTIFIER,
+	InvalidRequest:         users.ErrorCode_INVALID_REQUEST,
+	PasswordChangeRequired: users.ErrorCode_PASSWORD_CHANGE_REQUIRED,
+	PasswordRejected:       users.ErrorCode_PASSWORD_REJECTED,
+	PasswordChangeFailed:   users.ErrorCode_STORE_FAILURE,
+	InvalidFlowState:       users.ErrorCode_INVALID_FLOW_STATE,
+}
+
+// ErrorCode returns the shared error code of an LDAP store error code.
+func ErrorCode(storeError int32) users.ErrorCode {
+	if storeError == 0 {
+		return users.ErrorCode_NONE
+	}
+	if code, ok := errorCodes[storeError]; ok {
+		return code
+	}
+	return users.ErrorCode_STORE_FAILURE
+}
+
+// Converts an error code to a gRPC status, for the streaming RPCs whose messages can't carry an error code.
+func statusError(storeError int32, err error) error {
+	return grpcerr.New(ErrorCode(storeError), StoreName, storeError, err.Error())
+}
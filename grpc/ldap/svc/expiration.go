@@ -0,0 +1,177 @@
+package svc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"csb.nc/auth/stores/users"
+	"github.com/go-ldap/ldap"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	viperKeyLdapPasswordExpirationWarningDays            = "ldap.passwordExpiration.warningDays"
+	viperKeyLdapPasswordExpirationMaxPwdAgeCacheDuration = "ldap.passwordExpiration.maxPwdAgeCacheDuration"
+
+	ldapMaxPwdAgeCacheDurationDefault = time.Hour
+
+	ldapPasswordExpiryTimeComputedAttr = "msDS-UserPasswordExpiryTimeComputed"
+	ldapPwdLastSetAttr                 = "pwdLastSet"
+	ldapMaxPwdAgeAttr                  = "maxPwdAge"
+	ldapDefaultNamingContextAttr       = "defaultNamingContext"
+	ldapDomainFilter                   = "(objectClass=*)"
+
+	ldapUserAccountControlFlagDontExpirePassword = 0x00010000
+
+	// Number of 100-nanosecond intervals between January 1, 1601 and January 1, 1970.
+	fileTimeUnixEpoch = 116444736000000000
+)
+
+// Converts a FILETIME, the number of 100-nanosecond intervals since January 1, 1601 UTC, to a time.
+func fromFileTime(ft int64) time.Time {
+	ft -= fileTimeUnixEpoch
+	return time.Unix(ft/1e7, (ft%1e7)*100).UTC()
+}
+
+// The maxPwdAge of the domain, which changes rarely, so it is not read by each authentication.
+var maxPwdAgeCache struct {
+	sync.Mutex
+	value   time.Duration
+	expires time.Time
+}
+
+// Returns the maxPwdAge of the domain, read again once the cache duration has elapsed.
+func cachedDomainMaxPwdAge(conn *ldap.Conn) (time.Duration, error) {
+	maxPwdAgeCache.Lock()
+	defer maxPwdAgeCache.Unlock()
+
+	if time.Now().Before(maxPwdAgeCache.expires) {
+		return maxPwdAgeCache.value, nil
+	}
+	age, err := domainMaxPwdAge(conn)
+	if err != nil {
+		return 0, err
+	}
+	duration := ldapMaxPwdAgeCacheDurationDefault
+	if viper.IsSet(viperKeyLdapPasswordExpirationMaxPwdAgeCacheDuration) {
+		duration = viper.GetDuration(viperKeyLdapPasswordExpirationMaxPwdAgeCacheDuration)
+	}
+	maxPwdAgeCache.value, maxPwdAgeCache.expires = age, time.Now().Add(duration)
+	return age, nil
+}
+
+// Reads the maxPwdAge of the domain, from the domain object of the RootDSE default naming context.
+// The returned duration is zero when the passwords of the domain do not expire.
+func domainMaxPwdAge(conn *ldap.Conn) (time.Duration, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		ldapRootDSEFilter,
+		[]string{ldapDefaultNamingContextAttr},
+		nil,
+	))
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Entries) == 0 || res.Entries[0].GetAttributeValue(ldapDefaultNamingContextAttr) == "" {
+		return 0, fmt.Errorf("the default naming context could not be read from the RootDSE")
+	}
+
+	res, err = conn.Search(ldap.NewSearchRequest(
+		res.Entries[0].GetAttributeValue(ldapDefaultNamingContextAttr),
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		ldapDomainFilter,
+		[]string{ldapMaxPwdAgeAttr},
+		nil,
+	))
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Entries) == 0 {
+		return 0, fmt.Errorf("the domain object could not be read")
+	}
+
+	value := res.Entries[0].GetAttributeValue(ldapMaxPwdAgeAttr)
+	if value == "" {
+		return 0, nil
+	}
+	// The maxPwdAge is a negative number of 100-nanosecond intervals, the minimum value meaning that the passwords never expire.
+	age, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || age == math.MinInt64 {
+		return 0, err
+	}
+	if age < 0 {
+		age = -age
+	}
+	return time.Duration(age) * 100, nil
+}
+
+// Reads the password expiration of a user entry, fetched with the attributes of findAuthEntry.
+// The returned time is zero when the password does not expire, or must be changed at the next logon.
+func passwordExpiration(conn *ldap.Conn, entry *ldap.Entry) (time.Time, error) {
+	uac, err := strconv.ParseInt(entry.GetAttributeValue(ldapUserAccountControlAttr), 0, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if uac&ldapUserAccountControlFlagDontExpirePassword != 0 {
+		return time.Time{}, nil
+	}
+
+	// The constructed attribute takes the fine-grained password policies into account.
+	if value := entry.GetAttributeValue(ldapPasswordExpiryTimeComputedAttr); value != "" {
+		ft, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ft == 0 || ft == math.MaxInt64 {
+			return time.Time{}, err
+		}
+		return fromFileTime(ft), nil
+	}
+
+	value := entry.GetAttributeValue(ldapPwdLastSetAttr)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	pwdLastSet, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || pwdLastSet == 0 {
+		return time.Time{}, err
+	}
+	maxPwdAge, err := cachedDomainMaxPwdAge(conn)
+	if err != nil || maxPwdAge == 0 {
+		return time.Time{}, err
+	}
+	return fromFileTime(pwdLastSet).Add(maxPwdAge), nil
+}
+
+// Sets the password expiration of an authentication response.
+// The remaining days are rounded up, so a password expiring in 1 day and 23 hours expires in 2 days, and in 1 day on its last day.
+func setPasswordExpiration(resp *users.AuthResponse, expires time.Time) {
+	if expires.IsZero() {
+		return
+	}
+	resp.PasswordExpiresAt = timestamppb.New(expires)
+	if remaining := time.Until(expires); remaining > 0 {
+		resp.PasswordExpiresInDays = int32((remaining + 24*time.Hour - 1) / (24 * time.Hour))
+	}
+}
+
+// Checks if the password of a successful authentication expires within the warning window.
+func passwordExpiring(resp *users.AuthResponse) bool {
+	days := viper.GetInt(viperKeyLdapPasswordExpirationWarningDays)
+	if days <= 0 || resp.PasswordExpiresAt == nil {
+		return false
+	}
+	zap.L().Sugar().Debugf("The password expires in %d days.", resp.PasswordExpiresInDays)
+	return time.Until(resp.PasswordExpiresAt.AsTime()) <= time.Duration(days)*24*time.Hour
+}
@@ -0,0 +1,118 @@
+package svc
+
+import (
+	"fmt"
+	"strings"
+
+	"csb.nc/auth/stores/grpc/ldap/guid"
+	"csb.nc/auth/stores/tools/scim"
+	"csb.nc/auth/stores/users"
+	"github.com/go-ldap/ldap"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Builds the LDAP filter of a search request, from its search terms and its structured filter.
+func searchClaimsFilter(req *users.SearchRequest) (string, error) {
+	if req.Filter == nil {
+		return fmt.Sprintf(ldapUserFilter, searchTermsFilter(req.Search)), nil
+	}
+
+	zap.L().Sugar().Infof("Filtering the directory using: %s", scim.Format(req.Filter))
+	claimsFilter, err := searchFilter(req.Filter)
+	if err != nil {
+		return "", err
+	}
+	if req.Search != "" {
+		claimsFilter = searchTermsFilter(req.Search) + claimsFilter
+	}
+	return fmt.Sprintf(ldapUserFilter, claimsFilter), nil
+}
+
+// Builds the LDAP filter of the free text search terms, matched as prefixes. The terms are escaped, so their special
+// characters, such as the wildcards and the parentheses, are matched literally rather than changing the filter.
+func searchTermsFilter(search string) string {
+	return fmt.Sprintf(ldapSearchTermsFilter, ldap.EscapeFilter(search))
+}
+
+// Validates and translates a structured search filter into an LDAP filter.
+func searchFilter(f *users.Filter) (string, error) {
+	if err := scim.Validate(f); err != nil {
+		return "", err
+	}
+	return ldapFilter(f)
+}
+
+// Translates a structured search filter into an LDAP filter, using the claims mapping.
+func ldapFilter(f *users.Filter) (string, error) {
+	switch e := f.GetExpression().(type) {
+	case *users.Filter_Comparison:
+		return ldapComparisonFilter(e.Comparison)
+	case *users.Filter_And:
+		return ldapGroupFilter("&", e.And)
+	case *users.Filter_Or:
+		return ldapGroupFilter("|", e.Or)
+	case *users.Filter_Not:
+		inner, err := ldapFilter(e.Not)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(!%s)", inner), nil
+	default:
+		return "", fmt.Errorf("empty filter expression")
+	}
+}
+
+func ldapGroupFilter(op string, g *users.FilterGroup) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("(")
+	sb.WriteString(op)
+	for _, f := range g.GetFilters() {
+		inner, err := ldapFilter(f)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(inner)
+	}
+	sb.WriteString(")")
+	return sb.String(), nil
+}
+
+func ldapComparisonFilter(c *users.FilterComparison) (string, error) {
+	mapping := viper.Sub(viperKeyLdapClaimsMapping)
+	attr := mapping.GetString(c.Claim)
+	if attr == "" {
+		return "", fmt.Errorf("the claim '%s' is not mapped to an LDAP attribute", c.Claim)
+	}
+	if _, ok := parseDNReference(c.Claim, attr); ok {
+		return "", fmt.Errorf("the claim '%s' is resolved from a DN reference and cannot be filtered", c.Claim)
+	}
+
+	if c.Operator == users.FilterOperator_PR {
+		return fmt.Sprintf("(%s=*)", attr), nil
+	}
+
+	value := ldap.EscapeFilter(c.Value)
+	if viper.Sub(viperKeyLdapAttributes).GetString(attr) == "guid" {
+		// GUIDs are stored as bytes, so they can only be compared as a whole.
+		if c.Operator != users.FilterOperator_EQ {
+			return "", fmt.Errorf("the claim '%s' only supports the eq operator", c.Claim)
+		}
+		id, err := guid.FromString(c.Value)
+		if err != nil {
+			return "", err
+		}
+		value = id.EscapeFilter()
+	}
+
+	switch c.Operator {
+	case users.FilterOperator_EQ:
+		return fmt.Sprintf("(%s=%s)", attr, value), nil
+	case users.FilterOperator_SW:
+		return fmt.Sprintf("(%s=%s*)", attr, value), nil
+	case users.FilterOperator_CO:
+		return fmt.Sprintf("(%s=*%s*)", attr, value), nil
+	default:
+		return "", fmt.Errorf("unsupported operator %d", c.Operator)
+	}
+}
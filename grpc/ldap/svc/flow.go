@@ -0,0 +1,145 @@
+package svc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"csb.nc/auth/stores/tools/authflow"
+	"csb.nc/auth/stores/users"
+	"github.com/go-ldap/ldap"
+	"go.uber.org/zap"
+)
+
+const (
+	ldapUnicodePwdAttr = "unicodePwd"
+
+	// Data field of the bind diagnostic message when the password must be changed.
+	adDataPasswordMustChange = "773"
+	// Prefix of the modify diagnostic message when the new password does not comply with the password policy.
+	adDiagPasswordPolicy = "0000052D"
+)
+
+// Extracts the data field of the Active Directory diagnostic messages, such as `AcceptSecurityContext error, data 52e, v3839`.
+var adDiagnosticData = regexp.MustCompile(`data ([0-9a-fA-F]+)`)
+
+var flowStore = authflow.Store{
+	Name:         StoreName,
+	ErrorCode:    ErrorCode,
+	InvalidState: InvalidFlowState,
+}
+
+// Maps a bind error to an error code, using the reason given by the Active Directory diagnostic message.
+func bindError(err error) int32 {
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials && ldapErr.Err != nil {
+		if match := adDiagnosticData.FindStringSubmatch(ldapErr.Err.Error()); match != nil && strings.EqualFold(match[1], adDataPasswordMustChange) {
+			return PasswordChangeRequired
+		}
+	}
+	return UserBindFailed
+}
+
+// Encodes a password as expected by the unicodePwd attribute: quoted and encoded in UTF-16LE.
+func encodePassword(password string) string {
+	var buf bytes.Buffer
+	for _, c := range utf16.Encode([]rune("\"" + password + "\"")) {
+		binary.Write(&buf, binary.LittleEndian, c)
+	}
+	return buf.String()
+}
+
+// Changes the password of a user with the service account, once the new password follows the password policy of the store.
+// The change is done by removing the current password and adding the new one, so the domain controller checks the current password and enforces the domain password policy.
+// The violations of the password policy of the store are returned with the PasswordRejected error.
+func changePassword(username string, password string, newPassword string) (int32, []*users.PasswordViolation) {
+	zap.L().Sugar().Infof("Changing the password of the user: %s", username)
+
+	conn, err := openConn()
+	if err != nil {
+		zap.L().Error("Could not open LDAP connection", zap.Error(err))
+		return openConnError(err), nil
+	}
+	defer conn.Close()
+
+	entry, _, err := findAuthEntry(conn, username, passwordPolicyNameClaims())
+	if err != nil {
+		zap.L().Error("Could not search the user.", zap.Error(err), zap.String("userName", username))
+		return LdapSearchFailed, nil
+	}
+	if entry == nil {
+		return UserNotFound, nil
+	}
+
+	owner, err := passwordOwner(conn, entry, username)
+	if err != nil {
+		zap.L().Error("Could not read the names of the user.", zap.Error(err), zap.String("userName", username))
+		return LdapSearchFailed, nil
+	}
+	if violations := passwordPolicy().Check(newPassword, owner); len(violations) > 0 {
+		zap.L().Info("The new password has been rejected by the password policy of the store.", zap.String("userName", username))
+		return PasswordRejected, violations
+	}
+
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	req.Delete(ldapUnicodePwdAttr, []string{encodePassword(password)})
+	req.Add(ldapUnicodePwdAttr, []string{encodePassword(newPassword)})
+	if err := conn.Modify(req); err != nil {
+		var ldapErr *ldap.Error
+		switch {
+		case errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultConstraintViolation && strings.HasPrefix(ldapErr.Err.Error(), adDiagPasswordPolicy):
+			zap.L().Info("The new password has been rejected by the password policy.", zap.String("userName", username))
+			return PasswordRejected, nil
+		case errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultConstraintViolation:
+			// The current password is not the one removed.
+			zap.L().Warn("The current password is invalid.", zap.Error(err), zap.String("userName", username))
+			return UserBindFailed, nil
+		default:
+			zap.L().Error("Could not change the password.", zap.Error(err), zap.String("userName", username))
+			return PasswordChangeFailed, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// Runs the steps of the authentication flows against the domain controller.
+type flowHandler struct{}
+
+func (flowHandler) Password(creds *users.AuthRequest) *authflow.Step {
+	resp := Authenticate(creds)
+	if resp.Error == PasswordChangeRequired {
+		return &authflow.Step{Challenge: users.ChallengeType_NEW_PASSWORD_REQUIRED}
+	}
+	if resp.Succeeded && passwordExpiring(resp) {
+		// The user can change the password now, or keep it until it expires.
+		return &authflow.Step{Challenge: users.ChallengeType_PASSWORD_EXPIRING, Skipped: resp}
+	}
+	return &authflow.Step{Result: resp}
+}
+
+func (flowHandler) NewPassword(creds *users.AuthRequest, newPassword string) *authflow.Step {
+	switch code, violations := changePassword(creds.Username, creds.Password, newPassword); code {
+	case 0:
+	case PasswordRejected:
+		return &authflow.Step{Error: code, Violations: violations}
+	default:
+		return &authflow.Step{Result: &users.AuthResponse{Error: code}}
+	}
+
+	// The user is authenticated with the new password, which also reads the requested claims.
+	return &authflow.Step{Result: Authenticate(&users.AuthRequest{
+		Username: creds.Username,
+		Password: newPassword,
+		Claims:   creds.Claims,
+	})}
+}
+
+// AuthenticateFlow authenticates a user through a conversation, asking for a new password when the domain controller requires it,
+// or offering to change it when it expires soon.
+func AuthenticateFlow(stream users.User_AuthenticateFlowServer) error {
+	return authflow.Run(stream, flowHandler{}, flowStore)
+}
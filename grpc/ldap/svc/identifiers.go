@@ -0,0 +1,140 @@
+package svc
+
+import (
+	"fmt"
+	"strings"
+
+	"csb.nc/auth/stores/grpc/ldap/guid"
+	"csb.nc/auth/stores/tools/identifiers"
+	"csb.nc/auth/stores/users"
+	"github.com/go-ldap/ldap"
+	"github.com/spf13/viper"
+)
+
+const (
+	viperKeyLdapIdentifiers = "ldap.identifiers"
+
+	ldapIdentifierFilter      = "(%s=%s)"
+	ldapSAMAccountNameAttr    = "sAMAccountName"
+	ldapDistinguishedNameAttr = "distinguishedName"
+)
+
+// Keys of the identifier types in the ldap.identifiers configuration, which sets the attribute matched by each type.
+// The subjects and the usernames are always matched by the objectGUID and the sAMAccountName attributes.
+var ldapIdentifierKeys = map[users.IdentifierType]string{
+	users.IdentifierType_EMAIL:               "email",
+	users.IdentifierType_USER_PRINCIPAL_NAME: "userPrincipalName",
+	users.IdentifierType_DISTINGUISHED_NAME:  "distinguishedName",
+	users.IdentifierType_PHONE_NUMBER:        "phoneNumber",
+	users.IdentifierType_EXTERNAL_ID:         "externalId",
+}
+
+// identifierLookup is a validated identifier, with the LDAP attribute it matches.
+type identifierLookup struct {
+	identifierType users.IdentifierType
+	attr           string
+	value          string
+	id             guid.GUID
+	dn             *ldap.DN
+}
+
+// Validates the identifier, and finds the LDAP attribute matched by its type.
+// The returned error wraps identifiers.ErrInvalid.
+func newIdentifierLookup(identifier string, identifierType users.IdentifierType) (*identifierLookup, error) {
+	if err := identifiers.Validate(identifier, identifierType); err != nil {
+		return nil, err
+	}
+
+	l := &identifierLookup{identifierType: identifierType, value: identifier}
+	switch identifierType {
+	case users.IdentifierType_SUBJECT:
+		id, err := guid.FromString(identifier)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", identifiers.ErrInvalid, err)
+		}
+		l.attr = ldapObjectGUIDAttr
+		l.id = id
+		return l, nil
+	case users.IdentifierType_USER_NAME:
+		l.attr = ldapSAMAccountNameAttr
+		return l, nil
+	case users.IdentifierType_DISTINGUISHED_NAME:
+		dn, err := ldap.ParseDN(identifier)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", identifiers.ErrInvalid, err)
+		}
+		l.dn = dn
+	}
+
+	if key, ok := ldapIdentifierKeys[identifierType]; ok {
+		l.attr = viper.GetString(fmt.Sprintf("%s.%s", viperKeyLdapIdentifiers, key))
+	}
+	if l.attr == "" {
+		return nil, fmt.Errorf("%w: the identifier type %s is not mapped to an LDAP attribute", identifiers.ErrInvalid, identifierType)
+	}
+	return l, nil
+}
+
+// Builds the LDAP condition matching the identifier, without the user condition.
+func (l *identifierLookup) condition() string {
+	if l.identifierType == users.IdentifierType_SUBJECT {
+		return fmt.Sprintf(ldapIdentifierFilter, l.attr, l.id.EscapeFilter())
+	}
+	return fmt.Sprintf(ldapIdentifierFilter, l.attr, ldap.EscapeFilter(l.value))
+}
+
+// Checks if the entry, which must have been fetched with the identifier attribute, matches the identifier.
+func (l *identifierLookup) matches(entry *ldap.Entry) bool {
+	switch {
+	case l.identifierType == users.IdentifierType_SUBJECT:
+		id, err := guid.FromWindowsBytes(entry.GetRawAttributeValue(l.attr))
+		return err == nil && id == l.id
+	case l.dn != nil:
+		values := entry.GetAttributeValues(l.attr)
+		if strings.EqualFold(l.attr, ldapDistinguishedNameAttr) {
+			values = []string{entry.DN}
+		}
+		for _, v := range values {
+			if dn, err := ldap.ParseDN(v); err == nil && equalDN(dn, l.dn) {
+				return true
+			}
+		}
+		return false
+	default:
+		for _, v := range entry.GetAttributeValues(l.attr) {
+			if strings.EqualFold(v, l.value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Compares two DNs, ignoring the case of the attribute values as Active Directory does.
+func equalDN(a *ldap.DN, b *ldap.DN) bool {
+	if len(a.RDNs) != len(b.RDNs) {
+		return false
+	}
+	for i := range a.RDNs {
+		if len(a.RDNs[i].Attributes) != len(b.RDNs[i].Attributes) {
+			return false
+		}
+		for j, attr := range a.RDNs[i].Attributes {
+			other := b.RDNs[i].Attributes[j]
+			if !strings.EqualFold(attr.Type, other.Type) || !strings.EqualFold(attr.Value, other.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Validates the identifier, and builds the LDAP filter matching the user with that identifier.
+// The returned error wraps identifiers.ErrInvalid.
+func identifierFilter(identifier string, identifierType users.IdentifierType) (string, error) {
+	l, err := newIdentifierLookup(identifier, identifierType)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(ldapUserFilter, l.condition()), nil
+}
@@ -0,0 +1,119 @@
+package svc
+
+import (
+	"csb.nc/auth/stores/tools/passwords"
+	"csb.nc/auth/stores/users"
+	"github.com/go-ldap/ldap"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyLdapPasswordPolicy           = "ldap.passwordPolicy"
+	viperKeyLdapPasswordPolicyNameClaims = "ldap.passwordPolicy.nameClaims"
+)
+
+// Claims holding the names of the users, which must not be found in their passwords.
+var passwordPolicyNameClaimsDefault = []string{"name", "given_name", "family_name"}
+
+// Reads the password policy, the rules not configured keeping their default value.
+// The policy is checked before the passwords are sent to the domain controller, which still enforces the domain password policy, including the history.
+func passwordPolicy() passwords.Policy {
+	return passwords.LoadPolicy(viperKeyLdapPasswordPolicy)
+}
+
+// CheckPasswordPolicy checks the configured password policy when the store starts.
+func CheckPasswordPolicy() error {
+	return passwordPolicy().Validate()
+}
+
+func passwordPolicyNameClaims() []string {
+	if viper.IsSet(viperKeyLdapPasswordPolicyNameClaims) {
+		return viper.GetStringSlice(viperKeyLdapPasswordPolicyNameClaims)
+	}
+	return passwordPolicyNameClaimsDefault
+}
+
+// Reads the names of a user from its entry, which must have been fetched with the attributes of the name claims.
+func passwordOwner(conn *ldap.Conn, entry *ldap.Entry, username string) (passwords.Owner, error) {
+	owner := passwords.Owner{Username: username}
+	nameClaims := passwordPolicyNameClaims()
+	claims, err := entriesClaims(conn, []*ldap.Entry{entry}, nameClaims)
+	if err != nil {
+		return owner, err
+	}
+	for _, claim := range nameClaims {
+		if name := claims[0][claim]; name != "" {
+			owner.Names = append(owner.Names, name)
+		}
+	}
+	return owner, nil
+}
+
+// ValidatePassword checks a password against the password policy, and against the names of the user when it is identified.
+// The domain password policy is only checked when the password is changed.
+func ValidatePassword(req *users.ValidatePasswordRequest) *users.ValidatePasswordResponse {
+	resp := &users.ValidatePasswordResponse{}
+
+	owner := passwords.Owner{}
+	if req.Identifier != "" {
+		zap.L().Sugar().Infof("Validating a password of the user: %d:%s", req.IdentifierType, req.Identifier)
+
+		filter, err := identifierFilter(req.Identifier, req.IdentifierType)
+		if err != nil {
+			zap.L().Warn(
+				"The identifier is invalid.",
+				zap.Error(err),
+				zap.String("identifier", req.Identifier),
+				zap.Int("identifierType", int(req.IdentifierType)),
+			)
+			resp.Error = InvalidIdentifier
+			return resp
+		}
+
+		zap.L().Debug("Opening LDAP connection.")
+		conn, err := openConn()
+		if err != nil {
+			zap.L().Error("Could not open LDAP connection", zap.Error(err))
+			resp.Error = openConnError(err)
+			return resp
+		}
+		defer conn.Close()
+
+		attrs := append([]string{ldapSAMAccountNameAttr}, mapClaimsToLdapAttrs(passwordPolicyNameClaims())...)
+		entries, err := findEntries(conn, filter, attrs)
+		if err != nil {
+			zap.L().Error(
+				"An error has occured while searching the user.",
+				zap.Error(err),
+				zap.String("identifier", req.Identifier),
+				zap.Int("identifierType", int(req.IdentifierType)),
+			)
+			resp.Error = LdapSearchFailed
+			return resp
+		}
+		switch len(entries) {
+		case 0:
+			resp.Error = UserNotFound
+			return resp
+		case 1:
+		default:
+			resp.Error = AmbiguousIdentifier
+			return resp
+		}
+
+		if owner, err = passwordOwner(conn, entries[0], entries[0].GetAttributeValue(ldapSAMAccountNameAttr)); err != nil {
+			zap.L().Error("Could not read the names of the user.", zap.Error(err), zap.String("dn", entries[0].DN))
+			resp.Error = LdapSearchFailed
+			return resp
+		}
+	}
+
+	if resp.Violations = passwordPolicy().Check(req.Password, owner); len(resp.Violations) > 0 {
+		resp.Error = PasswordRejected
+		return resp
+	}
+	resp.Succeeded = true
+
+	return resp
+}
@@ -0,0 +1,215 @@
+package svc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyLdapClaimsReferencesMaxDepth  = "ldap.claims.references.maxDepth"
+	viperKeyLdapClaimsReferencesBatchSize = "ldap.claims.references.batchSize"
+
+	ldapReferenceSeparator        = "->"
+	ldapReferenceValuesSeparator  = ","
+	ldapDistinguishedNameFilter   = "(distinguishedName=%s)"
+	ldapReferencesMaxDepthDefault = 2
+	ldapReferencesBatchSize       = 50
+)
+
+// dnReference describes a claim whose value is read from an entry referenced by DN-valued attributes.
+// For example, the mapping `manager -> mail` follows the `manager` attribute and emits the `mail` attribute of the manager's entry.
+type dnReference struct {
+	claim string
+	hops  []string
+	attr  string
+}
+
+// Parses a claim mapping into a DN reference.
+// The boolean is false when the mapping is a plain LDAP attribute.
+func parseDNReference(claim string, mapping string) (dnReference, bool) {
+	parts := strings.Split(mapping, ldapReferenceSeparator)
+	if len(parts) < 2 {
+		return dnReference{}, false
+	}
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return dnReference{
+		claim: claim,
+		hops:  parts[:len(parts)-1],
+		attr:  parts[len(parts)-1],
+	}, true
+}
+
+// Finds the DN references among the requested claims.
+func findDNReferences(claims []string) []dnReference {
+	mapping := viper.Sub(viperKeyLdapClaimsMapping)
+	refs := make([]dnReference, 0)
+	for _, claim := range claims {
+		if ref, ok := parseDNReference(claim, mapping.GetString(claim)); ok && validDNReference(ref, true) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// Checks that a DN reference can be resolved: it does not exceed the maximum depth, and all its hops are DN attributes.
+// The invalid references are logged when warn is set.
+func validDNReference(ref dnReference, warn bool) bool {
+	maxDepth := ldapReferencesMaxDepthDefault
+	if viper.IsSet(viperKeyLdapClaimsReferencesMaxDepth) {
+		maxDepth = viper.GetInt(viperKeyLdapClaimsReferencesMaxDepth)
+	}
+	if len(ref.hops) > maxDepth {
+		if warn {
+			zap.L().Warn(
+				"The DN reference exceeds the maximum depth.",
+				zap.String("claim", ref.claim),
+				zap.Strings("hops", ref.hops),
+				zap.Int("maxDepth", maxDepth),
+			)
+		}
+		return false
+	}
+	convert := viper.Sub(viperKeyLdapAttributes)
+	for _, hop := range ref.hops {
+		if convert.GetString(hop) != "dn" {
+			if warn {
+				zap.L().Sugar().Warnf("The LDAP attribute '%s' of the claim '%s' is not a DN attribute.", hop, ref.claim)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// dnResolver resolves DN references by batching the lookups of the referenced entries.
+// The referenced entries are cached for the lifetime of the resolver, which should not outlive the request.
+type dnResolver struct {
+	conn    *ldap.Conn
+	attrs   []string
+	entries map[string]*ldap.Entry
+}
+
+// Creates a resolver that fetches the attributes required by the provided references.
+func newDNResolver(conn *ldap.Conn, refs []dnReference) *dnResolver {
+	set := make(map[string]bool)
+	attrs := make([]string, 0)
+	for _, ref := range refs {
+		needed := make([]string, 0, len(ref.hops))
+		needed = append(needed, ref.hops[1:]...)
+		needed = append(needed, ref.attr)
+		for _, attr := range needed {
+			if !set[attr] {
+				set[attr] = true
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+	return &dnResolver{
+		conn:    conn,
+		attrs:   attrs,
+		entries: make(map[string]*ldap.Entry),
+	}
+}
+
+// Fetches the entries that are not cached yet, using OR filters on their distinguished names.
+func (r *dnResolver) fetch(dns []string) error {
+	missing := make([]string, 0, len(dns))
+	for _, dn := range dns {
+		key := strings.ToLower(dn)
+		if _, ok := r.entries[key]; !ok {
+			// Marks the entry as requested so it's fetched once, even if it does not exist.
+			r.entries[key] = nil
+			missing = append(missing, dn)
+		}
+	}
+
+	batchSize := viper.GetInt(viperKeyLdapClaimsReferencesBatchSize)
+	if batchSize <= 0 {
+		batchSize = ldapReferencesBatchSize
+	}
+
+	for start := 0; start < len(missing); start += batchSize {
+		end := start + batchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		var sb strings.Builder
+		sb.WriteString("(|")
+		for _, dn := range missing[start:end] {
+			sb.WriteString(fmt.Sprintf(ldapDistinguishedNameFilter, ldap.EscapeFilter(dn)))
+		}
+		sb.WriteString(")")
+
+		zap.L().Sugar().Debugf("Resolving %d DN references.", end-start)
+		entries, err := findEntries(r.conn, sb.String(), r.attrs)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			r.entries[strings.ToLower(entry.DN)] = entry
+		}
+	}
+
+	return nil
+}
+
+// Resolves the DN references of each entry, and returns the resulting claims in the same order than the entries.
+func (r *dnResolver) resolve(entries []*ldap.Entry, refs []dnReference) ([]map[string]string, error) {
+	claims := make([]map[string]string, len(entries))
+	for i := range claims {
+		claims[i] = make(map[string]string, len(refs))
+	}
+	convert := viper.Sub(viperKeyLdapAttributes)
+
+	for _, ref := range refs {
+		current := make([][]*ldap.Entry, len(entries))
+		for i, entry := range entries {
+			current[i] = []*ldap.Entry{entry}
+		}
+
+		// Every hop is resolved for all the entries at once, so there is one batch per depth level.
+		for _, hop := range ref.hops {
+			dns := make([]string, 0)
+			for _, es := range current {
+				for _, e := range es {
+					dns = append(dns, e.GetAttributeValues(hop)...)
+				}
+			}
+			if err := r.fetch(dns); err != nil {
+				return nil, err
+			}
+			for i, es := range current {
+				next := make([]*ldap.Entry, 0)
+				for _, e := range es {
+					for _, dn := range e.GetAttributeValues(hop) {
+						if target := r.entries[strings.ToLower(dn)]; target != nil {
+							next = append(next, target)
+						}
+					}
+				}
+				current[i] = next
+			}
+		}
+
+		for i, es := range current {
+			values := make([]string, 0, len(es))
+			for _, e := range es {
+				if value, ok := attrValue(convert, e, ref.attr); ok && value != "" {
+					values = append(values, value)
+				}
+			}
+			if len(values) > 0 {
+				claims[i][ref.claim] = strings.Join(values, ldapReferenceValuesSeparator)
+			}
+		}
+	}
+
+	return claims, nil
+}
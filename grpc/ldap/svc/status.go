@@ -0,0 +1,137 @@
+package svc
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"csb.nc/auth/stores/users"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	ldapUserAccountControlComputedAttr = "msDS-User-Account-Control-Computed"
+	ldapLockoutTimeAttr                = "lockoutTime"
+	ldapAccountExpiresAttr             = "accountExpires"
+
+	ldapUserAccountControlFlagPasswordExpired = 0x00800000
+)
+
+// Attributes read to compute the status of an account.
+var accountStatusAttrs = []string{
+	ldapObjectGUIDAttr,
+	ldapUserAccountControlAttr,
+	ldapUserAccountControlComputedAttr,
+	ldapLockoutTimeAttr,
+	ldapAccountExpiresAttr,
+	ldapPwdLastSetAttr,
+	ldapPasswordExpiryTimeComputedAttr,
+}
+
+// Parses a FILETIME attribute value, returning a zero time when the value is not set or means never.
+func parseFileTime(value string) time.Time {
+	ft, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ft <= 0 || ft == math.MaxInt64 {
+		return time.Time{}
+	}
+	return fromFileTime(ft)
+}
+
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// GetAccountStatus reads the status of an account from its Active Directory attributes, without authenticating the user.
+func GetAccountStatus(req *users.AccountStatusRequest) *users.AccountStatusResponse {
+	zap.L().Sugar().Infof("Reading the account status of the user: %d:%s", req.IdentifierType, req.Identifier)
+
+	resp := &users.AccountStatusResponse{}
+
+	filter, err := identifierFilter(req.Identifier, req.IdentifierType)
+	if err != nil {
+		zap.L().Warn(
+			"The identifier is invalid.",
+			zap.Error(err),
+			zap.String("identifier", req.Identifier),
+			zap.Int("identifierType", int(req.IdentifierType)),
+		)
+		resp.Error = InvalidIdentifier
+		return resp
+	}
+
+	zap.L().Debug("Opening LDAP connection.")
+	conn, err := openConn()
+	if err != nil {
+		zap.L().Error("Could not open LDAP connection", zap.Error(err))
+		resp.Error = openConnError(err)
+		return resp
+	}
+	defer conn.Close()
+
+	entries, err := findEntries(conn, filter, accountStatusAttrs)
+	if err != nil {
+		zap.L().Error(
+			"An error has occured while reading the account status.",
+			zap.Error(err),
+			zap.String("identifier", req.Identifier),
+			zap.Int("identifierType", int(req.IdentifierType)),
+		)
+		resp.Error = LdapSearchFailed
+		return resp
+	}
+	switch len(entries) {
+	case 0:
+		resp.Error = UserNotFound
+		return resp
+	case 1:
+	default:
+		zap.L().Warn(
+			"Several users match the identifier.",
+			zap.Int("count", len(entries)),
+			zap.String("identifier", req.Identifier),
+			zap.Int("identifierType", int(req.IdentifierType)),
+		)
+		resp.Error = AmbiguousIdentifier
+		return resp
+	}
+
+	entry := entries[0]
+	item := entriesToItems(entries, []string{ldapObjectGUIDAttr})[0]
+	uac, err := strconv.ParseInt(entry.GetAttributeValue(ldapUserAccountControlAttr), 0, 64)
+	if err != nil {
+		zap.L().Error("Could not parse the user account control flag.", zap.Error(err), zap.String("dn", entry.DN))
+		resp.Error = LdapSearchFailed
+		return resp
+	}
+	// The computed flags report the lockout and the password expiration, which are not maintained in userAccountControl by the domain controllers.
+	computed, _ := strconv.ParseInt(entry.GetAttributeValue(ldapUserAccountControlComputedAttr), 0, 64)
+	now := time.Now()
+
+	resp.Subject = item[ldapObjectGUIDAttr]
+	resp.Enabled = uac&ldapUserAccountControlFlagAccountDisable == 0
+	resp.Locked = (uac|computed)&ldapUserAccountControlFlagLockout != 0
+	if resp.Locked {
+		resp.LockedAt = timestamp(parseFileTime(entry.GetAttributeValue(ldapLockoutTimeAttr)))
+	}
+
+	expires := parseFileTime(entry.GetAttributeValue(ldapAccountExpiresAttr))
+	resp.ExpiresAt = timestamp(expires)
+	resp.Expired = !expires.IsZero() && !expires.After(now)
+
+	resp.PasswordChangeRequired = entry.GetAttributeValue(ldapPwdLastSetAttr) == "0"
+	passwordExpires, err := passwordExpiration(conn, entry)
+	if err != nil {
+		zap.L().Warn("Could not read the password expiration.", zap.Error(err), zap.String("dn", entry.DN))
+	}
+	resp.PasswordExpiresAt = timestamp(passwordExpires)
+	resp.PasswordExpired = computed&ldapUserAccountControlFlagPasswordExpired != 0 ||
+		(!passwordExpires.IsZero() && !passwordExpires.After(now))
+
+	resp.Succeeded = true
+
+	return resp
+}
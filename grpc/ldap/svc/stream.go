@@ -0,0 +1,104 @@
+package svc
+
+import (
+	"csb.nc/auth/stores/tools/scim"
+	"csb.nc/auth/stores/users"
+	"github.com/go-ldap/ldap"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	viperKeyLdapSearchPageSize = "ldap.search.pageSize"
+
+	ldapSearchPageSizeDefault = 500
+)
+
+// StreamSearchClaims searches the claims with the provided search filter, and sends the results as each LDAP page arrives.
+// The sends block while the client does not consume the results, so the next page is only requested once the previous one has been sent.
+// The paged search is abandoned when the client cancels the stream.
+func StreamSearchClaims(req *users.SearchRequest, stream users.User_StreamSearchClaimsServer) error {
+	zap.L().Sugar().Infof("Streaming the search though the directory using: %s", req.Search)
+
+	filter, err := searchClaimsFilter(req)
+	if err != nil {
+		zap.L().Warn(
+			"Could not translate the search filter.",
+			zap.Error(err),
+			zap.String("filter", scim.Format(req.Filter)),
+		)
+		return statusError(InvalidFilter, err)
+	}
+	zap.L().Sugar().Debugf("LDAP filter: %s", filter)
+
+	zap.L().Debug("Opening LDAP connection.")
+	conn, err := openConn()
+	if err != nil {
+		zap.L().Error("Could not open LDAP connection", zap.Error(err))
+		return statusError(openConnError(err), err)
+	}
+	defer conn.Close()
+
+	pageSize := viper.GetInt(viperKeyLdapSearchPageSize)
+	if pageSize <= 0 {
+		pageSize = ldapSearchPageSizeDefault
+	}
+	paging := ldap.NewControlPaging(uint32(pageSize))
+	search := ldap.NewSearchRequest(
+		viper.GetString(viperKeyLdapContainer),
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		filter,
+		mapClaimsToLdapAttrs(req.Claims),
+		[]ldap.Control{paging},
+	)
+
+	for {
+		res, err := conn.Search(search)
+		if err != nil {
+			zap.L().Error(
+				"An error has occured while fetching claims.",
+				zap.Error(err),
+				zap.String("search", req.Search),
+				zap.Strings("claims", req.Claims),
+			)
+			return statusError(LdapSearchFailed, err)
+		}
+
+		items, err := entriesClaims(conn, res.Entries, req.Claims)
+		if err != nil {
+			zap.L().Error("An error has occured while resolving the claims references.", zap.Error(err))
+			return statusError(LdapSearchFailed, err)
+		}
+		for _, item := range items {
+			if err := stream.Send(&users.SearchResponseResult{Properties: item}); err != nil {
+				abandonPaging(conn, search, paging)
+				return err
+			}
+		}
+
+		control, ok := ldap.FindControl(res.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(control.Cookie) == 0 {
+			return nil
+		}
+		paging.SetCookie(control.Cookie)
+
+		if err := stream.Context().Err(); err != nil {
+			zap.L().Debug("The search stream has been closed by the client.")
+			abandonPaging(conn, search, paging)
+			return status.FromContextError(err).Err()
+		}
+	}
+}
+
+// Releases the paged search on the domain controller, by requesting a page of size zero.
+func abandonPaging(conn *ldap.Conn, search *ldap.SearchRequest, paging *ldap.ControlPaging) {
+	paging.PagingSize = 0
+	if _, err := conn.Search(search); err != nil {
+		zap.L().Debug("Could not abandon the paged search.", zap.Error(err))
+	}
+}
@@ -3,14 +3,13 @@ package svc
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"strconv"
-	"strings"
 
 	"csb.nc/auth/stores/grpc/ldap/guid"
+	"csb.nc/auth/stores/tools/scim"
 	"csb.nc/auth/stores/users"
 	"github.com/go-ldap/ldap"
 	"github.com/spf13/viper"
@@ -30,6 +29,24 @@ const (
 	UserAccountDisabled
 	// UserAccountLocked indicates that the user's account is disabled.
 	UserAccountLocked
+	// InvalidFilter indicates that the search filter is malformed or cannot be translated to an LDAP filter.
+	InvalidFilter
+	// ServiceAccountRequired indicates that the operation requires a service account, which is not configured in bind-as-user mode.
+	ServiceAccountRequired
+	// InvalidIdentifier indicates that the identifier is malformed for its identifier type.
+	InvalidIdentifier
+	// AmbiguousIdentifier indicates that several users match the identifier.
+	AmbiguousIdentifier
+	// InvalidRequest indicates that the request exceeds the limits of the store.
+	InvalidRequest
+	// PasswordChangeRequired indicates that the credentials are valid, but the password must be changed before the user can bind.
+	PasswordChangeRequired
+	// PasswordRejected indicates that the new password does not comply with the domain password policy.
+	PasswordRejected
+	// PasswordChangeFailed indicates that an error has occured while changing the password in the LDAP directory.
+	PasswordChangeFailed
+	// InvalidFlowState indicates that a request of an authentication flow does not answer the last challenge.
+	InvalidFlowState
 
 	viperKeyLdapUsername              = "ldap.username"
 	viperKeyLdapPassword              = "ldap.password"
@@ -46,7 +63,8 @@ const (
 
 	ldapObjectGUIDFilter       = "(&(objectCategory=person)(objectClass=user)(objectGUID=%s))"
 	ldapSAMAccountNameFilter   = "(&(objectCategory=person)(objectClass=user)(sAMAccountName=%s))"
-	ldapSearchFilter           = "(&(objectCategory=person)(objectClass=user)(|(sAMAccountName=%[1]s*)(sn=%[1]s*)(givenName=%[1]s*)(displayName=%[1]s*)(mail=%[1]s*)))"
+	ldapUserFilter             = "(&(objectCategory=person)(objectClass=user)%s)"
+	ldapSearchTermsFilter      = "(|(sAMAccountName=%[1]s*)(sn=%[1]s*)(givenName=%[1]s*)(displayName=%[1]s*)(mail=%[1]s*))"
 	ldapObjectGUIDAttr         = "objectGUID"
 	ldapDnAttr                 = "dn"
 	ldapUserAccountControlAttr = "userAccountControl"
@@ -57,12 +75,35 @@ const (
 	missingLdapCredentialsError = "Could not read LDAP credentials. Please define 'LDAP_USERNAME' and 'LDAP_PASSWORD' environment variables."
 )
 
-// Opens the LDAP connection and binds with the domain controller.
+// Opens the LDAP connection and binds with the domain controller using the service account.
 func openConn() (*ldap.Conn, error) {
-	if viper.GetString(viperKeyLdapUsername) == "" || viper.GetString(viperKeyLdapPassword) == "" {
+	if !hasServiceAccount() {
+		if isBindAsUser() {
+			return nil, errServiceAccountRequired
+		}
 		zap.L().Error(missingLdapCredentialsError)
 	}
 
+	conn, err := dialConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bindServiceAccount(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Binds the connection with the service account credentials.
+func bindServiceAccount(conn *ldap.Conn) error {
+	return conn.Bind(viper.GetString(viperKeyLdapUsername), viper.GetString(viperKeyLdapPassword))
+}
+
+// Opens the LDAP connection with the domain controller, without binding.
+func dialConn() (*ldap.Conn, error) {
 	protocol := viper.GetString(viperKeyLdapProtocol)
 	tlsEnabled := viper.GetBool(viperKeyLdapTLSEnabled)
 	tlsRootCAs := viper.GetStringSlice(viperKeyLdapTLSRootCAs)
@@ -103,17 +144,24 @@ func openConn() (*ldap.Conn, error) {
 		return nil, err
 	}
 
-	userName := viper.GetString(viperKeyLdapUsername)
-	password := viper.GetString(viperKeyLdapPassword)
-	if err := conn.Bind(userName, password); err != nil {
-		return nil, err
-	}
-
 	return conn, nil
 }
 
-// Searches & finds the LDAP attributes values into the LDAP directory.
-func findItems(conn *ldap.Conn, filter string, attrs []string) ([]map[string]string, error) {
+// Checks if the service account credentials are defined.
+func hasServiceAccount() bool {
+	return viper.GetString(viperKeyLdapUsername) != "" && viper.GetString(viperKeyLdapPassword) != ""
+}
+
+// Maps the error returned by openConn to an error code.
+func openConnError(err error) int32 {
+	if errors.Is(err, errServiceAccountRequired) {
+		return ServiceAccountRequired
+	}
+	return LdapConnectionFailed
+}
+
+// Searches the LDAP entries matching the filter into the LDAP directory.
+func findEntries(conn *ldap.Conn, filter string, attrs []string) ([]*ldap.Entry, error) {
 	req := ldap.NewSearchRequest(
 		viper.GetString(viperKeyLdapContainer),
 		ldap.ScopeWholeSubtree,
@@ -128,27 +176,48 @@ func findItems(conn *ldap.Conn, filter string, attrs []string) ([]map[string]str
 	res, err := conn.Search(req)
 	if err != nil {
 		// If the search has failed, there's no point to continue.
-		return make([]map[string]string, 0), err
+		return make([]*ldap.Entry, 0), err
 	}
-	items := make([]map[string]string, len(res.Entries))
+	return res.Entries, nil
+}
+
+// Converts the LDAP attribute value of the entry to a human readable string.
+// The boolean is false when the conversion type is not supported.
+func attrValue(convert *viper.Viper, entry *ldap.Entry, attr string) (string, bool) {
+	// Using the conversion mapping, we try to convert the LDAP attribute value to a human readable string.
+	cType := convert.GetString(attr)
+	switch cType {
+	case "string", "dn":
+		return entry.GetAttributeValue(attr), true
+	case "guid":
+		raw := entry.GetRawAttributeValue(attr)
+		if len(raw) == 0 {
+			return "", true
+		}
+		id, err := guid.FromWindowsBytes(raw)
+		if err != nil {
+			zap.L().Warn("Could not read the GUID attribute.", zap.Error(err), zap.String("attr", attr), zap.String("dn", entry.DN))
+			return "", false
+		}
+		return id.String(), true
+	default:
+		// There is nothing we can do for that case.
+		zap.L().Sugar().Warnf("Unsupported conversion type: %s", cType)
+		return "", false
+	}
+}
+
+// Converts the LDAP entries to LDAP attributes values.
+func entriesToItems(entries []*ldap.Entry, attrs []string) []map[string]string {
+	items := make([]map[string]string, len(entries))
 	convert := viper.Sub(viperKeyLdapAttributes)
 
-	for index, entry := range res.Entries {
+	for index, entry := range entries {
 		itemValues := make(map[string]string, len(attrs))
 
 		for _, attr := range attrs {
-			// Using the conversion mapping, we try to convert the LDAP attribute value to a human readable string.
-			cType := convert.GetString(attr)
-			switch cType {
-			case "string":
-				itemValues[attr] = entry.GetAttributeValue(attr)
-			case "guid":
-				var bytes [16]byte
-				copy(bytes[:], entry.GetRawAttributeValue(attr)[:16])
-				itemValues[attr] = guid.FromWindowsArray(bytes).String()
-			default:
-				// There is nothing we can do for that case.
-				zap.L().Sugar().Warnf("Unsupported conversion type: %s", cType)
+			if value, ok := attrValue(convert, entry, attr); ok {
+				itemValues[attr] = value
 			}
 		}
 
@@ -156,7 +225,16 @@ func findItems(conn *ldap.Conn, filter string, attrs []string) ([]map[string]str
 		items[index] = itemValues
 	}
 
-	return items, nil
+	return items
+}
+
+// Searches & finds the LDAP attributes values into the LDAP directory.
+func findItems(conn *ldap.Conn, filter string, attrs []string) ([]map[string]string, error) {
+	entries, err := findEntries(conn, filter, attrs)
+	if err != nil {
+		return make([]map[string]string, 0), err
+	}
+	return entriesToItems(entries, attrs), nil
 }
 
 // Maps claims names to LDAP attributes names
@@ -165,7 +243,13 @@ func mapClaimsToLdapAttrs(claims []string) []string {
 	attrs := make([]string, 0)
 	for _, claim := range claims {
 		attr := mapping.GetString(claim)
-		if attr != "" {
+		if ref, ok := parseDNReference(claim, attr); ok {
+			// Only the first DN attribute is read from the entry, the others are read from the referenced entries.
+			// The references which cannot be resolved are not read at all.
+			if validDNReference(ref, false) {
+				attrs = append(attrs, ref.hops[0])
+			}
+		} else if attr != "" {
 			attrs = append(attrs, attr)
 		}
 	}
@@ -202,10 +286,97 @@ func mapLdapAttrsToClaims(attrs map[string]string) map[string]string {
 	return claims
 }
 
+// Searches the LDAP entries matching the filter and maps them to the requested claims, including the DN references.
+func findItemsClaims(conn *ldap.Conn, filter string, claims []string) ([]map[string]string, error) {
+	entries, err := findEntries(conn, filter, mapClaimsToLdapAttrs(claims))
+	if err != nil {
+		return make([]map[string]string, 0), err
+	}
+	return entriesClaims(conn, entries, claims)
+}
+
+// Maps the LDAP entries to the requested claims, including the claims read from the referenced entries.
+// The entries must have been fetched with the attributes of the claims.
+func entriesClaims(conn *ldap.Conn, entries []*ldap.Entry, claims []string) ([]map[string]string, error) {
+	items := entriesToItems(entries, mapClaimsToLdapAttrs(claims))
+	results := make([]map[string]string, len(items))
+	for index, item := range items {
+		results[index] = mapLdapAttrsToClaims(item)
+	}
+
+	if refs := findDNReferences(claims); len(refs) > 0 && len(entries) > 0 {
+		resolved, err := newDNResolver(conn, refs).resolve(entries, refs)
+		if err != nil {
+			return make([]map[string]string, 0), err
+		}
+		for index, refClaims := range resolved {
+			for k, v := range refClaims {
+				results[index][k] = v
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// Checks if the account is disabled or locked, and returns the matching error code.
+func checkUserAccountControl(item map[string]string) int32 {
+	zap.L().Debug("Checking if the account is disabled or locked.")
+	userAccountControlValue := item[ldapUserAccountControlAttr]
+	userAccountControl, err := strconv.ParseInt(userAccountControlValue, 0, 32)
+	if err != nil {
+		zap.L().Error(
+			"Could not parse the user account control flag.",
+			zap.Error(err),
+			zap.String("userAccountControlValue", userAccountControlValue),
+		)
+		return LdapSearchFailed
+	}
+	if userAccountControl|ldapUserAccountControlFlagAccountDisable == userAccountControl {
+		return UserAccountDisabled
+	} else if userAccountControl|ldapUserAccountControlFlagLockout == userAccountControl {
+		return UserAccountLocked
+	}
+	return 0
+}
+
+// Searches the entry of a user by its sAMAccountName, with the attributes required by the authentication and the requested claims.
+// The returned entry is nil when the user has not been found.
+func findAuthEntry(conn *ldap.Conn, username string, claims []string) (*ldap.Entry, map[string]string, error) {
+	attrs := append([]string{
+		ldapObjectGUIDAttr,
+		ldapUserAccountControlAttr,
+		ldapPasswordExpiryTimeComputedAttr,
+		ldapPwdLastSetAttr,
+	}, mapClaimsToLdapAttrs(claims)...)
+	filter := fmt.Sprintf(ldapSAMAccountNameFilter, ldap.EscapeFilter(username))
+	entries, err := findEntries(conn, filter, attrs)
+	if err != nil || len(entries) == 0 {
+		return nil, nil, err
+	}
+	return entries[0], entriesToItems(entries[:1], attrs)[0], nil
+}
+
+// Maps the entry of an authenticated user to the requested claims.
+func authClaims(conn *ldap.Conn, entry *ldap.Entry, claims []string) (map[string]string, error) {
+	if len(claims) == 0 {
+		return nil, nil
+	}
+	results, err := entriesClaims(conn, []*ldap.Entry{entry}, claims)
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
 // Authenticate authenticates a user against the domain controler using the provided credentials.
 func Authenticate(req *users.AuthRequest) *users.AuthResponse {
 	zap.L().Sugar().Infof("Authenticating user: %s", req.Username)
 
+	if isBindAsUser() {
+		return authenticateAsUser(req)
+	}
+
 	resp := &users.AuthResponse{}
 
 	zap.L().Debug("Opening LDAP connection.")
@@ -219,43 +390,23 @@ func Authenticate(req *users.AuthRequest) *users.AuthResponse {
 
 	zap.L().Sugar().Debugf("Searching the distinguished name of the user: %s", req.Username)
 
-	filter := fmt.Sprintf(ldapSAMAccountNameFilter, req.Username)
-	items, err := findItems(conn, filter, []string{ldapObjectGUIDAttr, ldapUserAccountControlAttr})
-
+	entry, item, err := findAuthEntry(conn, req.Username, req.Claims)
 	if err != nil {
 		zap.L().Error(
 			fmt.Sprintf("Could not search LDAP attributes using sAMAccountName: %s", req.Username),
 			zap.Error(err),
-			zap.String("filter", filter),
 			zap.String("userName", req.Username),
 		)
 		resp.Error = LdapSearchFailed
 		return resp
 	}
 
-	if len(items) == 0 {
+	if entry == nil {
 		resp.Error = UserNotFound
 		return resp
 	}
 
-	zap.L().Debug("Checking if the account is disabled or locked.")
-	item := items[0]
-	userAccountControlValue := item[ldapUserAccountControlAttr]
-	if userAccountControl, err := strconv.ParseInt(userAccountControlValue, 0, 32); err == nil {
-		if userAccountControl|ldapUserAccountControlFlagAccountDisable == userAccountControl {
-			resp.Error = UserAccountDisabled
-		} else if userAccountControl|ldapUserAccountControlFlagLockout == userAccountControl {
-			resp.Error = UserAccountLocked
-		}
-	} else {
-		zap.L().Error(
-			"Could not parse the user account control flag.",
-			zap.Error(err),
-			zap.String("userAccountControlValue", userAccountControlValue),
-		)
-		resp.Error = LdapSearchFailed
-	}
-	if resp.Error > 0 {
+	if resp.Error = checkUserAccountControl(item); resp.Error > 0 {
 		return resp
 	}
 
@@ -270,12 +421,32 @@ func Authenticate(req *users.AuthRequest) *users.AuthResponse {
 			zap.String("dn", dn),
 			zap.String("userName", req.Username),
 		)
-		resp.Error = UserBindFailed
+		resp.Error = bindError(err)
 		return resp
 	}
 
+	// The claims and the password expiration are only read once the user is authenticated, so the failed logins do not cost their searches.
+	// They are read with the service account, bound again on the connection.
+	if err := bindServiceAccount(conn); err != nil {
+		zap.L().Error("Could not bind the service account again.", zap.Error(err))
+		resp.Error = LdapConnectionFailed
+		return resp
+	}
+	claims, err := authClaims(conn, entry, req.Claims)
+	if err != nil {
+		zap.L().Error("An error has occured while fetching claims.", zap.Error(err), zap.String("userName", req.Username))
+		resp.Error = LdapSearchFailed
+		return resp
+	}
+	expires, err := passwordExpiration(conn, entry)
+	if err != nil {
+		zap.L().Warn("Could not read the password expiration.", zap.Error(err), zap.String("userName", req.Username))
+	}
+
 	resp.Succeeded = true
 	resp.Subject = item[ldapObjectGUIDAttr]
+	resp.Claims = claims
+	setPasswordExpiration(resp, expires)
 
 	return resp
 }
@@ -289,48 +460,28 @@ func FindClaims(req *users.ClaimsRequest) *users.ClaimsResponse {
 		Claims:    make(map[string]string, len(req.Claims)),
 	}
 
+	filter, err := identifierFilter(req.Identifier, req.IdentifierType)
+	if err != nil {
+		zap.L().Warn(
+			"The identifier is invalid.",
+			zap.Error(err),
+			zap.String("identifier", req.Identifier),
+			zap.Int("identifierType", int(req.IdentifierType)),
+		)
+		resp.Error = InvalidIdentifier
+		return resp
+	}
+
 	zap.L().Debug("Opening LDAP connection.")
 	conn, err := openConn()
 	if err != nil {
 		zap.L().Error("Could not open LDAP connection", zap.Error(err))
-		resp.Error = LdapConnectionFailed
+		resp.Error = openConnError(err)
 		return resp
 	}
 	defer conn.Close()
 
-	var filter string
-	switch req.IdentifierType {
-	case users.IdentifierType_SUBJECT:
-		id, err := guid.FromString(req.Identifier)
-		if err != nil {
-			zap.L().Error(
-				"Could not parse the identifier into a GUID.",
-				zap.Error(err),
-				zap.String("identifier", req.Identifier),
-			)
-		}
-		// Active Directory requires the objectGUID to be hex string with each hex escaped.
-		var sb strings.Builder
-		src := make([]byte, 1)
-		var dst []byte
-		for _, b := range id.ToWindowsArray() {
-			src[0] = b
-			dst = make([]byte, hex.EncodedLen(len(src)))
-			hex.Encode(dst, src)
-			sb.WriteString("\\")
-			sb.Write(dst)
-		}
-		filter = fmt.Sprintf(ldapObjectGUIDFilter, sb.String())
-	case users.IdentifierType_USER_NAME:
-		filter = fmt.Sprintf(ldapSAMAccountNameFilter, req.Identifier)
-	default:
-		zap.L().Sugar().Warnf("Unsupported identifier type: %d", req.IdentifierType)
-		resp.Error = LdapSearchFailed
-		return resp
-	}
-
-	attrs := mapClaimsToLdapAttrs(req.Claims)
-	items, err := findItems(conn, filter, attrs)
+	items, err := findItemsClaims(conn, filter, req.Claims)
 	if err != nil {
 		zap.L().Error(
 			"An error has occured while fetching claims.",
@@ -346,10 +497,19 @@ func FindClaims(req *users.ClaimsRequest) *users.ClaimsResponse {
 		resp.Error = UserNotFound
 		return resp
 	}
+	if len(items) > 1 {
+		zap.L().Warn(
+			"Several users match the identifier.",
+			zap.Int("count", len(items)),
+			zap.String("identifier", req.Identifier),
+			zap.Int("identifierType", int(req.IdentifierType)),
+		)
+		resp.Error = AmbiguousIdentifier
+		return resp
+	}
 
-	item := items[0]
 	resp.Succeeded = true
-	resp.Claims = mapLdapAttrsToClaims(item)
+	resp.Claims = items[0]
 
 	return resp
 }
@@ -366,16 +526,24 @@ func SearchClaims(req *users.SearchRequest) *users.SearchResponse {
 	conn, err := openConn()
 	if err != nil {
 		zap.L().Error("Could not open LDAP connection", zap.Error(err))
-		resp.Error = LdapConnectionFailed
+		resp.Error = openConnError(err)
 		return resp
 	}
 	defer conn.Close()
 
-	filter := fmt.Sprintf(ldapSearchFilter, req.Search)
+	filter, err := searchClaimsFilter(req)
+	if err != nil {
+		zap.L().Warn(
+			"Could not translate the search filter.",
+			zap.Error(err),
+			zap.String("filter", scim.Format(req.Filter)),
+		)
+		resp.Error = InvalidFilter
+		return resp
+	}
 	zap.L().Sugar().Debugf("LDAP filter: %s", filter)
 
-	attrs := mapClaimsToLdapAttrs(req.Claims)
-	items, err := findItems(conn, filter, attrs)
+	items, err := findItemsClaims(conn, filter, req.Claims)
 	if err != nil {
 		zap.L().Error(
 			"An error has occured while fetching claims.",
@@ -390,7 +558,7 @@ func SearchClaims(req *users.SearchRequest) *users.SearchResponse {
 	resp.Results = make([]*users.SearchResponseResult, len(items))
 	for index, item := range items {
 		result := &users.SearchResponseResult{
-			Properties: mapLdapAttrsToClaims(item),
+			Properties: item,
 		}
 		resp.Results[index] = result
 	}
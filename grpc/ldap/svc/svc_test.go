@@ -1,15 +1,24 @@
 package svc
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"csb.nc/auth/stores/grpc/ldap/ldaptest"
 	"csb.nc/auth/stores/tools"
+	"csb.nc/auth/stores/tools/scim"
 	"csb.nc/auth/stores/users"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -17,19 +26,37 @@ const (
 	cfgType = "yaml"
 	cfgPath = "../"
 
-	viperKeyTestsUsersLdapAuthenticate = "tests.users.ldap.authenticate"
-	viperKeyTestsUsersLdapFindClaims   = "tests.users.ldap.findClaims"
-	viperKeyTestsUsersLdapSearchClaims = "tests.users.ldap.searchClaims"
+	viperKeyTestsLdapDirectory               = "tests.ldap.directory"
+	viperKeyTestsLdapMinPasswordLength       = "tests.ldap.minPasswordLength"
+	viperKeyTestsUsersLdapAuthenticate       = "tests.users.ldap.authenticate"
+	viperKeyTestsUsersLdapAuthenticateAsUser = "tests.users.ldap.authenticateAsUser"
+	viperKeyTestsUsersLdapFindClaims         = "tests.users.ldap.findClaims"
+	viperKeyTestsUsersLdapSearchClaims       = "tests.users.ldap.searchClaims"
+	viperKeyTestsUsersLdapFindBatch          = "tests.users.ldap.findClaimsBatch"
+	viperKeyTestsUsersLdapAccountStatus      = "tests.users.ldap.getAccountStatus"
 )
 
+// The in-process directory the tests run against.
+var directory *ldaptest.Server
+
 func TestMain(m *testing.M) {
 	os.Setenv(strings.ToUpper(tools.ViperKeyEnvironment), "test")
 	tools.InitConfig(cfgName, cfgType, cfgPath)
-	if viper.Get(viperKeyLdapUsername) == "" || viper.Get(viperKeyLdapPassword) == "" {
-		zap.L().Fatal(missingLdapCredentialsError)
-	} else {
-		os.Exit(m.Run())
+
+	var err error
+	if directory, err = ldaptest.NewServerFromLDIF(viper.GetString(viperKeyTestsLdapDirectory)); err != nil {
+		zap.L().Fatal("Could not load the test directory.", zap.Error(err))
 	}
+	directory.MinPasswordLength = viper.GetInt(viperKeyTestsLdapMinPasswordLength)
+	if err = directory.Start(); err != nil {
+		zap.L().Fatal("Could not start the test directory.", zap.Error(err))
+	}
+	viper.Set(viperKeyLdapServer, directory.Host())
+	viper.Set(viperKeyLdapPort, directory.Port())
+
+	code := m.Run()
+	directory.Close()
+	os.Exit(code)
 }
 
 type authenticateTestCases struct {
@@ -37,25 +64,145 @@ type authenticateTestCases struct {
 }
 
 type authenticateTestCase struct {
-	Username  string `mapstructure:"username"`
-	Password  string `mapstructure:"password"`
-	Subject   string `mapstructure:"subject"`
-	Succeeded bool   `mapstructure:"succeeded"`
+	Username  string            `mapstructure:"username"`
+	Password  string            `mapstructure:"password"`
+	Subject   string            `mapstructure:"subject"`
+	Claims    []string          `mapstructure:"claims"`
+	Values    map[string]string `mapstructure:"values"`
+	Succeeded bool              `mapstructure:"succeeded"`
+	Error     int32             `mapstructure:"error"`
 }
 
 func TestAuthenticate(t *testing.T) {
 	testCases := &authenticateTestCases{}
 	viper.Sub(viperKeyTestsUsersLdapAuthenticate).Unmarshal(testCases)
+	runAuthenticateCases(t, testCases.Cases)
+}
+
+type accountStatusTestCases struct {
+	Cases []accountStatusTestCase `mapstructure:"cases"`
+}
+
+type accountStatusTestCase struct {
+	Identifier             string               `mapstructure:"identifier"`
+	IdentifierType         users.IdentifierType `mapstructure:"identifierType"`
+	Subject                string               `mapstructure:"subject"`
+	Enabled                bool                 `mapstructure:"enabled"`
+	Locked                 bool                 `mapstructure:"locked"`
+	LockedAt               string               `mapstructure:"lockedAt"`
+	PasswordChangeRequired bool                 `mapstructure:"passwordChangeRequired"`
+	Succeeded              bool                 `mapstructure:"succeeded"`
+	Error                  int32                `mapstructure:"error"`
+}
+
+func TestGetAccountStatus(t *testing.T) {
+	testCases := &accountStatusTestCases{}
+	viper.Sub(viperKeyTestsUsersLdapAccountStatus).Unmarshal(testCases)
 	for i, tc := range testCases.Cases {
+		t.Run(fmt.Sprintf("Case=%d;Identifier=%s;IdentifierType=%d", i, tc.Identifier, tc.IdentifierType), func(t *testing.T) {
+			req := &users.AccountStatusRequest{
+				Identifier:     tc.Identifier,
+				IdentifierType: tc.IdentifierType,
+			}
+			resp := GetAccountStatus(req)
+			lockedAt := ""
+			if resp.LockedAt != nil {
+				lockedAt = resp.LockedAt.AsTime().Format(time.RFC3339)
+			}
+			switch {
+			case resp.Succeeded != tc.Succeeded:
+				t.Errorf("GetAccountStatus failed with error %d.", resp.Error)
+			case resp.Error != tc.Error:
+				t.Errorf("The error %d is different from %d.", resp.Error, tc.Error)
+			case tc.Subject != "" && resp.Subject != tc.Subject:
+				t.Errorf("The subject %s is different from %s.", resp.Subject, tc.Subject)
+			case resp.Enabled != tc.Enabled || resp.Locked != tc.Locked || resp.PasswordChangeRequired != tc.PasswordChangeRequired:
+				t.Errorf("Unexpected account status: %v", resp)
+			case lockedAt != tc.LockedAt:
+				t.Errorf("The account has been locked at %s instead of %s.", lockedAt, tc.LockedAt)
+			case resp.Expired || resp.PasswordExpired:
+				t.Errorf("The account should not be expired: %v", resp)
+			}
+		})
+	}
+}
+
+func TestGetAccountStatusExpired(t *testing.T) {
+	const dn = "CN=Service Authtest,OU=AADDC Users,DC=csb,DC=nc"
+	expired := time.Now().Add(-time.Hour).Truncate(time.Second)
+	value := []byte(strconv.FormatInt(ldaptest.FileTime(expired), 10))
+	directory.Modify(dn, func(e *ldaptest.Entry) {
+		e.Set("accountExpires", value)
+		e.Set("msDS-UserPasswordExpiryTimeComputed", value)
+	})
+	defer directory.Modify(dn, func(e *ldaptest.Entry) {
+		e.Set("accountExpires")
+		e.Set("msDS-UserPasswordExpiryTimeComputed")
+	})
+
+	resp := GetAccountStatus(&users.AccountStatusRequest{Identifier: "service.authtest", IdentifierType: users.IdentifierType_USER_NAME})
+	switch {
+	case !resp.Succeeded:
+		t.Errorf("GetAccountStatus failed with error %d.", resp.Error)
+	case !resp.Expired || resp.ExpiresAt == nil || !resp.ExpiresAt.AsTime().Equal(expired):
+		t.Errorf("The account should have expired at %v: %v", expired, resp)
+	case !resp.PasswordExpired || resp.PasswordExpiresAt == nil || !resp.PasswordExpiresAt.AsTime().Equal(expired):
+		t.Errorf("The password should have expired at %v: %v", expired, resp)
+	}
+}
+
+func TestAuthenticateFailureSearches(t *testing.T) {
+	// The failed logins only search the user's entry, even when reference claims and the password expiration would be read.
+	before := directory.Searches()
+	req := &users.AuthRequest{Username: "service.authtest", Password: "incorrect", Claims: []string{"email", "manager_email"}}
+	if resp := Authenticate(req); resp.Error != UserBindFailed {
+		t.Fatalf("The authentication should fail, error: %d", resp.Error)
+	}
+	if searches := directory.Searches() - before; searches != 1 {
+		t.Errorf("%d searches have been done for a failed login.", searches)
+	}
+}
+
+type authenticateAsUserTestCases struct {
+	Template string                 `mapstructure:"template"`
+	Cases    []authenticateTestCase `mapstructure:"cases"`
+}
+
+func TestAuthenticateAsUser(t *testing.T) {
+	var testCases []authenticateAsUserTestCases
+	viper.UnmarshalKey(viperKeyTestsUsersLdapAuthenticateAsUser, &testCases)
+	defer viper.Set(viperKeyLdapBindMode, ldapBindModeService)
+	viper.Set(viperKeyLdapBindMode, ldapBindModeUser)
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Template=%s", tc.Template), func(t *testing.T) {
+			viper.Set(viperKeyLdapBindTemplate, tc.Template)
+			runAuthenticateCases(t, tc.Cases)
+		})
+	}
+}
+
+func runAuthenticateCases(t *testing.T, testCases []authenticateTestCase) {
+	for i, tc := range testCases {
 		t.Run(fmt.Sprintf("Case=%d;Principal=%s", i, tc.Username), func(t *testing.T) {
 			req := &users.AuthRequest{
 				Username: tc.Username,
 				Password: tc.Password,
+				Claims:   tc.Claims,
 			}
 			if resp := Authenticate(req); resp.Succeeded != tc.Succeeded {
 				t.Errorf("Authentication failed with error %d.", resp.Error)
+			} else if resp.Error != tc.Error {
+				t.Errorf("The error %d is different from %d.", resp.Error, tc.Error)
 			} else if resp.Subject != tc.Subject {
 				t.Errorf("The subject %s is different from %s.", resp.Subject, tc.Subject)
+			} else if !resp.Succeeded && len(resp.Claims) > 0 {
+				t.Errorf("%d claims have been returned by a failed authentication.", len(resp.Claims))
+			} else {
+				for k, v := range tc.Values {
+					if fc := resp.Claims[k]; fc != v {
+						t.Errorf("Claim '%s' does not have the expected value of '%s', value: %s", k, v, fc)
+					}
+				}
 			}
 		})
 	}
@@ -71,6 +218,7 @@ type findClaimsTestCase struct {
 	Claims         []string             `mapstructure:"claims"`
 	Values         map[string]string    `mapstructure:"values"`
 	Succeeded      bool                 `mapstructure:"succeeded"`
+	Error          int32                `mapstructure:"error"`
 }
 
 func TestFindClaims(t *testing.T) {
@@ -85,6 +233,8 @@ func TestFindClaims(t *testing.T) {
 			}
 			if resp := FindClaims(req); resp.Succeeded != tc.Succeeded {
 				t.Errorf("FindClaims failed with error %d.", resp.Error)
+			} else if resp.Error != tc.Error {
+				t.Errorf("The error %d is different from %d.", resp.Error, tc.Error)
 			} else {
 				for k, v := range tc.Values {
 					if fc := resp.Claims[k]; fc != v {
@@ -96,12 +246,105 @@ func TestFindClaims(t *testing.T) {
 	}
 }
 
+type findClaimsBatchTestCases struct {
+	Cases []findClaimsBatchTestCase `mapstructure:"cases"`
+}
+
+type findClaimsBatchTestCase struct {
+	Identifiers []findClaimsBatchIdentifier `mapstructure:"identifiers"`
+	Claims      []string                    `mapstructure:"claims"`
+}
+
+type findClaimsBatchIdentifier struct {
+	Identifier     string               `mapstructure:"identifier"`
+	IdentifierType users.IdentifierType `mapstructure:"identifierType"`
+	Values         map[string]string    `mapstructure:"values"`
+	Succeeded      bool                 `mapstructure:"succeeded"`
+	Error          int32                `mapstructure:"error"`
+}
+
+func TestFindClaimsBatch(t *testing.T) {
+	testCases := &findClaimsBatchTestCases{}
+	viper.Sub(viperKeyTestsUsersLdapFindBatch).Unmarshal(testCases)
+	for i, tc := range testCases.Cases {
+		t.Run(fmt.Sprintf("Case=%d;Identifiers=%d", i, len(tc.Identifiers)), func(t *testing.T) {
+			req := &users.ClaimsBatchRequest{
+				Identifiers: make([]*users.ClaimsBatchIdentifier, len(tc.Identifiers)),
+				Claims:      tc.Claims,
+			}
+			for j, id := range tc.Identifiers {
+				req.Identifiers[j] = &users.ClaimsBatchIdentifier{
+					Identifier:     id.Identifier,
+					IdentifierType: id.IdentifierType,
+				}
+			}
+			resp := FindClaimsBatch(req)
+			if !resp.Succeeded {
+				t.Fatalf("FindClaimsBatch failed with error %d.", resp.Error)
+			}
+			if len(resp.Results) != len(tc.Identifiers) {
+				t.Fatalf("%d results have been returned for %d identifiers.", len(resp.Results), len(tc.Identifiers))
+			}
+			for j, id := range tc.Identifiers {
+				result := resp.Results[j]
+				if result.Identifier != id.Identifier || result.IdentifierType != id.IdentifierType {
+					t.Errorf("The result %d is for the identifier %s instead of %s.", j, result.Identifier, id.Identifier)
+				} else if result.Succeeded != id.Succeeded || result.Error != id.Error {
+					t.Errorf("The result of %s has failed with error %d instead of %d.", id.Identifier, result.Error, id.Error)
+				}
+				for k, v := range id.Values {
+					if fc := result.Claims[k]; fc != v {
+						t.Errorf("Claim '%s' of %s does not have the expected value of '%s', value: %s", k, id.Identifier, v, fc)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFindClaimsBatchLimit(t *testing.T) {
+	req := &users.ClaimsBatchRequest{Claims: []string{"sub"}}
+	for i := 0; i <= viper.GetInt(viperKeyLdapBatchMaxIdentifiers); i++ {
+		req.Identifiers = append(req.Identifiers, &users.ClaimsBatchIdentifier{Identifier: "service.authtest", IdentifierType: users.IdentifierType_USER_NAME})
+	}
+	if resp := FindClaimsBatch(req); resp.Error != InvalidRequest || len(resp.Results) > 0 {
+		t.Errorf("The batch above the maximum should be rejected, error: %d", resp.Error)
+	}
+	// The batch at the maximum is searched, with the attribute of its identifiers requested once.
+	req.Identifiers = req.Identifiers[1:]
+	if resp := FindClaimsBatch(req); !resp.Succeeded || len(resp.Results) != len(req.Identifiers) || resp.Results[0].Claims["sub"] == "" {
+		t.Errorf("The batch at the maximum should be searched: %v", resp)
+	}
+}
+
+func TestMapClaimsToLdapAttrs(t *testing.T) {
+	testCases := []struct {
+		claims []string
+		attrs  []string
+	}{
+		{[]string{"email", "manager_email"}, []string{"mail", "manager"}},
+		{[]string{"manager_name", "direct_reports_emails"}, []string{"manager", "directReports"}},
+		// The references deeper than the maximum depth, or following attributes which are not DNs, are not read.
+		{[]string{"skip_manager_email", "phone_email"}, []string{}},
+		{[]string{"unknown"}, []string{}},
+	}
+	for _, tc := range testCases {
+		if attrs := mapClaimsToLdapAttrs(tc.claims); strings.Join(attrs, ",") != strings.Join(tc.attrs, ",") {
+			t.Errorf("The attributes of %v are %v instead of %v.", tc.claims, attrs, tc.attrs)
+		}
+		if refs := findDNReferences(tc.claims); len(refs) > len(tc.attrs) {
+			t.Errorf("Unresolvable references have been found for %v: %v", tc.claims, refs)
+		}
+	}
+}
+
 type searchClaimsTestCases struct {
 	Cases []searchClaimsTestCase `mapstructure:"cases"`
 }
 
 type searchClaimsTestCase struct {
 	Search    string              `mapstructure:"search"`
+	Filter    string              `mapstructure:"filter"`
 	Claims    []string            `mapstructure:"claims"`
 	Values    []map[string]string `mapstructure:"values"`
 	Succeeded bool                `mapstructure:"succeeded"`
@@ -116,6 +359,13 @@ func TestSearchClaims(t *testing.T) {
 				Search: tc.Search,
 				Claims: tc.Claims,
 			}
+			if tc.Filter != "" {
+				f, err := scim.Parse(tc.Filter)
+				if err != nil {
+					t.Fatalf("Could not parse the filter '%s': %v", tc.Filter, err)
+				}
+				req.Filter = f
+			}
 			if resp := SearchClaims(req); resp.Succeeded != tc.Succeeded {
 				t.Errorf("SearchClaims failed with error %d.", resp.Error)
 			} else {
@@ -130,3 +380,448 @@ func TestSearchClaims(t *testing.T) {
 		})
 	}
 }
+
+// searchClaimsStream collects the results sent by StreamSearchClaims, and cancels the stream after the limit.
+type searchClaimsStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	cancel  context.CancelFunc
+	limit   int
+	results []*users.SearchResponseResult
+}
+
+func (s *searchClaimsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *searchClaimsStream) Send(result *users.SearchResponseResult) error {
+	s.results = append(s.results, result)
+	if s.limit > 0 && len(s.results) >= s.limit {
+		s.cancel()
+	}
+	return nil
+}
+
+func TestStreamSearchClaims(t *testing.T) {
+	testCases := &searchClaimsTestCases{}
+	viper.Sub(viperKeyTestsUsersLdapSearchClaims).Unmarshal(testCases)
+	for i, tc := range testCases.Cases {
+		t.Run(fmt.Sprintf("Case=%d;Search=%s", i, tc.Search), func(t *testing.T) {
+			req := &users.SearchRequest{
+				Search: tc.Search,
+				Claims: tc.Claims,
+			}
+			if tc.Filter != "" {
+				f, err := scim.Parse(tc.Filter)
+				if err != nil {
+					t.Fatalf("Could not parse the filter '%s': %v", tc.Filter, err)
+				}
+				req.Filter = f
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream := &searchClaimsStream{ctx: ctx, cancel: cancel}
+			if err := StreamSearchClaims(req, stream); (err == nil) != tc.Succeeded {
+				t.Errorf("StreamSearchClaims failed: %v", err)
+			} else if len(stream.results) != len(tc.Values) {
+				t.Errorf("%d results have been streamed instead of %d.", len(stream.results), len(tc.Values))
+			} else {
+				for i, m := range tc.Values {
+					for k, v := range m {
+						if fc := stream.results[i].Properties[k]; fc != v {
+							t.Errorf("Claim '%s' does not have the expected value of '%s', value: %s", k, v, fc)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStreamSearchClaimsCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &searchClaimsStream{ctx: ctx, cancel: cancel, limit: 1}
+	req := &users.SearchRequest{
+		Search: "Service",
+		Claims: []string{"sub"},
+	}
+	// The page size of the tests is 1, so the search stops after the first page.
+	err := StreamSearchClaims(req, stream)
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("The stream should have been canceled, error: %v", err)
+	}
+	if len(stream.results) != 1 {
+		t.Errorf("%d results have been streamed after the cancellation.", len(stream.results))
+	}
+}
+
+func TestSearchClaimsEscapesSearchTerms(t *testing.T) {
+	testCases := []struct {
+		search  string
+		escaped string
+	}{
+		{"*", `\2a`},
+		{"*)(objectClass=*", `\2a\29\28objectClass=\2a`},
+		{`dupont\`, `dupont\5c`},
+		{"(marie)", `\28marie\29`},
+	}
+	for _, tc := range testCases {
+		filter, err := searchClaimsFilter(&users.SearchRequest{Search: tc.search})
+		if err != nil {
+			t.Fatalf("Could not build the filter of %q: %v", tc.search, err)
+		}
+		if want := fmt.Sprintf(ldapUserFilter, fmt.Sprintf(ldapSearchTermsFilter, tc.escaped)); filter != want {
+			t.Errorf("The search terms %q are not escaped: %s", tc.search, filter)
+		}
+	}
+
+	// The wildcard is matched literally, so it does not return all the users.
+	if resp := SearchClaims(&users.SearchRequest{Search: "*", Claims: []string{"sub"}}); len(resp.Results) != 0 {
+		t.Errorf("The wildcard search terms have returned users: %v", resp.Results)
+	}
+}
+
+// watchUsersStream collects the changes sent by WatchUsers.
+type watchUsersStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	changes chan *users.UserChange
+}
+
+func (s *watchUsersStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchUsersStream) Send(change *users.UserChange) error {
+	s.changes <- change
+	return nil
+}
+
+func TestWatchUsers(t *testing.T) {
+	const (
+		dn      = "CN=Service Authtest,OU=AADDC Users,DC=csb,DC=nc"
+		subject = "4e8b910b-c12f-49cd-abe7-ced2b6a8d6af"
+		phone   = "46.31.31"
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &watchUsersStream{ctx: ctx, changes: make(chan *users.UserChange, 10)}
+	req := &users.WatchRequest{
+		Claims: []string{"sub", "phone_number"},
+		Cursor: strconv.FormatInt(directory.HighestCommittedUSN(), 10),
+	}
+	done := make(chan error)
+	go func() {
+		done <- WatchUsers(req, stream)
+	}()
+
+	previous := directory.Entry(dn).Value("telephoneNumber")
+	defer directory.Modify(dn, func(e *ldaptest.Entry) {
+		e.Set("telephoneNumber", []byte(previous))
+	})
+	if err := directory.Modify(dn, func(e *ldaptest.Entry) {
+		e.Set("telephoneNumber", []byte(phone))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case change := <-stream.changes:
+		if change.Subject != subject {
+			t.Errorf("The subject %s is different from %s.", change.Subject, subject)
+		}
+		if v := change.Claims["phone_number"]; v != phone {
+			t.Errorf("Claim 'phone_number' does not have the expected value of '%s', value: %s", phone, v)
+		}
+		if change.Disabled || change.Locked {
+			t.Errorf("The user should neither be disabled nor locked.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("No change has been received.")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("WatchUsers failed: %v", err)
+	}
+}
+
+// authFlowStream answers the challenges sent by AuthenticateFlow with the answers, in order, with the state of the last challenge.
+type authFlowStream struct {
+	grpc.ServerStream
+	answers   []*users.AuthFlowRequest
+	responses []*users.AuthFlowResponse
+}
+
+func (s *authFlowStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *authFlowStream) Send(resp *users.AuthFlowResponse) error {
+	s.responses = append(s.responses, resp)
+	return nil
+}
+
+func (s *authFlowStream) Recv() (*users.AuthFlowRequest, error) {
+	if len(s.answers) == 0 {
+		return nil, io.EOF
+	}
+	req := s.answers[0]
+	s.answers = s.answers[1:]
+	if len(s.responses) > 0 {
+		req.State = s.responses[len(s.responses)-1].State
+	}
+	return req, nil
+}
+
+func TestAuthenticateFlow(t *testing.T) {
+	const (
+		dn          = "CN=Service MustChange,OU=AADDC Users,DC=csb,DC=nc"
+		subject     = "7c3e5a21-9d84-4f6b-b2e0-5a1c8f3d9e67"
+		password    = "Lor49914"
+		newPassword = "Lor49914-Changed"
+	)
+
+	// The password is changed by the flow, so the entry is restored for the other tests.
+	defer directory.Modify(dn, func(e *ldaptest.Entry) {
+		e.Set("userPassword", []byte(password))
+		e.Set("pwdLastSet", []byte("0"))
+	})
+
+	stream := &authFlowStream{answers: []*users.AuthFlowRequest{
+		{Credentials: &users.AuthRequest{Username: "service.mustchange", Password: password, Claims: []string{"email"}}},
+		{Challenge: users.ChallengeType_NEW_PASSWORD_REQUIRED, NewPassword: "short"},
+		{Challenge: users.ChallengeType_NEW_PASSWORD_REQUIRED, NewPassword: "MustChange-42"},
+		{Challenge: users.ChallengeType_NEW_PASSWORD_REQUIRED, NewPassword: newPassword},
+	}}
+	if err := AuthenticateFlow(stream); err != nil {
+		t.Fatalf("AuthenticateFlow failed: %v", err)
+	}
+	if len(stream.responses) != 4 {
+		t.Fatalf("%d responses have been sent instead of 4.", len(stream.responses))
+	}
+	if c := stream.responses[0].Challenge; c == nil || c.Type != users.ChallengeType_NEW_PASSWORD_REQUIRED || c.Error != 0 {
+		t.Errorf("A new password should have been required: %v", c)
+	}
+	if c := stream.responses[1].Challenge; c == nil || c.Type != users.ChallengeType_NEW_PASSWORD_REQUIRED || c.Error != PasswordRejected {
+		t.Errorf("The short password should have been rejected: %v", c)
+	}
+	if c := stream.responses[2].Challenge; c == nil || c.Error != PasswordRejected || len(c.Violations) != 1 || c.Violations[0].Type != users.PasswordViolationType_CONTAINS_NAME {
+		t.Errorf("The password containing the name should have been rejected by the policy of the store: %v", c)
+	}
+	if r := stream.responses[3].Result; r == nil || !r.Succeeded || r.Subject != subject || r.Claims["email"] != "service.mustchange@csb.nc" {
+		t.Errorf("The flow should have authenticated the user: %v", r)
+	}
+
+	if resp := Authenticate(&users.AuthRequest{Username: "service.mustchange", Password: newPassword}); !resp.Succeeded {
+		t.Errorf("The new password has not been set, error %d.", resp.Error)
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	testCases := []struct {
+		identifier     string
+		identifierType users.IdentifierType
+		password       string
+		error          int32
+		violations     []users.PasswordViolationType
+	}{
+		{"", users.IdentifierType_USER_NAME, "Authtest-Reef-42", 0, nil},
+		{"", users.IdentifierType_USER_NAME, "abc", PasswordRejected, []users.PasswordViolationType{users.PasswordViolationType_TOO_SHORT}},
+		{"service.authtest", users.IdentifierType_USER_NAME, "Tropical-Reef-42", 0, nil},
+		{"service.authtest", users.IdentifierType_USER_NAME, "Authtest-Reef-42", PasswordRejected, []users.PasswordViolationType{users.PasswordViolationType_CONTAINS_NAME}},
+		{"service.authtest@csb.nc", users.IdentifierType_EMAIL, "Service.Authtest-42", PasswordRejected, []users.PasswordViolationType{users.PasswordViolationType_CONTAINS_USER_NAME, users.PasswordViolationType_CONTAINS_NAME}},
+		{"unknown", users.IdentifierType_USER_NAME, "Tropical-Reef-42", UserNotFound, nil},
+	}
+	for _, tc := range testCases {
+		resp := ValidatePassword(&users.ValidatePasswordRequest{Identifier: tc.identifier, IdentifierType: tc.identifierType, Password: tc.password})
+		if resp.Error != tc.error || resp.Succeeded != (tc.error == 0) || len(resp.Violations) != len(tc.violations) {
+			t.Errorf("%s:%s: the response is %v.", tc.identifier, tc.password, resp)
+			continue
+		}
+		for i, v := range resp.Violations {
+			if v.Type != tc.violations[i] {
+				t.Errorf("%s:%s: the violations are %v instead of %v.", tc.identifier, tc.password, resp.Violations, tc.violations)
+				break
+			}
+		}
+	}
+}
+
+func TestPasswordExpiration(t *testing.T) {
+	const dn = "CN=Service Authtest,OU=AADDC Users,DC=csb,DC=nc"
+	now := time.Now()
+	testCases := []struct {
+		name    string
+		attr    string
+		value   time.Time
+		expires time.Time
+		days    int32
+	}{
+		{"NeverExpires", "", time.Time{}, time.Time{}, 0},
+		// The remaining days are rounded up.
+		{"PwdLastSet", "pwdLastSet", now.Add(-40 * 24 * time.Hour), now.Add(2 * 24 * time.Hour), 2},
+		{"ExpiryTimeComputed", "msDS-UserPasswordExpiryTimeComputed", now.Add(30*24*time.Hour - time.Hour), now.Add(30*24*time.Hour - time.Hour), 30},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.attr != "" {
+				directory.Modify(dn, func(e *ldaptest.Entry) {
+					e.Set(tc.attr, []byte(strconv.FormatInt(ldaptest.FileTime(tc.value), 10)))
+				})
+				defer directory.Modify(dn, func(e *ldaptest.Entry) {
+					e.Set(tc.attr)
+				})
+			}
+
+			resp := Authenticate(&users.AuthRequest{Username: "service.authtest", Password: "Lor49914"})
+			switch {
+			case !resp.Succeeded:
+				t.Errorf("Authentication failed with error %d.", resp.Error)
+			case tc.expires.IsZero() && resp.PasswordExpiresAt != nil:
+				t.Errorf("The password should not expire, expiration: %v", resp.PasswordExpiresAt.AsTime())
+			case tc.expires.IsZero():
+			case resp.PasswordExpiresAt == nil:
+				t.Errorf("The password expiration is missing.")
+			case resp.PasswordExpiresAt.AsTime().Before(tc.expires.Add(-time.Second)) || resp.PasswordExpiresAt.AsTime().After(tc.expires.Add(time.Second)):
+				t.Errorf("The password expires at %v instead of %v.", resp.PasswordExpiresAt.AsTime(), tc.expires)
+			case resp.PasswordExpiresInDays != tc.days:
+				t.Errorf("The password expires in %d days instead of %d.", resp.PasswordExpiresInDays, tc.days)
+			}
+		})
+	}
+}
+
+func TestDomainMaxPwdAgeCache(t *testing.T) {
+	conn, err := openConn()
+	if err != nil {
+		t.Fatalf("Could not open the LDAP connection: %v", err)
+	}
+	defer conn.Close()
+
+	maxPwdAgeCache.expires = time.Time{}
+	if age, err := cachedDomainMaxPwdAge(conn); err != nil || age != 42*24*time.Hour {
+		t.Fatalf("The maxPwdAge of the domain is %v instead of 42 days, error: %v", age, err)
+	}
+	// The cached value is returned without searching the directory again.
+	before := directory.Searches()
+	if age, err := cachedDomainMaxPwdAge(conn); err != nil || age != 42*24*time.Hour {
+		t.Errorf("The cached maxPwdAge is %v, error: %v", age, err)
+	}
+	if searches := directory.Searches() - before; searches != 0 {
+		t.Errorf("The maxPwdAge has been read again, with %d searches.", searches)
+	}
+}
+
+func TestAuthenticateFlowPasswordExpiring(t *testing.T) {
+	const dn = "CN=Service Authtest,OU=AADDC Users,DC=csb,DC=nc"
+	directory.Modify(dn, func(e *ldaptest.Entry) {
+		e.Set("pwdLastSet", []byte(strconv.FormatInt(ldaptest.FileTime(time.Now().Add(-40*24*time.Hour)), 10)))
+	})
+	defer directory.Modify(dn, func(e *ldaptest.Entry) {
+		e.Set("pwdLastSet")
+	})
+
+	stream := &authFlowStream{answers: []*users.AuthFlowRequest{
+		{Credentials: &users.AuthRequest{Username: "service.authtest", Password: "Lor49914"}},
+		{Challenge: users.ChallengeType_PASSWORD_EXPIRING},
+	}}
+	if err := AuthenticateFlow(stream); err != nil {
+		t.Fatalf("AuthenticateFlow failed: %v", err)
+	}
+	if len(stream.responses) != 2 {
+		t.Fatalf("%d responses have been sent instead of 2.", len(stream.responses))
+	}
+	if c := stream.responses[0].Challenge; c == nil || c.Type != users.ChallengeType_PASSWORD_EXPIRING {
+		t.Errorf("The expiring password should have been reported: %v", c)
+	}
+	if r := stream.responses[1].Result; r == nil || !r.Succeeded || r.PasswordExpiresInDays != 2 {
+		t.Errorf("The flow should have authenticated the user, keeping the password: %v", r)
+	}
+}
+
+func TestWatchUsersFromCursorZero(t *testing.T) {
+	// The cursor 0 is before all the changes, so the users are sent without being changed.
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &watchUsersStream{ctx: ctx, changes: make(chan *users.UserChange, 100)}
+	done := make(chan error)
+	go func() {
+		done <- WatchUsers(&users.WatchRequest{Claims: []string{"sub"}, Cursor: "0"}, stream)
+	}()
+
+	select {
+	case change := <-stream.changes:
+		if change.Claims["sub"] != change.Subject {
+			t.Errorf("The first change of %s should carry its claims: %v", change.Subject, change.Claims)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The changes before the stream has started have not been received.")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("WatchUsers failed: %v", err)
+	}
+}
+
+func TestWatchUsersPrune(t *testing.T) {
+	const subject = "4e8b910b-c12f-49cd-abe7-ced2b6a8d6af"
+	conn, err := openConn()
+	if err != nil {
+		t.Fatalf("Could not open the LDAP connection: %v", err)
+	}
+	defer conn.Close()
+
+	w := &watcher{
+		claims: []string{"sub"},
+		seen: map[string]userSnapshot{
+			subject:                                {claims: []uint64{hashClaim(subject)}},
+			"00000000-0000-0000-0000-000000000001": {claims: []uint64{1}},
+		},
+		pruned: time.Now(),
+	}
+	if err := w.prune(conn); err != nil || len(w.seen) != 2 {
+		t.Fatalf("The users should only be pruned once per interval, error: %v, users: %v", err, w.seen)
+	}
+	w.pruned = time.Now().Add(-ldapWatchPruneIntervalDefault)
+	if err := w.prune(conn); err != nil {
+		t.Fatalf("Could not prune the users: %v", err)
+	}
+	if _, ok := w.seen[subject]; !ok || len(w.seen) != 1 {
+		t.Errorf("Only the users missing from the container should be pruned: %v", w.seen)
+	}
+}
+
+func TestWatchUsersPermanentFailure(t *testing.T) {
+	testCases := []struct {
+		name     string
+		key      string
+		value    string
+		bindMode string
+		code     codes.Code
+	}{
+		{"Rejected service account", viperKeyLdapPassword, "incorrect", ldapBindModeService, codes.Unavailable},
+		{"Missing service account", viperKeyLdapPassword, "", ldapBindModeUser, codes.FailedPrecondition},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			previous := viper.GetString(tc.key)
+			defer viper.Set(tc.key, previous)
+			defer viper.Set(viperKeyLdapBindMode, ldapBindModeService)
+			viper.Set(tc.key, tc.value)
+			viper.Set(viperKeyLdapBindMode, tc.bindMode)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			stream := &watchUsersStream{ctx: ctx, changes: make(chan *users.UserChange, 10)}
+			err := WatchUsers(&users.WatchRequest{Claims: []string{"sub"}}, stream)
+			if ctx.Err() != nil {
+				t.Fatalf("The stream has been polled until the timeout.")
+			}
+			if status.Code(err) != tc.code {
+				t.Errorf("The stream has been closed with %v instead of the %s code.", err, tc.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package svc
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/users"
+	"github.com/go-ldap/ldap"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	viperKeyLdapWatchInterval      = "ldap.watch.interval"
+	viperKeyLdapWatchPageSize      = "ldap.watch.pageSize"
+	viperKeyLdapWatchPruneInterval = "ldap.watch.pruneInterval"
+
+	ldapUSNChangedFilter        = "(&(objectCategory=person)(objectClass=user)(uSNChanged>=%d))"
+	ldapUSNChangedAttr          = "uSNChanged"
+	ldapHighestCommittedUSNAttr = "highestCommittedUSN"
+	ldapRootDSEFilter           = "(objectClass=*)"
+
+	ldapWatchIntervalDefault      = 30 * time.Second
+	ldapWatchPageSizeDefault      = 500
+	ldapWatchPruneIntervalDefault = time.Hour
+)
+
+// watcher polls the domain controller for the users whose uSNChanged is greater than the cursor.
+// The uSNChanged attribute is local to a domain controller, so the LDAP server should always target the same one.
+type watcher struct {
+	claims []string
+	// The USN of the last change read, only known once positioned: from the cursor, or from the highest committed USN
+	// when the stream has no cursor. A cursor of 0 is a valid position, before all the changes.
+	usn        int64
+	positioned bool
+	// The users already seen, so their following changes only carry the changed claims.
+	seen map[string]userSnapshot
+	// The time of the last removal of the users deleted or moved out of the container from seen.
+	pruned time.Time
+}
+
+// userSnapshot is the state of a user already seen: the hashes of its requested claims, in the order of the request,
+// 0 for the missing claims, and its account status. The values are not kept, so long-lived streams stay small.
+type userSnapshot struct {
+	claims []uint64
+	status int32
+}
+
+// WatchUsers streams the changes of the users' claims and account status, until the client cancels the stream.
+// The first change of a user after the stream has started carries all the requested claims, the following ones carry only the changed claims.
+func WatchUsers(req *users.WatchRequest, stream users.User_WatchUsersServer) error {
+	zap.L().Sugar().Infof("Watching the users changes from cursor: %s", req.Cursor)
+
+	w := &watcher{
+		claims: req.Claims,
+		seen:   make(map[string]userSnapshot),
+		pruned: time.Now(),
+	}
+	if req.Cursor != "" {
+		usn, err := strconv.ParseInt(req.Cursor, 10, 64)
+		if err != nil || usn < 0 {
+			return grpcerr.New(users.ErrorCode_INVALID_CURSOR, StoreName, 0, fmt.Sprintf("invalid cursor %q", req.Cursor))
+		}
+		w.usn, w.positioned = usn, true
+	}
+
+	interval := viper.GetDuration(viperKeyLdapWatchInterval)
+	if interval <= 0 {
+		interval = ldapWatchIntervalDefault
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.poll(stream); err != nil {
+			if stream.Context().Err() != nil {
+				return nil
+			}
+			// The errors that polling again cannot fix end the stream, the others are retried at the next tick.
+			if isPermanentError(err) {
+				zap.L().Error("The users changes cannot be polled, the stream is closed.", zap.Error(err))
+				return statusError(openConnError(err), err)
+			}
+			zap.L().Error("Could not poll the users changes.", zap.Error(err))
+		}
+		select {
+		case <-stream.Context().Done():
+			zap.L().Debug("The users changes stream has been closed.")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks if an error cannot be fixed by retrying: the service account is missing or rejected, or it is not allowed to read the users.
+func isPermanentError(err error) bool {
+	if errors.Is(err, errServiceAccountRequired) {
+		return true
+	}
+	var ldapErr *ldap.Error
+	return errors.As(err, &ldapErr) &&
+		(ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials || ldapErr.ResultCode == ldap.LDAPResultInsufficientAccessRights)
+}
+
+// Reads the highest USN committed by the domain controller from the RootDSE.
+func highestCommittedUSN(conn *ldap.Conn) (int64, error) {
+	req := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		ldapRootDSEFilter,
+		[]string{ldapHighestCommittedUSNAttr},
+		nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Entries) == 0 {
+		return 0, fmt.Errorf("the RootDSE could not be read")
+	}
+	return strconv.ParseInt(res.Entries[0].GetAttributeValue(ldapHighestCommittedUSNAttr), 10, 64)
+}
+
+// Searches the users changed since the cursor, and sends their changes.
+func (w *watcher) poll(stream users.User_WatchUsersServer) error {
+	conn, err := openConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !w.positioned {
+		// Without a cursor, the stream only carries the changes that happen after it has started.
+		if w.usn, err = highestCommittedUSN(conn); err != nil {
+			return err
+		}
+		w.positioned = true
+		zap.L().Sugar().Debugf("Watching the users changes from USN: %d", w.usn)
+		return nil
+	}
+	if err := w.prune(conn); err != nil {
+		return err
+	}
+
+	attrs := append(mapClaimsToLdapAttrs(w.claims), ldapObjectGUIDAttr, ldapUserAccountControlAttr, ldapUSNChangedAttr)
+	pageSize := viper.GetInt(viperKeyLdapWatchPageSize)
+	if pageSize <= 0 {
+		pageSize = ldapWatchPageSizeDefault
+	}
+	req := ldap.NewSearchRequest(
+		viper.GetString(viperKeyLdapContainer),
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		fmt.Sprintf(ldapUSNChangedFilter, w.usn+1),
+		attrs,
+		nil,
+	)
+	res, err := conn.SearchWithPaging(req, uint32(pageSize))
+	if err != nil {
+		return err
+	}
+
+	items := entriesToItems(res.Entries, attrs)
+	usns := make([]int64, len(items))
+	for index, item := range items {
+		usns[index], _ = strconv.ParseInt(item[ldapUSNChangedAttr], 10, 64)
+	}
+	// The changes are sent in the USN order, so the cursor of each change can be used to resume the stream.
+	sort.Sort(&itemsByUSN{items: items, usns: usns})
+
+	for index, item := range items {
+		subject := item[ldapObjectGUIDAttr]
+		claims := mapLdapAttrsToClaims(item)
+		previous, seen := w.seen[subject]
+		snapshot := userSnapshot{claims: make([]uint64, len(w.claims)), status: checkUserAccountControl(item)}
+		changed := make(map[string]string)
+		for i, claim := range w.claims {
+			v, ok := claims[claim]
+			if !ok {
+				continue
+			}
+			snapshot.claims[i] = hashClaim(v)
+			if !seen || previous.claims[i] != snapshot.claims[i] {
+				changed[claim] = v
+			}
+		}
+		statusChanged := !seen || previous.status != snapshot.status
+
+		w.seen[subject] = snapshot
+		if usns[index] > w.usn {
+			w.usn = usns[index]
+		}
+
+		if len(changed) == 0 && !statusChanged {
+			continue
+		}
+		change := &users.UserChange{
+			Subject:  subject,
+			Claims:   changed,
+			Disabled: snapshot.status == UserAccountDisabled,
+			Locked:   snapshot.status == UserAccountLocked,
+			Cursor:   strconv.FormatInt(usns[index], 10),
+		}
+		zap.L().Sugar().Debugf("Sending the changes of the user: %s", subject)
+		if err := stream.Send(change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Hashes the value of a claim, never to 0, which is the hash of the missing claims.
+func hashClaim(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	if sum := h.Sum64(); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+// Removes the users which are no longer in the container, deleted or moved, from the users already seen, once per prune interval.
+// The users of the container are read by pages, with their objectGUID only.
+func (w *watcher) prune(conn *ldap.Conn) error {
+	interval := viper.GetDuration(viperKeyLdapWatchPruneInterval)
+	if interval <= 0 {
+		interval = ldapWatchPruneIntervalDefault
+	}
+	if len(w.seen) == 0 || time.Since(w.pruned) < interval {
+		return nil
+	}
+
+	pageSize := viper.GetInt(viperKeyLdapWatchPageSize)
+	if pageSize <= 0 {
+		pageSize = ldapWatchPageSizeDefault
+	}
+	attrs := []string{ldapObjectGUIDAttr}
+	req := ldap.NewSearchRequest(
+		viper.GetString(viperKeyLdapContainer),
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		fmt.Sprintf(ldapUserFilter, ""),
+		attrs,
+		nil,
+	)
+	res, err := conn.SearchWithPaging(req, uint32(pageSize))
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(res.Entries))
+	for _, item := range entriesToItems(res.Entries, attrs) {
+		present[item[ldapObjectGUIDAttr]] = true
+	}
+	for subject := range w.seen {
+		if !present[subject] {
+			delete(w.seen, subject)
+		}
+	}
+	w.pruned = time.Now()
+	zap.L().Sugar().Debugf("%d users are tracked by the users changes stream.", len(w.seen))
+	return nil
+}
+
+// itemsByUSN sorts the LDAP items by their uSNChanged.
+type itemsByUSN struct {
+	items []map[string]string
+	usns  []int64
+}
+
+func (s *itemsByUSN) Len() int {
+	return len(s.items)
+}
+
+func (s *itemsByUSN) Less(i, j int) bool {
+	return s.usns[i] < s.usns[j]
+}
+
+func (s *itemsByUSN) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.usns[i], s.usns[j] = s.usns[j], s.usns[i]
+}
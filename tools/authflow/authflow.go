@@ -0,0 +1,169 @@
+// Package authflow runs the AuthenticateFlow conversations of the user stores.
+//
+// A flow starts with the credentials of the user. While the store requires more from the user, such as a new password,
+// a challenge is sent with a state token, which must be returned with the answer. The flow ends with the result of the authentication.
+package authflow
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/users"
+	"go.uber.org/zap"
+)
+
+const stateSize = 32
+
+// Step is the outcome of a step of the flow: either the result that ends the flow, or the challenge to send to the client.
+// A step without result nor challenge sends the previous challenge again, with the error of the answer.
+type Step struct {
+	Result    *users.AuthResponse
+	Challenge users.ChallengeType
+	Error     int32
+	// Violations are the rules of the password policy that a rejected new password does not follow.
+	Violations []*users.PasswordViolation
+	// Skipped is the result of an optional challenge, such as PASSWORD_EXPIRING, returned when the client does not change its password.
+	Skipped *users.AuthResponse
+}
+
+// Handler runs the steps of the flow in a store.
+type Handler interface {
+	// Password checks the credentials of the first step.
+	Password(creds *users.AuthRequest) *Step
+	// NewPassword changes the password of the user, answering NEW_PASSWORD_REQUIRED or PASSWORD_EXPIRING.
+	// The credentials are the ones of the first step, with the current password.
+	NewPassword(creds *users.AuthRequest, newPassword string) *Step
+}
+
+// OTPHandler is implemented by the stores sending the OTP_REQUIRED challenge, the other stores reject its answers.
+type OTPHandler interface {
+	// OTP checks the one-time code answering OTP_REQUIRED. The credentials are the ones of the first step.
+	OTP(creds *users.AuthRequest, otp string) *Step
+}
+
+// Store identifies the store running the flow, to build the error codes and statuses.
+type Store struct {
+	Name      string
+	ErrorCode func(storeError int32) users.ErrorCode
+	// InvalidState is the store error code returned when a request does not follow the flow.
+	InvalidState int32
+}
+
+// Run runs a flow until its result is sent, the client closes the stream or a request does not follow the flow.
+func Run(stream users.User_AuthenticateFlowServer, h Handler, store Store) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return recvError(err)
+	}
+	if req.State != "" || req.Challenge != users.ChallengeType_NO_CHALLENGE || req.Credentials == nil {
+		return store.invalid("the flow must start with the credentials")
+	}
+
+	creds := req.Credentials
+	step := h.Password(creds)
+	challenge := users.ChallengeType_NO_CHALLENGE
+	var skipped *users.AuthResponse
+	for {
+		if step.Result != nil {
+			return store.sendResult(stream, step.Result)
+		}
+		if step.Challenge != users.ChallengeType_NO_CHALLENGE {
+			challenge = step.Challenge
+			skipped = step.Skipped
+		}
+
+		state, err := newState()
+		if err != nil {
+			zap.L().Error("Could not generate the flow state.", zap.Error(err))
+			return store.failure(err)
+		}
+		zap.L().Sugar().Debugf("Sending the %s challenge to the user: %s", challenge, creds.Username)
+		if err := stream.Send(&users.AuthFlowResponse{
+			State: state,
+			Challenge: &users.AuthChallenge{
+				Type:       challenge,
+				Error:      step.Error,
+				Code:       store.code(step.Error),
+				Violations: step.Violations,
+			},
+		}); err != nil {
+			return err
+		}
+
+		if req, err = stream.Recv(); err != nil {
+			return recvError(err)
+		}
+		if req.State != state || req.Challenge != challenge {
+			return store.invalid(fmt.Sprintf("the request does not answer the %s challenge", challenge))
+		}
+
+		switch challenge {
+		case users.ChallengeType_NEW_PASSWORD_REQUIRED:
+			if req.NewPassword == "" {
+				return store.invalid("the new password is missing")
+			}
+			step = h.NewPassword(creds, req.NewPassword)
+		case users.ChallengeType_PASSWORD_EXPIRING:
+			if req.NewPassword == "" {
+				step = &Step{Result: skipped}
+			} else {
+				step = h.NewPassword(creds, req.NewPassword)
+			}
+		case users.ChallengeType_OTP_REQUIRED:
+			oh, ok := h.(OTPHandler)
+			if !ok {
+				return store.invalid(fmt.Sprintf("the %s challenge is not supported", challenge))
+			}
+			if req.Otp == "" {
+				return store.invalid("the one-time code is missing")
+			}
+			step = oh.OTP(creds, req.Otp)
+		default:
+			return store.invalid(fmt.Sprintf("the %s challenge is not supported", challenge))
+		}
+	}
+}
+
+// Generates a random state token, which binds an answer to its challenge.
+func newState() (string, error) {
+	b := make([]byte, stateSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// A client closing the stream abandons the flow, which is not an error.
+func recvError(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (s Store) code(storeError int32) users.ErrorCode {
+	if storeError == 0 {
+		return users.ErrorCode_NONE
+	}
+	return s.ErrorCode(storeError)
+}
+
+// Sends the result ending the flow, or the status of a failed flow.
+func (s Store) sendResult(stream users.User_AuthenticateFlowServer, resp *users.AuthResponse) error {
+	resp.Code = s.code(resp.Error)
+	if err := grpcerr.Check(stream.Context(), resp.Code, s.Name, resp.Error); err != nil {
+		return err
+	}
+	return stream.Send(&users.AuthFlowResponse{Result: resp})
+}
+
+func (s Store) invalid(message string) error {
+	return grpcerr.New(users.ErrorCode_INVALID_FLOW_STATE, s.Name, s.InvalidState, message)
+}
+
+func (s Store) failure(err error) error {
+	return grpcerr.New(users.ErrorCode_STORE_FAILURE, s.Name, 0, err.Error())
+}
@@ -0,0 +1,309 @@
+package authflow
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"csb.nc/auth/stores/tools/grpcerr"
+	"csb.nc/auth/stores/users"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	mustChange = "must-change"
+	expiring   = "expiring"
+	withOTP    = "with-otp"
+	password   = "password"
+	rejected   = "short"
+	otp        = "123456"
+
+	errInvalidPassword = 1
+	errRejected        = 2
+	errInvalidState    = 3
+	errInvalidOTP      = 4
+)
+
+var store = Store{
+	Name: "test",
+	ErrorCode: func(storeError int32) users.ErrorCode {
+		switch storeError {
+		case errInvalidPassword:
+			return users.ErrorCode_INVALID_CREDENTIALS
+		case errRejected:
+			return users.ErrorCode_PASSWORD_REJECTED
+		case errInvalidOTP:
+			return users.ErrorCode_INVALID_OTP
+		default:
+			return users.ErrorCode_STORE_FAILURE
+		}
+	},
+	InvalidState: errInvalidState,
+}
+
+// handler requires a new password for the mustChange user, and warns the expiring user.
+type handler struct{}
+
+func (handler) Password(creds *users.AuthRequest) *Step {
+	switch {
+	case creds.Password != password:
+		return &Step{Result: &users.AuthResponse{Error: errInvalidPassword}}
+	case creds.Username == mustChange:
+		return &Step{Challenge: users.ChallengeType_NEW_PASSWORD_REQUIRED}
+	case creds.Username == expiring:
+		return &Step{Challenge: users.ChallengeType_PASSWORD_EXPIRING, Skipped: &users.AuthResponse{Succeeded: true, Subject: password}}
+	default:
+		return &Step{Result: &users.AuthResponse{Succeeded: true, Subject: password}}
+	}
+}
+
+func (handler) NewPassword(creds *users.AuthRequest, newPassword string) *Step {
+	if newPassword == rejected {
+		return &Step{Error: errRejected, Violations: []*users.PasswordViolation{{Type: users.PasswordViolationType_TOO_SHORT, Limit: 12}}}
+	}
+	return &Step{Result: &users.AuthResponse{Succeeded: true, Subject: newPassword}}
+}
+
+// otpHandler also requires the one-time code of the withOTP user.
+type otpHandler struct {
+	handler
+}
+
+func (h otpHandler) Password(creds *users.AuthRequest) *Step {
+	if creds.Username == withOTP && creds.Password == password {
+		return &Step{Challenge: users.ChallengeType_OTP_REQUIRED}
+	}
+	return h.handler.Password(creds)
+}
+
+func (otpHandler) OTP(creds *users.AuthRequest, code string) *Step {
+	if code != otp {
+		return &Step{Error: errInvalidOTP}
+	}
+	return &Step{Result: &users.AuthResponse{Succeeded: true, Subject: withOTP}}
+}
+
+// flowStream answers the challenges with the answers, in order, copying the state of the last response unless told otherwise.
+type flowStream struct {
+	grpc.ServerStream
+	answers   []*users.AuthFlowRequest
+	responses []*users.AuthFlowResponse
+}
+
+func (s *flowStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *flowStream) Send(resp *users.AuthFlowResponse) error {
+	s.responses = append(s.responses, resp)
+	return nil
+}
+
+func (s *flowStream) Recv() (*users.AuthFlowRequest, error) {
+	if len(s.answers) == 0 {
+		return nil, io.EOF
+	}
+	req := s.answers[0]
+	s.answers = s.answers[1:]
+	if req.State == "" && len(s.responses) > 0 {
+		req.State = s.responses[len(s.responses)-1].State
+	}
+	return req, nil
+}
+
+func credentials(username string, pwd string) *users.AuthFlowRequest {
+	return &users.AuthFlowRequest{Credentials: &users.AuthRequest{Username: username, Password: pwd}}
+}
+
+func answer(challenge users.ChallengeType, newPassword string) *users.AuthFlowRequest {
+	return &users.AuthFlowRequest{Challenge: challenge, NewPassword: newPassword}
+}
+
+func answerOTP(code string) *users.AuthFlowRequest {
+	return &users.AuthFlowRequest{Challenge: users.ChallengeType_OTP_REQUIRED, Otp: code}
+}
+
+func TestRun(t *testing.T) {
+	testCases := []struct {
+		name       string
+		answers    []*users.AuthFlowRequest
+		challenges []users.ChallengeType
+		subject    string
+		error      int32
+		status     codes.Code
+	}{
+		{"Password", []*users.AuthFlowRequest{credentials("user", password)}, nil, password, 0, codes.OK},
+		{"InvalidPassword", []*users.AuthFlowRequest{credentials("user", "incorrect")}, nil, "", errInvalidPassword, codes.OK},
+		{
+			"NewPassword",
+			[]*users.AuthFlowRequest{credentials(mustChange, password), answer(users.ChallengeType_NEW_PASSWORD_REQUIRED, "new")},
+			[]users.ChallengeType{users.ChallengeType_NEW_PASSWORD_REQUIRED},
+			"new", 0, codes.OK,
+		},
+		{
+			"RejectedPassword",
+			[]*users.AuthFlowRequest{
+				credentials(mustChange, password),
+				answer(users.ChallengeType_NEW_PASSWORD_REQUIRED, rejected),
+				answer(users.ChallengeType_NEW_PASSWORD_REQUIRED, "new"),
+			},
+			[]users.ChallengeType{users.ChallengeType_NEW_PASSWORD_REQUIRED, users.ChallengeType_NEW_PASSWORD_REQUIRED},
+			"new", 0, codes.OK,
+		},
+		{
+			"SkippedExpiring",
+			[]*users.AuthFlowRequest{credentials(expiring, password), answer(users.ChallengeType_PASSWORD_EXPIRING, "")},
+			[]users.ChallengeType{users.ChallengeType_PASSWORD_EXPIRING},
+			password, 0, codes.OK,
+		},
+		{
+			"ChangedExpiring",
+			[]*users.AuthFlowRequest{credentials(expiring, password), answer(users.ChallengeType_PASSWORD_EXPIRING, "new")},
+			[]users.ChallengeType{users.ChallengeType_PASSWORD_EXPIRING},
+			"new", 0, codes.OK,
+		},
+		{
+			"Abandoned",
+			[]*users.AuthFlowRequest{credentials(mustChange, password)},
+			[]users.ChallengeType{users.ChallengeType_NEW_PASSWORD_REQUIRED},
+			"", 0, codes.OK,
+		},
+		{"MissingCredentials", []*users.AuthFlowRequest{{}}, nil, "", 0, codes.InvalidArgument},
+		{
+			"WrongChallenge",
+			[]*users.AuthFlowRequest{credentials(mustChange, password), answer(users.ChallengeType_OTP_REQUIRED, "new")},
+			[]users.ChallengeType{users.ChallengeType_NEW_PASSWORD_REQUIRED},
+			"", 0, codes.InvalidArgument,
+		},
+		{
+			"WrongState",
+			[]*users.AuthFlowRequest{credentials(mustChange, password), {State: "forged", Challenge: users.ChallengeType_NEW_PASSWORD_REQUIRED, NewPassword: "new"}},
+			[]users.ChallengeType{users.ChallengeType_NEW_PASSWORD_REQUIRED},
+			"", 0, codes.InvalidArgument,
+		},
+		{
+			"MissingNewPassword",
+			[]*users.AuthFlowRequest{credentials(mustChange, password), answer(users.ChallengeType_NEW_PASSWORD_REQUIRED, "")},
+			[]users.ChallengeType{users.ChallengeType_NEW_PASSWORD_REQUIRED},
+			"", 0, codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stream := &flowStream{answers: tc.answers}
+			err := Run(stream, handler{}, store)
+			if status.Code(err) != tc.status {
+				t.Fatalf("The flow has ended with %v instead of %s.", err, tc.status)
+			}
+			if err != nil {
+				if info := grpcerr.ErrorInfo(err); info == nil || info.Metadata[grpcerr.MetadataError] != "3" {
+					t.Errorf("Unexpected ErrorInfo: %v", info)
+				}
+			}
+
+			challenges := make([]users.ChallengeType, 0)
+			var result *users.AuthResponse
+			for _, resp := range stream.responses {
+				if resp.Result != nil {
+					result = resp.Result
+				} else if resp.State == "" {
+					t.Errorf("The %s challenge has no state.", resp.Challenge.Type)
+				} else {
+					challenges = append(challenges, resp.Challenge.Type)
+				}
+			}
+			if len(challenges) != len(tc.challenges) {
+				t.Fatalf("The challenges %v have been sent instead of %v.", challenges, tc.challenges)
+			}
+			for i := range challenges {
+				if challenges[i] != tc.challenges[i] {
+					t.Errorf("The challenge %s has been sent instead of %s.", challenges[i], tc.challenges[i])
+				}
+			}
+			if tc.subject == "" && tc.error == 0 {
+				if result != nil {
+					t.Errorf("A result has been sent: %v", result)
+				}
+			} else if result == nil {
+				t.Errorf("No result has been sent.")
+			} else if result.Subject != tc.subject || result.Error != tc.error {
+				t.Errorf("Unexpected result: %v", result)
+			} else if result.Code != store.code(tc.error) {
+				t.Errorf("The code %s is different from %s.", result.Code, store.code(tc.error))
+			}
+		})
+	}
+}
+
+func TestRunRejectedPasswordError(t *testing.T) {
+	stream := &flowStream{answers: []*users.AuthFlowRequest{
+		credentials(mustChange, password),
+		answer(users.ChallengeType_NEW_PASSWORD_REQUIRED, rejected),
+	}}
+	if err := Run(stream, handler{}, store); err != nil {
+		t.Fatalf("The flow has failed: %v", err)
+	}
+	if len(stream.responses) != 2 {
+		t.Fatalf("%d responses have been sent instead of 2.", len(stream.responses))
+	}
+	if c := stream.responses[1].Challenge; c == nil || c.Error != errRejected || c.Code != users.ErrorCode_PASSWORD_REJECTED {
+		t.Errorf("The rejected password is not reported by the challenge: %v", c)
+	} else if len(c.Violations) != 1 || c.Violations[0].Type != users.PasswordViolationType_TOO_SHORT {
+		t.Errorf("The violations are not reported by the challenge: %v", c.Violations)
+	}
+	if stream.responses[0].State == stream.responses[1].State {
+		t.Errorf("The state has not changed between the challenges.")
+	}
+}
+
+func TestRunOTP(t *testing.T) {
+	testCases := []struct {
+		name      string
+		h         Handler
+		answers   []*users.AuthFlowRequest
+		responses int
+		result    int32
+		status    codes.Code
+	}{
+		{"OTP", otpHandler{}, []*users.AuthFlowRequest{credentials(withOTP, password), answerOTP(otp)}, 2, 0, codes.OK},
+		{"InvalidOTP", otpHandler{}, []*users.AuthFlowRequest{credentials(withOTP, password), answerOTP("000000"), answerOTP(otp)}, 3, 0, codes.OK},
+		{"WithoutOTP", otpHandler{}, []*users.AuthFlowRequest{credentials("user", password)}, 1, 0, codes.OK},
+		{"InvalidPassword", otpHandler{}, []*users.AuthFlowRequest{credentials(withOTP, "incorrect")}, 1, errInvalidPassword, codes.OK},
+		{"MissingOTP", otpHandler{}, []*users.AuthFlowRequest{credentials(withOTP, password), answerOTP("")}, 1, 0, codes.InvalidArgument},
+		{"Unsupported", unsupportedOTPHandler{}, []*users.AuthFlowRequest{credentials(withOTP, password), answerOTP(otp)}, 1, 0, codes.InvalidArgument},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stream := &flowStream{answers: tc.answers}
+			if err := Run(stream, tc.h, store); status.Code(err) != tc.status {
+				t.Fatalf("The flow has ended with %v instead of %s.", err, tc.status)
+			}
+			if len(stream.responses) != tc.responses {
+				t.Fatalf("%d responses have been sent instead of %d.", len(stream.responses), tc.responses)
+			}
+			if tc.status != codes.OK {
+				return
+			}
+			if result := stream.responses[tc.responses-1].Result; result == nil || result.Error != tc.result {
+				t.Errorf("Unexpected result: %v", result)
+			}
+			// The rejected code is reported by the same challenge, sent again.
+			if tc.responses == 3 {
+				if c := stream.responses[1].Challenge; c == nil || c.Type != users.ChallengeType_OTP_REQUIRED || c.Code != users.ErrorCode_INVALID_OTP {
+					t.Errorf("The invalid code is not reported by the challenge: %v", c)
+				}
+			}
+		})
+	}
+}
+
+// unsupportedOTPHandler sends the OTP_REQUIRED challenge without checking its answers.
+type unsupportedOTPHandler struct {
+	handler
+}
+
+func (h unsupportedOTPHandler) Password(creds *users.AuthRequest) *Step {
+	return otpHandler{h.handler}.Password(creds)
+}
@@ -0,0 +1,98 @@
+// Package grpcerr converts the error codes of the user stores to gRPC statuses.
+//
+// The infrastructure and request errors are returned as gRPC statuses, with a google.rpc.ErrorInfo detail.
+// The business outcomes, such as invalid credentials or a user not found, stay in the responses.
+package grpcerr
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"csb.nc/auth/stores/users"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Domain is the domain of the ErrorInfo details.
+	Domain = "auth.csb.nc"
+
+	// MetadataStore is the ErrorInfo metadata key of the store name.
+	MetadataStore = "store"
+	// MetadataError is the ErrorInfo metadata key of the store specific error code, which is also set in the Error field of the responses.
+	MetadataError = "error"
+)
+
+// Status codes of the error codes returned as gRPC statuses.
+var statusCodes = map[users.ErrorCode]codes.Code{
+	users.ErrorCode_STORE_UNAVAILABLE:        codes.Unavailable,
+	users.ErrorCode_STORE_FAILURE:            codes.Internal,
+	users.ErrorCode_INVALID_FILTER:           codes.InvalidArgument,
+	users.ErrorCode_INVALID_IDENTIFIER:       codes.InvalidArgument,
+	users.ErrorCode_INVALID_CURSOR:           codes.InvalidArgument,
+	users.ErrorCode_SERVICE_ACCOUNT_REQUIRED: codes.FailedPrecondition,
+	users.ErrorCode_DEADLINE_EXCEEDED:        codes.DeadlineExceeded,
+	users.ErrorCode_INVALID_FLOW_STATE:       codes.InvalidArgument,
+	users.ErrorCode_INVALID_REQUEST:          codes.InvalidArgument,
+	users.ErrorCode_UNAUTHENTICATED:          codes.Unauthenticated,
+	users.ErrorCode_RATE_LIMITED:             codes.ResourceExhausted,
+}
+
+// IsStatus reports whether the error code is returned as a gRPC status, instead of in the response.
+func IsStatus(code users.ErrorCode) bool {
+	_, ok := statusCodes[code]
+	return ok
+}
+
+// New builds the gRPC status error of an error code, with an ErrorInfo detail carrying the store and its specific error code.
+func New(code users.ErrorCode, store string, storeError int32, message string) error {
+	c, ok := statusCodes[code]
+	if !ok {
+		c = codes.Unknown
+	}
+	st := status.New(c, message)
+	info := &errdetails.ErrorInfo{
+		Reason: code.String(),
+		Domain: Domain,
+		Metadata: map[string]string{
+			MetadataStore: store,
+			MetadataError: strconv.Itoa(int(storeError)),
+		},
+	}
+	if detailed, err := st.WithDetails(info); err == nil {
+		st = detailed
+	} else {
+		zap.L().Warn("Could not add the error details to the status.", zap.Error(err))
+	}
+	return st.Err()
+}
+
+// Check returns the gRPC status error of a failed request, or nil if the error code is a business outcome.
+// When the request context has expired, the status errors are returned as DeadlineExceeded, as the failure is likely caused
+// by the deadline. The business outcomes are kept, as the store has answered them.
+func Check(ctx context.Context, code users.ErrorCode, store string, storeError int32) error {
+	if !IsStatus(code) {
+		return nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return New(users.ErrorCode_DEADLINE_EXCEEDED, store, storeError, "the request deadline has expired")
+	}
+	return New(code, store, storeError, code.String())
+}
+
+// ErrorInfo returns the ErrorInfo detail of a status error, or nil if it has none.
+func ErrorInfo(err error) *errdetails.ErrorInfo {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package grpcerr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"csb.nc/auth/stores/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		code   users.ErrorCode
+		status codes.Code
+	}{
+		{users.ErrorCode_NONE, codes.OK},
+		{users.ErrorCode_USER_NOT_FOUND, codes.OK},
+		{users.ErrorCode_INVALID_CREDENTIALS, codes.OK},
+		{users.ErrorCode_STORE_UNAVAILABLE, codes.Unavailable},
+		{users.ErrorCode_STORE_FAILURE, codes.Internal},
+		{users.ErrorCode_INVALID_FILTER, codes.InvalidArgument},
+		{users.ErrorCode_SERVICE_ACCOUNT_REQUIRED, codes.FailedPrecondition},
+		{users.ErrorCode_INVALID_FLOW_STATE, codes.InvalidArgument},
+		{users.ErrorCode_PASSWORD_REJECTED, codes.OK},
+		{users.ErrorCode_USER_EXISTS, codes.OK},
+		{users.ErrorCode_ACCOUNT_EXPIRED, codes.OK},
+		{users.ErrorCode_EMAIL_NOT_VERIFIED, codes.OK},
+		{users.ErrorCode_INVALID_TOKEN, codes.OK},
+		{users.ErrorCode_RATE_LIMITED, codes.ResourceExhausted},
+		{users.ErrorCode_SECOND_FACTOR_REQUIRED, codes.OK},
+		{users.ErrorCode_INVALID_OTP, codes.OK},
+		{users.ErrorCode_OTP_NOT_ENABLED, codes.OK},
+		{users.ErrorCode_OTP_ALREADY_ENABLED, codes.OK},
+		{users.ErrorCode_VERSION_CONFLICT, codes.OK},
+		{users.ErrorCode_INVALID_REQUEST, codes.InvalidArgument},
+		{users.ErrorCode_UNAUTHENTICATED, codes.Unauthenticated},
+	}
+	for _, tc := range testCases {
+		err := Check(ctx, tc.code, "test", 42)
+		if status.Code(err) != tc.status {
+			t.Errorf("The status of %s is %s instead of %s.", tc.code, status.Code(err), tc.status)
+		}
+		if err == nil {
+			continue
+		}
+		info := ErrorInfo(err)
+		if info == nil {
+			t.Errorf("The status of %s has no ErrorInfo.", tc.code)
+		} else if info.Reason != tc.code.String() || info.Domain != Domain || info.Metadata[MetadataStore] != "test" || info.Metadata[MetadataError] != "42" {
+			t.Errorf("Unexpected ErrorInfo of %s: %v", tc.code, info)
+		}
+	}
+}
+
+func TestCheckDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	if err := Check(ctx, users.ErrorCode_NONE, "test", 0); err != nil {
+		t.Errorf("A successful request should not fail: %v", err)
+	}
+	// The business outcomes have been answered by the store before the deadline.
+	if err := Check(ctx, users.ErrorCode_INVALID_CREDENTIALS, "test", 4); err != nil {
+		t.Errorf("A business outcome should stay in the response: %v", err)
+	}
+	err := Check(ctx, users.ErrorCode_STORE_UNAVAILABLE, "test", 1)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("The status is %s instead of %s.", status.Code(err), codes.DeadlineExceeded)
+	}
+	if info := ErrorInfo(err); info == nil || info.Reason != users.ErrorCode_DEADLINE_EXCEEDED.String() {
+		t.Errorf("Unexpected ErrorInfo: %v", info)
+	}
+}
@@ -0,0 +1,148 @@
+// Package identifiers validates the user identifiers received by the user stores, before any lookup.
+//
+// The rules are shared by all the stores. A store can apply stricter rules afterwards, such as the GUID format of the
+// subjects of the LDAP store.
+package identifiers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"csb.nc/auth/stores/users"
+)
+
+const (
+	// MaxSubjectLength is the maximum length of a subject.
+	MaxSubjectLength = 64
+	// MaxUserNameLength is the maximum length of a username.
+	MaxUserNameLength = 256
+	// MaxEmailLength is the maximum length of an email address (RFC 5321).
+	MaxEmailLength = 254
+	// MaxUserPrincipalNameLength is the maximum length of a user principal name.
+	MaxUserPrincipalNameLength = 256
+	// MaxDistinguishedNameLength is the maximum length of a distinguished name.
+	MaxDistinguishedNameLength = 2048
+	// MaxPhoneNumberLength is the maximum length of a phone number.
+	MaxPhoneNumberLength = 32
+	// MaxExternalIDLength is the maximum length of an external ID.
+	MaxExternalIDLength = 128
+)
+
+// ErrInvalid is the error wrapped by all the validation errors.
+var ErrInvalid = errors.New("invalid identifier")
+
+// rule is the validation rule of an identifier type.
+type rule struct {
+	maxLength int
+	allowed   func(r rune) bool
+	// format checks the whole identifier, once its characters are validated. It's optional.
+	format func(identifier string) error
+}
+
+// Characters that are never allowed in addresses.
+const addressForbiddenChars = "\"(),:;<>[\\]*"
+
+var rules = map[users.IdentifierType]rule{
+	// The subjects are GUIDs or opaque IDs, in any of their textual forms.
+	users.IdentifierType_SUBJECT: {
+		maxLength: MaxSubjectLength,
+		allowed: func(r rune) bool {
+			return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.:{}", r))
+		},
+	},
+	// The usernames follow the sAMAccountName rules of Active Directory, which are the strictest of the stores.
+	users.IdentifierType_USER_NAME: {
+		maxLength: MaxUserNameLength,
+		allowed: func(r rune) bool {
+			return unicode.IsPrint(r) && !strings.ContainsRune("\"/\\[]:;|=,+*?<>()", r)
+		},
+	},
+	users.IdentifierType_EMAIL: {
+		maxLength: MaxEmailLength,
+		allowed:   isAddressChar,
+		format:    addressFormat,
+	},
+	users.IdentifierType_USER_PRINCIPAL_NAME: {
+		maxLength: MaxUserPrincipalNameLength,
+		allowed:   isAddressChar,
+		format:    addressFormat,
+	},
+	// The distinguished names can escape any character, they are checked by the stores that support them.
+	users.IdentifierType_DISTINGUISHED_NAME: {
+		maxLength: MaxDistinguishedNameLength,
+		allowed:   unicode.IsPrint,
+		format: func(identifier string) error {
+			if !strings.Contains(identifier, "=") {
+				return errors.New("the distinguished name has no attribute")
+			}
+			return nil
+		},
+	},
+	users.IdentifierType_PHONE_NUMBER: {
+		maxLength: MaxPhoneNumberLength,
+		allowed: func(r rune) bool {
+			return (r >= '0' && r <= '9') || strings.ContainsRune("+-. ()", r)
+		},
+		format: func(identifier string) error {
+			if strings.IndexFunc(identifier, unicode.IsDigit) < 0 {
+				return errors.New("the phone number has no digit")
+			}
+			return nil
+		},
+	},
+	users.IdentifierType_EXTERNAL_ID: {
+		maxLength: MaxExternalIDLength,
+		allowed: func(r rune) bool {
+			return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.:@", r))
+		},
+	},
+}
+
+// Checks if the character is allowed in an email address or a user principal name.
+func isAddressChar(r rune) bool {
+	return unicode.IsPrint(r) && !unicode.IsSpace(r) && !strings.ContainsRune(addressForbiddenChars, r)
+}
+
+// Checks that the identifier has the local@domain form.
+func addressFormat(identifier string) error {
+	at := strings.Index(identifier, "@")
+	if at <= 0 || at != strings.LastIndex(identifier, "@") {
+		return errors.New("the address must have a single @ preceded by a name")
+	}
+	domain := identifier[at+1:]
+	if domain == "" || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") || strings.Contains(domain, "..") {
+		return errors.New("the address domain is invalid")
+	}
+	return nil
+}
+
+// Validate checks the identifier against the rules of its type.
+// The returned error wraps ErrInvalid.
+func Validate(identifier string, identifierType users.IdentifierType) error {
+	r, ok := rules[identifierType]
+	if !ok {
+		return fmt.Errorf("%w: unsupported identifier type %d", ErrInvalid, identifierType)
+	}
+	if identifier == "" {
+		return fmt.Errorf("%w: the %s identifier is empty", ErrInvalid, identifierType)
+	}
+	if len(identifier) > r.maxLength {
+		return fmt.Errorf("%w: the %s identifier is longer than %d bytes", ErrInvalid, identifierType, r.maxLength)
+	}
+	if strings.TrimSpace(identifier) != identifier {
+		return fmt.Errorf("%w: the %s identifier starts or ends with a space", ErrInvalid, identifierType)
+	}
+	for _, c := range identifier {
+		if c == unicode.ReplacementChar || !r.allowed(c) {
+			return fmt.Errorf("%w: the %s identifier contains the forbidden character %q", ErrInvalid, identifierType, c)
+		}
+	}
+	if r.format != nil {
+		if err := r.format(identifier); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package identifiers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"csb.nc/auth/stores/users"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []struct {
+		identifier     string
+		identifierType users.IdentifierType
+	}{
+		{"4e8b910b-c12f-49cd-abe7-ced2b6a8d6af", users.IdentifierType_SUBJECT},
+		{"{4e8b910b-c12f-49cd-abe7-ced2b6a8d6af}", users.IdentifierType_SUBJECT},
+		{"urn:uuid:4e8b910b-c12f-49cd-abe7-ced2b6a8d6af", users.IdentifierType_SUBJECT},
+		{"12345", users.IdentifierType_SUBJECT},
+		{"service.authtest", users.IdentifierType_USER_NAME},
+		{"service.authtest@csb.nc", users.IdentifierType_USER_NAME},
+		{"jérôme.dupont", users.IdentifierType_USER_NAME},
+		{"service.authtest@csb.nc", users.IdentifierType_EMAIL},
+		{"service+tag@mail.csb.nc", users.IdentifierType_EMAIL},
+		{"service.authtest@csb.nc", users.IdentifierType_USER_PRINCIPAL_NAME},
+		{"CN=Service Authtest,OU=AADDC Users,DC=csb,DC=nc", users.IdentifierType_DISTINGUISHED_NAME},
+		{"CN=Dupont\\, Marie,OU=AADDC Users,DC=csb,DC=nc", users.IdentifierType_DISTINGUISHED_NAME},
+		{"46.30.30", users.IdentifierType_PHONE_NUMBER},
+		{"+687 (46) 30-30", users.IdentifierType_PHONE_NUMBER},
+		{"E-001234", users.IdentifierType_EXTERNAL_ID},
+	}
+	for _, tc := range valid {
+		if err := Validate(tc.identifier, tc.identifierType); err != nil {
+			t.Errorf("The identifier %q should be valid: %v", tc.identifier, err)
+		}
+	}
+
+	invalid := []struct {
+		identifier     string
+		identifierType users.IdentifierType
+	}{
+		{"", users.IdentifierType_SUBJECT},
+		{"", users.IdentifierType_USER_NAME},
+		{strings.Repeat("a", MaxSubjectLength+1), users.IdentifierType_SUBJECT},
+		{strings.Repeat("a", MaxUserNameLength+1), users.IdentifierType_USER_NAME},
+		{"4e8b910b c12f", users.IdentifierType_SUBJECT},
+		{"4e8b910b*", users.IdentifierType_SUBJECT},
+		{" service.authtest", users.IdentifierType_USER_NAME},
+		{"service*", users.IdentifierType_USER_NAME},
+		{"service)(objectClass=*", users.IdentifierType_USER_NAME},
+		{"service\\2a", users.IdentifierType_USER_NAME},
+		{"service\x00", users.IdentifierType_USER_NAME},
+		{"service\xff", users.IdentifierType_USER_NAME},
+		{"service.authtest", users.IdentifierType_EMAIL},
+		{"@csb.nc", users.IdentifierType_EMAIL},
+		{"service@", users.IdentifierType_EMAIL},
+		{"service@csb..nc", users.IdentifierType_EMAIL},
+		{"service@authtest@csb.nc", users.IdentifierType_EMAIL},
+		{"service authtest@csb.nc", users.IdentifierType_EMAIL},
+		{"service*@csb.nc", users.IdentifierType_EMAIL},
+		{strings.Repeat("a", MaxEmailLength) + "@csb.nc", users.IdentifierType_EMAIL},
+		{"service.authtest", users.IdentifierType_USER_PRINCIPAL_NAME},
+		{"Service Authtest", users.IdentifierType_DISTINGUISHED_NAME},
+		{"CN=Service\nAuthtest", users.IdentifierType_DISTINGUISHED_NAME},
+		{"+-.", users.IdentifierType_PHONE_NUMBER},
+		{"46.30.30*", users.IdentifierType_PHONE_NUMBER},
+		{"E 001234", users.IdentifierType_EXTERNAL_ID},
+		{"E*", users.IdentifierType_EXTERNAL_ID},
+		{"service.authtest", users.IdentifierType(42)},
+	}
+	for _, tc := range invalid {
+		if err := Validate(tc.identifier, tc.identifierType); err == nil {
+			t.Errorf("The identifier %q should be invalid.", tc.identifier)
+		} else if !errors.Is(err, ErrInvalid) {
+			t.Errorf("The error %v does not wrap ErrInvalid.", err)
+		}
+	}
+}
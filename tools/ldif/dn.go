@@ -0,0 +1,31 @@
+package ldif
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The characters escaped in the values of the DNs. The equal sign is not required by RFC 4514, but is escaped by
+// most directories.
+const dnSpecialChars = ",+\"\\<>;="
+
+// EscapeDNValue escapes an attribute value of an RDN, as RFC 4514 requires.
+// The control characters are escaped as hex pairs, the other UTF-8 characters are kept.
+func EscapeDNValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(dnSpecialChars, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
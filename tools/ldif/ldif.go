@@ -0,0 +1,59 @@
+// Package ldif reads the LDIF files (RFC 2849) and writes the DNs (RFC 4514) of the directory entries, for the stores
+// that exchange their users with a directory.
+package ldif
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The longest logical line read, the binary values such as the photos being base64 encoded.
+const maxLineLength = 1024 * 1024
+
+// Line is a logical line of an LDIF file, once its folded lines are joined.
+type Line struct {
+	// Text is the attribute and its value, or "" for the blank lines ending the records.
+	Text string
+	// Number is the number of the first physical line of the logical line, from 1.
+	Number int
+}
+
+// Unfold reads the logical lines of an LDIF file, joining the folded lines and removing the comments.
+// The other lines made of whitespace are blank lines.
+func Unfold(r io.Reader) ([]Line, error) {
+	var (
+		lines   []Line
+		number  int
+		comment bool
+		// A folded line continues the last line, or the comment, until a blank line.
+		continued bool
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, " ") && continued:
+			if !comment {
+				lines[len(lines)-1].Text += line[1:]
+			}
+		case strings.TrimSpace(line) == "":
+			lines = append(lines, Line{Number: number})
+			comment, continued = false, false
+		case strings.HasPrefix(line, " "):
+			return nil, fmt.Errorf("line %d: the folded line does not continue a line", number)
+		case strings.HasPrefix(line, "#"):
+			comment, continued = true, true
+		default:
+			lines = append(lines, Line{Text: line, Number: number})
+			comment, continued = false, true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
@@ -0,0 +1,57 @@
+package ldif
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnfold(t *testing.T) {
+	file := "version: 1\r\n" +
+		"# A comment\n" +
+		"  folded in the comment\n" +
+		"\n" +
+		"dn: uid=alice.martin,ou=users,\n" +
+		" dc=csb,dc=nc\n" +
+		"description: folded\n" +
+		"  with a space\n" +
+		" \n" +
+		"\n" +
+		"dn: uid=bob.durand,ou=users,dc=csb,dc=nc\n"
+	lines, err := Unfold(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("Could not unfold the lines: %v", err)
+	}
+	want := []Line{
+		{"version: 1", 1},
+		{"", 4},
+		{"dn: uid=alice.martin,ou=users,dc=csb,dc=nc", 5},
+		{"description: folded with a space", 7},
+		{"", 10},
+		{"dn: uid=bob.durand,ou=users,dc=csb,dc=nc", 11},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Unexpected lines: %q", lines)
+	}
+
+	if _, err := Unfold(strings.NewReader("dn: uid=alice.martin\n\n folded\n")); err == nil {
+		t.Error("A folded line after a blank line should be rejected.")
+	}
+}
+
+func TestEscapeDNValue(t *testing.T) {
+	testCases := map[string]string{
+		"alice.martin":   "alice.martin",
+		"Dupont, Marie":  "Dupont\\, Marie",
+		`a+b=c;d<e>f"g\`: `a\+b\=c\;d\<e\>f\"g\\`,
+		" #leading":      "\\ #leading",
+		"#hash":          "\\#hash",
+		"trailing ":      "trailing\\ ",
+		"Jérôme\x01":     "Jérôme\\01",
+	}
+	for value, want := range testCases {
+		if escaped := EscapeDNValue(value); escaped != want {
+			t.Errorf("%q: expected %q, got %q", value, want, escaped)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Package passwords hashes and verifies the passwords of the user stores.
+//
+// The hashes are stored in the PHC string format, `$<id>$<param>=<value>,...$<salt>$<hash>`, with the argon2id and pbkdf2-sha256 algorithms,
+// or in the modular crypt format of bcrypt (`$2a$`, `$2b$`, `$2y$`).
+// The legacy hashes, unsalted SHA-256 hex digests, are still verified but must be upgraded with Hash.
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// Argon2id is the PHC identifier of the argon2id algorithm.
+	Argon2id = "argon2id"
+	// Bcrypt is the identifier of the bcrypt algorithm.
+	Bcrypt = "bcrypt"
+	// PBKDF2 is the PHC identifier of the PBKDF2 algorithm with HMAC-SHA256.
+	PBKDF2 = "pbkdf2-sha256"
+
+	saltLength = 16
+	keyLength  = 32
+	// The bcrypt hashes have a 22 characters salt and a 31 characters hash, after the version and the cost.
+	bcryptHashLength = 60
+)
+
+var (
+	// ErrUnsupportedHash is returned when a hash is not in a supported format.
+	ErrUnsupportedHash = errors.New("unsupported password hash")
+
+	// The PHC salts and hashes are encoded in base64 without padding.
+	b64 = base64.RawStdEncoding
+)
+
+// Params are the parameters of the hashing algorithms.
+type Params struct {
+	// Algorithm is the algorithm of the new hashes: argon2id, bcrypt or pbkdf2-sha256.
+	Algorithm string
+	// Argon2Memory is the memory used by argon2id, in KiB.
+	Argon2Memory uint32
+	// Argon2Time is the number of passes of argon2id.
+	Argon2Time uint32
+	// Argon2Threads is the degree of parallelism of argon2id.
+	Argon2Threads uint8
+	// BcryptCost is the cost of bcrypt.
+	BcryptCost int
+	// PBKDF2Iterations is the number of iterations of PBKDF2.
+	PBKDF2Iterations int
+}
+
+// Upper bounds of the parameters of the hashes, which are rejected above them.
+// A stored or imported hash must not make a verification allocate or compute without limit.
+const (
+	// MaxArgon2Memory is the maximum memory of argon2id, 1 GiB.
+	MaxArgon2Memory = 1024 * 1024
+	// MaxArgon2Time is the maximum number of passes of argon2id.
+	MaxArgon2Time = 16
+	// MaxPBKDF2Iterations is the maximum number of iterations of PBKDF2.
+	MaxPBKDF2Iterations = 10000000
+)
+
+// DefaultParams are the parameters recommended by OWASP, with argon2id.
+var DefaultParams = Params{
+	Algorithm:        Argon2id,
+	Argon2Memory:     64 * 1024,
+	Argon2Time:       3,
+	Argon2Threads:    2,
+	BcryptCost:       12,
+	PBKDF2Iterations: 310000,
+}
+
+// Hash hashes a password with a random salt, using the algorithm of the parameters.
+// The parameters above the upper bounds are rejected, as the hashes could not be verified.
+func Hash(password string, p Params) (string, error) {
+	switch p.Algorithm {
+	case Argon2id:
+		if p.Argon2Memory > MaxArgon2Memory || p.Argon2Time > MaxArgon2Time {
+			return "", fmt.Errorf("%w: the argon2id parameters exceed m=%d,t=%d", ErrUnsupportedHash, MaxArgon2Memory, MaxArgon2Time)
+		}
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Argon2Time, p.Argon2Memory, p.Argon2Threads, keyLength)
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version, p.Argon2Memory, p.Argon2Time, p.Argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		return string(hash), err
+	case PBKDF2:
+		if p.PBKDF2Iterations > MaxPBKDF2Iterations {
+			return "", fmt.Errorf("%w: the PBKDF2 iterations exceed %d", ErrUnsupportedHash, MaxPBKDF2Iterations)
+		}
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key := pbkdf2.Key([]byte(password), salt, p.PBKDF2Iterations, keyLength, sha256.New)
+		return fmt.Sprintf("$%s$i=%d$%s$%s", PBKDF2, p.PBKDF2Iterations, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("%w: unknown algorithm '%s'", ErrUnsupportedHash, p.Algorithm)
+	}
+}
+
+// Verify checks a password against a hash, in constant time.
+// An error is returned when the hash is malformed or its algorithm is not supported.
+func Verify(password string, hash string) (bool, error) {
+	if isLegacy(hash) {
+		expected, err := hex.DecodeString(hash)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ErrUnsupportedHash, err)
+		}
+		actual := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(actual[:], expected) == 1, nil
+	}
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	h, err := parse(hash)
+	if err != nil {
+		return false, err
+	}
+	var key []byte
+	switch h.algorithm {
+	case Argon2id:
+		key = argon2.IDKey([]byte(password), h.salt, h.params.Argon2Time, h.params.Argon2Memory, h.params.Argon2Threads, uint32(len(h.key)))
+	case PBKDF2:
+		key = pbkdf2.Key([]byte(password), h.salt, h.params.PBKDF2Iterations, len(h.key), sha256.New)
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+// NeedsRehash checks if a hash must be upgraded to the algorithm and the parameters, which is the case of all the legacy hashes.
+func NeedsRehash(hash string, p Params) bool {
+	if isLegacy(hash) {
+		return true
+	}
+	if isBcrypt(hash) {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return p.Algorithm != Bcrypt || err != nil || cost != p.BcryptCost
+	}
+
+	h, err := parse(hash)
+	if err != nil || h.algorithm != p.Algorithm {
+		return true
+	}
+	switch h.algorithm {
+	case Argon2id:
+		return h.params.Argon2Memory != p.Argon2Memory || h.params.Argon2Time != p.Argon2Time || h.params.Argon2Threads != p.Argon2Threads
+	default:
+		return h.params.PBKDF2Iterations != p.PBKDF2Iterations
+	}
+}
+
+// Validate checks that a hash is in a supported format, without verifying any password.
+// ErrUnsupportedHash is returned when it is not.
+func Validate(hash string) error {
+	if isLegacy(hash) {
+		if _, err := hex.DecodeString(hash); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnsupportedHash, err)
+		}
+		return nil
+	}
+	if isBcrypt(hash) {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil || len(hash) != bcryptHashLength {
+			return fmt.Errorf("%w: malformed bcrypt hash", ErrUnsupportedHash)
+		}
+		return nil
+	}
+	_, err := parse(hash)
+	return err
+}
+
+// A legacy hash is the hex digest of SHA-256, without salt.
+func isLegacy(hash string) bool {
+	return len(hash) == hex.EncodedLen(sha256.Size) && !strings.HasPrefix(hash, "$")
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// phcHash is a parsed PHC string.
+type phcHash struct {
+	algorithm string
+	params    Params
+	salt      []byte
+	key       []byte
+}
+
+// Parses an argon2id or pbkdf2-sha256 PHC string.
+func parse(hash string) (*phcHash, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) < 5 || fields[0] != "" {
+		return nil, ErrUnsupportedHash
+	}
+	h := &phcHash{algorithm: fields[1]}
+
+	var params string
+	switch {
+	case h.algorithm == Argon2id && len(fields) == 6:
+		if fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, fmt.Errorf("%w: unsupported argon2 version '%s'", ErrUnsupportedHash, fields[2])
+		}
+		params = fields[3]
+	case h.algorithm == PBKDF2 && len(fields) == 5:
+		params = fields[2]
+	default:
+		return nil, ErrUnsupportedHash
+	}
+
+	for _, param := range strings.Split(params, ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%w: malformed parameter '%s'", ErrUnsupportedHash, param)
+		}
+		value, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil || value == 0 {
+			return nil, fmt.Errorf("%w: invalid parameter '%s'", ErrUnsupportedHash, param)
+		}
+		switch {
+		case h.algorithm == Argon2id && kv[0] == "m" && value <= MaxArgon2Memory:
+			h.params.Argon2Memory = uint32(value)
+		case h.algorithm == Argon2id && kv[0] == "t" && value <= MaxArgon2Time:
+			h.params.Argon2Time = uint32(value)
+		case h.algorithm == Argon2id && kv[0] == "p" && value <= 255:
+			h.params.Argon2Threads = uint8(value)
+		case h.algorithm == PBKDF2 && kv[0] == "i" && value <= MaxPBKDF2Iterations:
+			h.params.PBKDF2Iterations = int(value)
+		default:
+			return nil, fmt.Errorf("%w: unknown or too large parameter '%s'", ErrUnsupportedHash, param)
+		}
+	}
+	if (h.algorithm == Argon2id && (h.params.Argon2Memory == 0 || h.params.Argon2Time == 0 || h.params.Argon2Threads == 0)) ||
+		(h.algorithm == PBKDF2 && h.params.PBKDF2Iterations == 0) {
+		return nil, fmt.Errorf("%w: missing parameters", ErrUnsupportedHash)
+	}
+	h.params.Algorithm = h.algorithm
+
+	var err error
+	if h.salt, err = b64.DecodeString(fields[len(fields)-2]); err != nil || len(h.salt) == 0 {
+		return nil, fmt.Errorf("%w: invalid salt", ErrUnsupportedHash)
+	}
+	if h.key, err = b64.DecodeString(fields[len(fields)-1]); err != nil || len(h.key) == 0 {
+		return nil, fmt.Errorf("%w: invalid hash", ErrUnsupportedHash)
+	}
+	return h, nil
+}
@@ -0,0 +1,181 @@
+package passwords
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Cheap parameters, so the tests run fast.
+var testParams = Params{
+	Algorithm:        Argon2id,
+	Argon2Memory:     1024,
+	Argon2Time:       1,
+	Argon2Threads:    1,
+	BcryptCost:       4,
+	PBKDF2Iterations: 1000,
+}
+
+func withAlgorithm(algorithm string) Params {
+	p := testParams
+	p.Algorithm = algorithm
+	return p
+}
+
+func TestHashAndVerify(t *testing.T) {
+	testCases := []struct {
+		algorithm string
+		prefix    string
+	}{
+		{Argon2id, "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{Bcrypt, "$2a$04$"},
+		{PBKDF2, "$pbkdf2-sha256$i=1000$"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.algorithm, func(t *testing.T) {
+			p := withAlgorithm(tc.algorithm)
+			hash, err := Hash("Lor49914", p)
+			if err != nil {
+				t.Fatalf("Could not hash the password: %v", err)
+			}
+			if !strings.HasPrefix(hash, tc.prefix) {
+				t.Errorf("The hash %s does not start with %s.", hash, tc.prefix)
+			}
+			if other, _ := Hash("Lor49914", p); other == hash {
+				t.Errorf("Two hashes of the same password are equal, the salt is missing.")
+			}
+			if ok, err := Verify("Lor49914", hash); !ok || err != nil {
+				t.Errorf("The password does not match its hash, error: %v", err)
+			}
+			if ok, err := Verify("incorrect", hash); ok || err != nil {
+				t.Errorf("An incorrect password matches the hash, error: %v", err)
+			}
+			if NeedsRehash(hash, p) {
+				t.Errorf("The hash should not need a rehash.")
+			}
+		})
+	}
+}
+
+func TestVerifyKnownHashes(t *testing.T) {
+	testCases := []struct {
+		hash string
+		ok   bool
+	}{
+		// SHA-256 of "password", in lower and upper case.
+		{"5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", true},
+		{"5E884898DA28047151D0E56F8DC6292773603D0D6AABBDD62A11EF721D1542D8", true},
+		{"6e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", false},
+		// Reference hashes of "password", with the salt "somesalt" for argon2id and PBKDF2.
+		{"$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM", true},
+		{"$pbkdf2-sha256$i=1000$c29tZXNhbHQ$j4Aa14inUtOh7Sg/D7hH54ohymuHNQD4+ccfhepGWAY", true},
+		{"$2a$04$jkKc/5q2G6mjeV9eSy2sWeis41LlkqEHkOVdTVegiC4BjJvZP0jd6", true},
+	}
+	for _, tc := range testCases {
+		if ok, err := Verify("password", tc.hash); err != nil {
+			t.Errorf("Could not verify the hash %s: %v", tc.hash, err)
+		} else if ok != tc.ok {
+			t.Errorf("The verification of %s is %t instead of %t.", tc.hash, ok, tc.ok)
+		}
+	}
+}
+
+func TestVerifyMalformedHashes(t *testing.T) {
+	hashes := []string{
+		"",
+		"plain",
+		"$argon2id$v=16$m=1024,t=1,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM",
+		"$argon2id$v=19$m=1024,t=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM",
+		"$argon2id$v=19$m=1024,t=1,p=1,x=2$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM",
+		"$argon2i$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM",
+		"$pbkdf2-sha256$i=0$c29tZXNhbHQ$j4Aa14inUtOh7Sg/D7hH54ohymuHNQD4+ccfhepGWAY",
+		"$pbkdf2-sha256$i=1000$$j4Aa14inUtOh7Sg/D7hH54ohymuHNQD4+ccfhepGWAY",
+		"$pbkdf2-sha256$i=1000$c29tZXNhbHQ$!!!",
+		"zz884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM",
+		"$argon2id$v=19$m=1024,t=4294967295,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM",
+		"$pbkdf2-sha256$i=4294967295$c29tZXNhbHQ$j4Aa14inUtOh7Sg/D7hH54ohymuHNQD4+ccfhepGWAY",
+	}
+	for _, hash := range hashes {
+		if ok, err := Verify("password", hash); ok || !errors.Is(err, ErrUnsupportedHash) {
+			t.Errorf("The malformed hash %q should not be verified, error: %v", hash, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		hash  string
+		valid bool
+	}{
+		{"5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", true},
+		{"$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM", true},
+		{"$pbkdf2-sha256$i=1000$c29tZXNhbHQ$j4Aa14inUtOh7Sg/D7hH54ohymuHNQD4+ccfhepGWAY", true},
+		{"$2a$04$jkKc/5q2G6mjeV9eSy2sWeis41LlkqEHkOVdTVegiC4BjJvZP0jd6", true},
+		{"$2a$04$jkKc/5q2G6mjeV9eSy2sWeis41LlkqEHkOVdTVeg", false},
+		{"$2a$xx$jkKc/5q2G6mjeV9eSy2sWeis41LlkqEHkOVdTVegiC4BjJvZP0jd6", false},
+		{"", false},
+		{"password", false},
+		{"$argon2id$v=19$m=1024,t=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM", false},
+		{"zz884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", false},
+		// The parameters above the upper bounds would make the verifications allocate or compute without limit.
+		{"$argon2id$v=19$m=1048576,t=16,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM", true},
+		{"$argon2id$v=19$m=4294967295,t=1,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM", false},
+		{"$argon2id$v=19$m=1024,t=17,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM", false},
+		{"$pbkdf2-sha256$i=10000000$c29tZXNhbHQ$j4Aa14inUtOh7Sg/D7hH54ohymuHNQD4+ccfhepGWAY", true},
+		{"$pbkdf2-sha256$i=10000001$c29tZXNhbHQ$j4Aa14inUtOh7Sg/D7hH54ohymuHNQD4+ccfhepGWAY", false},
+	}
+	for _, tc := range testCases {
+		if err := Validate(tc.hash); (err == nil) != tc.valid || (err != nil && !errors.Is(err, ErrUnsupportedHash)) {
+			t.Errorf("The validation of %q has returned %v.", tc.hash, err)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	argon, _ := Hash("password", testParams)
+	bcrypted, _ := Hash("password", withAlgorithm(Bcrypt))
+	stronger := testParams
+	stronger.Argon2Time = 2
+	costlier := withAlgorithm(Bcrypt)
+	costlier.BcryptCost = 5
+
+	testCases := []struct {
+		name   string
+		hash   string
+		params Params
+		rehash bool
+	}{
+		{"Legacy", "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", testParams, true},
+		{"SameParams", argon, testParams, false},
+		{"StrongerParams", argon, stronger, true},
+		{"OtherAlgorithm", argon, withAlgorithm(PBKDF2), true},
+		{"BcryptCost", bcrypted, costlier, true},
+		{"Malformed", "$unknown$", testParams, true},
+	}
+	for _, tc := range testCases {
+		if rehash := NeedsRehash(tc.hash, tc.params); rehash != tc.rehash {
+			t.Errorf("%s: NeedsRehash is %t instead of %t.", tc.name, rehash, tc.rehash)
+		}
+	}
+}
+
+func TestHashParamsAboveBounds(t *testing.T) {
+	memory := testParams
+	memory.Argon2Memory = MaxArgon2Memory + 1
+	passes := testParams
+	passes.Argon2Time = MaxArgon2Time + 1
+	iterations := withAlgorithm(PBKDF2)
+	iterations.PBKDF2Iterations = MaxPBKDF2Iterations + 1
+	for _, p := range []Params{memory, passes, iterations} {
+		if _, err := Hash("password", p); !errors.Is(err, ErrUnsupportedHash) {
+			t.Errorf("The parameters %+v should be rejected, error: %v", p, err)
+		}
+	}
+}
+
+func TestHashUnknownAlgorithm(t *testing.T) {
+	if _, err := Hash("password", withAlgorithm("md5")); !errors.Is(err, ErrUnsupportedHash) {
+		t.Errorf("An unknown algorithm should not be supported, error: %v", err)
+	}
+}
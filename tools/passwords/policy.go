@@ -0,0 +1,229 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	// The words of the names shorter than this are not searched in the passwords, as they would reject too many of them.
+	minNameWordLength = 3
+	// Length of the SHA-1 hash prefixes naming the range files of the breached passwords.
+	breachedPrefixLength = 5
+)
+
+// Keys of the policy rules, under the configuration prefix of each store.
+const (
+	viperKeyMinLength           = "minLength"
+	viperKeyMaxLength           = "maxLength"
+	viperKeyMinCharacterClasses = "minCharacterClasses"
+	viperKeyBreachedDirectory   = "breachedDirectory"
+)
+
+// Policy is the password policy the stores enforce on the new passwords.
+type Policy struct {
+	// MinLength is the minimum number of characters of a password.
+	MinLength int
+	// MaxLength is the maximum number of characters of a password, not limited when 0.
+	MaxLength int
+	// MinCharacterClasses is the number of character classes a password must contain,
+	// among the lowercase letters, the uppercase letters, the digits and the other characters.
+	MinCharacterClasses int
+	// Breached lists the breached passwords, which are rejected. The passwords are not checked when it is nil.
+	Breached BreachedList
+}
+
+// DefaultPolicy is the policy of the stores whose policy is not configured.
+var DefaultPolicy = Policy{
+	MinLength:           12,
+	MaxLength:           128,
+	MinCharacterClasses: 3,
+}
+
+// LoadPolicy reads the policy configured under the prefix, such as `passwords.policy`,
+// the rules not configured keeping their default value.
+func LoadPolicy(prefix string) Policy {
+	p := DefaultPolicy
+	if key := prefix + "." + viperKeyMinLength; viper.IsSet(key) {
+		p.MinLength = viper.GetInt(key)
+	}
+	if key := prefix + "." + viperKeyMaxLength; viper.IsSet(key) {
+		p.MaxLength = viper.GetInt(key)
+	}
+	if key := prefix + "." + viperKeyMinCharacterClasses; viper.IsSet(key) {
+		p.MinCharacterClasses = viper.GetInt(key)
+	}
+	if dir := viper.GetString(prefix + "." + viperKeyBreachedDirectory); dir != "" {
+		p.Breached = BreachedDirectory(dir)
+	}
+	return p
+}
+
+// Validate checks the policy when a store starts. Its breached passwords directory must exist,
+// as every password would be accepted as not breached otherwise.
+func (p Policy) Validate() error {
+	if d, ok := p.Breached.(BreachedDirectory); ok {
+		info, err := os.Stat(string(d))
+		if err != nil {
+			return fmt.Errorf("the breached passwords directory cannot be read: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("the breached passwords directory %s is not a directory", d)
+		}
+	}
+	return nil
+}
+
+// Owner is the user whose password is checked, whose username and names must not be found in the password.
+type Owner struct {
+	Username string
+	// Names are the names of the user, such as its given name or its display name. Each word of a name is searched separately.
+	Names []string
+}
+
+func violation(t users.PasswordViolationType, limit int, format string, args ...interface{}) *users.PasswordViolation {
+	return &users.PasswordViolation{Type: t, Message: fmt.Sprintf(format, args...), Limit: int32(limit)}
+}
+
+// Check returns the rules of the policy that the password does not follow, none when the password is accepted.
+func (p Policy) Check(password string, owner Owner) []*users.PasswordViolation {
+	var violations []*users.PasswordViolation
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, violation(users.PasswordViolationType_TOO_SHORT, p.MinLength, "The password must contain at least %d characters.", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, violation(users.PasswordViolationType_TOO_LONG, p.MaxLength, "The password must contain at most %d characters.", p.MaxLength))
+	}
+	if characterClasses(password) < p.MinCharacterClasses {
+		violations = append(violations, violation(
+			users.PasswordViolationType_MISSING_CHARACTER_CLASSES,
+			p.MinCharacterClasses,
+			"The password must contain %d of the following: lowercase letters, uppercase letters, digits and other characters.",
+			p.MinCharacterClasses,
+		))
+	}
+
+	lower := strings.ToLower(password)
+	if containsUsername(lower, owner.Username) {
+		violations = append(violations, violation(users.PasswordViolationType_CONTAINS_USER_NAME, 0, "The password must not contain the username."))
+	}
+	if containsName(lower, owner.Names) {
+		violations = append(violations, violation(users.PasswordViolationType_CONTAINS_NAME, 0, "The password must not contain the names of the user."))
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			// The list being unavailable must not prevent the users from changing their passwords.
+			zap.L().Error("Could not check the breached passwords.", zap.Error(err))
+		} else if breached {
+			violations = append(violations, violation(users.PasswordViolationType_BREACHED, 0, "The password has appeared in a data breach."))
+		}
+	}
+
+	return violations
+}
+
+// Counts the character classes of the password.
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// Checks if the lower cased password contains the username, or its local part when it is an email address.
+func containsUsername(password string, username string) bool {
+	username = strings.ToLower(username)
+	if i := strings.IndexByte(username, '@'); i >= 0 {
+		username = username[:i]
+	}
+	return utf8.RuneCountInString(username) >= minNameWordLength && strings.Contains(password, username)
+}
+
+// Checks if the lower cased password contains a word of the names.
+func containsName(password string, names []string) bool {
+	for _, name := range names {
+		words := strings.FieldsFunc(strings.ToLower(name), func(c rune) bool {
+			return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+		})
+		for _, word := range words {
+			if utf8.RuneCountInString(word) >= minNameWordLength && strings.Contains(password, word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckHistory returns the REUSED violation when the password matches one of the hashes of the previous passwords of the user.
+func CheckHistory(password string, hashes []string) *users.PasswordViolation {
+	for _, hash := range hashes {
+		if ok, _ := Verify(password, hash); ok {
+			return violation(users.PasswordViolationType_REUSED, len(hashes), "The password must differ from the %d previous passwords.", len(hashes))
+		}
+	}
+	return nil
+}
+
+// BreachedList tells if a password is known to have been breached.
+type BreachedList interface {
+	Contains(password string) (bool, error)
+}
+
+// BreachedDirectory is a directory of breached passwords in the k-anonymity range format, such as the downloads of Have I Been Pwned.
+// The directory holds a file per prefix of 5 hex characters of the SHA-1 hashes, named `<PREFIX>.txt`,
+// listing the other 35 characters of the hashes with the number of breaches, one `<SUFFIX>:<COUNT>` per line.
+// A missing file means that no breached password has this prefix, the directory itself is checked by Policy.Validate.
+type BreachedDirectory string
+
+// Contains checks if the SHA-1 hash of the password is listed in the range file of its prefix.
+func (d BreachedDirectory) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+
+	f, err := os.Open(filepath.Join(string(d), prefix+".txt"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,120 @@
+package passwords
+
+import (
+	"testing"
+
+	"csb.nc/auth/stores/users"
+	"github.com/spf13/viper"
+)
+
+func violationTypes(violations []*users.PasswordViolation) []users.PasswordViolationType {
+	types := make([]users.PasswordViolationType, len(violations))
+	for i, v := range violations {
+		types[i] = v.Type
+	}
+	return types
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p := DefaultPolicy
+	p.MaxLength = 24
+	p.Breached = BreachedDirectory("testdata/breached")
+	owner := Owner{Username: "alice.martin@csb.nc", Names: []string{"Alice Martin", "Al"}}
+
+	testCases := []struct {
+		password   string
+		violations []users.PasswordViolationType
+	}{
+		{"Tropical-Reef-42", nil},
+		{"Trop-Reef-4", []users.PasswordViolationType{users.PasswordViolationType_TOO_SHORT}},
+		{"Tropical-Reef-42-Tropical-Reef-42", []users.PasswordViolationType{users.PasswordViolationType_TOO_LONG}},
+		{"tropicalreef42", []users.PasswordViolationType{users.PasswordViolationType_MISSING_CHARACTER_CLASSES}},
+		{"tropical-reef-42", nil},
+		{"Été-Tropical-Reef", nil},
+		{"ALICE.MARTIN-42", []users.PasswordViolationType{users.PasswordViolationType_CONTAINS_USER_NAME, users.PasswordViolationType_CONTAINS_NAME}},
+		{"Tropical-Martin-42", []users.PasswordViolationType{users.PasswordViolationType_CONTAINS_NAME}},
+		{"Tropical-Reef-Al-42", nil},
+		{"Summer-Holidays-2024", []users.PasswordViolationType{users.PasswordViolationType_BREACHED}},
+		{"Short", []users.PasswordViolationType{users.PasswordViolationType_TOO_SHORT, users.PasswordViolationType_MISSING_CHARACTER_CLASSES}},
+	}
+	for _, tc := range testCases {
+		violations := p.Check(tc.password, owner)
+		types := violationTypes(violations)
+		if len(types) != len(tc.violations) {
+			t.Errorf("%s: the violations are %v instead of %v.", tc.password, types, tc.violations)
+			continue
+		}
+		for i := range types {
+			if types[i] != tc.violations[i] || violations[i].Message == "" {
+				t.Errorf("%s: the violations are %v instead of %v.", tc.password, types, tc.violations)
+				break
+			}
+		}
+	}
+
+	if v := p.Check("Short", owner)[0]; v.Limit != int32(p.MinLength) {
+		t.Errorf("The limit of the violation is %d instead of %d.", v.Limit, p.MinLength)
+	}
+}
+
+func TestBreachedDirectory(t *testing.T) {
+	testCases := []struct {
+		dir      BreachedDirectory
+		password string
+		breached bool
+	}{
+		{"testdata/breached", "Summer-Holidays-2024", true},
+		{"testdata/breached", "Summer-Holidays-2025", false},
+		{"testdata/missing", "Summer-Holidays-2024", false},
+	}
+	for _, tc := range testCases {
+		breached, err := tc.dir.Contains(tc.password)
+		if err != nil {
+			t.Errorf("%s: could not check the password: %v", tc.password, err)
+		}
+		if breached != tc.breached {
+			t.Errorf("%s in %s: breached is %t instead of %t.", tc.password, tc.dir, breached, tc.breached)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("tests.policy.minLength", 8)
+	viper.Set("tests.policy.breachedDirectory", "testdata/breached")
+
+	p := LoadPolicy("tests.policy")
+	if p.MinLength != 8 || p.MaxLength != DefaultPolicy.MaxLength || p.MinCharacterClasses != DefaultPolicy.MinCharacterClasses {
+		t.Errorf("The policy is %+v.", p)
+	}
+	if p.Breached != BreachedDirectory("testdata/breached") {
+		t.Errorf("The breached passwords are %v instead of testdata/breached.", p.Breached)
+	}
+	if err := p.Validate(); err != nil {
+		t.Errorf("The policy should be valid: %v", err)
+	}
+	if err := LoadPolicy("tests.missing").Validate(); err != nil {
+		t.Errorf("The policy without breached passwords should be valid: %v", err)
+	}
+
+	for _, dir := range []string{"testdata/missing", "testdata/breached/C7DAF.txt"} {
+		viper.Set("tests.policy.breachedDirectory", dir)
+		if err := LoadPolicy("tests.policy").Validate(); err == nil {
+			t.Errorf("The breached passwords directory %s should be rejected.", dir)
+		}
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	history := []string{
+		// SHA-256 of Lor49914.
+		"d90a83ee66e0bc4ce6f5150cafa84edf0b4117644edb70e54fbd468e2fc183e5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$yOmu3JVvan3/Ck1ClA32KGI/Mo6hI1AFq6yTPFcJPiM",
+	}
+	if v := CheckHistory("Lor49914", history); v == nil || v.Type != users.PasswordViolationType_REUSED || v.Limit != 2 {
+		t.Errorf("A previous password should be rejected: %v", v)
+	}
+	if v := CheckHistory("Tropical-Reef-42", history); v != nil {
+		t.Errorf("A new password should be accepted: %v", v)
+	}
+}
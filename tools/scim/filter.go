@@ -0,0 +1,361 @@
+// Package scim implements the structured search filters of the user stores.
+//
+// The filters follow the SCIM filter syntax (RFC 7644, section 3.4.2.2), restricted to the
+// `eq`, `sw`, `co` and `pr` operators and the `and`, `or` and `not` logical operators.
+package scim
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"csb.nc/auth/stores/users"
+)
+
+const (
+	// MaxDepth is the maximum nesting depth of a filter.
+	MaxDepth = 16
+
+	keywordAnd = "and"
+	keywordOr  = "or"
+	keywordNot = "not"
+)
+
+var operators = map[string]users.FilterOperator{
+	"eq": users.FilterOperator_EQ,
+	"sw": users.FilterOperator_SW,
+	"co": users.FilterOperator_CO,
+	"pr": users.FilterOperator_PR,
+}
+
+// Validate checks that the filter is well formed.
+func Validate(f *users.Filter) error {
+	return validate(f, 1)
+}
+
+func validate(f *users.Filter, depth int) error {
+	if f == nil {
+		return errors.New("empty filter")
+	}
+	if depth > MaxDepth {
+		return fmt.Errorf("the filter exceeds the maximum depth of %d", MaxDepth)
+	}
+	switch e := f.Expression.(type) {
+	case *users.Filter_Comparison:
+		if e.Comparison == nil || e.Comparison.Claim == "" {
+			return errors.New("missing comparison claim")
+		}
+		if _, ok := users.FilterOperator_name[int32(e.Comparison.Operator)]; !ok {
+			return fmt.Errorf("unsupported operator %d", e.Comparison.Operator)
+		}
+	case *users.Filter_And:
+		return validateGroup(e.And, depth)
+	case *users.Filter_Or:
+		return validateGroup(e.Or, depth)
+	case *users.Filter_Not:
+		return validate(e.Not, depth+1)
+	default:
+		return errors.New("empty filter expression")
+	}
+	return nil
+}
+
+func validateGroup(g *users.FilterGroup, depth int) error {
+	if g == nil || len(g.Filters) == 0 {
+		return errors.New("empty filter group")
+	}
+	for _, f := range g.Filters {
+		if err := validate(f, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match evaluates the filter against the claims.
+// Comparisons are case insensitive, as the SCIM attributes are by default.
+func Match(f *users.Filter, claims map[string]string) bool {
+	switch e := f.GetExpression().(type) {
+	case *users.Filter_Comparison:
+		value, ok := claims[e.Comparison.Claim]
+		value = strings.ToLower(value)
+		expected := strings.ToLower(e.Comparison.Value)
+		switch e.Comparison.Operator {
+		case users.FilterOperator_EQ:
+			return ok && value == expected
+		case users.FilterOperator_SW:
+			return ok && strings.HasPrefix(value, expected)
+		case users.FilterOperator_CO:
+			return ok && strings.Contains(value, expected)
+		case users.FilterOperator_PR:
+			return ok && value != ""
+		}
+	case *users.Filter_And:
+		for _, sub := range e.And.GetFilters() {
+			if !Match(sub, claims) {
+				return false
+			}
+		}
+		return true
+	case *users.Filter_Or:
+		for _, sub := range e.Or.GetFilters() {
+			if Match(sub, claims) {
+				return true
+			}
+		}
+		return false
+	case *users.Filter_Not:
+		return !Match(e.Not, claims)
+	}
+	return false
+}
+
+// Format returns the SCIM representation of the filter.
+func Format(f *users.Filter) string {
+	switch e := f.GetExpression().(type) {
+	case *users.Filter_Comparison:
+		op := strings.ToLower(e.Comparison.Operator.String())
+		if e.Comparison.Operator == users.FilterOperator_PR {
+			return fmt.Sprintf("%s %s", e.Comparison.Claim, op)
+		}
+		return fmt.Sprintf("%s %s %s", e.Comparison.Claim, op, strconv.Quote(e.Comparison.Value))
+	case *users.Filter_And:
+		return formatGroup(e.And, keywordAnd)
+	case *users.Filter_Or:
+		return formatGroup(e.Or, keywordOr)
+	case *users.Filter_Not:
+		return fmt.Sprintf("%s (%s)", keywordNot, Format(e.Not))
+	}
+	return ""
+}
+
+func formatGroup(g *users.FilterGroup, keyword string) string {
+	parts := make([]string, len(g.GetFilters()))
+	for i, f := range g.GetFilters() {
+		parts[i] = Format(f)
+		if _, ok := f.GetExpression().(*users.Filter_Comparison); !ok {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " "+keyword+" ")
+}
+
+// Comparison creates a filter comparing a claim with a value.
+func Comparison(claim string, op users.FilterOperator, value string) *users.Filter {
+	return &users.Filter{
+		Expression: &users.Filter_Comparison{
+			Comparison: &users.FilterComparison{Claim: claim, Operator: op, Value: value},
+		},
+	}
+}
+
+// And creates a filter matching when all the filters match.
+func And(filters ...*users.Filter) *users.Filter {
+	return &users.Filter{Expression: &users.Filter_And{And: &users.FilterGroup{Filters: filters}}}
+}
+
+// Or creates a filter matching when any of the filters matches.
+func Or(filters ...*users.Filter) *users.Filter {
+	return &users.Filter{Expression: &users.Filter_Or{Or: &users.FilterGroup{Filters: filters}}}
+}
+
+// Not creates a filter matching when the filter does not match.
+func Not(f *users.Filter) *users.Filter {
+	return &users.Filter{Expression: &users.Filter_Not{Not: f}}
+}
+
+// Parse parses a SCIM filter, such as `name sw "Jean" and not (email pr)`.
+func Parse(s string) (*users.Filter, error) {
+	p := &parser{input: s}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	f, err := p.parseOr(1)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected token %q in filter %q", p.tokens[p.pos].text, s)
+	}
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) tokenize() error {
+	s := p.input
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			p.tokens = append(p.tokens, token{kind: tokenOpen, text: "("})
+			i++
+		case c == ')':
+			p.tokens = append(p.tokens, token{kind: tokenClose, text: ")"})
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return fmt.Errorf("unterminated string in filter %q", s)
+			}
+			value, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return fmt.Errorf("invalid string %s in filter %q", s[i:j+1], s)
+			}
+			p.tokens = append(p.tokens, token{kind: tokenString, text: value})
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(s) && !unicode.IsSpace(rune(s[j])) && s[j] != '(' && s[j] != ')' && s[j] != '"'; j++ {
+			}
+			p.tokens = append(p.tokens, token{kind: tokenWord, text: s[i:j]})
+			i = j
+		}
+	}
+	return nil
+}
+
+func (p *parser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenWord && strings.EqualFold(p.tokens[p.pos].text, keyword)
+}
+
+func (p *parser) next() (token, error) {
+	if p.pos >= len(p.tokens) {
+		return token{}, fmt.Errorf("unexpected end of filter %q", p.input)
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *parser) parseOr(depth int) (*users.Filter, error) {
+	if depth > MaxDepth {
+		return nil, fmt.Errorf("the filter exceeds the maximum depth of %d", MaxDepth)
+	}
+	f, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	filters := []*users.Filter{f}
+	for p.peekKeyword(keywordOr) {
+		p.pos++
+		f, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return Or(filters...), nil
+}
+
+func (p *parser) parseAnd(depth int) (*users.Filter, error) {
+	f, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	filters := []*users.Filter{f}
+	for p.peekKeyword(keywordAnd) {
+		p.pos++
+		f, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return And(filters...), nil
+}
+
+func (p *parser) parseUnary(depth int) (*users.Filter, error) {
+	if p.peekKeyword(keywordNot) {
+		p.pos++
+		f, err := p.parseGroup(depth)
+		if err != nil {
+			return nil, err
+		}
+		return Not(f), nil
+	}
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOpen {
+		return p.parseGroup(depth)
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseGroup(depth int) (*users.Filter, error) {
+	if t, err := p.next(); err != nil {
+		return nil, err
+	} else if t.kind != tokenOpen {
+		return nil, fmt.Errorf("expected '(' instead of %q in filter %q", t.text, p.input)
+	}
+	f, err := p.parseOr(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	if t, err := p.next(); err != nil {
+		return nil, err
+	} else if t.kind != tokenClose {
+		return nil, fmt.Errorf("expected ')' instead of %q in filter %q", t.text, p.input)
+	}
+	return f, nil
+}
+
+func (p *parser) parseComparison() (*users.Filter, error) {
+	claim, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if claim.kind != tokenWord {
+		return nil, fmt.Errorf("expected a claim instead of %q in filter %q", claim.text, p.input)
+	}
+	opToken, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := operators[strings.ToLower(opToken.text)]
+	if opToken.kind != tokenWord || !ok {
+		return nil, fmt.Errorf("unsupported operator %q in filter %q", opToken.text, p.input)
+	}
+	if op == users.FilterOperator_PR {
+		return Comparison(claim.text, op, ""), nil
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if value.kind != tokenString && value.kind != tokenWord {
+		return nil, fmt.Errorf("expected a value instead of %q in filter %q", value.text, p.input)
+	}
+	return Comparison(claim.text, op, value.text), nil
+}
@@ -0,0 +1,81 @@
+package scim
+
+import (
+	"fmt"
+	"testing"
+)
+
+var claims = map[string]string{
+	"name":         "Authtest Service",
+	"email":        "service.authtest@csb.nc",
+	"phone_number": "",
+}
+
+func TestParseAndMatch(t *testing.T) {
+	testCases := []struct {
+		filter string
+		format string
+		match  bool
+	}{
+		{`name eq "authtest service"`, `name eq "authtest service"`, true},
+		{`name sw "Auth"`, `name sw "Auth"`, true},
+		{`name sw "Service"`, `name sw "Service"`, false},
+		{`email co "@CSB.nc"`, `email co "@CSB.nc"`, true},
+		{`email pr`, `email pr`, true},
+		{`phone_number pr`, `phone_number pr`, false},
+		{`given_name pr`, `given_name pr`, false},
+		{`name sw "Auth" and email co "csb"`, `name sw "Auth" and email co "csb"`, true},
+		{`name sw "Nope" or email co "csb"`, `name sw "Nope" or email co "csb"`, true},
+		{`not (email pr)`, `not (email pr)`, false},
+		{`name sw "Auth" AND (email eq "x" OR NOT (phone_number pr))`, `name sw "Auth" and (email eq "x" or (not (phone_number pr)))`, true},
+		{`name eq "quote \"inside\""`, `name eq "quote \"inside\""`, false},
+	}
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("Case=%d;Filter=%s", i, tc.filter), func(t *testing.T) {
+			f, err := Parse(tc.filter)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if err := Validate(f); err != nil {
+				t.Fatalf("Validate failed: %v", err)
+			}
+			if s := Format(f); s != tc.format {
+				t.Errorf("The filter is formatted as %s instead of %s.", s, tc.format)
+			}
+			if m := Match(f, claims); m != tc.match {
+				t.Errorf("Match returned %t instead of %t.", m, tc.match)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	testCases := []string{
+		``,
+		`name`,
+		`name gt "1"`,
+		`name eq`,
+		`name eq "unterminated`,
+		`(name pr`,
+		`name pr)`,
+		`not name pr`,
+		`name pr and`,
+	}
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("Case=%d;Filter=%s", i, tc), func(t *testing.T) {
+			if _, err := Parse(tc); err == nil {
+				t.Errorf("Parse should have failed.")
+			}
+		})
+	}
+}
+
+func TestValidateDepth(t *testing.T) {
+	f := Comparison("name", 0, "x")
+	for i := 0; i < MaxDepth; i++ {
+		f = Not(f)
+	}
+	if err := Validate(f); err == nil {
+		t.Errorf("Validate should have failed for a filter deeper than %d.", MaxDepth)
+	}
+}
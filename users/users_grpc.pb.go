@@ -18,8 +18,14 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type UserClient interface {
 	Authenticate(ctx context.Context, in *AuthRequest, opts ...grpc.CallOption) (*AuthResponse, error)
+	AuthenticateFlow(ctx context.Context, opts ...grpc.CallOption) (User_AuthenticateFlowClient, error)
+	GetAccountStatus(ctx context.Context, in *AccountStatusRequest, opts ...grpc.CallOption) (*AccountStatusResponse, error)
 	FindClaims(ctx context.Context, in *ClaimsRequest, opts ...grpc.CallOption) (*ClaimsResponse, error)
+	FindClaimsBatch(ctx context.Context, in *ClaimsBatchRequest, opts ...grpc.CallOption) (*ClaimsBatchResponse, error)
 	SearchClaims(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error)
+	StreamSearchClaims(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (User_StreamSearchClaimsClient, error)
+	WatchUsers(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (User_WatchUsersClient, error)
+	ValidatePassword(ctx context.Context, in *ValidatePasswordRequest, opts ...grpc.CallOption) (*ValidatePasswordResponse, error)
 }
 
 type userClient struct {
@@ -39,6 +45,46 @@ func (c *userClient) Authenticate(ctx context.Context, in *AuthRequest, opts ...
 	return out, nil
 }
 
+func (c *userClient) AuthenticateFlow(ctx context.Context, opts ...grpc.CallOption) (User_AuthenticateFlowClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_User_serviceDesc.Streams[0], "/auth.User/AuthenticateFlow", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &userAuthenticateFlowClient{stream}
+	return x, nil
+}
+
+type User_AuthenticateFlowClient interface {
+	Send(*AuthFlowRequest) error
+	Recv() (*AuthFlowResponse, error)
+	grpc.ClientStream
+}
+
+type userAuthenticateFlowClient struct {
+	grpc.ClientStream
+}
+
+func (x *userAuthenticateFlowClient) Send(m *AuthFlowRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *userAuthenticateFlowClient) Recv() (*AuthFlowResponse, error) {
+	m := new(AuthFlowResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *userClient) GetAccountStatus(ctx context.Context, in *AccountStatusRequest, opts ...grpc.CallOption) (*AccountStatusResponse, error) {
+	out := new(AccountStatusResponse)
+	err := c.cc.Invoke(ctx, "/auth.User/GetAccountStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *userClient) FindClaims(ctx context.Context, in *ClaimsRequest, opts ...grpc.CallOption) (*ClaimsResponse, error) {
 	out := new(ClaimsResponse)
 	err := c.cc.Invoke(ctx, "/auth.User/FindClaims", in, out, opts...)
@@ -48,6 +94,15 @@ func (c *userClient) FindClaims(ctx context.Context, in *ClaimsRequest, opts ...
 	return out, nil
 }
 
+func (c *userClient) FindClaimsBatch(ctx context.Context, in *ClaimsBatchRequest, opts ...grpc.CallOption) (*ClaimsBatchResponse, error) {
+	out := new(ClaimsBatchResponse)
+	err := c.cc.Invoke(ctx, "/auth.User/FindClaimsBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *userClient) SearchClaims(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error) {
 	out := new(SearchResponse)
 	err := c.cc.Invoke(ctx, "/auth.User/SearchClaims", in, out, opts...)
@@ -57,13 +112,92 @@ func (c *userClient) SearchClaims(ctx context.Context, in *SearchRequest, opts .
 	return out, nil
 }
 
+func (c *userClient) StreamSearchClaims(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (User_StreamSearchClaimsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_User_serviceDesc.Streams[1], "/auth.User/StreamSearchClaims", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &userStreamSearchClaimsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type User_StreamSearchClaimsClient interface {
+	Recv() (*SearchResponseResult, error)
+	grpc.ClientStream
+}
+
+type userStreamSearchClaimsClient struct {
+	grpc.ClientStream
+}
+
+func (x *userStreamSearchClaimsClient) Recv() (*SearchResponseResult, error) {
+	m := new(SearchResponseResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *userClient) WatchUsers(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (User_WatchUsersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_User_serviceDesc.Streams[2], "/auth.User/WatchUsers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &userWatchUsersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type User_WatchUsersClient interface {
+	Recv() (*UserChange, error)
+	grpc.ClientStream
+}
+
+type userWatchUsersClient struct {
+	grpc.ClientStream
+}
+
+func (x *userWatchUsersClient) Recv() (*UserChange, error) {
+	m := new(UserChange)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *userClient) ValidatePassword(ctx context.Context, in *ValidatePasswordRequest, opts ...grpc.CallOption) (*ValidatePasswordResponse, error) {
+	out := new(ValidatePasswordResponse)
+	err := c.cc.Invoke(ctx, "/auth.User/ValidatePassword", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // UserServer is the server API for User service.
 // All implementations must embed UnimplementedUserServer
 // for forward compatibility
 type UserServer interface {
 	Authenticate(context.Context, *AuthRequest) (*AuthResponse, error)
+	AuthenticateFlow(User_AuthenticateFlowServer) error
+	GetAccountStatus(context.Context, *AccountStatusRequest) (*AccountStatusResponse, error)
 	FindClaims(context.Context, *ClaimsRequest) (*ClaimsResponse, error)
+	FindClaimsBatch(context.Context, *ClaimsBatchRequest) (*ClaimsBatchResponse, error)
 	SearchClaims(context.Context, *SearchRequest) (*SearchResponse, error)
+	StreamSearchClaims(*SearchRequest, User_StreamSearchClaimsServer) error
+	WatchUsers(*WatchRequest, User_WatchUsersServer) error
+	ValidatePassword(context.Context, *ValidatePasswordRequest) (*ValidatePasswordResponse, error)
 	mustEmbedUnimplementedUserServer()
 }
 
@@ -74,12 +208,30 @@ type UnimplementedUserServer struct {
 func (UnimplementedUserServer) Authenticate(context.Context, *AuthRequest) (*AuthResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Authenticate not implemented")
 }
+func (UnimplementedUserServer) AuthenticateFlow(User_AuthenticateFlowServer) error {
+	return status.Errorf(codes.Unimplemented, "method AuthenticateFlow not implemented")
+}
+func (UnimplementedUserServer) GetAccountStatus(context.Context, *AccountStatusRequest) (*AccountStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAccountStatus not implemented")
+}
 func (UnimplementedUserServer) FindClaims(context.Context, *ClaimsRequest) (*ClaimsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method FindClaims not implemented")
 }
+func (UnimplementedUserServer) FindClaimsBatch(context.Context, *ClaimsBatchRequest) (*ClaimsBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FindClaimsBatch not implemented")
+}
 func (UnimplementedUserServer) SearchClaims(context.Context, *SearchRequest) (*SearchResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SearchClaims not implemented")
 }
+func (UnimplementedUserServer) StreamSearchClaims(*SearchRequest, User_StreamSearchClaimsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamSearchClaims not implemented")
+}
+func (UnimplementedUserServer) WatchUsers(*WatchRequest, User_WatchUsersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchUsers not implemented")
+}
+func (UnimplementedUserServer) ValidatePassword(context.Context, *ValidatePasswordRequest) (*ValidatePasswordResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ValidatePassword not implemented")
+}
 func (UnimplementedUserServer) mustEmbedUnimplementedUserServer() {}
 
 // UnsafeUserServer may be embedded to opt out of forward compatibility for this service.
@@ -111,6 +263,50 @@ func _User_Authenticate_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _User_AuthenticateFlow_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(UserServer).AuthenticateFlow(&userAuthenticateFlowServer{stream})
+}
+
+type User_AuthenticateFlowServer interface {
+	Send(*AuthFlowResponse) error
+	Recv() (*AuthFlowRequest, error)
+	grpc.ServerStream
+}
+
+type userAuthenticateFlowServer struct {
+	grpc.ServerStream
+}
+
+func (x *userAuthenticateFlowServer) Send(m *AuthFlowResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *userAuthenticateFlowServer) Recv() (*AuthFlowRequest, error) {
+	m := new(AuthFlowRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _User_GetAccountStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccountStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserServer).GetAccountStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.User/GetAccountStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserServer).GetAccountStatus(ctx, req.(*AccountStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _User_FindClaims_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(ClaimsRequest)
 	if err := dec(in); err != nil {
@@ -129,6 +325,24 @@ func _User_FindClaims_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _User_FindClaimsBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClaimsBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserServer).FindClaimsBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.User/FindClaimsBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserServer).FindClaimsBatch(ctx, req.(*ClaimsBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _User_SearchClaims_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(SearchRequest)
 	if err := dec(in); err != nil {
@@ -147,6 +361,66 @@ func _User_SearchClaims_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _User_StreamSearchClaims_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SearchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UserServer).StreamSearchClaims(m, &userStreamSearchClaimsServer{stream})
+}
+
+type User_StreamSearchClaimsServer interface {
+	Send(*SearchResponseResult) error
+	grpc.ServerStream
+}
+
+type userStreamSearchClaimsServer struct {
+	grpc.ServerStream
+}
+
+func (x *userStreamSearchClaimsServer) Send(m *SearchResponseResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _User_WatchUsers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UserServer).WatchUsers(m, &userWatchUsersServer{stream})
+}
+
+type User_WatchUsersServer interface {
+	Send(*UserChange) error
+	grpc.ServerStream
+}
+
+type userWatchUsersServer struct {
+	grpc.ServerStream
+}
+
+func (x *userWatchUsersServer) Send(m *UserChange) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _User_ValidatePassword_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValidatePasswordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserServer).ValidatePassword(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.User/ValidatePassword",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserServer).ValidatePassword(ctx, req.(*ValidatePasswordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _User_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "auth.User",
 	HandlerType: (*UserServer)(nil),
@@ -155,14 +429,915 @@ var _User_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Authenticate",
 			Handler:    _User_Authenticate_Handler,
 		},
+		{
+			MethodName: "GetAccountStatus",
+			Handler:    _User_GetAccountStatus_Handler,
+		},
 		{
 			MethodName: "FindClaims",
 			Handler:    _User_FindClaims_Handler,
 		},
+		{
+			MethodName: "FindClaimsBatch",
+			Handler:    _User_FindClaimsBatch_Handler,
+		},
 		{
 			MethodName: "SearchClaims",
 			Handler:    _User_SearchClaims_Handler,
 		},
+		{
+			MethodName: "ValidatePassword",
+			Handler:    _User_ValidatePassword_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "AuthenticateFlow",
+			Handler:       _User_AuthenticateFlow_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "StreamSearchClaims",
+			Handler:       _User_StreamSearchClaims_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchUsers",
+			Handler:       _User_WatchUsers_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "users.proto",
+}
+
+// AccountsAdminClient is the client API for AccountsAdmin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AccountsAdminClient interface {
+	CreateUser(ctx context.Context, in *CreateUserRequest, opts ...grpc.CallOption) (*AccountResponse, error)
+	GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*AccountResponse, error)
+	UpdateUser(ctx context.Context, in *UpdateUserRequest, opts ...grpc.CallOption) (*AccountResponse, error)
+	DeleteUser(ctx context.Context, in *DeleteUserRequest, opts ...grpc.CallOption) (*AccountResponse, error)
+	SetPassword(ctx context.Context, in *SetPasswordRequest, opts ...grpc.CallOption) (*AccountResponse, error)
+	DisableUser(ctx context.Context, in *DisableUserRequest, opts ...grpc.CallOption) (*AccountResponse, error)
+	UnlockUser(ctx context.Context, in *UnlockUserRequest, opts ...grpc.CallOption) (*AccountResponse, error)
+	ResetTOTP(ctx context.Context, in *ResetTOTPRequest, opts ...grpc.CallOption) (*AccountResponse, error)
+	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error)
+}
+
+type accountsAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAccountsAdminClient(cc grpc.ClientConnInterface) AccountsAdminClient {
+	return &accountsAdminClient{cc}
+}
+
+func (c *accountsAdminClient) CreateUser(ctx context.Context, in *CreateUserRequest, opts ...grpc.CallOption) (*AccountResponse, error) {
+	out := new(AccountResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/CreateUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsAdminClient) GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*AccountResponse, error) {
+	out := new(AccountResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/GetUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsAdminClient) UpdateUser(ctx context.Context, in *UpdateUserRequest, opts ...grpc.CallOption) (*AccountResponse, error) {
+	out := new(AccountResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/UpdateUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsAdminClient) DeleteUser(ctx context.Context, in *DeleteUserRequest, opts ...grpc.CallOption) (*AccountResponse, error) {
+	out := new(AccountResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/DeleteUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsAdminClient) SetPassword(ctx context.Context, in *SetPasswordRequest, opts ...grpc.CallOption) (*AccountResponse, error) {
+	out := new(AccountResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/SetPassword", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsAdminClient) DisableUser(ctx context.Context, in *DisableUserRequest, opts ...grpc.CallOption) (*AccountResponse, error) {
+	out := new(AccountResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/DisableUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsAdminClient) UnlockUser(ctx context.Context, in *UnlockUserRequest, opts ...grpc.CallOption) (*AccountResponse, error) {
+	out := new(AccountResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/UnlockUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsAdminClient) ResetTOTP(ctx context.Context, in *ResetTOTPRequest, opts ...grpc.CallOption) (*AccountResponse, error) {
+	out := new(AccountResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/ResetTOTP", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsAdminClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error) {
+	out := new(ListUsersResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsAdmin/ListUsers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AccountsAdminServer is the server API for AccountsAdmin service.
+// All implementations must embed UnimplementedAccountsAdminServer
+// for forward compatibility
+type AccountsAdminServer interface {
+	CreateUser(context.Context, *CreateUserRequest) (*AccountResponse, error)
+	GetUser(context.Context, *GetUserRequest) (*AccountResponse, error)
+	UpdateUser(context.Context, *UpdateUserRequest) (*AccountResponse, error)
+	DeleteUser(context.Context, *DeleteUserRequest) (*AccountResponse, error)
+	SetPassword(context.Context, *SetPasswordRequest) (*AccountResponse, error)
+	DisableUser(context.Context, *DisableUserRequest) (*AccountResponse, error)
+	UnlockUser(context.Context, *UnlockUserRequest) (*AccountResponse, error)
+	ResetTOTP(context.Context, *ResetTOTPRequest) (*AccountResponse, error)
+	ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error)
+	mustEmbedUnimplementedAccountsAdminServer()
+}
+
+// UnimplementedAccountsAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAccountsAdminServer struct {
+}
+
+func (UnimplementedAccountsAdminServer) CreateUser(context.Context, *CreateUserRequest) (*AccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateUser not implemented")
+}
+func (UnimplementedAccountsAdminServer) GetUser(context.Context, *GetUserRequest) (*AccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+}
+func (UnimplementedAccountsAdminServer) UpdateUser(context.Context, *UpdateUserRequest) (*AccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateUser not implemented")
+}
+func (UnimplementedAccountsAdminServer) DeleteUser(context.Context, *DeleteUserRequest) (*AccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUser not implemented")
+}
+func (UnimplementedAccountsAdminServer) SetPassword(context.Context, *SetPasswordRequest) (*AccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPassword not implemented")
+}
+func (UnimplementedAccountsAdminServer) DisableUser(context.Context, *DisableUserRequest) (*AccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DisableUser not implemented")
+}
+func (UnimplementedAccountsAdminServer) UnlockUser(context.Context, *UnlockUserRequest) (*AccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnlockUser not implemented")
+}
+func (UnimplementedAccountsAdminServer) ResetTOTP(context.Context, *ResetTOTPRequest) (*AccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResetTOTP not implemented")
+}
+func (UnimplementedAccountsAdminServer) ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+}
+func (UnimplementedAccountsAdminServer) mustEmbedUnimplementedAccountsAdminServer() {}
+
+// UnsafeAccountsAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AccountsAdminServer will
+// result in compilation errors.
+type UnsafeAccountsAdminServer interface {
+	mustEmbedUnimplementedAccountsAdminServer()
+}
+
+func RegisterAccountsAdminServer(s grpc.ServiceRegistrar, srv AccountsAdminServer) {
+	s.RegisterService(&_AccountsAdmin_serviceDesc, srv)
+}
+
+func _AccountsAdmin_CreateUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).CreateUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/CreateUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).CreateUser(ctx, req.(*CreateUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsAdmin_GetUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).GetUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/GetUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).GetUser(ctx, req.(*GetUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsAdmin_UpdateUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).UpdateUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/UpdateUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).UpdateUser(ctx, req.(*UpdateUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsAdmin_DeleteUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).DeleteUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/DeleteUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).DeleteUser(ctx, req.(*DeleteUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsAdmin_SetPassword_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetPasswordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).SetPassword(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/SetPassword",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).SetPassword(ctx, req.(*SetPasswordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsAdmin_DisableUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DisableUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).DisableUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/DisableUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).DisableUser(ctx, req.(*DisableUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsAdmin_UnlockUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnlockUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).UnlockUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/UnlockUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).UnlockUser(ctx, req.(*UnlockUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsAdmin_ResetTOTP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResetTOTPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).ResetTOTP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/ResetTOTP",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).ResetTOTP(ctx, req.(*ResetTOTPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsAdmin_ListUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsAdminServer).ListUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsAdmin/ListUsers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsAdminServer).ListUsers(ctx, req.(*ListUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _AccountsAdmin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "auth.AccountsAdmin",
+	HandlerType: (*AccountsAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateUser",
+			Handler:    _AccountsAdmin_CreateUser_Handler,
+		},
+		{
+			MethodName: "GetUser",
+			Handler:    _AccountsAdmin_GetUser_Handler,
+		},
+		{
+			MethodName: "UpdateUser",
+			Handler:    _AccountsAdmin_UpdateUser_Handler,
+		},
+		{
+			MethodName: "DeleteUser",
+			Handler:    _AccountsAdmin_DeleteUser_Handler,
+		},
+		{
+			MethodName: "SetPassword",
+			Handler:    _AccountsAdmin_SetPassword_Handler,
+		},
+		{
+			MethodName: "DisableUser",
+			Handler:    _AccountsAdmin_DisableUser_Handler,
+		},
+		{
+			MethodName: "UnlockUser",
+			Handler:    _AccountsAdmin_UnlockUser_Handler,
+		},
+		{
+			MethodName: "ResetTOTP",
+			Handler:    _AccountsAdmin_ResetTOTP_Handler,
+		},
+		{
+			MethodName: "ListUsers",
+			Handler:    _AccountsAdmin_ListUsers_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "users.proto",
+}
+
+// AccountsRegistrationClient is the client API for AccountsRegistration service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AccountsRegistrationClient interface {
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegistrationResponse, error)
+	SendVerification(ctx context.Context, in *SendVerificationRequest, opts ...grpc.CallOption) (*RegistrationResponse, error)
+	VerifyEmail(ctx context.Context, in *VerifyEmailRequest, opts ...grpc.CallOption) (*RegistrationResponse, error)
+}
+
+type accountsRegistrationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAccountsRegistrationClient(cc grpc.ClientConnInterface) AccountsRegistrationClient {
+	return &accountsRegistrationClient{cc}
+}
+
+func (c *accountsRegistrationClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegistrationResponse, error) {
+	out := new(RegistrationResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsRegistration/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsRegistrationClient) SendVerification(ctx context.Context, in *SendVerificationRequest, opts ...grpc.CallOption) (*RegistrationResponse, error) {
+	out := new(RegistrationResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsRegistration/SendVerification", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsRegistrationClient) VerifyEmail(ctx context.Context, in *VerifyEmailRequest, opts ...grpc.CallOption) (*RegistrationResponse, error) {
+	out := new(RegistrationResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsRegistration/VerifyEmail", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AccountsRegistrationServer is the server API for AccountsRegistration service.
+// All implementations must embed UnimplementedAccountsRegistrationServer
+// for forward compatibility
+type AccountsRegistrationServer interface {
+	Register(context.Context, *RegisterRequest) (*RegistrationResponse, error)
+	SendVerification(context.Context, *SendVerificationRequest) (*RegistrationResponse, error)
+	VerifyEmail(context.Context, *VerifyEmailRequest) (*RegistrationResponse, error)
+	mustEmbedUnimplementedAccountsRegistrationServer()
+}
+
+// UnimplementedAccountsRegistrationServer must be embedded to have forward compatible implementations.
+type UnimplementedAccountsRegistrationServer struct {
+}
+
+func (UnimplementedAccountsRegistrationServer) Register(context.Context, *RegisterRequest) (*RegistrationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedAccountsRegistrationServer) SendVerification(context.Context, *SendVerificationRequest) (*RegistrationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendVerification not implemented")
+}
+func (UnimplementedAccountsRegistrationServer) VerifyEmail(context.Context, *VerifyEmailRequest) (*RegistrationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyEmail not implemented")
+}
+func (UnimplementedAccountsRegistrationServer) mustEmbedUnimplementedAccountsRegistrationServer() {}
+
+// UnsafeAccountsRegistrationServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AccountsRegistrationServer will
+// result in compilation errors.
+type UnsafeAccountsRegistrationServer interface {
+	mustEmbedUnimplementedAccountsRegistrationServer()
+}
+
+func RegisterAccountsRegistrationServer(s grpc.ServiceRegistrar, srv AccountsRegistrationServer) {
+	s.RegisterService(&_AccountsRegistration_serviceDesc, srv)
+}
+
+func _AccountsRegistration_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsRegistrationServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsRegistration/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsRegistrationServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsRegistration_SendVerification_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendVerificationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsRegistrationServer).SendVerification(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsRegistration/SendVerification",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsRegistrationServer).SendVerification(ctx, req.(*SendVerificationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsRegistration_VerifyEmail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyEmailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsRegistrationServer).VerifyEmail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsRegistration/VerifyEmail",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsRegistrationServer).VerifyEmail(ctx, req.(*VerifyEmailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _AccountsRegistration_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "auth.AccountsRegistration",
+	HandlerType: (*AccountsRegistrationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _AccountsRegistration_Register_Handler,
+		},
+		{
+			MethodName: "SendVerification",
+			Handler:    _AccountsRegistration_SendVerification_Handler,
+		},
+		{
+			MethodName: "VerifyEmail",
+			Handler:    _AccountsRegistration_VerifyEmail_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "users.proto",
+}
+
+// AccountsPasswordResetClient is the client API for AccountsPasswordReset service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AccountsPasswordResetClient interface {
+	RequestPasswordReset(ctx context.Context, in *RequestPasswordResetRequest, opts ...grpc.CallOption) (*PasswordResetResponse, error)
+	ResetPassword(ctx context.Context, in *ResetPasswordRequest, opts ...grpc.CallOption) (*PasswordResetResponse, error)
+}
+
+type accountsPasswordResetClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAccountsPasswordResetClient(cc grpc.ClientConnInterface) AccountsPasswordResetClient {
+	return &accountsPasswordResetClient{cc}
+}
+
+func (c *accountsPasswordResetClient) RequestPasswordReset(ctx context.Context, in *RequestPasswordResetRequest, opts ...grpc.CallOption) (*PasswordResetResponse, error) {
+	out := new(PasswordResetResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsPasswordReset/RequestPasswordReset", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsPasswordResetClient) ResetPassword(ctx context.Context, in *ResetPasswordRequest, opts ...grpc.CallOption) (*PasswordResetResponse, error) {
+	out := new(PasswordResetResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsPasswordReset/ResetPassword", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AccountsPasswordResetServer is the server API for AccountsPasswordReset service.
+// All implementations must embed UnimplementedAccountsPasswordResetServer
+// for forward compatibility
+type AccountsPasswordResetServer interface {
+	RequestPasswordReset(context.Context, *RequestPasswordResetRequest) (*PasswordResetResponse, error)
+	ResetPassword(context.Context, *ResetPasswordRequest) (*PasswordResetResponse, error)
+	mustEmbedUnimplementedAccountsPasswordResetServer()
+}
+
+// UnimplementedAccountsPasswordResetServer must be embedded to have forward compatible implementations.
+type UnimplementedAccountsPasswordResetServer struct {
+}
+
+func (UnimplementedAccountsPasswordResetServer) RequestPasswordReset(context.Context, *RequestPasswordResetRequest) (*PasswordResetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestPasswordReset not implemented")
+}
+func (UnimplementedAccountsPasswordResetServer) ResetPassword(context.Context, *ResetPasswordRequest) (*PasswordResetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResetPassword not implemented")
+}
+func (UnimplementedAccountsPasswordResetServer) mustEmbedUnimplementedAccountsPasswordResetServer() {}
+
+// UnsafeAccountsPasswordResetServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AccountsPasswordResetServer will
+// result in compilation errors.
+type UnsafeAccountsPasswordResetServer interface {
+	mustEmbedUnimplementedAccountsPasswordResetServer()
+}
+
+func RegisterAccountsPasswordResetServer(s grpc.ServiceRegistrar, srv AccountsPasswordResetServer) {
+	s.RegisterService(&_AccountsPasswordReset_serviceDesc, srv)
+}
+
+func _AccountsPasswordReset_RequestPasswordReset_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RequestPasswordResetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsPasswordResetServer).RequestPasswordReset(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsPasswordReset/RequestPasswordReset",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsPasswordResetServer).RequestPasswordReset(ctx, req.(*RequestPasswordResetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsPasswordReset_ResetPassword_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResetPasswordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsPasswordResetServer).ResetPassword(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsPasswordReset/ResetPassword",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsPasswordResetServer).ResetPassword(ctx, req.(*ResetPasswordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _AccountsPasswordReset_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "auth.AccountsPasswordReset",
+	HandlerType: (*AccountsPasswordResetServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RequestPasswordReset",
+			Handler:    _AccountsPasswordReset_RequestPasswordReset_Handler,
+		},
+		{
+			MethodName: "ResetPassword",
+			Handler:    _AccountsPasswordReset_ResetPassword_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "users.proto",
+}
+
+// AccountsTOTPClient is the client API for AccountsTOTP service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AccountsTOTPClient interface {
+	EnrollTOTP(ctx context.Context, in *EnrollTOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error)
+	ConfirmTOTP(ctx context.Context, in *TOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error)
+	VerifyTOTP(ctx context.Context, in *TOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error)
+	DisableTOTP(ctx context.Context, in *TOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error)
+	RegenerateRecoveryCodes(ctx context.Context, in *TOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error)
+}
+
+type accountsTOTPClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAccountsTOTPClient(cc grpc.ClientConnInterface) AccountsTOTPClient {
+	return &accountsTOTPClient{cc}
+}
+
+func (c *accountsTOTPClient) EnrollTOTP(ctx context.Context, in *EnrollTOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error) {
+	out := new(TOTPResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsTOTP/EnrollTOTP", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsTOTPClient) ConfirmTOTP(ctx context.Context, in *TOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error) {
+	out := new(TOTPResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsTOTP/ConfirmTOTP", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsTOTPClient) VerifyTOTP(ctx context.Context, in *TOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error) {
+	out := new(TOTPResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsTOTP/VerifyTOTP", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsTOTPClient) DisableTOTP(ctx context.Context, in *TOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error) {
+	out := new(TOTPResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsTOTP/DisableTOTP", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsTOTPClient) RegenerateRecoveryCodes(ctx context.Context, in *TOTPRequest, opts ...grpc.CallOption) (*TOTPResponse, error) {
+	out := new(TOTPResponse)
+	err := c.cc.Invoke(ctx, "/auth.AccountsTOTP/RegenerateRecoveryCodes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AccountsTOTPServer is the server API for AccountsTOTP service.
+// All implementations must embed UnimplementedAccountsTOTPServer
+// for forward compatibility
+type AccountsTOTPServer interface {
+	EnrollTOTP(context.Context, *EnrollTOTPRequest) (*TOTPResponse, error)
+	ConfirmTOTP(context.Context, *TOTPRequest) (*TOTPResponse, error)
+	VerifyTOTP(context.Context, *TOTPRequest) (*TOTPResponse, error)
+	DisableTOTP(context.Context, *TOTPRequest) (*TOTPResponse, error)
+	RegenerateRecoveryCodes(context.Context, *TOTPRequest) (*TOTPResponse, error)
+	mustEmbedUnimplementedAccountsTOTPServer()
+}
+
+// UnimplementedAccountsTOTPServer must be embedded to have forward compatible implementations.
+type UnimplementedAccountsTOTPServer struct {
+}
+
+func (UnimplementedAccountsTOTPServer) EnrollTOTP(context.Context, *EnrollTOTPRequest) (*TOTPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EnrollTOTP not implemented")
+}
+func (UnimplementedAccountsTOTPServer) ConfirmTOTP(context.Context, *TOTPRequest) (*TOTPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ConfirmTOTP not implemented")
+}
+func (UnimplementedAccountsTOTPServer) VerifyTOTP(context.Context, *TOTPRequest) (*TOTPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyTOTP not implemented")
+}
+func (UnimplementedAccountsTOTPServer) DisableTOTP(context.Context, *TOTPRequest) (*TOTPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DisableTOTP not implemented")
+}
+func (UnimplementedAccountsTOTPServer) RegenerateRecoveryCodes(context.Context, *TOTPRequest) (*TOTPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegenerateRecoveryCodes not implemented")
+}
+func (UnimplementedAccountsTOTPServer) mustEmbedUnimplementedAccountsTOTPServer() {}
+
+// UnsafeAccountsTOTPServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AccountsTOTPServer will
+// result in compilation errors.
+type UnsafeAccountsTOTPServer interface {
+	mustEmbedUnimplementedAccountsTOTPServer()
+}
+
+func RegisterAccountsTOTPServer(s grpc.ServiceRegistrar, srv AccountsTOTPServer) {
+	s.RegisterService(&_AccountsTOTP_serviceDesc, srv)
+}
+
+func _AccountsTOTP_EnrollTOTP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnrollTOTPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsTOTPServer).EnrollTOTP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsTOTP/EnrollTOTP",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsTOTPServer).EnrollTOTP(ctx, req.(*EnrollTOTPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsTOTP_ConfirmTOTP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TOTPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsTOTPServer).ConfirmTOTP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsTOTP/ConfirmTOTP",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsTOTPServer).ConfirmTOTP(ctx, req.(*TOTPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsTOTP_VerifyTOTP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TOTPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsTOTPServer).VerifyTOTP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsTOTP/VerifyTOTP",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsTOTPServer).VerifyTOTP(ctx, req.(*TOTPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsTOTP_DisableTOTP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TOTPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsTOTPServer).DisableTOTP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsTOTP/DisableTOTP",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsTOTPServer).DisableTOTP(ctx, req.(*TOTPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AccountsTOTP_RegenerateRecoveryCodes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TOTPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsTOTPServer).RegenerateRecoveryCodes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/auth.AccountsTOTP/RegenerateRecoveryCodes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsTOTPServer).RegenerateRecoveryCodes(ctx, req.(*TOTPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _AccountsTOTP_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "auth.AccountsTOTP",
+	HandlerType: (*AccountsTOTPServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "EnrollTOTP",
+			Handler:    _AccountsTOTP_EnrollTOTP_Handler,
+		},
+		{
+			MethodName: "ConfirmTOTP",
+			Handler:    _AccountsTOTP_ConfirmTOTP_Handler,
+		},
+		{
+			MethodName: "VerifyTOTP",
+			Handler:    _AccountsTOTP_VerifyTOTP_Handler,
+		},
+		{
+			MethodName: "DisableTOTP",
+			Handler:    _AccountsTOTP_DisableTOTP_Handler,
+		},
+		{
+			MethodName: "RegenerateRecoveryCodes",
+			Handler:    _AccountsTOTP_RegenerateRecoveryCodes_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "users.proto",